@@ -0,0 +1,364 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrInvalidFormat = errors.New("access log format is invalid; json, logfmt, combined values are permited only")
+	ErrInvalidField  = errors.New("access log field is undefined")
+	ErrInvalidSample = errors.New("access log sample is invalid; format is PATH_PREFIX=RATE, rate is in [0, 1]")
+	ErrInvalidSink   = errors.New("access log sink is invalid")
+)
+
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatLogfmt   Format = "logfmt"
+	FormatCombined Format = "combined"
+)
+
+// Record is one served request; empty fields are skipped in json and logfmt formats
+type Record struct {
+	Time      time.Time
+	Level     zerolog.Level
+	RequestId string
+	TraceId   string
+
+	Status    int
+	Bytes     int
+	Method    string
+	Path      string
+	Proto     string
+	Ip        string
+	Latency   time.Duration
+	UserAgent string
+	Referer   string
+
+	Uid           string
+	Srv           string
+	Core          string
+	QualityBefore string
+	QualityAfter  string
+	Cluster       string
+	Fallback      bool
+	Expires       string
+}
+
+// fields - field name => value getter; getters return nil for empty values
+var fields = map[string]func(*Record) interface{}{
+	"time":  func(r *Record) interface{} { return r.Time.Format(time.RFC3339Nano) },
+	"level": func(r *Record) interface{} { return r.Level.String() },
+	"id":    func(r *Record) interface{} { return nilIfEmpty(r.RequestId) },
+	"trace": func(r *Record) interface{} { return nilIfEmpty(r.TraceId) },
+
+	"status":     func(r *Record) interface{} { return r.Status },
+	"bytes":      func(r *Record) interface{} { return r.Bytes },
+	"method":     func(r *Record) interface{} { return r.Method },
+	"path":       func(r *Record) interface{} { return r.Path },
+	"ip":         func(r *Record) interface{} { return r.Ip },
+	"latency":    func(r *Record) interface{} { return float64(r.Latency.Microseconds()) / 1000 }, // milliseconds
+	"user_agent": func(r *Record) interface{} { return nilIfEmpty(r.UserAgent) },
+	"referer":    func(r *Record) interface{} { return nilIfEmpty(r.Referer) },
+
+	"uid":            func(r *Record) interface{} { return nilIfEmpty(r.Uid) },
+	"srv":            func(r *Record) interface{} { return nilIfEmpty(r.Srv) },
+	"core":           func(r *Record) interface{} { return nilIfEmpty(r.Core) },
+	"quality_before": func(r *Record) interface{} { return nilIfEmpty(r.QualityBefore) },
+	"quality_after":  func(r *Record) interface{} { return nilIfEmpty(r.QualityAfter) },
+	"cluster":        func(r *Record) interface{} { return nilIfEmpty(r.Cluster) },
+	"fallback":       func(r *Record) interface{} { return r.Fallback },
+	"expires":        func(r *Record) interface{} { return nilIfEmpty(r.Expires) },
+}
+
+func nilIfEmpty(val string) interface{} {
+	if val == "" {
+		return nil
+	}
+
+	return val
+}
+
+type (
+	AccessLog struct {
+		log *zerolog.Logger
+
+		format Format
+		fields []string
+		sinks  []sink
+
+		// sorted by prefix length, the longest prefix is matched first
+		samples []*sample
+
+		bufpool sync.Pool
+	}
+	sample struct {
+		prefix string
+		rate   float64
+	}
+)
+
+func NewAccessLog(ctx context.Context) (alog *AccessLog, e error) {
+	ccx := ctx.Value(utils.ContextKeyCliContext).(*cli.Context)
+
+	alog = &AccessLog{
+		log:    ctx.Value(utils.ContextKeyLogger).(*zerolog.Logger),
+		format: Format(ccx.String("access-log-format")),
+	}
+	alog.bufpool.New = func() interface{} { return bytes.NewBuffer(nil) }
+
+	switch alog.format {
+	case FormatJSON, FormatLogfmt, FormatCombined:
+	default:
+		return nil, fmt.Errorf("%w; %s", ErrInvalidFormat, alog.format)
+	}
+
+	for _, field := range strings.Split(ccx.String("access-log-fields"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		} else if _, ok := fields[field]; !ok {
+			return nil, fmt.Errorf("%w; %s", ErrInvalidField, field)
+		}
+
+		alog.fields = append(alog.fields, field)
+	}
+
+	for _, buf := range ccx.StringSlice("access-log-sample") {
+		var smpl *sample
+		if smpl, e = parseSample(buf); e != nil {
+			return
+		}
+
+		alog.samples = append(alog.samples, smpl)
+	}
+
+	sort.SliceStable(alog.samples, func(i, j int) bool {
+		return len(alog.samples[i].prefix) > len(alog.samples[j].prefix)
+	})
+
+	sinks := ccx.StringSlice("access-log-sink")
+
+	// legacy syslog settings, access records were sent to the syslog server before
+	if server := ccx.String("syslog-server"); server != "" {
+		sinks = append(sinks, fmt.Sprintf("syslog+%s://%s?tag=%s",
+			ccx.String("syslog-proto"), server, url.QueryEscape(ccx.String("syslog-tag"))))
+	}
+
+	for _, buf := range sinks {
+		var snk sink
+		if snk, e = newSink(buf, alog.log); e != nil {
+			alog.Close()
+			return nil, fmt.Errorf("%w; %s - %s", ErrInvalidSink, buf, e.Error())
+		}
+
+		alog.sinks = append(alog.sinks, snk)
+	}
+
+	return
+}
+
+func parseSample(buf string) (_ *sample, e error) {
+	prefix, rate, ok := strings.Cut(buf, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("%w; %s", ErrInvalidSample, buf)
+	}
+
+	smpl := &sample{prefix: prefix}
+	if smpl.rate, e = strconv.ParseFloat(rate, 64); e != nil || smpl.rate < 0 || smpl.rate > 1 {
+		return nil, fmt.Errorf("%w; %s", ErrInvalidSample, buf)
+	}
+
+	return smpl, nil
+}
+
+// sampled reports if the record should be written; server errors are never sampled out
+func (m *AccessLog) sampled(rec *Record) bool {
+	if rec.Status >= 500 {
+		return true
+	}
+
+	for _, smpl := range m.samples {
+		if strings.HasPrefix(rec.Path, smpl.prefix) {
+			return smpl.rate == 1 || rand.Float64() < smpl.rate // skipcq: GSC-G404 math/rand is enough
+		}
+	}
+
+	return true
+}
+
+// Log formats the record once and writes it to all sinks;
+// stdout sinks are skipped if stdout is false (see access-log-stdout runtime param)
+func (m *AccessLog) Log(rec *Record, stdout bool) {
+	if len(m.sinks) == 0 || !m.sampled(rec) {
+		return
+	}
+
+	buf := m.bufpool.Get().(*bytes.Buffer)
+	defer m.bufpool.Put(buf)
+
+	buf.Reset()
+	m.encode(buf, rec)
+
+	for _, snk := range m.sinks {
+		if snk.isStdout() && !stdout {
+			continue
+		}
+
+		if e := snk.write(rec, buf.Bytes()); e != nil {
+			m.log.Warn().Err(e).Msg("could not write access log record")
+		}
+	}
+}
+
+func (m *AccessLog) encode(buf *bytes.Buffer, rec *Record) {
+	switch m.format {
+	case FormatCombined:
+		encodeCombined(buf, rec)
+	case FormatLogfmt:
+		m.encodeLogfmt(buf, rec)
+	default:
+		m.encodeJSON(buf, rec)
+	}
+
+	buf.WriteByte('\n')
+}
+
+func (m *AccessLog) encodeJSON(buf *bytes.Buffer, rec *Record) {
+	buf.WriteByte('{')
+
+	var written bool
+	for _, field := range m.fields {
+		val := fields[field](rec)
+		if val == nil {
+			continue
+		}
+
+		if written {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(strconv.Quote(field))
+		buf.WriteByte(':')
+
+		// values are strings, numbers and bools only, so errors are impossible here
+		raw, _ := json.Marshal(val)
+		buf.Write(raw)
+
+		written = true
+	}
+
+	buf.WriteByte('}')
+}
+
+func (m *AccessLog) encodeLogfmt(buf *bytes.Buffer, rec *Record) {
+	var written bool
+	for _, field := range m.fields {
+		val := fields[field](rec)
+		if val == nil {
+			continue
+		}
+
+		if written {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(field)
+		buf.WriteByte('=')
+
+		switch v := val.(type) {
+		case string:
+			if v == "" || strings.IndexFunc(v, isLogfmtQuoted) != -1 {
+				buf.WriteString(strconv.Quote(v))
+			} else {
+				buf.WriteString(v)
+			}
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', 3, 64))
+		default:
+			fmt.Fprint(buf, v)
+		}
+
+		written = true
+	}
+}
+
+// isLogfmtQuoted reports if the value with the rune must be quoted; control chars are escaped
+// by quoting, so clients could not write their own lines with headers
+func isLogfmtQuoted(r rune) bool {
+	return r == ' ' || r == '=' || r == '"' || r == '\\' || r == utf8.RuneError || !unicode.IsPrint(r)
+}
+
+// encodeCombined writes apache/nginx combined format; the field list is not used here
+func encodeCombined(buf *bytes.Buffer, rec *Record) {
+	dash := func(val string) string {
+		if val == "" {
+			return "-"
+		}
+
+		return escapeCombined(val)
+	}
+
+	fmt.Fprintf(buf, `%s - %s [%s] "%s %s %s" %d %d "%s" "%s"`,
+		dash(rec.Ip), dash(rec.Uid), rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeCombined(rec.Method), escapeCombined(rec.Path), dash(rec.Proto), rec.Status, rec.Bytes,
+		dash(rec.Referer), dash(rec.UserAgent))
+}
+
+// escapeCombined escapes quotes, backslashes and bytes out of printable ascii as \xHH like nginx does
+func escapeCombined(val string) string {
+	idx := strings.IndexFunc(val, func(r rune) bool {
+		return r == '"' || r == '\\' || r < 0x20 || r > 0x7e
+	})
+	if idx == -1 {
+		return val
+	}
+
+	var buf strings.Builder
+	buf.WriteString(val[:idx])
+
+	for i := idx; i < len(val); i++ {
+		if c := val[i]; c == '"' || c == '\\' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&buf, "\\x%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+
+	return buf.String()
+}
+
+func (m *AccessLog) Close() {
+	for _, snk := range m.sinks {
+		if e := snk.close(); e != nil {
+			m.log.Warn().Err(e).Msg("could not close access log sink")
+		}
+	}
+}
+
+func hostname() string {
+	host, e := os.Hostname()
+	if e != nil || host == "" {
+		return "-"
+	}
+
+	return host
+}
@@ -0,0 +1,356 @@
+package accesslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestRecord() *Record {
+	return &Record{
+		Time:      time.Date(2026, 10, 18, 16, 0, 0, 0, time.UTC),
+		Level:     zerolog.InfoLevel,
+		Status:    204,
+		Method:    "GET",
+		Path:      "/videos/media/ts/9000/1/720/hash_00001.ts",
+		Proto:     "HTTP/1.1",
+		Ip:        "10.0.0.1",
+		Latency:   1500 * time.Microsecond,
+		UserAgent: "curl/8.0 (linux)",
+		Uid:       "u1",
+	}
+}
+
+func TestParseSample(t *testing.T) {
+	for _, tc := range []struct {
+		buf    string
+		prefix string
+		rate   float64
+		err    bool
+	}{
+		{buf: "/videos/media/ts=0.1", prefix: "/videos/media/ts", rate: 0.1},
+		{buf: "/=1", prefix: "/", rate: 1},
+		{buf: "/api=0", prefix: "/api", rate: 0},
+		{buf: "/api", err: true},
+		{buf: "api=0.5", err: true},
+		{buf: "/api=1.5", err: true},
+		{buf: "/api=-0.1", err: true},
+		{buf: "/api=half", err: true},
+	} {
+		smpl, e := parseSample(tc.buf)
+		if tc.err {
+			if !errors.Is(e, ErrInvalidSample) {
+				t.Errorf("%s: expected ErrInvalidSample, got %v", tc.buf, e)
+			}
+			continue
+		}
+
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", tc.buf, e)
+		} else if smpl.prefix != tc.prefix || smpl.rate != tc.rate {
+			t.Errorf("%s: got %s=%v", tc.buf, smpl.prefix, smpl.rate)
+		}
+	}
+}
+
+func TestSampled(t *testing.T) {
+	alog := &AccessLog{samples: []*sample{
+		{prefix: "/videos/media/ts", rate: 0},
+		{prefix: "/videos", rate: 1},
+	}}
+
+	rec := newTestRecord()
+	if alog.sampled(rec) {
+		t.Error("the longest prefix with rate 0 must drop the record")
+	}
+
+	if rec.Status = 502; !alog.sampled(rec) {
+		t.Error("server errors must never be sampled out")
+	}
+
+	if rec.Status, rec.Path = 200, "/videos/media/subs/1.vtt"; !alog.sampled(rec) {
+		t.Error("the shorter prefix with rate 1 must keep the record")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	fields := []string{"time", "status", "path", "uid", "latency", "fallback", "referer", "user_agent"}
+
+	for _, tc := range []struct {
+		format Format
+		line   string
+	}{
+		{
+			format: FormatJSON,
+			line: `{"time":"2026-10-18T16:00:00Z","status":204,"path":"/videos/media/ts/9000/1/720/hash_00001.ts",` +
+				`"uid":"u1","latency":1.5,"fallback":false,"user_agent":"curl/8.0 (linux)"}`,
+		},
+		{
+			format: FormatLogfmt,
+			line: `time=2026-10-18T16:00:00Z status=204 path=/videos/media/ts/9000/1/720/hash_00001.ts ` +
+				`uid=u1 latency=1.500 fallback=false user_agent="curl/8.0 (linux)"`,
+		},
+		{
+			format: FormatCombined,
+			line: `10.0.0.1 - u1 [18/Oct/2026:16:00:00 +0000] "GET /videos/media/ts/9000/1/720/hash_00001.ts HTTP/1.1" ` +
+				`204 0 "-" "curl/8.0 (linux)"`,
+		},
+	} {
+		alog := &AccessLog{format: tc.format, fields: fields}
+
+		var buf bytes.Buffer
+		alog.encode(&buf, newTestRecord())
+
+		if got := buf.String(); got != tc.line+"\n" {
+			t.Errorf("%s:\n got %s\nwant %s", tc.format, got, tc.line)
+		}
+	}
+}
+
+// TestEncodeEscaping checks that client values with quotes and control chars could not
+// forge access log lines
+func TestEncodeEscaping(t *testing.T) {
+	rec := newTestRecord()
+	rec.Path = "/videos/\"x\".ts"
+	rec.Referer = "https://example.org/\\\x00"
+	rec.UserAgent = "curl\n10.0.0.2 - - [18/Oct/2026:16:00:00 +0000] \"GET / HTTP/1.1\" 200 0 \"-\" \"й\""
+
+	for _, tc := range []struct {
+		format    Format
+		fields    []string
+		userAgent string
+		line      string
+	}{
+		{
+			format: FormatLogfmt,
+			fields: []string{"path", "referer", "user_agent"},
+			line: `path="/videos/\"x\".ts" referer="https://example.org/\\\x00" ` +
+				`user_agent="curl\n10.0.0.2 - - [18/Oct/2026:16:00:00 +0000] \"GET / HTTP/1.1\" 200 0 \"-\" \"й\""`,
+		},
+		{
+			format:    FormatLogfmt,
+			fields:    []string{"user_agent"},
+			userAgent: "curl\tx\x7f",
+			line:      `user_agent="curl\tx\x7f"`,
+		},
+		{
+			format: FormatCombined,
+			line: `10.0.0.1 - u1 [18/Oct/2026:16:00:00 +0000] "GET /videos/\x22x\x22.ts HTTP/1.1" 204 0 ` +
+				`"https://example.org/\x5C\x00" ` +
+				`"curl\x0A10.0.0.2 - - [18/Oct/2026:16:00:00 +0000] \x22GET / HTTP/1.1\x22 200 0 \x22-\x22 \x22\xD0\xB9\x22"`,
+		},
+	} {
+		alog := &AccessLog{format: tc.format, fields: tc.fields}
+
+		record := *rec
+		if tc.userAgent != "" {
+			record.UserAgent = tc.userAgent
+		}
+
+		var buf bytes.Buffer
+		alog.encode(&buf, &record)
+
+		if got := buf.String(); got != tc.line+"\n" {
+			t.Errorf("%s:\n got %s\nwant %s", tc.format, got, tc.line)
+		}
+
+		if strings.Count(buf.String(), "\n") != 1 {
+			t.Errorf("%s: the record is written in several lines", tc.format)
+		}
+	}
+}
+
+func newTestFileSink(t *testing.T, path string, maxSize int64, maxBackups int) *fileSink {
+	t.Helper()
+
+	snk, e := newFileSink(&url.URL{
+		Path:     path,
+		RawQuery: fmt.Sprintf("max_size=%d&max_backups=%d", maxSize, maxBackups),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	t.Cleanup(func() { snk.close() })
+	return snk
+}
+
+// readLines returns lines of the path and its backups, the newest file is the last one
+func readLines(t *testing.T, path string, backups int) (files [][]string) {
+	t.Helper()
+
+	for idx := backups; idx >= 0; idx-- {
+		name := path
+		if idx != 0 {
+			name += "." + strconv.Itoa(idx)
+		}
+
+		buf, e := os.ReadFile(name)
+		if errors.Is(e, os.ErrNotExist) {
+			continue
+		} else if e != nil {
+			t.Fatal(e)
+		}
+
+		files = append(files, strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n"))
+	}
+
+	return
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	snk := newTestFileSink(t, path, 20, 2)
+
+	// every line is 10 bytes, so every file has 2 lines
+	for i := 0; i < 10; i++ {
+		if e := snk.write(nil, []byte(fmt.Sprintf("line %04d\n", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	files := readLines(t, path, 3)
+	if len(files) != 3 {
+		t.Fatalf("expected the file and 2 backups, got %d files", len(files))
+	}
+
+	for idx, want := range [][]string{
+		{"line 0004", "line 0005"},
+		{"line 0006", "line 0007"},
+		{"line 0008", "line 0009"},
+	} {
+		if strings.Join(files[idx], ",") != strings.Join(want, ",") {
+			t.Errorf("file %d: got %v, want %v", idx, files[idx], want)
+		}
+	}
+}
+
+func TestFileSinkRotationWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	snk := newTestFileSink(t, path, 20, 0)
+
+	for i := 0; i < 5; i++ {
+		if e := snk.write(nil, []byte(fmt.Sprintf("line %04d\n", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	files := readLines(t, path, 1)
+	if len(files) != 1 || strings.Join(files[0], ",") != "line 0004" {
+		t.Errorf("expected the last line only, got %v", files)
+	}
+}
+
+// TestFileSinkSharedRotation emulates prefork children which write to the same file
+func TestFileSinkSharedRotation(t *testing.T) {
+	const lines, backups = 40, 30
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	sinks := []*fileSink{
+		newTestFileSink(t, path, 40, backups),
+		newTestFileSink(t, path, 40, backups),
+	}
+
+	for i := 0; i < lines; i++ {
+		snk := sinks[i%len(sinks)]
+
+		// the other sink's rotations are noticed by the check interval in production
+		snk.checked = time.Time{}
+
+		if e := snk.write(nil, []byte(fmt.Sprintf("line %04d\n", i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	var got []string
+	for _, file := range readLines(t, path, backups) {
+		if len(file) > 4 {
+			t.Errorf("file is larger than max_size - %v", file)
+		}
+
+		got = append(got, file...)
+	}
+
+	if len(got) != lines {
+		t.Fatalf("expected %d lines, got %d - %v", lines, len(got), got)
+	}
+
+	for i, line := range got {
+		if want := fmt.Sprintf("line %04d", i); line != want {
+			t.Errorf("lines are reordered by rotations: line %d is %s", i, line)
+		}
+	}
+}
+
+func TestSyslogSinkUnavailable(t *testing.T) {
+	// the port is free after the listener is closed, so dials are refused
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	log := zerolog.Nop()
+	snk, e := newSyslogSink(&url.URL{Scheme: "syslog+tcp", Host: address}, &log)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer snk.close()
+
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		if e = snk.write(newTestRecord(), []byte("line\n")); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes are blocked by the unavailable syslog server for %s", elapsed)
+	}
+}
+
+func TestSyslogSinkUdp(t *testing.T) {
+	conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	log := zerolog.Nop()
+	snk, e := newSyslogSink(&url.URL{Scheme: "syslog+udp", Host: conn.LocalAddr().String(), RawQuery: "tag=addie"}, &log)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = snk.write(newTestRecord(), []byte("status=204\n")); e != nil {
+		t.Fatal(e)
+	}
+	snk.close()
+
+	buf := make([]byte, 1024)
+	if e = conn.SetReadDeadline(time.Now().Add(3 * time.Second)); e != nil {
+		t.Fatal(e)
+	}
+
+	n, _, e := conn.ReadFrom(buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// local0 (16) * 8 + info (6)
+	want := fmt.Sprintf("<134>1 2026-10-18T16:00:00Z %s addie %d access - status=204", hostname(), os.Getpid())
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
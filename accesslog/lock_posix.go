@@ -0,0 +1,27 @@
+//go:build !windows
+
+package accesslog
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes the exclusive lock of the path, processes which share the log file
+// rotate it one by one
+func lockFile(path string) (unlock func(), e error) {
+	var fd *os.File
+	if fd, e = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644); e != nil {
+		return
+	}
+
+	if e = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); e != nil {
+		fd.Close()
+		return
+	}
+
+	return func() {
+		_ = syscall.Flock(int(fd.Fd()), syscall.LOCK_UN) // closing releases the lock anyway
+		fd.Close()
+	}, e
+}
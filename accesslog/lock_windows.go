@@ -0,0 +1,8 @@
+//go:build windows
+
+package accesslog
+
+// lockFile - file locks are not implemented for windows, rotations of the shared file are not serialized
+func lockFile(string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,462 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFileMaxSize    = 100 << 20 // bytes
+	defaultFileMaxBackups = 5
+
+	syslogFacilityLocal0 = 16
+)
+
+var (
+	errSinkUnsupported = errors.New("sink scheme is unsupported; stdout, file, syslog+udp, syslog+tcp, syslog+unix values are permited only")
+	errSyslogBackoff   = errors.New("syslog server is unavailable, the message is dropped until the redial")
+)
+
+type sink interface {
+	write(rec *Record, line []byte) error
+	close() error
+	isStdout() bool
+}
+
+// newSink parses sink definitions:
+//
+//	stdout
+//	file:///var/log/addie/access.log?max_size=104857600&max_backups=5
+//	syslog+udp://127.0.0.1:514?tag=addie&facility=16
+//	syslog+tcp://127.0.0.1:514
+//	syslog+unix:///dev/log
+func newSink(buf string, log *zerolog.Logger) (_ sink, e error) {
+	if buf == "stdout" {
+		return &stdoutSink{}, e
+	}
+
+	var rrl *url.URL
+	if rrl, e = url.Parse(buf); e != nil {
+		return
+	}
+
+	switch rrl.Scheme {
+	case "stdout":
+		return &stdoutSink{}, e
+	case "file":
+		return newFileSink(rrl)
+	case "syslog+udp", "syslog+tcp", "syslog+unix":
+		return newSyslogSink(rrl, log)
+	default:
+		return nil, errSinkUnsupported
+	}
+}
+
+type stdoutSink struct {
+	mu sync.Mutex
+}
+
+func (m *stdoutSink) write(_ *Record, line []byte) (e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, e = os.Stdout.Write(line)
+	return
+}
+
+func (*stdoutSink) close() error   { return nil }
+func (*stdoutSink) isStdout() bool { return true }
+
+// fileSink rotates the file by size; rotated files are path.1 ... path.N, path.1 is the newest.
+// Prefork children share the file, so the size is the file's one, rotations are serialized
+// by the lock file and the file is reopened by others when the path's inode is changed
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	checked time.Time
+}
+
+// fileSinkCheckInterval - interval of checks if the file has been rotated by other processes
+const fileSinkCheckInterval = time.Second
+
+func newFileSink(rrl *url.URL) (_ *fileSink, e error) {
+	snk := &fileSink{
+		path:       rrl.Path,
+		maxSize:    defaultFileMaxSize,
+		maxBackups: defaultFileMaxBackups,
+	}
+
+	if snk.path == "" {
+		return nil, errors.New("file path could not be empty")
+	}
+
+	if buf := rrl.Query().Get("max_size"); buf != "" {
+		if snk.maxSize, e = strconv.ParseInt(buf, 10, 64); e != nil || snk.maxSize <= 0 {
+			return nil, fmt.Errorf("max_size is invalid - %s", buf)
+		}
+	}
+
+	if buf := rrl.Query().Get("max_backups"); buf != "" {
+		if snk.maxBackups, e = strconv.Atoi(buf); e != nil || snk.maxBackups < 0 {
+			return nil, fmt.Errorf("max_backups is invalid - %s", buf)
+		}
+	}
+
+	if e = os.MkdirAll(filepath.Dir(snk.path), 0o755); e != nil {
+		return
+	}
+
+	return snk, snk.open()
+}
+
+func (m *fileSink) open() (e error) {
+	if m.file, e = os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); e != nil {
+		return
+	}
+
+	var stat os.FileInfo
+	if stat, e = m.file.Stat(); e != nil {
+		return
+	}
+
+	m.size, m.checked = stat.Size(), time.Now()
+	return
+}
+
+func (m *fileSink) reopen() error {
+	if e := m.file.Close(); e != nil {
+		return e
+	}
+
+	return m.open()
+}
+
+// isRotated reports if the path is not the opened file anymore
+func (m *fileSink) isRotated() (_ bool, e error) {
+	var fstat, pstat os.FileInfo
+	if fstat, e = m.file.Stat(); e != nil {
+		return
+	}
+
+	if pstat, e = os.Stat(m.path); errors.Is(e, os.ErrNotExist) {
+		return true, nil
+	} else if e != nil {
+		return
+	}
+
+	return !os.SameFile(fstat, pstat), nil
+}
+
+// sync reopens the file rotated by other processes and updates the size by other writers
+func (m *fileSink) sync() (e error) {
+	var rotated bool
+	if rotated, e = m.isRotated(); e != nil {
+		return
+	} else if rotated {
+		return m.reopen()
+	}
+
+	var stat os.FileInfo
+	if stat, e = m.file.Stat(); e != nil {
+		return
+	}
+
+	m.size, m.checked = stat.Size(), time.Now()
+	return
+}
+
+func (m *fileSink) rotate() (e error) {
+	var unlock func()
+	if unlock, e = lockFile(m.path + ".lock"); e != nil {
+		return
+	}
+	defer unlock()
+
+	// the file has been rotated by the other process while the lock was waited
+	var rotated bool
+	if rotated, e = m.isRotated(); e != nil {
+		return
+	} else if rotated {
+		return m.reopen()
+	}
+
+	if e = m.file.Close(); e != nil {
+		return
+	}
+
+	if m.maxBackups == 0 {
+		if e = os.Remove(m.path); e != nil && !errors.Is(e, os.ErrNotExist) {
+			return
+		}
+
+		return m.open()
+	}
+
+	for idx := m.maxBackups - 1; idx > 0; idx-- {
+		src := m.path + "." + strconv.Itoa(idx)
+		if e = os.Rename(src, m.path+"."+strconv.Itoa(idx+1)); e != nil && !errors.Is(e, os.ErrNotExist) {
+			return
+		}
+	}
+
+	if e = os.Rename(m.path, m.path+".1"); e != nil {
+		return
+	}
+
+	return m.open()
+}
+
+func (m *fileSink) write(_ *Record, line []byte) (e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		if e = m.open(); e != nil {
+			m.file = nil
+			return
+		}
+	}
+
+	// the local size is not precise if the file is shared, it's synced before rotation
+	if time.Since(m.checked) > fileSinkCheckInterval || m.size+int64(len(line)) > m.maxSize {
+		if e = m.sync(); e != nil {
+			m.file.Close()
+			m.file = nil
+			return
+		}
+	}
+
+	if m.size+int64(len(line)) > m.maxSize && m.size != 0 {
+		if e = m.rotate(); e != nil {
+			if m.file != nil {
+				m.file.Close()
+			}
+			m.file = nil
+			return
+		}
+	}
+
+	var n int
+	n, e = m.file.Write(line)
+	m.size += int64(n)
+
+	return
+}
+
+func (m *fileSink) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	return m.file.Close()
+}
+
+func (*fileSink) isStdout() bool { return false }
+
+// syslogSink writes RFC5424 messages; tcp messages are framed with octet counting (RFC6587).
+// Messages are written by the writer goroutine through the bounded queue, so requests are never
+// blocked by the syslog server; messages are dropped if the queue is full or the server is down,
+// the connection is re-established with backoff
+type syslogSink struct {
+	log *zerolog.Logger
+
+	network, address string
+
+	tag      string
+	facility int
+	hostname string
+	procid   string
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+
+	// the writer goroutine's state
+	conn    net.Conn
+	backoff time.Duration
+	redial  time.Time
+	dropped atomic.Uint64
+}
+
+const (
+	syslogQueueSize  = 4096
+	syslogMinBackoff = 100 * time.Millisecond
+	syslogMaxBackoff = 30 * time.Second
+)
+
+func newSyslogSink(rrl *url.URL, log *zerolog.Logger) (_ *syslogSink, e error) {
+	snk := &syslogSink{
+		log:      log,
+		network:  strings.TrimPrefix(rrl.Scheme, "syslog+"),
+		address:  rrl.Host,
+		tag:      rrl.Query().Get("tag"),
+		facility: syslogFacilityLocal0,
+		hostname: hostname(),
+		procid:   strconv.Itoa(os.Getpid()),
+		queue:    make(chan []byte, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	// /dev/log is a datagram socket on most systems
+	if snk.network == "unix" {
+		snk.network, snk.address = "unixgram", rrl.Path
+	}
+
+	if snk.address == "" {
+		return nil, errors.New("syslog address could not be empty")
+	}
+
+	if snk.tag == "" {
+		snk.tag = filepath.Base(os.Args[0])
+	}
+
+	if buf := rrl.Query().Get("facility"); buf != "" {
+		if snk.facility, e = strconv.Atoi(buf); e != nil || snk.facility < 0 || snk.facility > 23 {
+			return nil, fmt.Errorf("facility is invalid - %s", buf)
+		}
+	}
+
+	go snk.run()
+	return snk, e
+}
+
+func (m *syslogSink) severity(level zerolog.Level) int {
+	switch {
+	case level >= zerolog.ErrorLevel:
+		return 3
+	case level == zerolog.WarnLevel:
+		return 4
+	case level == zerolog.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// write queues the message; the full queue is not an error of the request, dropped
+// messages are reported by the writer goroutine
+func (m *syslogSink) write(rec *Record, line []byte) (e error) {
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s access - %s",
+		m.facility*8+m.severity(rec.Level), rec.Time.Format(time.RFC3339Nano),
+		m.hostname, m.tag, m.procid, strings.TrimSuffix(string(line), "\n"))
+
+	if m.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.queue <- []byte(msg):
+	default:
+		m.dropped.Add(1)
+	}
+
+	return
+}
+
+func (m *syslogSink) run() {
+	defer close(m.done)
+
+	for msg := range m.queue {
+		if e := m.send(msg); e != nil {
+			m.dropped.Add(1)
+			continue
+		}
+
+		if dropped := m.dropped.Swap(0); dropped != 0 {
+			m.log.Warn().Uint64("dropped", dropped).Str("address", m.address).
+				Msg("some access records have been dropped, syslog server was unavailable or slow")
+		}
+	}
+
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// send writes the message to the connection, the connection is dialed again
+// after the backoff if the previous one has failed
+func (m *syslogSink) send(msg []byte) (e error) {
+	if m.conn == nil {
+		if time.Now().Before(m.redial) {
+			return errSyslogBackoff
+		}
+
+		if m.conn, e = net.DialTimeout(m.network, m.address, time.Second); e != nil {
+			m.conn = nil
+			m.fail(e)
+			return
+		}
+	}
+
+	if e = m.conn.SetWriteDeadline(time.Now().Add(time.Second)); e == nil {
+		_, e = m.conn.Write(msg)
+	}
+
+	if e != nil {
+		m.conn.Close()
+		m.conn = nil
+		m.fail(e)
+		return
+	}
+
+	m.backoff = 0
+	return
+}
+
+func (m *syslogSink) fail(e error) {
+	if m.backoff *= 2; m.backoff < syslogMinBackoff {
+		m.backoff = syslogMinBackoff
+	} else if m.backoff > syslogMaxBackoff {
+		m.backoff = syslogMaxBackoff
+	}
+
+	m.redial = time.Now().Add(m.backoff)
+	m.log.Warn().Err(e).Str("address", m.address).Dur("backoff", m.backoff).
+		Msg("could not write to syslog server, access records are dropped until the redial")
+}
+
+// close flushes queued messages and closes the connection
+func (m *syslogSink) close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+
+	m.closed = true
+	close(m.queue)
+	m.mu.Unlock()
+
+	<-m.done
+	return nil
+}
+
+func (*syslogSink) isStdout() bool { return false }
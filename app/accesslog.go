@@ -0,0 +1,52 @@
+package app
+
+import (
+	"time"
+
+	"github.com/MindHunter86/addie/accesslog"
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// accessLogRecord collects request's locals set by middlewares and handlers;
+// records are filtered by access-log-level runtime param
+func (m *App) accessLogRecord(c *fiber.Ctx, status int, lvl zerolog.Level, start time.Time, latency time.Duration) {
+	if lvl < m.runtime.Config.Get(runtime.ParamAccessLevel).(zerolog.Level) {
+		return
+	}
+
+	local := func(key string) string {
+		val, _ := c.Locals(key).(string)
+		return val
+	}
+
+	requestid, _ := c.Locals("requestid").(string)
+	fallback, _ := c.Locals("fallback").(bool)
+
+	m.accessLog.Log(&accesslog.Record{
+		Time:      start,
+		Level:     lvl,
+		RequestId: requestid,
+		TraceId:   getRequestSpan(c).TraceID(),
+
+		Status:    status,
+		Bytes:     len(c.Response().Body()),
+		Method:    c.Method(),
+		Path:      c.Path(),
+		Proto:     c.Protocol(),
+		Ip:        c.IP(),
+		Latency:   latency,
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Referer:   c.Get(fiber.HeaderReferer),
+
+		Uid:           local("uid"),
+		Srv:           local("srv"),
+		Core:          local("core"),
+		QualityBefore: local("quality_before"),
+		QualityAfter:  local("quality_after"),
+		Cluster:       local("cluster"),
+		Fallback:      fallback,
+		Expires:       local("expires"),
+	}, m.runtime.Config.Get(runtime.ParamAccessStdout).(int) != 0)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,12 +15,28 @@ import (
 
 var (
 	errApiAbnormalResponse = errors.New("there is some problems with anilibria servers communication")
+	errApiTitleNotFound    = errors.New("title is not found in the api")
+	errApiQueueTimeout     = errors.New("there are too many concurrent api requests; request has been dropped by queue timeout")
+	errApiCircuitOpen      = errors.New("api circuit breaker is open; request has been rejected")
+	errApiRetryTimeout     = errors.New("anilibria-api-retry-timeout must be positive")
 )
 
 type ApiClient struct {
 	http *http.Client
 
 	apiBaseUrl *url.URL
+
+	// sem caps concurrent api requests, nil if the cap is disabled
+	sem          chan struct{}
+	queueTimeout time.Duration
+
+	// idempotent background requests are retried with jittered exponential backoff
+	// until the retry timeout of all attempts
+	retries                int
+	retryBackoff, retryMax time.Duration
+	retryTimeout           time.Duration
+
+	state apiClientState
 }
 
 const defaultApiMethodFilter = "id,code,names,updated,last_change,player"
@@ -27,7 +44,8 @@ const defaultApiMethodFilter = "id,code,names,updated,last_change,player"
 type ApiRequestMethod string
 
 const (
-	apiMethodGetTitle ApiRequestMethod = "/getTitle"
+	apiMethodGetTitle   ApiRequestMethod = "/getTitle"
+	apiMethodGetUpdates ApiRequestMethod = "/getUpdates"
 )
 
 type (
@@ -87,9 +105,28 @@ func NewApiClient() (*ApiClient, error) {
 
 	var apiClient = &ApiClient{
 		http: &http.Client{
-			Timeout:   time.Duration(gCli.Int("http-client-timeout")) * time.Second,
+			Timeout:   gCli.Duration("http-client-timeout"),
 			Transport: httpTransport,
 		},
+		queueTimeout: gCli.Duration("anilibria-api-queue-timeout"),
+
+		retries:      gCli.Int("anilibria-api-retries"),
+		retryBackoff: gCli.Duration("anilibria-api-retry-backoff"),
+		retryMax:     gCli.Duration("anilibria-api-retry-max-backoff"),
+		retryTimeout: gCli.Duration("anilibria-api-retry-timeout"),
+
+		state: newApiClientState(
+			gCli.Int("anilibria-api-breaker-threshold"),
+			gCli.Duration("anilibria-api-breaker-cooldown"),
+		),
+	}
+
+	if apiClient.retryTimeout <= 0 {
+		return nil, errApiRetryTimeout
+	}
+
+	if concurrency := gCli.Int("anilibria-api-max-concurrency"); concurrency > 0 {
+		apiClient.sem = make(chan struct{}, concurrency)
 	}
 
 	return apiClient, apiClient.getApiBaseUrl()
@@ -99,3 +136,68 @@ func (m *ApiClient) getApiBaseUrl() (e error) {
 	m.apiBaseUrl, e = url.Parse(gCli.String("anilibria-api-baseurl"))
 	return e
 }
+
+// acquire waits for the free slot of concurrent api requests not longer than the queue timeout
+func (m *ApiClient) acquire() bool {
+	if m.sem == nil {
+		return true
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(m.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-gCtx.Done():
+		return false
+	}
+}
+
+func (m *ApiClient) release() {
+	if m.sem != nil {
+		<-m.sem
+	}
+}
+
+// getRetryBackoff returns the full jittered backoff of the attempt, so retries of
+// concurrent requests are spread out
+func (m *ApiClient) getRetryBackoff(attempt int) time.Duration {
+	backoff := m.getRetryBackoffLimit(attempt)
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff))) // skipcq: GSC-G404 math/rand is enough
+}
+
+// getRetryBackoffLimit returns the exponential backoff of the attempt limited by the max one;
+// the backoff is shifted only if the result is not greater than the max one, so large attempts never overflow
+func (m *ApiClient) getRetryBackoffLimit(attempt int) time.Duration {
+	if attempt >= 0 && m.retryBackoff > 0 && m.retryBackoff <= m.retryMax>>attempt {
+		return m.retryBackoff << attempt
+	}
+
+	return m.retryMax
+}
+
+// isApiRetryable - transport errors, timeouts and 5xx responses are retried;
+// status is 0 if there is no response
+func isApiRetryable(e error, status int) bool {
+	switch {
+	case e == nil, errors.Is(e, errApiTitleNotFound):
+		return false
+	case status == 0:
+		return true
+	default:
+		return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+	}
+}
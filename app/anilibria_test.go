@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestGetRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		backoff, max time.Duration
+		attempt      int
+		limit        time.Duration
+	}{
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 0, limit: 100 * time.Millisecond},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 2, limit: 400 * time.Millisecond},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 3, limit: 800 * time.Millisecond},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 4, limit: time.Second},
+		// the shifted backoff overflows int64 for these attempts
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 37, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 40, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 63, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 64, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: time.Second, attempt: 1000, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: time.Duration(1<<63 - 1), attempt: 36, limit: 100 * time.Millisecond << 36},
+		{backoff: 100 * time.Millisecond, max: time.Duration(1<<63 - 1), attempt: 37, limit: time.Duration(1<<63 - 1)},
+		{backoff: time.Hour, max: time.Second, attempt: 0, limit: time.Second},
+		{backoff: 100 * time.Millisecond, max: 0, attempt: 3, limit: 0},
+		{backoff: 0, max: time.Second, attempt: 3, limit: time.Second},
+	} {
+		client := &ApiClient{retryBackoff: tc.backoff, retryMax: tc.max}
+
+		if limit := client.getRetryBackoffLimit(tc.attempt); limit != tc.limit {
+			t.Errorf("backoff %s, max %s, attempt %d: got limit %s, want %s", tc.backoff, tc.max, tc.attempt, limit, tc.limit)
+			continue
+		}
+
+		// the jittered backoff is in [0, limit), 0 if the limit is 0
+		for i := 0; i < 100; i++ {
+			if backoff := client.getRetryBackoff(tc.attempt); backoff < 0 || backoff > tc.limit || backoff == tc.limit && tc.limit != 0 {
+				t.Fatalf("backoff %s, max %s, attempt %d: got %s, want [0, %s)", tc.backoff, tc.max, tc.attempt, backoff, tc.limit)
+			}
+		}
+	}
+}
+
+func TestIsApiRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		e         error
+		status    int
+		retryable bool
+	}{
+		{e: nil, status: http.StatusOK},
+		{e: errApiTitleNotFound, status: http.StatusOK},
+		{e: fmt.Errorf("%w; 9000", errApiTitleNotFound), status: 0},
+		{e: context.DeadlineExceeded, status: 0, retryable: true},
+		{e: errTestApi, status: http.StatusBadGateway, retryable: true},
+		{e: errTestApi, status: http.StatusTooManyRequests, retryable: true},
+		{e: errTestApi, status: http.StatusBadRequest},
+		{e: errTestApi, status: http.StatusNotFound},
+	} {
+		if retryable := isApiRetryable(tc.e, tc.status); retryable != tc.retryable {
+			t.Errorf("%v, status %d: got retryable %t", tc.e, tc.status, retryable)
+		}
+	}
+}
+
+// newTestApiClient returns the api client of the handler with the retry timeout and without retries
+func newTestApiClient(t *testing.T, handler http.Handler) *ApiClient {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	baseUrl, e := url.Parse(server.URL)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	previous := gCtx
+	t.Cleanup(func() { gCtx = previous })
+	gCtx = context.Background()
+
+	return &ApiClient{
+		http:         server.Client(),
+		apiBaseUrl:   baseUrl,
+		retryTimeout: 10 * time.Second,
+		state:        newApiClientState(0, time.Minute),
+	}
+}
+
+// TestApiRetries checks that only background requests are retried and the concurrency slot
+// is free while retries wait out their backoff
+func TestApiRetries(t *testing.T) {
+	setTestCliContext(t, nil)
+
+	var requests int32
+	client := newTestApiClient(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	client.retries, client.retryBackoff, client.retryMax = 2, 200*time.Millisecond, 200*time.Millisecond
+	client.sem, client.queueTimeout = make(chan struct{}, 1), 50*time.Millisecond
+
+	// the request of the client makes one attempt
+	fb := fiber.New()
+	fb.Get("/", func(c *fiber.Ctx) error {
+		c.Locals("logger", gLog)
+		return client.getApiResponse(c, http.MethodGet, apiMethodGetTitle).Err()
+	})
+
+	if _, e := fb.Test(httptest.NewRequest(http.MethodGet, "/", nil)); e != nil {
+		t.Fatal(e)
+	} else if attempts := atomic.LoadInt32(&requests); attempts != 1 {
+		t.Fatalf("got %d attempts of the client request", attempts)
+	}
+
+	// the background request is retried
+	atomic.StoreInt32(&requests, 0)
+	done := make(chan error, 1)
+	go func() { done <- client.getApiResponse(nil, http.MethodGet, apiMethodGetTitle).Err() }()
+
+	// other requests get the slot while the background one waits out its backoff
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&requests) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the background request is not started")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if !client.acquire() {
+		t.Error("the slot is held by the request which waits out its backoff")
+	} else {
+		client.release()
+	}
+
+	if e := <-done; e == nil {
+		t.Error("the failed request has no error")
+	}
+
+	if attempts := atomic.LoadInt32(&requests); attempts != 3 {
+		t.Errorf("got %d attempts of the background request, expected 3", attempts)
+	}
+}
+
+// TestApiRetryTimeout checks that all attempts are limited by the retry timeout
+func TestApiRetryTimeout(t *testing.T) {
+	setTestCliContext(t, nil)
+
+	var requests int32
+	client := newTestApiClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(150 * time.Millisecond):
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	client.retries, client.retryTimeout = 10, 200*time.Millisecond
+
+	start := time.Now()
+	if e := client.getApiResponse(nil, http.MethodGet, apiMethodGetTitle).Err(); e == nil {
+		t.Error("the failed request has no error")
+	}
+
+	if elapsed, attempts := time.Since(start), atomic.LoadInt32(&requests); elapsed > time.Second || attempts > 2 {
+		t.Errorf("got %d attempts in %s with the retry timeout 200ms", attempts, elapsed)
+	}
+}
@@ -1,14 +1,20 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/MindHunter86/addie/tracing"
 	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
 )
 
 func (m *apiResponse) parseApiResponse(schema interface{}) (e error) {
@@ -67,9 +73,16 @@ func (*ApiClient) setApiRequestHeaders(req *http.Request) *http.Request {
 	return req
 }
 
+// getApiResponse makes the api request; c is nil for background requests, they are logged
+// by the global logger and are not traced
 func (m *ApiClient) getApiResponse(c *fiber.Ctx, hmethod string, amethod ApiRequestMethod, params ...interface{}) (arsp *apiResponse) {
 	arsp = &apiResponse{}
 
+	log, parent := gLog, (*tracing.Span)(nil)
+	if c != nil {
+		log, parent = rlog(c), getRequestSpan(c)
+	}
+
 	rrl := *m.apiBaseUrl
 	rrl.Path = rrl.Path + string(amethod)
 
@@ -91,21 +104,115 @@ func (m *ApiClient) getApiResponse(c *fiber.Ctx, hmethod string, amethod ApiRequ
 
 	rrl.RawQuery = rgs.Encode()
 
-	rlog(c).Trace().Msgf("rawquery: %s", rrl.RawQuery)
+	log.Trace().Msgf("rawquery: %s", rrl.RawQuery)
+
+	// dropped requests are not api failures
+	if !m.acquire() {
+		log.Warn().Str("api_method", string(amethod)).Msg("api request has been dropped by the concurrency cap")
+		arsp.err = errApiQueueTimeout
+		return
+	}
+
+	// the slot is released while retries wait out their backoff
+	acquired := true
+	defer func() {
+		if acquired {
+			m.release()
+		}
+	}()
+
+	// requests are rejected without attempts by the open breaker, they are not api failures too
+	if !m.state.allow() {
+		log.Debug().Str("api_method", string(amethod)).Msg("api request has been rejected by the circuit breaker")
+		arsp.err = errApiCircuitOpen
+		return
+	}
+
+	defer func() {
+		// not found titles are valid responses of the healthy api
+		if arsp.err != nil && !errors.Is(arsp.err, errApiTitleNotFound) {
+			m.state.failed(arsp.err)
+			return
+		}
+
+		m.state.succeeded()
+	}()
+
+	// only idempotent background requests are retried, bodies could not be read twice;
+	// requests of clients make one attempt, they are revalidated in background
+	var retries int
+	if c == nil && hmethod == http.MethodGet && body == nil {
+		retries = m.retries
+	}
+
+	// all attempts with their backoffs are limited by the one deadline
+	ctx, cancel := context.WithTimeout(gCtx, m.retryTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		var status int
+		if arsp, status = m.doApiRequest(ctx, log, parent, hmethod, amethod, rrl.String(), body); attempt >= retries ||
+			!isApiRetryable(arsp.Err(), status) {
+			return
+		}
+
+		backoff := m.getRetryBackoff(attempt)
+		if deadline, _ := ctx.Deadline(); time.Now().Add(backoff).After(deadline) {
+			log.Warn().Err(arsp.Err()).Str("api_method", string(amethod)).Int("attempt", attempt+1).
+				Msg("api request has been failed, there is no time left for retries")
+			return
+		}
+
+		log.Warn().Err(arsp.Err()).Str("api_method", string(amethod)).Int("attempt", attempt+1).
+			Dur("backoff", backoff).Msg("api request has been failed, retrying...")
+
+		m.release()
+		acquired = false
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// the last failure is returned if the cap is still reached
+		if acquired = m.acquire(); !acquired {
+			return
+		}
+	}
+}
+
+// doApiRequest makes the one attempt of the api request; status is 0 if there is no response
+func (m *ApiClient) doApiRequest(ctx context.Context, log *zerolog.Logger, parent *tracing.Span, hmethod string,
+	amethod ApiRequestMethod, rrl string, body io.Reader) (arsp *apiResponse, status int) {
+	arsp = &apiResponse{}
 
 	var req *http.Request
-	if req, arsp.err = http.NewRequest(hmethod, rrl.String(), body); arsp.Err() != nil {
+	if req, arsp.err = http.NewRequestWithContext(ctx, hmethod, rrl, body); arsp.Err() != nil {
 		return
 	}
 	m.setApiRequestHeaders(req)
 
+	span := parent.CurrentStage().Child("anilibria api", tracing.SpanKindClient)
+	span.SetAttribute("http.method", hmethod)
+	span.SetAttribute("http.url", rrl)
+	defer span.Finish()
+
+	if span != nil {
+		req.Header.Set(tracing.HeaderTraceparent, span.Traceparent())
+	}
+
 	var rsp *http.Response
 	if rsp, arsp.err = m.http.Do(req); arsp.Err() != nil {
+		span.SetError(arsp.err)
 		return
 	}
+	span.SetAttribute("http.status_code", strconv.Itoa(rsp.StatusCode))
 	defer func() {
 		if e := rsp.Body.Close(); e != nil {
-			rlog(c).Warn().Err(e)
+			log.Warn().Err(e)
 		}
 	}()
 
@@ -115,24 +222,28 @@ func (m *ApiClient) getApiResponse(c *fiber.Ctx, hmethod string, amethod ApiRequ
 	if arsp.payload, arsp.err = io.ReadAll(rsp.Body); arsp.Err() != nil {
 		return
 	}
+	status = rsp.StatusCode
 
 	switch rsp.StatusCode {
 	case http.StatusOK:
-		rlog(c).Debug().Str("api_method", string(amethod)).Msg("api reqiest has been completed with response 200 OK")
+		log.Debug().Str("api_method", string(amethod)).Msg("api reqiest has been completed with response 200 OK")
 	default:
-		rlog(c).Warn().Str("api_method", string(amethod)).Int("api_response_code", rsp.StatusCode).
+		log.Warn().Str("api_method", string(amethod)).Int("api_response_code", rsp.StatusCode).
 			Msg("abnormal api response; trying to parse api error object...")
 
 		var aerr *apiError
-		if err := arsp.parseApiResponse(&aerr); err != nil {
-			rlog(c).Error().Err(arsp.Err()).Msg("got an error in parsing reponse error object")
+		if err := arsp.parseApiResponse(&aerr); err != nil || aerr == nil || aerr.Error == nil {
+			log.Error().Err(arsp.Err()).Msg("got an error in parsing reponse error object")
 			arsp.err = errApiAbnormalResponse
 			return
 		}
 
-		rlog(c).Warn().Int("error_code", aerr.Error.Code).Str("error_desc", aerr.Error.Message).
+		log.Warn().Int("error_code", aerr.Error.Code).Str("error_desc", aerr.Error.Message).
 			Msg("api error object has been parse")
-		arsp.err = errApiAbnormalResponse
+
+		if arsp.err = errApiAbnormalResponse; aerr.Error.Code == http.StatusNotFound {
+			arsp.err = errApiTitleNotFound
+		}
 		return
 	}
 
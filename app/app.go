@@ -4,23 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
-	"regexp"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/MindHunter86/addie/accesslog"
 	"github.com/MindHunter86/addie/balancer"
 	"github.com/MindHunter86/addie/blocklist"
+	"github.com/MindHunter86/addie/media"
 	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
+	"github.com/MindHunter86/addie/tracing"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
 	bolt "github.com/gofiber/storage/bbolt"
 	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v2"
+	"go.etcd.io/bbolt"
 )
 
 var (
@@ -35,29 +38,41 @@ var (
 	gAniApi *ApiClient
 
 	gController *Controller
+
+	// only one of them is defined in --http-prefork mode
+	gPreforkParent *preforkParent
+	gPreforkChild  *preforkChild
 )
 
+var errKeyringReloadInterval = errors.New("link-keyring-reload-interval must be positive")
+
 type App struct {
 	fb     *fiber.App
 	fbstor fiber.Storage
 
-	cache     *CachedTitlesBucket
+	cache     *TitlesCache
+	flights   *titleFlights
 	blocklist *blocklist.Blocklist
 	runtime   *runtime.Runtime
+	keyring   *signer.Keyring
+	signers   *signer.Signers
+	signMemo  *signer.Memo // nil if link-expiration-bucket is disabled
 
 	cloudBalancer balancer.Balancer
 	bareBalancer  balancer.Balancer
 
-	chunkRegexp *regexp.Regexp
+	routes       *media.Router
+	playlists    *playlistSource
+	destinations *destinationResolver
 
-	syslogWriter io.Writer
+	accessLog *accesslog.AccessLog
+	tracer    *tracing.Tracer
 }
 
-func NewApp(c *cli.Context, l *zerolog.Logger, s io.Writer) (app *App) {
+func NewApp(c *cli.Context, l *zerolog.Logger) (app *App) {
 	gCli, gLog = c, l
 
 	app = &App{}
-	app.syslogWriter = s
 
 	app.fb = fiber.New(fiber.Config{
 		EnableTrustedProxyCheck: len(gCli.String("http-trusted-proxies")) > 0,
@@ -84,6 +99,7 @@ func NewApp(c *cli.Context, l *zerolog.Logger, s io.Writer) (app *App) {
 			fiber.MethodGet,
 			fiber.MethodOptions,
 			fiber.MethodPost,
+			fiber.MethodDelete,
 		},
 
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -156,8 +172,35 @@ func (m *App) Bootstrap() (e error) {
 
 	// BOOTSTRAP SECTION:
 	// common
-	const chunksplit = `^(\/[^\/]+\/[^\/]+\/[^\/]+\/)([^\/]+)\/([^\/]+)\/([^\/]+)\/([^.\/]+)\.ts$`
-	m.chunkRegexp = regexp.MustCompile(chunksplit)
+	if m.routes, e = media.NewRouter(gCli.StringSlice("media-route")); e != nil {
+		return
+	}
+
+	if m.playlists, e = newPlaylistSource(); e != nil {
+		return
+	}
+
+	if m.destinations, e = newDestinationResolver(
+		gCli.String("balancer-destination-template"),
+		gCli.StringSlice("balancer-destination-rule"),
+		gCli.String("balancer-destination-meta-key"),
+	); e != nil {
+		return
+	}
+
+	// access log
+	if m.accessLog, e = accesslog.NewAccessLog(gCtx); e != nil {
+		return
+	}
+	defer m.accessLog.Close()
+
+	// tracing
+	if m.tracer, e = tracing.NewTracer(gCtx); e != nil {
+		return
+	}
+	gofunc(&wg, func() {
+		m.tracer.Run(gCtx)
+	})
 
 	// anilibria API
 	gLog.Info().Msg("starting anilibria api client...")
@@ -167,17 +210,73 @@ func (m *App) Bootstrap() (e error) {
 
 	// fake quality cooler cache
 	gLog.Info().Msg("starting fake quality cache buckets...")
-	m.cache = NewCachedTitlesBucket()
+
+	// with prefork the database is opened by the parent only, children forward fetched titles to it
+	var db *bbolt.DB
+	if gCli.Bool("title-cache-persist") && !fiber.IsChild() {
+		var closer func()
+		if db, closer, e = m.getDatabase(); e != nil {
+			return
+		}
+		defer closer()
+	}
+
+	if m.cache, e = NewTitlesCache(
+		gCli.Int("title-cache-size"),
+		gCli.Duration("title-cache-ttl"),
+		gCli.Duration("title-cache-negative-ttl"),
+		gCli.Duration("title-cache-stale-ttl"),
+		db,
+	); e != nil {
+		return
+	}
+	gCtx = context.WithValue(gCtx, utils.ContextKeyTitlesCache, m.cache)
+	gofunc(&wg, func() {
+		m.cache.Persist(gCtx)
+	})
+	m.flights = newTitleFlights()
 
 	// blocklist
 	m.blocklist = blocklist.NewBlocklist(gCtx)
 	gCtx = context.WithValue(gCtx, utils.ContextKeyBlocklist, m.blocklist)
 
-	// runtime
-	if m.runtime, e = runtime.NewRuntime(gCtx); e != nil {
+	// signing keyring
+	// link-secret is the legacy key without id, file keys are reloaded on changes,
+	// consul keys are applied as runtime patches
+	m.keyring = signer.NewKeyring()
+	if secret := gCli.String("link-secret"); secret != "" {
+		m.keyring.Load(signer.SourceFlag, []*signer.Key{{Secret: secret}})
+	}
+
+	if path := gCli.String("link-keyring-file"); path != "" {
+		if gCli.Duration("link-keyring-reload-interval") <= 0 {
+			return errKeyringReloadInterval
+		} else if e = m.keyring.LoadFile(path); e != nil {
+			return
+		}
+
+		gofunc(&wg, func() {
+			m.keyring.WatchFile(gCtx, gLog, path, gCli.Duration("link-keyring-reload-interval"))
+		})
+	}
+
+	// links could not be signed without keys; consul keys are received after the start
+	if _, err := m.keyring.Signing(time.Now()); err != nil && !gCli.Bool("link-keyring-consul") {
+		return fmt.Errorf("%w; link-secret, link-keyring-file or link-keyring-consul must be defined", err)
+	}
+
+	gCtx = context.WithValue(gCtx, utils.ContextKeyKeyring, m.keyring)
+
+	if m.signers, e = signer.NewSigners(gCtx); e != nil {
 		return
 	}
-	gCtx = context.WithValue(gCtx, utils.ContextKeyRuntime, m.runtime)
+	gCtx = context.WithValue(gCtx, utils.ContextKeySigners, m.signers)
+
+	if gCli.Duration("link-expiration-bucket") >= 2*time.Second && gCli.Int("link-sign-memo-size") > 0 {
+		if m.signMemo, e = signer.NewMemo(gCli.Int("link-sign-memo-size")); e != nil {
+			return
+		}
+	}
 
 	// balancer V2
 	gLog.Info().Msg("bootstrap balancer_v2 subsystems...")
@@ -192,6 +291,13 @@ func (m *App) Bootstrap() (e error) {
 			balancer.BalancerClusterNodes: m.bareBalancer,
 		})
 
+	// runtime
+	// balancers must be initialized before runtime for server states patching
+	if m.runtime, e = runtime.NewRuntime(gCtx); e != nil {
+		return
+	}
+	gCtx = context.WithValue(gCtx, utils.ContextKeyRuntime, m.runtime)
+
 	gController.WithContext(gCtx)
 	gController.SetReady()
 
@@ -201,9 +307,61 @@ func (m *App) Bootstrap() (e error) {
 		return
 	}
 
-	// consul bootstrap
-	gLog.Info().Msg("bootstrap consul subsystems...")
-	gofunc(&wg, gConsul.bootstrap)
+	// prefork
+	// the parent owns consul watchers and pushes runtime patches and servers to children
+	if gCli.Bool("http-prefork") {
+		digest := func() string {
+			return getStateDigest(m.runtime, m.cloudBalancer, m.bareBalancer)
+		}
+
+		if fiber.IsChild() {
+			if gPreforkChild, e = newPreforkChild(digest, rpatcher, m.cache, m.cloudBalancer, m.bareBalancer); e != nil {
+				return
+			}
+		} else {
+			if gPreforkParent, e = newPreforkParent(digest, m.cache); e != nil {
+				return
+			}
+			m.fb.Hooks().OnFork(gPreforkParent.fork)
+		}
+	}
+
+	// titles prewarmer
+	var prewarmer *titlesPrewarmer
+	if prewarmer, e = newTitlesPrewarmer(m); e != nil {
+		return
+	}
+
+	switch {
+	case gPreforkChild != nil:
+		gLog.Info().Msg("prefork child mode; consul subsystems are managed by the parent")
+		gofunc(&wg, func() {
+			gPreforkChild.run(gCtx, gCli.Duration("http-prefork-check-interval"))
+		})
+	case gPreforkParent != nil:
+		gofunc(&wg, func() {
+			if e := gPreforkParent.serve(gCtx); e != nil {
+				gLog.Error().Err(e).Msg("prefork parent could not serve children")
+				gAbort()
+			}
+		})
+
+		fallthrough
+	default:
+		// consul bootstrap
+		gLog.Info().Msg("bootstrap consul subsystems...")
+		gofunc(&wg, gConsul.bootstrap)
+
+		// prefork children get prewarmed titles from the parent
+		gofunc(&wg, func() {
+			prewarmer.Run(gCtx)
+		})
+	}
+
+	// balancers stats publishing for aggregated views
+	gofunc(&wg, func() {
+		newStatsPublisher(m.cloudBalancer, m.bareBalancer).run(gCtx)
+	})
 
 	// http
 	gofunc(&wg, func() {
@@ -246,6 +404,10 @@ LOOP:
 		case patch := <-rpatcher:
 			gLog.Debug().Msg("new configuration detected, applying...")
 			m.runtime.ApplyPatch(patch)
+
+			if gPreforkParent != nil {
+				gPreforkParent.broadcastPatch(patch)
+			}
 		case <-kernSignal:
 			gLog.Info().Msg("kernel signal has been caught; initiate application closing...")
 			gAbort()
@@ -267,10 +429,31 @@ LOOP:
 	}
 }
 
-func (m *App) rsyslog(c *fiber.Ctx) (l *zerolog.Logger) {
-	return c.Locals("syslogger").(*zerolog.Logger)
-}
-
 func rlog(c *fiber.Ctx) *zerolog.Logger {
 	return c.Locals("logger").(*zerolog.Logger)
 }
+
+// getDatabase returns bbolt database of database-prefix; the database of the limiter is reused
+// because bbolt files are locked exclusively
+func (m *App) getDatabase() (db *bbolt.DB, closer func(), e error) {
+	if stor, ok := m.fbstor.(*bolt.Storage); ok {
+		return stor.Conn(), func() {}, e
+	}
+
+	prefix := gCli.String("database-prefix")
+	if prefix == "" {
+		prefix = "."
+	}
+
+	if db, e = bbolt.Open(fmt.Sprintf("%s/%s.db", prefix, gCli.App.Name), 0600, &bbolt.Options{
+		Timeout: time.Second,
+	}); e != nil {
+		return
+	}
+
+	return db, func() {
+		if err := db.Close(); err != nil {
+			gLog.Error().Err(err).Msg("could not close database")
+		}
+	}, e
+}
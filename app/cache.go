@@ -1,49 +1,356 @@
 package app
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/gofiber/fiber/v2"
-	"github.com/rs/zerolog"
+	lru "github.com/hashicorp/golang-lru"
+	"go.etcd.io/bbolt"
 )
 
-type CachedTitlesBucket struct {
-	locker sync.RWMutex
-	bucket map[uint32]*TitleSerie
+var (
+	errCacheTitleMissing = errors.New("title is missing in the api")
+	errCacheSerieMissing = errors.New("serie is missing in the api response")
+)
+
+const titlesCacheBucket = "titles-cache"
+
+const (
+	// titlesCachePersistInterval - how often changed titles are written to the db
+	titlesCachePersistInterval = time.Second
+	// titlesCachePersistBatch - count of changed titles which are written without waiting for the interval
+	titlesCachePersistBatch = 256
+)
+
+// CachedTitle - series of the title from the api; titles which the api says are missing
+// are cached too, so they are not requested on every chunk
+type CachedTitle struct {
+	Id      uint16                 `json:"id"`
+	Series  map[uint16]*TitleSerie `json:"series,omitempty"`
+	Missing bool                   `json:"missing,omitempty"`
+
+	// LastChange - last_change of the title in the api, the title is changed if it moves
+	LastChange uint64 `json:"last_change,omitempty"`
+
+	Updated time.Time `json:"updated"`
+	Expires time.Time `json:"expires"`
+}
+
+func (m *CachedTitle) isFresh(now time.Time) bool {
+	return now.Before(m.Expires)
+}
+
+// TitlesCache is LRU of titles with TTL; expired titles are kept until eviction, so they
+// may be served for the stale TTL while they are revalidated. Titles are persisted in bbolt
+// by Persist() if the db is defined
+type TitlesCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+
+	ttl, negativeTtl, staleTtl time.Duration
+
+	db        *bbolt.DB
+	persister *titlesPersister
+}
+
+// titlesPersister collects changes of LRU for batch writes, so LRU never waits for the disk;
+// the last change of the title wins, nil is the removed title
+type titlesPersister struct {
+	db *bbolt.DB
+
+	mu      sync.Mutex
+	pending map[uint16]*CachedTitle
+	batch   chan struct{}
 }
 
-func NewCachedTitlesBucket() *CachedTitlesBucket {
-	return &CachedTitlesBucket{
-		bucket: make(map[uint32]*TitleSerie),
+func NewTitlesCache(size int, ttl, negativeTtl, staleTtl time.Duration, db *bbolt.DB) (_ *TitlesCache, e error) {
+	cache := &TitlesCache{
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		staleTtl:    staleTtl,
+		db:          db,
+	}
+
+	if cache.lru, e = lru.NewWithEvict(size, cache.onEvict); e != nil {
+		return
+	}
+
+	if db == nil {
+		return cache, e
+	}
+
+	cache.persister = &titlesPersister{
+		db:      db,
+		pending: make(map[uint16]*CachedTitle),
+		batch:   make(chan struct{}, 1),
+	}
+
+	if e = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(titlesCacheBucket))
+		return err
+	}); e != nil {
+		return
 	}
+
+	return cache, cache.load()
 }
 
-func (m *CachedTitlesBucket) PullSerie(c *fiber.Ctx, tid, sid uint16) (serie *TitleSerie, _ error) {
-	if tid == 0 || sid == 0 {
-		return serie, errors.New("cache: tid, sid zero found")
+// load fills LRU with persisted titles, the newest ones are kept if there are more titles than LRU size
+func (m *TitlesCache) load() (e error) {
+	var titles []*CachedTitle
+
+	if e = m.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(titlesCacheBucket)).ForEach(func(_, v []byte) error {
+			var title *CachedTitle
+			if err := json.Unmarshal(v, &title); err != nil {
+				gLog.Warn().Err(err).Msg("could not parse persisted title, skipping")
+				return nil
+			}
+
+			titles = append(titles, title)
+			return nil
+		})
+	}); e != nil {
+		return
+	}
+
+	sort.Slice(titles, func(i, j int) bool {
+		return titles[i].Updated.Before(titles[j].Updated)
+	})
+
+	// titles evicted while loading are removed from the db by the next write
+	m.mu.Lock()
+	for _, title := range titles {
+		m.lru.Add(title.Id, title)
 	}
+	m.mu.Unlock()
 
-	m.locker.RLock()
-	if zerolog.GlobalLevel() <= zerolog.TraceLevel {
-		rlog(c).Trace().Int("cache_size", len(m.bucket)+1).Msg("cache size debug")
+	gLog.Info().Int("titles", len(titles)).Msg("persisted titles cache has been loaded")
+	return
+}
+
+// Get returns the title and its freshness; nil is returned if the title is not cached
+func (m *TitlesCache) Get(tid uint16) (_ *CachedTitle, fresh bool) {
+	buf, ok := m.lru.Get(tid)
+	if !ok {
+		return nil, false
 	}
 
-	serie = m.bucket[uint32(tid)<<16|uint32(sid)]
-	m.locker.RUnlock()
+	title := buf.(*CachedTitle)
+	return title, title.isFresh(time.Now())
+}
+
+// GetSerie returns the serie of the fresh title; the missing serie of the fresh title
+// is cached for the negative TTL, new series are requested after it
+func (m *TitlesCache) GetSerie(tid, sid uint16) (serie *TitleSerie, fresh bool, e error) {
+	var title *CachedTitle
+	if title, fresh = m.Get(tid); !fresh {
+		return
+	}
+
+	switch serie = title.Series[sid]; {
+	case title.Missing:
+		e = errCacheTitleMissing
+	case serie == nil && time.Since(title.Updated) < m.negativeTtl:
+		e = errCacheSerieMissing
+	case serie == nil:
+		fresh = false
+	}
 
 	return
 }
 
-func (m *CachedTitlesBucket) PushSerie(serie *TitleSerie) (_ error) {
-	if serie == nil || serie.Title == 0 || serie.Serie == 0 {
-		return errors.New("cache: serie.Title, serie.Serie zero found or serie is undefined")
+// GetStaleSerie returns the serie of the expired title within the stale TTL;
+// missing titles are not served stale
+func (m *TitlesCache) GetStaleSerie(tid, sid uint16) *TitleSerie {
+	title, fresh := m.Get(tid)
+	if title == nil || fresh || title.Missing || time.Since(title.Expires) > m.staleTtl {
+		return nil
+	}
+
+	return title.Series[sid]
+}
+
+// PushSeries replaces all series of the title and returns the cached title
+func (m *TitlesCache) PushSeries(tid uint16, lastChange uint64, series []*TitleSerie) *CachedTitle {
+	now := time.Now()
+
+	title := &CachedTitle{
+		Id:         tid,
+		Series:     make(map[uint16]*TitleSerie, len(series)),
+		LastChange: lastChange,
+		Updated:    now,
+		Expires:    now.Add(m.ttl),
+	}
+
+	for _, serie := range series {
+		title.Series[serie.Serie] = serie
+	}
+
+	m.push(title)
+	return title
+}
+
+// PushMissing caches the title as missing for the negative TTL and returns the cached title
+func (m *TitlesCache) PushMissing(tid uint16) *CachedTitle {
+	now := time.Now()
+
+	title := &CachedTitle{
+		Id:      tid,
+		Missing: true,
+		Updated: now,
+		Expires: now.Add(m.negativeTtl),
+	}
+
+	m.push(title)
+	return title
+}
+
+// PushTitle caches the title as is; prefork children get titles prewarmed by the parent
+func (m *TitlesCache) PushTitle(title *CachedTitle) {
+	if title == nil || title.Id == 0 {
+		return
 	}
 
-	m.locker.Lock()
+	m.push(title)
+}
+
+// GetFreshTitles returns fresh titles which are not missing in the api
+func (m *TitlesCache) GetFreshTitles() (titles []*CachedTitle) {
+	now := time.Now()
 
-	m.bucket[uint32(serie.Title)<<16|uint32(serie.Serie)] = serie
-	m.locker.Unlock()
+	for _, key := range m.lru.Keys() {
+		buf, ok := m.lru.Peek(key)
+		if !ok {
+			continue
+		}
+
+		if title := buf.(*CachedTitle); !title.Missing && title.isFresh(now) {
+			titles = append(titles, title)
+		}
+	}
 
 	return
 }
+
+func (m *TitlesCache) push(title *CachedTitle) {
+	// lru and db changes of the same title must not be reordered
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.Add(title.Id, title)
+	m.persister.put(title.Id, title)
+}
+
+// Delete removes the title from LRU, the db write is queued by onEvict
+func (m *TitlesCache) Delete(tid uint16) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lru.Remove(tid)
+}
+
+func (m *TitlesCache) Len() int {
+	return m.lru.Len()
+}
+
+// onEvict queues removal of evicted and deleted titles; it's called by LRU under the cache's mutex
+func (m *TitlesCache) onEvict(key, _ interface{}) {
+	m.persister.put(key.(uint16), nil)
+}
+
+// Persist writes changed titles to the db until the context is done, the last changes are
+// written before return; the cache is in-memory only without the db
+func (m *TitlesCache) Persist(ctx context.Context) {
+	if m.persister == nil {
+		return
+	}
+
+	gLog.Debug().Msg("titles cache persister started")
+	defer gLog.Debug().Msg("titles cache persister stopped")
+
+	ticker := time.NewTicker(titlesCachePersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.persister.write()
+			return
+		case <-ticker.C:
+		case <-m.persister.batch:
+		}
+
+		m.persister.write()
+	}
+}
+
+// put is nil-safe, so the cache without the db does not check the persister
+func (m *titlesPersister) put(tid uint16, title *CachedTitle) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.pending[tid] = title
+	full := len(m.pending) >= titlesCachePersistBatch
+	m.mu.Unlock()
+
+	if full {
+		select {
+		case m.batch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// write puts and deletes pending titles in one transaction; failed changes are not retried,
+// the db is refilled by next changes of titles
+func (m *titlesPersister) write() {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[uint16]*CachedTitle, len(pending))
+	m.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	if e := m.db.Update(func(tx *bbolt.Tx) (err error) {
+		bucket := tx.Bucket([]byte(titlesCacheBucket))
+
+		for tid, title := range pending {
+			if title == nil {
+				if err = bucket.Delete(titlesCacheKey(tid)); err != nil {
+					return
+				}
+				continue
+			}
+
+			var buf []byte
+			if buf, err = json.Marshal(title); err != nil {
+				gLog.Error().Err(err).Uint16("tid", tid).Msg("could not marshal title for persisting")
+				continue
+			}
+
+			if err = bucket.Put(titlesCacheKey(tid), buf); err != nil {
+				return
+			}
+		}
+
+		return nil
+	}); e != nil {
+		gLog.Error().Err(e).Int("titles", len(pending)).Msg("could not persist titles cache changes")
+	}
+}
+
+func titlesCacheKey(tid uint16) []byte {
+	key := make([]byte, 2)
+	binary.BigEndian.PutUint16(key, tid)
+	return key
+}
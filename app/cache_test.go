@@ -0,0 +1,298 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func newTestTitle(tid uint16, updated, expires time.Time, series ...uint16) *CachedTitle {
+	title := &CachedTitle{
+		Id:      tid,
+		Series:  make(map[uint16]*TitleSerie, len(series)),
+		Updated: updated,
+		Expires: expires,
+	}
+
+	for _, sid := range series {
+		title.Series[sid] = &TitleSerie{Title: tid, Serie: sid}
+	}
+
+	return title
+}
+
+func openTestDatabase(t *testing.T, path string) *bbolt.DB {
+	t.Helper()
+
+	db, e := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return db
+}
+
+// getPersisted returns ids of titles in the db
+func getPersisted(t *testing.T, db *bbolt.DB) (tids map[uint16]bool) {
+	t.Helper()
+
+	tids = make(map[uint16]bool)
+	if e := db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(titlesCacheBucket)).ForEach(func(k, _ []byte) error {
+			tids[binary.BigEndian.Uint16(k)] = true
+			return nil
+		})
+	}); e != nil {
+		t.Fatal(e)
+	}
+
+	return
+}
+
+func TestTitlesCacheTTL(t *testing.T) {
+	cache := newTestTitlesCache(t)
+
+	pushed := cache.PushSeries(9000, 1, []*TitleSerie{{Title: 9000, Serie: 1}})
+	if time.Until(pushed.Expires) <= 59*time.Minute {
+		t.Errorf("got expiration %s, expected ttl 1h", pushed.Expires)
+	}
+
+	if title, fresh := cache.Get(9000); title != pushed || !fresh {
+		t.Errorf("pushed title is not fresh - %+v", title)
+	}
+
+	if serie, fresh, e := cache.GetSerie(9000, 1); serie == nil || !fresh || e != nil {
+		t.Errorf("got serie %+v, %t, %v", serie, fresh, e)
+	}
+
+	// expired titles are kept until eviction, but they are not fresh
+	now := time.Now()
+	cache.PushTitle(newTestTitle(9001, now.Add(-2*time.Hour), now.Add(-time.Second), 1))
+
+	if title, fresh := cache.Get(9001); title == nil || fresh {
+		t.Errorf("expired title is fresh or removed - %+v", title)
+	}
+
+	if serie, fresh, e := cache.GetSerie(9001, 1); serie != nil || fresh || e != nil {
+		t.Errorf("got serie %+v, %t, %v of the expired title", serie, fresh, e)
+	}
+
+	if titles := cache.GetFreshTitles(); len(titles) != 1 || titles[0] != pushed {
+		t.Errorf("got fresh titles %+v", titles)
+	}
+}
+
+func TestTitlesCacheNegative(t *testing.T) {
+	cache := newTestTitlesCache(t)
+
+	// missing titles are cached for the negative ttl and they are not stale
+	missing := cache.PushMissing(9000)
+	if !missing.Missing || time.Until(missing.Expires) > time.Minute {
+		t.Errorf("got missing title %+v, expected negative ttl 1m", missing)
+	}
+
+	if _, fresh, e := cache.GetSerie(9000, 1); !fresh || !errors.Is(e, errCacheTitleMissing) {
+		t.Errorf("got %t, %v for the missing title", fresh, e)
+	}
+
+	if titles := cache.GetFreshTitles(); len(titles) != 0 {
+		t.Errorf("missing titles are returned as fresh - %+v", titles)
+	}
+
+	now := time.Now()
+	cache.PushTitle(&CachedTitle{Id: 9000, Missing: true, Updated: now.Add(-2 * time.Minute), Expires: now.Add(-time.Minute)})
+
+	if serie := cache.GetStaleSerie(9000, 1); serie != nil {
+		t.Error("missing title is served stale")
+	}
+
+	// the missing serie of the fresh title is cached for the negative ttl too
+	cache.PushSeries(9001, 1, []*TitleSerie{{Title: 9001, Serie: 1}})
+	if serie, fresh, e := cache.GetSerie(9001, 2); serie != nil || !fresh || !errors.Is(e, errCacheSerieMissing) {
+		t.Errorf("got serie %+v, %t, %v for the missing serie", serie, fresh, e)
+	}
+
+	// the new serie is requested after the negative ttl
+	cache.PushTitle(newTestTitle(9001, now.Add(-2*time.Minute), now.Add(time.Hour), 1))
+	if serie, fresh, e := cache.GetSerie(9001, 2); serie != nil || fresh || e != nil {
+		t.Errorf("got serie %+v, %t, %v for the missing serie after the negative ttl", serie, fresh, e)
+	}
+}
+
+func TestTitlesCacheStale(t *testing.T) {
+	cache := newTestTitlesCache(t)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		title *CachedTitle
+		stale bool
+	}{
+		{name: "fresh", title: newTestTitle(9000, now, now.Add(time.Hour), 1)},
+		{name: "within the stale ttl", title: newTestTitle(9000, now.Add(-2*time.Hour), now.Add(-30*time.Minute), 1), stale: true},
+		{name: "after the stale ttl", title: newTestTitle(9000, now.Add(-3*time.Hour), now.Add(-2*time.Hour), 1)},
+	} {
+		cache.PushTitle(tc.title)
+
+		if serie := cache.GetStaleSerie(9000, 1); (serie != nil) != tc.stale {
+			t.Errorf("%s: got stale serie %+v", tc.name, serie)
+		}
+
+		if serie := cache.GetStaleSerie(9000, 2); serie != nil {
+			t.Errorf("%s: unknown serie is served stale", tc.name)
+		}
+	}
+
+	if serie := cache.GetStaleSerie(9001, 1); serie != nil {
+		t.Error("not cached title is served stale")
+	}
+}
+
+func TestTitlesCacheEviction(t *testing.T) {
+	db := openTestDatabase(t, filepath.Join(t.TempDir(), "addie.db"))
+	defer db.Close()
+
+	cache, e := NewTitlesCache(2, time.Hour, time.Minute, time.Hour, db)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cache.PushSeries(9000, 1, nil)
+	cache.PushSeries(9001, 1, nil)
+
+	// the recently used title is kept
+	cache.Get(9000)
+	cache.PushSeries(9002, 1, nil)
+
+	if cache.Len() != 2 {
+		t.Errorf("got %d titles, the size is 2", cache.Len())
+	}
+
+	if title, _ := cache.Get(9001); title != nil {
+		t.Error("the least recently used title is not evicted")
+	}
+
+	// the db is not changed by LRU operations
+	if tids := getPersisted(t, db); len(tids) != 0 {
+		t.Errorf("titles %v are persisted before the write", tids)
+	}
+
+	cache.persister.write()
+	if tids := getPersisted(t, db); len(tids) != 2 || !tids[9000] || !tids[9002] {
+		t.Errorf("got persisted titles %v", tids)
+	}
+
+	if !cache.Delete(9000) || cache.Delete(9000) {
+		t.Error("title is not deleted once")
+	}
+
+	cache.persister.write()
+	if tids := getPersisted(t, db); len(tids) != 1 || !tids[9002] {
+		t.Errorf("got persisted titles %v after the deletion", tids)
+	}
+}
+
+// TestTitlesCacheReload checks that titles are restored after the restart,
+// the newest ones are kept if the size has been decreased
+func TestTitlesCacheReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addie.db")
+	db := openTestDatabase(t, path)
+
+	cache, e := NewTitlesCache(10, time.Hour, time.Minute, time.Hour, db)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	now := time.Now()
+	for i := uint16(0); i < 3; i++ {
+		cache.PushTitle(newTestTitle(9000+i, now.Add(time.Duration(i)*time.Second), now.Add(time.Hour), 1, 2))
+	}
+	cache.PushMissing(8000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		cache.Persist(ctx)
+	}()
+
+	// the last changes are written on the shutdown
+	cancel()
+	<-done
+
+	if e = db.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	db = openTestDatabase(t, path)
+	defer db.Close()
+
+	if cache, e = NewTitlesCache(3, time.Hour, time.Minute, time.Hour, db); e != nil {
+		t.Fatal(e)
+	}
+
+	if cache.Len() != 3 {
+		t.Fatalf("got %d titles after the reload", cache.Len())
+	}
+
+	if title, _ := cache.Get(9000); title != nil {
+		t.Error("the oldest title is loaded over the size")
+	}
+
+	if title, fresh := cache.Get(9002); title == nil || !fresh || len(title.Series) != 2 || title.Series[2].Serie != 2 {
+		t.Errorf("got reloaded title %+v", title)
+	}
+
+	if _, fresh, e := cache.GetSerie(8000, 1); !fresh || !errors.Is(e, errCacheTitleMissing) {
+		t.Errorf("missing title is not reloaded - %t, %v", fresh, e)
+	}
+
+	// the title which is not loaded is removed from the db by the next write
+	cache.persister.write()
+	if tids := getPersisted(t, db); len(tids) != 3 || tids[9000] {
+		t.Errorf("got persisted titles %v", tids)
+	}
+}
+
+func TestTitlesCacheBatch(t *testing.T) {
+	db := openTestDatabase(t, filepath.Join(t.TempDir(), "addie.db"))
+	defer db.Close()
+
+	cache, e := NewTitlesCache(titlesCachePersistBatch*2, time.Hour, time.Minute, time.Hour, db)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		cache.Persist(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the full batch is written without waiting for the interval
+	for tid := uint16(1); tid <= titlesCachePersistBatch; tid++ {
+		cache.PushMissing(tid)
+	}
+
+	deadline := time.Now().Add(titlesCachePersistInterval / 2)
+	for len(getPersisted(t, db)) != titlesCachePersistBatch {
+		if time.Now().After(deadline) {
+			t.Fatal("the full batch is not written before the interval")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
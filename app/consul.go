@@ -3,9 +3,9 @@ package app
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
 	"strings"
 	"sync"
 	"time"
@@ -28,10 +28,13 @@ type consulClient struct {
 	ctx context.Context
 
 	balancers []balancer.Balancer
+	watchers  *consulWatchers
 }
 
 var (
 	errConsulInvalidCluster = errors.New("clustername cound not be empty")
+	errConsulCASFailed      = errors.New("could not update consul value because of concurrent changes; try again")
+	errConsulStatsLocked    = errors.New("stats key is held by the other session; instance names must be unique")
 )
 
 func newConsulClient(balancers ...balancer.Balancer) (client *consulClient, e error) {
@@ -55,9 +58,16 @@ func newConsulClient(balancers ...balancer.Balancer) (client *consulClient, e er
 		}
 	}
 
-	client = new(consulClient)
+	// ctx is replaced in bootstrap(); prefork children use the client without bootstrap
+	clusters := make([]string, 0, len(balancers))
+	for _, blcnr := range balancers {
+		clusters = append(clusters, blcnr.GetClusterName())
+	}
+
+	client = &consulClient{ctx: gCtx}
 	client.Client, e = capi.NewClient(cfg)
 	client.balancers = balancers
+	client.watchers = newConsulWatchers(clusters...)
 	return
 }
 
@@ -130,7 +140,7 @@ func (m *consulClient) listenClusterEvents(cluster balancer.Balancer) (e error)
 	defer gLog.Debug().Msgf("consul event listener stopped for cluster %s", cluster.GetClusterName())
 
 	var idx uint64
-	var servers map[string]net.IP
+	var servers map[string]*balancer.UpstreamEntry
 	var fails uint8
 
 	for {
@@ -149,6 +159,7 @@ func (m *consulClient) listenClusterEvents(cluster balancer.Balancer) (e error)
 			gLog.Warn().Uint8("fails", fails).Err(e).
 				Msg("there some problems with serverlist receiving from consul")
 			fails = fails + 1
+			m.watchers.clusterFailed(cluster.GetClusterName(), e)
 
 			time.Sleep(1 * time.Second)
 			continue
@@ -156,6 +167,7 @@ func (m *consulClient) listenClusterEvents(cluster balancer.Balancer) (e error)
 
 		gLog.Debug().Msg("consul listenEvents iteration triggered")
 		fails = 0
+		m.watchers.clusterReceived(cluster.GetClusterName(), idx, len(servers))
 
 		if len(servers) == 0 {
 			gLog.Warn().Msg("received empty serverlist from consul")
@@ -164,18 +176,22 @@ func (m *consulClient) listenClusterEvents(cluster balancer.Balancer) (e error)
 		if gLog.GetLevel() == zerolog.TraceLevel {
 			gLog.Trace().Msg("received serverlist debug")
 
-			for _, ip := range servers {
-				gLog.Trace().Msgf("received serverlist entry - %s", ip.String())
+			for address, entry := range servers {
+				gLog.Trace().Msgf("received serverlist entry - %s (%s)", address, entry.Name)
 			}
 		}
 
 		cluster.UpdateServers(servers)
+
+		if gPreforkParent != nil {
+			gPreforkParent.broadcastServers(cluster.GetClusterName(), servers)
+		}
 	}
 }
 
 // func (m *consulClient)
 
-func (m *consulClient) getHealthServers(idx uint64, service string) (_ map[string]net.IP, _ uint64, e error) {
+func (m *consulClient) getHealthServers(idx uint64, service string) (_ map[string]*balancer.UpstreamEntry, _ uint64, e error) {
 	opts := *defaultOpts
 	opts.WaitIndex = idx
 
@@ -184,19 +200,17 @@ func (m *consulClient) getHealthServers(idx uint64, service string) (_ map[strin
 		return nil, idx, e
 	}
 
-	var ip net.IP
-	var servers = make(map[string]net.IP)
+	var servers = make(map[string]*balancer.UpstreamEntry)
 
 	for _, entry := range entries {
-		gLog.Debug().Msgf("new health service entry %s:%d", entry.Node.Address, entry.Service.Port)
-
-		ip = net.ParseIP(entry.Node.Address)
-		if ip == nil {
-			gLog.Warn().Msgf("there is invalid server address from consul - %s", entry.Node.Address)
+		upstream, err := balancer.NewUpstreamEntry(entry)
+		if err != nil {
+			gLog.Warn().Err(err).Msg("there is invalid health service entry from consul")
 			continue
 		}
 
-		servers[entry.Node.Node] = ip
+		gLog.Debug().Msgf("new health service entry %s (%s)", upstream.Address(), upstream.Name)
+		servers[upstream.Address()] = upstream
 	}
 
 	return servers, meta.LastIndex, e
@@ -275,6 +289,165 @@ func (m *consulClient) updateQualityRewrite(q utils.TitleQuality) (e error) {
 	return
 }
 
+// updateServerState puts (or removes if state is nil) server state in consul KV;
+// check-and-set is used because states of all clusters are stored in one key
+func (m *consulClient) updateServerState(cluster, server string, state *balancer.ServerState) (e error) {
+	ckey := m.getPrefixedSettingsKey(utils.CfgBalancerServerStates)
+
+	var kv *capi.KVPair
+	if kv, _, e = m.KV().Get(ckey, nil); e != nil {
+		return
+	} else if kv == nil {
+		kv = &capi.KVPair{Key: ckey}
+	}
+
+	states := make(balancer.ClusterServerStates)
+	if len(kv.Value) != 0 {
+		if e = json.Unmarshal(kv.Value, &states); e != nil {
+			return
+		}
+	}
+
+	if states[cluster] == nil {
+		states[cluster] = make(balancer.ServerStates)
+	}
+
+	if state == nil {
+		delete(states[cluster], server)
+	} else {
+		states[cluster][server] = state
+	}
+
+	if kv.Value, e = json.Marshal(states); e != nil {
+		return
+	}
+
+	var ok bool
+	if ok, _, e = m.KV().CAS(kv, nil); e != nil {
+		return
+	} else if !ok {
+		return errConsulCASFailed
+	}
+
+	return
+}
+
+// consul limits session TTLs by 10s..24h
+const (
+	statsSessionMinTTL = 10 * time.Second
+	statsSessionMaxTTL = 24 * time.Hour
+)
+
+// createStatsSession creates the session of the instance's published stats; consul deletes keys
+// of the session when it's expired or destroyed, so snapshots of dead and renamed instances are not
+// kept in KV forever. Sessions of previous runs of the instance on this agent's node are destroyed
+// for taking their keys over; sessions of other nodes are kept, they are instances with the same name
+func (m *consulClient) createStatsSession(instance string, ttl time.Duration) (id string, e error) {
+	name := "addie-stats-" + instance
+
+	var node string
+	if node, e = m.Agent().NodeName(); e != nil {
+		return
+	}
+
+	var sessions []*capi.SessionEntry
+	if sessions, _, e = m.Session().Node(node, (&capi.QueryOptions{}).WithContext(gCtx)); e != nil {
+		return
+	}
+
+	for _, session := range sessions {
+		if session.Name != name {
+			continue
+		}
+
+		gLog.Debug().Msgf("destroying stats session %s of the previous run", session.ID)
+		if _, e = m.Session().Destroy(session.ID, (&capi.WriteOptions{}).WithContext(gCtx)); e != nil {
+			return
+		}
+	}
+
+	if ttl < statsSessionMinTTL {
+		ttl = statsSessionMinTTL
+	} else if ttl > statsSessionMaxTTL {
+		ttl = statsSessionMaxTTL
+	}
+
+	// lock delay blocks keys of invalidated sessions, it's useless for stats
+	id, _, e = m.Session().Create(&capi.SessionEntry{
+		Name:      name,
+		TTL:       ttl.String(),
+		Behavior:  capi.SessionBehaviorDelete,
+		LockDelay: time.Millisecond,
+	}, (&capi.WriteOptions{}).WithContext(gCtx))
+	return
+}
+
+// renewStatsSession returns false if the session is expired and its keys are deleted
+func (m *consulClient) renewStatsSession(id string) (_ bool, e error) {
+	var session *capi.SessionEntry
+	session, _, e = m.Session().Renew(id, (&capi.WriteOptions{}).WithContext(gCtx))
+	return session != nil, e
+}
+
+// destroyStatsSession deletes published stats of the session
+func (m *consulClient) destroyStatsSession(ctx context.Context, id string) (e error) {
+	_, e = m.Session().Destroy(id, (&capi.WriteOptions{}).WithContext(ctx))
+	return
+}
+
+// publishStats puts the instance's stats snapshot to consul KV under the session,
+// see getPublishedStats() for aggregation
+func (m *consulClient) publishStats(instance, session string, stats *balancer.ClusterStats) (e error) {
+	kv := &capi.KVPair{Key: m.getPrefixedStatsKey(stats.Cluster, instance), Session: session}
+	if kv.Value, e = json.Marshal(stats); e != nil {
+		return
+	}
+
+	var acquired bool
+	if acquired, _, e = m.KV().Acquire(kv, (&capi.WriteOptions{}).WithContext(gCtx)); e == nil && !acquired {
+		e = fmt.Errorf("%w; %s", errConsulStatsLocked, kv.Key)
+	}
+
+	return
+}
+
+// getPublishedStats returns the cluster's snapshots published not earlier than since;
+// empty instance means all instances of the cluster
+func (m *consulClient) getPublishedStats(cluster, instance string, since time.Time) (snapshots []*balancer.ClusterStats, e error) {
+	ckey := m.getPrefixedStatsKey(cluster, instance)
+
+	var pairs capi.KVPairs
+	if pairs, _, e = m.KV().List(ckey, nil); e != nil {
+		return
+	}
+
+	for _, pair := range pairs {
+		// list is prefixed, so "host1" matches "host10" as well
+		if instance != "" && pair.Key != ckey {
+			continue
+		}
+
+		var stats *balancer.ClusterStats
+		if err := json.Unmarshal(pair.Value, &stats); err != nil || stats == nil {
+			gLog.Warn().Err(err).Msgf("could not parse published stats from %s, skipping", pair.Key)
+			continue
+		}
+
+		if stats.Timestamp.Before(since) {
+			gLog.Trace().Msgf("stale stats found in %s, skipping", pair.Key)
+			continue
+		}
+
+		snapshots = append(snapshots, stats)
+	}
+
+	return
+}
+
+func (*consulClient) getPrefixedStatsKey(cluster, instance string) string {
+	return fmt.Sprintf("%s/stats/%s/%s", gCli.String("consul-kv-prefix"), cluster, instance)
+}
+
 func (*consulClient) getPrefixedSettingsKey(key string) string {
 	return fmt.Sprintf("%s/settings/%s", gCli.String("consul-kv-prefix"), key)
 }
@@ -329,10 +502,12 @@ loop:
 				break loop
 			} else if e != nil {
 				gLog.Error().Err(e).Msgf("could not get consul values for %s prefix", prefix)
+				m.watchers.kvFailed(e)
 				timeCooler()
 				continue
 			} else if len(pairs) == 0 {
 				gLog.Warn().Msg("consul sent empty values")
+				m.watchers.kvReceived(meta.LastIndex)
 				timeCooler()
 				continue
 			}
@@ -370,6 +545,7 @@ loop:
 			}
 
 			idx = meta.LastIndex
+			m.watchers.kvReceived(idx)
 		}
 	}
 }
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	capi "github.com/hashicorp/consul/api"
+)
+
+// testConsulNode is the node of the emulated consul agent
+const testConsulNode = "node-1"
+
+// testConsul emulates consul KV and sessions API used by addie
+type testConsul struct {
+	sync.Mutex
+
+	kv       map[string]*capi.KVPair
+	sessions map[string]*capi.SessionEntry
+	seq      int
+}
+
+// newTestConsul replaces gConsul with the client of the emulated consul for the test
+func newTestConsul(t *testing.T) *testConsul {
+	t.Helper()
+
+	fake := &testConsul{
+		kv:       make(map[string]*capi.KVPair),
+		sessions: make(map[string]*capi.SessionEntry),
+	}
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client, e := capi.NewClient(&capi.Config{Address: srv.URL})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	previous, previousCtx := gConsul, gCtx
+	t.Cleanup(func() { gConsul, gCtx = previous, previousCtx })
+
+	gConsul, gCtx = &consulClient{Client: client, ctx: context.Background()}, context.Background()
+	return fake
+}
+
+func (m *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v1/kv/"):
+		m.listKV(w, strings.TrimPrefix(path, "/v1/kv/"))
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/v1/kv/"):
+		m.acquireKV(w, r, strings.TrimPrefix(path, "/v1/kv/"))
+	case path == "/v1/session/create":
+		var body struct{ Name, TTL, Behavior, LockDelay string }
+		if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.seq++
+		session := &capi.SessionEntry{ID: fmt.Sprintf("session-%d", m.seq), Name: body.Name, Node: testConsulNode,
+			TTL: body.TTL, Behavior: body.Behavior}
+		m.sessions[session.ID] = session
+
+		fmt.Fprintf(w, `{"ID": %q}`, session.ID)
+	case path == "/v1/agent/self":
+		fmt.Fprintf(w, `{"Config": {"NodeName": %q}}`, testConsulNode)
+	case path == "/v1/session/list" || strings.HasPrefix(path, "/v1/session/node/"):
+		node := strings.TrimPrefix(path, "/v1/session/node/")
+
+		sessions := make([]*capi.SessionEntry, 0, len(m.sessions))
+		for _, session := range m.sessions {
+			if node == path || session.Node == node {
+				sessions = append(sessions, session)
+			}
+		}
+
+		json.NewEncoder(w).Encode(sessions)
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		session, ok := m.sessions[strings.TrimPrefix(path, "/v1/session/renew/")]
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode([]*capi.SessionEntry{session})
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		m.invalidate(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		fmt.Fprint(w, "true")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *testConsul) listKV(w http.ResponseWriter, prefix string) {
+	var pairs capi.KVPairs
+	for key, pair := range m.kv {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	if len(pairs) == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func (m *testConsul) acquireKV(w http.ResponseWriter, r *http.Request, key string) {
+	value, e := io.ReadAll(r.Body)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := r.URL.Query().Get("acquire")
+	if _, ok := m.sessions[session]; !ok {
+		http.Error(w, "invalid session "+session, http.StatusInternalServerError)
+		return
+	}
+
+	if pair, ok := m.kv[key]; ok && pair.Session != "" && pair.Session != session {
+		fmt.Fprint(w, "false")
+		return
+	}
+
+	m.kv[key] = &capi.KVPair{Key: key, Value: value, Session: session}
+	fmt.Fprint(w, "true")
+}
+
+// invalidate destroys the session like consul does it on the session's TTL expiration
+func (m *testConsul) invalidate(id string) {
+	session, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+
+	delete(m.sessions, id)
+	for key, pair := range m.kv {
+		if pair.Session != id {
+			continue
+		}
+
+		if session.Behavior == capi.SessionBehaviorDelete {
+			delete(m.kv, key)
+		} else {
+			pair.Session = ""
+		}
+	}
+}
+
+func (m *testConsul) put(key string, value []byte, session string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.kv[key] = &capi.KVPair{Key: key, Value: value, Session: session}
+}
+
+func (m *testConsul) get(key string) *capi.KVPair {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.kv[key]
+}
+
+func (m *testConsul) getSession(id string) *capi.SessionEntry {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.sessions[id]
+}
+
+func (m *testConsul) createSession(name, node string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	m.seq++
+	id := fmt.Sprintf("session-%d", m.seq)
+	m.sessions[id] = &capi.SessionEntry{ID: id, Name: name, Node: node, Behavior: capi.SessionBehaviorDelete}
+
+	return id
+}
+
+func (m *testConsul) expire(id string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.invalidate(id)
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/blocklist"
 	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog"
@@ -19,12 +25,19 @@ type Controller struct {
 
 	balancers map[balancer.BalancerCluster]balancer.Balancer
 	runtime   *runtime.Runtime
+	blocklist *blocklist.Blocklist
+	keyring   *signer.Keyring
+	signers   *signer.Signers
+	titles    *TitlesCache
 
 	isReady bool
+	started time.Time
 }
 
 func NewController() *Controller {
-	return &Controller{}
+	return &Controller{
+		started: time.Now(),
+	}
 }
 
 func (m *Controller) SetReady() {
@@ -40,6 +53,10 @@ func (m *Controller) WithContext(c context.Context) *Controller {
 
 	m.balancers = c.Value(utils.ContextKeyBalancers).(map[balancer.BalancerCluster]balancer.Balancer)
 	m.runtime = c.Value(utils.ContextKeyRuntime).(*runtime.Runtime)
+	m.blocklist = c.Value(utils.ContextKeyBlocklist).(*blocklist.Blocklist)
+	m.keyring = c.Value(utils.ContextKeyKeyring).(*signer.Keyring)
+	m.signers = c.Value(utils.ContextKeySigners).(*signer.Signers)
+	m.titles = c.Value(utils.ContextKeyTitlesCache).(*TitlesCache)
 	return m
 }
 
@@ -50,6 +67,69 @@ func respondPlainWithStatus(c *fiber.Ctx, status int) error {
 	return c.SendStatus(status)
 }
 
+// GetHealth is the liveness probe; the process is alive if it responds
+func (m *Controller) GetHealth(c *fiber.Ctx) error {
+	return c.JSON(&struct {
+		Status string  `json:"status"`
+		Pid    int     `json:"pid"`
+		Uptime float64 `json:"uptime"` // seconds
+	}{"ok", os.Getpid(), time.Since(m.started).Seconds()})
+}
+
+// GetReadiness is the readiness probe; 503 is returned until consul server lists of all clusters
+// and runtime KV have been received and if any of consul watchers has stalled
+func (m *Controller) GetReadiness(c *fiber.Ctx) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.isReady {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "application is not initialized yet")
+	}
+
+	report := &readinessReport{
+		Mode:      getPreforkMode(),
+		Api:       gAniApi.state.snapshot(),
+		Balancers: make(map[string]*balancerReadiness, len(m.balancers)),
+		Blocklist: &blocklistReadiness{
+			Enabled: m.runtime.Config.Get(runtime.ParamBlocklist).(int) != 0,
+			Size:    m.blocklist.Size(),
+		},
+	}
+
+	report.Keyring = &keyringReadiness{}
+	if key, err := m.keyring.Signing(time.Now()); err != nil {
+		report.Keyring.Error = err.Error()
+	} else {
+		report.Keyring.SigningKey = key.Id
+	}
+
+	if gPreforkChild != nil {
+		report.Prefork = gPreforkChild.getHealth()
+	} else {
+		report.Consul = gConsul.watchers.snapshot()
+	}
+
+	for _, blcr := range m.balancers {
+		stats, readiness := blcr.GetStatsSnapshot(), &balancerReadiness{}
+		for _, server := range stats.Servers {
+			if readiness.Servers++; !server.IsDown && server.Share > 0 {
+				readiness.Available++
+			}
+		}
+
+		report.Balancers[stats.Cluster] = readiness
+	}
+
+	report.check(gCli.Duration("consul-watch-stall-timeout"))
+
+	status := fiber.StatusOK
+	if !report.Ready {
+		status = fiber.StatusServiceUnavailable
+	}
+
+	return c.Status(status).JSON(report)
+}
+
 func (m *Controller) getBalancerByString(input string) (_ balancer.BalancerCluster, e error) {
 	if input == "" {
 		e = fiber.NewError(fiber.StatusNotFound, "cluster could not be empty")
@@ -75,10 +155,39 @@ func (m *Controller) GetBalancerStats(c *fiber.Ctx) (e error) {
 		return
 	}
 
-	fmt.Fprintln(c, m.balancers[cluster].GetStats())
+	var stats *balancer.ClusterStats
+	if stats, e = getScopedStats(m.balancers[cluster], strings.TrimSpace(c.Query("scope", "local"))); e != nil {
+		return
+	}
+
+	if strings.TrimSpace(c.Query("format")) == "json" {
+		return c.JSON(stats)
+	}
+
+	fmt.Fprintln(c, balancer.RenderStats(stats))
 	return respondPlainWithStatus(c, fiber.StatusOK)
 }
 
+func (m *Controller) GetBalancerServerStats(c *fiber.Ctx) (e error) {
+	cluster, e := m.getBalancerByString(strings.TrimSpace(c.Query("cluster")))
+	if e != nil {
+		return
+	}
+
+	server := strings.TrimSpace(c.Query("server"))
+	if server == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "given server is empty")
+	}
+
+	for _, stats := range m.balancers[cluster].GetStatsSnapshot().Servers {
+		if stats.Name == server || stats.Address == server {
+			return c.JSON(stats)
+		}
+	}
+
+	return fiber.NewError(fiber.StatusNotFound, "given server is not found in the cluster upstream")
+}
+
 func (m *Controller) BalancerStatsReset(c *fiber.Ctx) (e error) {
 	cluster, e := m.getBalancerByString(strings.TrimSpace(c.Query("cluster")))
 	if e != nil {
@@ -99,6 +208,83 @@ func (m *Controller) BalancerUpstreamReset(c *fiber.Ctx) (e error) {
 	return respondPlainWithStatus(c, fiber.StatusNoContent)
 }
 
+func (m *Controller) BalancerServerDrain(c *fiber.Ctx) error {
+	return m.switchServerState(c, "drain", func() (_ *balancer.ServerState, e error) {
+		var period time.Duration
+		// chunks are moved gradually; /server/maintenance moves all chunks of the server at once
+		if period, e = time.ParseDuration(c.Query("period", "10m")); e != nil || period <= 0 {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "given period is invalid, it must be greater than zero")
+		}
+
+		return balancer.NewDrainState(period), e
+	})
+}
+
+func (m *Controller) BalancerServerMaintenance(c *fiber.Ctx) error {
+	return m.switchServerState(c, "maintenance", func() (*balancer.ServerState, error) {
+		return balancer.NewMaintenanceState(), nil
+	})
+}
+
+// switchServerState sets the state of newState to the server if it's enabled, or removes the server's state
+func (m *Controller) switchServerState(c *fiber.Ctx, mode string, newState func() (*balancer.ServerState, error)) (e error) {
+	cluster, e := m.getBalancerByString(strings.TrimSpace(c.Query("cluster")))
+	if e != nil {
+		return
+	}
+
+	server, input := strings.TrimSpace(c.Query("server")), strings.TrimSpace(c.Query("enabled", "1"))
+	if server == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "given server is empty")
+	} else if input != "0" && input != "1" {
+		return fiber.NewError(fiber.StatusBadRequest, "enabled query can be only 0 or 1")
+	} else if input == "1" && !m.balancers[cluster].HasServer(server) {
+		// states of unknown servers still can be removed, e.g. after the server decommission
+		return fiber.NewError(fiber.StatusNotFound, "given server is not found in the cluster upstream")
+	}
+
+	var state *balancer.ServerState
+	if input == "1" {
+		if state, e = newState(); e != nil {
+			return
+		}
+	}
+
+	name := m.balancers[cluster].GetClusterName()
+	if e = gConsul.updateServerState(name, server, state); e != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
+
+	rlog(c).Info().Msgf("%s mode for %s (%s) has been switched to %s by %s", mode, server, name, input, c.IP())
+	return respondPlainWithStatus(c, fiber.StatusNoContent)
+}
+
+// GetPreforkHealth returns the parent's view of prefork children;
+// 503 is returned if any child has diverged or the parent has not reported for a while
+func (*Controller) GetPreforkHealth(c *fiber.Ctx) error {
+	if gPreforkChild == nil {
+		return fiber.NewError(fiber.StatusNotFound, "prefork mode is disabled")
+	}
+
+	health := gPreforkChild.getHealth()
+	if health == nil {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "there is no health reports from the prefork parent yet")
+	}
+
+	status := fiber.StatusOK
+	if health.isStale() {
+		status = fiber.StatusServiceUnavailable
+	}
+
+	for _, child := range health.Children {
+		if child.Diverged {
+			status = fiber.StatusServiceUnavailable
+		}
+	}
+
+	return c.Status(status).JSON(health)
+}
+
 func (m *Controller) BlockIP(c *fiber.Ctx) error {
 	ip := strings.TrimSpace(c.Query("ip"))
 	if ip == "" {
@@ -222,3 +408,104 @@ func (m *Controller) UpdateQualityRewrite(c *fiber.Ctx) (e error) {
 
 	return respondPlainWithStatus(c, fiber.StatusOK)
 }
+
+// VerifySign recomputes the signature of the link with the scheme of the cluster and keys of the keyring;
+// body - {"url": "LINK", "uid": "UID", "server": "SERVER", "client_ip": "IP", "cluster": "CLUSTER"}
+func (m *Controller) VerifySign(c *fiber.Ctx) (e error) {
+	var body struct {
+		Url      string `json:"url"`
+		Uid      string `json:"uid"`
+		Server   string `json:"server"`
+		ClientIp string `json:"client_ip"`
+		Cluster  string `json:"cluster"`
+	}
+
+	if e = c.BodyParser(&body); e != nil {
+		return fiber.NewError(fiber.StatusBadRequest, e.Error())
+	} else if body.Url == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "given url is empty")
+	}
+
+	vreq := &signer.VerifyRequest{
+		Uid:      body.Uid,
+		ClientIp: body.ClientIp,
+		Server:   body.Server,
+	}
+
+	if vreq.Link, e = url.Parse(body.Url); e != nil {
+		return fiber.NewError(fiber.StatusBadRequest, e.Error())
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return c.JSON(signer.Verify(m.signers.Get(body.Cluster), m.keyring, vreq, time.Now()))
+}
+
+func (*Controller) getTitleIdParam(c *fiber.Ctx) (_ uint16, e error) {
+	var tid uint64
+	if tid, e = strconv.ParseUint(c.Params("id"), 10, 16); e != nil || tid == 0 {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "given title id is invalid")
+	}
+
+	return uint16(tid), e
+}
+
+// GetCachedTitle responds with the cached title and its freshness;
+// prefork children respond with the title of the parent's cache
+func (m *Controller) GetCachedTitle(c *fiber.Ctx) (e error) {
+	var tid uint16
+	if tid, e = m.getTitleIdParam(c); e != nil {
+		return
+	}
+
+	title, fresh := m.titles.Get(tid)
+	if gPreforkChild != nil {
+		ctx, cancel := context.WithTimeout(c.UserContext(), preforkRequestTimeout)
+		defer cancel()
+
+		if title, e = gPreforkChild.getTitle(ctx, tid); e != nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "could not get the title from the prefork parent - "+e.Error())
+		} else if title != nil {
+			fresh = title.isFresh(time.Now())
+		}
+	}
+
+	if title == nil {
+		return fiber.NewError(fiber.StatusNotFound, "title is not cached")
+	}
+
+	return c.JSON(&struct {
+		*CachedTitle
+		Fresh bool `json:"fresh"`
+	}{title, fresh})
+}
+
+// DeleteCachedTitle invalidates the title, so it's requested from the api with the next request;
+// prefork children respond after the parent has invalidated the title in all processes
+func (m *Controller) DeleteCachedTitle(c *fiber.Ctx) (e error) {
+	var tid uint16
+	if tid, e = m.getTitleIdParam(c); e != nil {
+		return
+	}
+
+	found := m.titles.Delete(tid)
+	if gPreforkChild != nil {
+		ctx, cancel := context.WithTimeout(c.UserContext(), preforkRequestTimeout)
+		defer cancel()
+
+		var pfound bool
+		if pfound, e = gPreforkChild.deleteTitle(ctx, tid); e != nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "could not invalidate the title in the prefork parent - "+e.Error())
+		}
+
+		found = found || pfound
+	}
+
+	if !found {
+		return fiber.NewError(fiber.StatusNotFound, "title is not cached")
+	}
+
+	rlog(c).Info().Msgf("title %d has been removed from the cache by %s", tid, c.IP())
+	return respondPlainWithStatus(c, fiber.StatusNoContent)
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	errDestinationInvalidRule = errors.New("destination rule is invalid; format is cluster=template:TEMPLATE or cluster=regexp:/EXPR/REPLACEMENT/")
+	errDestinationNoMatch     = errors.New("server name does not match destination regexp")
+)
+
+type (
+	// destinationResolver builds sign targets (host or host:port) for balanced servers;
+	// priority - server meta override, cluster rule, default template
+	destinationResolver struct {
+		metaKey  string
+		fallback *destinationRule
+		rules    map[string]*destinationRule // consul service name => rule
+	}
+	destinationRule struct {
+		tmpl *template.Template
+
+		regexp      *regexp.Regexp
+		replacement string
+	}
+	destinationData struct {
+		Name   string
+		Ip     string
+		Port   int
+		Meta   map[string]string
+		Domain string
+	}
+)
+
+var destinationFuncs = template.FuncMap{
+	"replace":    strings.ReplaceAll,
+	"trimSuffix": strings.TrimSuffix,
+	"trimPrefix": strings.TrimPrefix,
+	"lower":      strings.ToLower,
+	"host":       hostLiteral,
+	"hostport": func(host string, port int) string {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	},
+}
+
+func newDestinationResolver(fallback string, rules []string, metaKey string) (_ *destinationResolver, e error) {
+	resolver := &destinationResolver{
+		metaKey: metaKey,
+		rules:   make(map[string]*destinationRule),
+	}
+
+	if resolver.fallback, e = newTemplateDestinationRule("default", fallback); e != nil {
+		return
+	}
+
+	for _, rule := range rules {
+		cluster, definition, ok := strings.Cut(rule, "=")
+		if !ok || cluster == "" {
+			return nil, fmt.Errorf("%w; %s", errDestinationInvalidRule, rule)
+		}
+
+		kind, payload, _ := strings.Cut(definition, ":")
+
+		switch kind {
+		case "template":
+			resolver.rules[cluster], e = newTemplateDestinationRule(cluster, payload)
+		case "regexp":
+			resolver.rules[cluster], e = newRegexpDestinationRule(payload)
+		default:
+			e = errDestinationInvalidRule
+		}
+
+		if e != nil {
+			return nil, fmt.Errorf("%w; %s", e, rule)
+		}
+	}
+
+	return resolver, e
+}
+
+func newTemplateDestinationRule(name, text string) (_ *destinationRule, e error) {
+	rule := &destinationRule{}
+	rule.tmpl, e = template.New(name).Funcs(destinationFuncs).Option("missingkey=zero").Parse(text)
+	return rule, e
+}
+
+// newRegexpDestinationRule parses sed-like /EXPR/REPLACEMENT/ definitions;
+// the first char is a delimiter, so it could be changed for expressions with slashes
+func newRegexpDestinationRule(payload string) (_ *destinationRule, e error) {
+	if len(payload) < 3 {
+		return nil, errDestinationInvalidRule
+	}
+
+	parts := strings.Split(payload[1:], payload[:1])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, errDestinationInvalidRule
+	}
+
+	rule := &destinationRule{replacement: parts[1]}
+	rule.regexp, e = regexp.Compile(parts[0])
+	return rule, e
+}
+
+func (m *destinationResolver) resolve(cluster string, server *balancer.BalancerServer) (_ string, e error) {
+	meta := server.GetMeta()
+	if override := strings.TrimSpace(meta[m.metaKey]); m.metaKey != "" && override != "" {
+		return hostLiteral(override), e
+	}
+
+	rule, ok := m.rules[cluster]
+	if !ok {
+		rule = m.fallback
+	}
+
+	var destination string
+	if destination, e = rule.render(server, meta); e != nil {
+		return
+	}
+
+	return hostLiteral(destination), e
+}
+
+func (m *destinationRule) render(server *balancer.BalancerServer, meta map[string]string) (_ string, e error) {
+	if m.regexp != nil {
+		if !m.regexp.MatchString(server.Name) {
+			return "", fmt.Errorf("%w; %s", errDestinationNoMatch, server.Name)
+		}
+
+		return m.regexp.ReplaceAllString(server.Name, m.replacement), e
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if e = m.tmpl.Execute(buf, &destinationData{
+		Name:   server.Name,
+		Ip:     server.Ip.String(),
+		Port:   server.Port,
+		Meta:   meta,
+		Domain: gCli.String("consul-entries-domain"),
+	}); e != nil {
+		return
+	}
+
+	return strings.TrimSpace(buf.String()), e
+}
+
+// getServerDestination renders the server's sign target (host or host:port)
+func (m *App) getServerDestination(cluster balancer.Balancer, server *balancer.BalancerServer) (destination string, e error) {
+	if destination, e = m.destinations.resolve(cluster.GetClusterName(), server); e != nil {
+		gLog.Error().Err(e).Str("server", server.Name).Str("cluster", cluster.GetClusterName()).
+			Msg("could not resolve server destination")
+		return "", fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
+
+	return
+}
+
+// hostLiteral wraps bare ipv6 addresses (including ipv4-mapped ones) with brackets for using them in URLs
+func hostLiteral(host string) string {
+	if ip := net.ParseIP(host); ip != nil && strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+
+	return host
+}
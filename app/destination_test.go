@@ -0,0 +1,172 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/urfave/cli/v2"
+)
+
+// TestDestinationSignTargets checks sign targets of servers which are identified
+// by their service addresses and ports
+func TestDestinationSignTargets(t *testing.T) {
+	setTestCliContext(t, []cli.Flag{&cli.StringFlag{Name: "consul-entries-domain", Value: "libria.fun"}})
+
+	servers := newTestServers(t,
+		&balancer.UpstreamEntry{Name: "cache-01-node", Ip: net.ParseIP("10.0.0.1")},
+		&balancer.UpstreamEntry{Name: "cache-02-node", Ip: net.ParseIP("10.1.0.2"), Port: 8080},
+		&balancer.UpstreamEntry{Name: "cache-03-node", Ip: net.ParseIP("2001:db8::3"), Port: 8443},
+		&balancer.UpstreamEntry{Name: "cache-04-node", Ip: net.ParseIP("2001:db8::4")},
+	)
+
+	for _, tc := range []struct {
+		template string
+		server   string
+		target   string
+	}{
+		{template: `{{ replace .Name "-node" "" }}.{{ .Domain }}`, server: "cache-01-node", target: "cache-01.libria.fun"},
+		{template: `{{ .Ip }}`, server: "cache-02-node", target: "10.1.0.2"},
+		{template: `{{ hostport .Ip .Port }}`, server: "cache-02-node", target: "10.1.0.2:8080"},
+		{template: `{{ .Name }}.{{ .Domain }}:{{ .Port }}`, server: "cache-02-node", target: "cache-02-node.libria.fun:8080"},
+		// ipv6 literals are wrapped by brackets for urls
+		{template: `{{ .Ip }}`, server: "cache-03-node", target: "[2001:db8::3]"},
+		{template: `{{ host .Ip }}`, server: "cache-03-node", target: "[2001:db8::3]"},
+		{template: `{{ hostport .Ip .Port }}`, server: "cache-03-node", target: "[2001:db8::3]:8443"},
+		{template: `{{ .Ip }}`, server: "cache-04-node", target: "[2001:db8::4]"},
+	} {
+		resolver, e := newDestinationResolver(tc.template, nil, "")
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if target, e := resolver.resolve("cache-node-internal", servers[tc.server]); e != nil || target != tc.target {
+			t.Errorf("%s of %s: got %q (%v), want %q", tc.template, tc.server, target, e, tc.target)
+		}
+	}
+}
+
+func TestNewDestinationResolver(t *testing.T) {
+	for _, tc := range []struct {
+		rule string
+		err  bool
+	}{
+		{rule: `cache-node-internal=template:{{ .Name }}.example.org`},
+		{rule: `cache-node-internal=regexp:/^(.+)-node$/${1}.example.org/`},
+		// the first char is the delimiter
+		{rule: `cache-node-internal=regexp:#^(.+)/node$#${1}.example.org#`},
+		{rule: `cache-node-internal=regexp:/^(.+)-node$/${1}.example.org`, err: true},
+		{rule: `cache-node-internal=regexp:/a/b/c/`, err: true},
+		{rule: `cache-node-internal=regexp:/a/`, err: true},
+		{rule: `cache-node-internal=regexp:ab`, err: true},
+		{rule: `cache-node-internal=regexp:`, err: true},
+		{rule: `cache-node-internal=regexp:/(/x/`, err: true},
+		{rule: `cache-node-internal=template:{{ .Name`, err: true},
+		{rule: `cache-node-internal=sed:/a/b/`, err: true},
+		{rule: `cache-node-internal`, err: true},
+		{rule: `=template:{{ .Name }}`, err: true},
+	} {
+		if _, e := newDestinationResolver(`{{ .Name }}`, []string{tc.rule}, ""); (e != nil) != tc.err {
+			t.Errorf("%s: got error %v", tc.rule, e)
+		}
+	}
+
+	if _, e := newDestinationResolver(`{{ .Name`, nil, ""); e == nil {
+		t.Error("invalid default template is parsed")
+	}
+}
+
+func TestDestinationResolve(t *testing.T) {
+	setTestCliContext(t, []cli.Flag{&cli.StringFlag{Name: "consul-entries-domain", Value: "libria.fun"}})
+
+	servers := newTestServers(t,
+		&balancer.UpstreamEntry{Name: "cache-01-node", Ip: net.ParseIP("10.0.0.1")},
+		&balancer.UpstreamEntry{Name: "cache-02-node", Ip: net.ParseIP("10.0.0.2"), Meta: map[string]string{"public_hostname": "edge-02.example.org"}},
+		&balancer.UpstreamEntry{Name: "cache-03-node", Ip: net.ParseIP("10.0.0.3"), Meta: map[string]string{"public_hostname": " 2001:db8::3 "}},
+		&balancer.UpstreamEntry{Name: "cache-04", Ip: net.ParseIP("10.0.0.4"), Meta: map[string]string{"public_hostname": ""}},
+	)
+
+	resolver, e := newDestinationResolver(`{{ replace .Name "-node" "" }}.{{ .Domain }}`, []string{
+		`cache-node-internal=regexp:/^(.+)-node$/${1}.internal.example.org/`,
+		`cache-cloud-ingress=template:{{ .Ip }}`,
+	}, "public_hostname")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, tc := range []struct {
+		cluster, server string
+		target          string
+		err             error
+	}{
+		{cluster: "cache-node-internal", server: "cache-01-node", target: "cache-01.internal.example.org"},
+		{cluster: "cache-cloud-ingress", server: "cache-01-node", target: "10.0.0.1"},
+		// clusters without rules use the default template
+		{cluster: "cache-node-external", server: "cache-01-node", target: "cache-01.libria.fun"},
+		// meta overrides all rules, ipv6 literals are wrapped by brackets
+		{cluster: "cache-node-internal", server: "cache-02-node", target: "edge-02.example.org"},
+		{cluster: "cache-cloud-ingress", server: "cache-03-node", target: "[2001:db8::3]"},
+		// empty meta is not an override
+		{cluster: "cache-cloud-ingress", server: "cache-04", target: "10.0.0.4"},
+		{cluster: "cache-node-internal", server: "cache-04", err: errDestinationNoMatch},
+	} {
+		target, e := resolver.resolve(tc.cluster, servers[tc.server])
+
+		switch {
+		case tc.err != nil:
+			if !errors.Is(e, tc.err) {
+				t.Errorf("%s of %s: expected %v, got %v", tc.server, tc.cluster, tc.err, e)
+			}
+		case e != nil || target != tc.target:
+			t.Errorf("%s of %s: got %q (%v), want %q", tc.server, tc.cluster, target, e, tc.target)
+		}
+	}
+
+	// meta overrides are disabled with the empty key
+	resolver.metaKey = ""
+	if target, _ := resolver.resolve("cache-node-internal", servers["cache-02-node"]); target != "cache-02.internal.example.org" {
+		t.Errorf("got %q with disabled meta overrides", target)
+	}
+}
+
+func TestHostLiteral(t *testing.T) {
+	for host, literal := range map[string]string{
+		"10.0.0.1":             "10.0.0.1",
+		"2001:db8::1":          "[2001:db8::1]",
+		"::ffff:10.0.0.1":      "[::ffff:10.0.0.1]",
+		"[2001:db8::1]":        "[2001:db8::1]",
+		"cache-01.example.org": "cache-01.example.org",
+		"10.0.0.1:8080":        "10.0.0.1:8080",
+	} {
+		if got := hostLiteral(host); got != literal {
+			t.Errorf("%s: got %s, want %s", host, got, literal)
+		}
+	}
+}
+
+// newTestServers returns balancer servers of given upstream entries by their names
+func newTestServers(t *testing.T, entries ...*balancer.UpstreamEntry) map[string]*balancer.BalancerServer {
+	t.Helper()
+
+	upstream := make(map[string]*balancer.UpstreamEntry, len(entries))
+	for _, entry := range entries {
+		upstream[entry.Address()] = entry
+	}
+
+	blcr := newTestBalancer(t)
+	blcr.UpdateServers(upstream)
+
+	// servers are not in maintenance, so the chunk is balanced to all of them
+	balanced, e := blcr.BalanceByChunkN("", "servers.m3u8", len(entries))
+	if e != nil || len(balanced) != len(entries) {
+		t.Fatalf("got %d servers of %d, %v", len(balanced), len(entries), e)
+	}
+
+	servers := make(map[string]*balancer.BalancerServer, len(balanced))
+	for _, server := range balanced {
+		servers[server.Name] = server
+	}
+
+	return servers
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+)
+
+type (
+	// titleFlight is the api request of the title which is shared by all waiters
+	titleFlight struct {
+		wg sync.WaitGroup
+
+		tss []*TitleSerie
+		e   error
+	}
+
+	// titleFlights deduplicates concurrent api requests of the same title; on release
+	// of a new episode all chunk requests of the title miss the cache at once
+	titleFlights struct {
+		mu      sync.Mutex
+		flights map[uint16]*titleFlight
+	}
+)
+
+func newTitleFlights() *titleFlights {
+	return &titleFlights{
+		flights: make(map[uint16]*titleFlight),
+	}
+}
+
+// Do calls fn if there is no in-flight request of the title, otherwise waits for its result;
+// shared is true if the result has been received by the other caller
+func (m *titleFlights) Do(tid uint16, fn func() ([]*TitleSerie, error)) (tss []*TitleSerie, shared bool, e error) {
+	m.mu.Lock()
+	if flight, ok := m.flights[tid]; ok {
+		m.mu.Unlock()
+
+		flight.wg.Wait()
+		return flight.tss, true, flight.e
+	}
+
+	flight := &titleFlight{}
+	flight.wg.Add(1)
+	m.flights[tid] = flight
+	m.mu.Unlock()
+
+	// waiters must not be locked forever if fn panics
+	defer func() {
+		if r := recover(); r != nil {
+			flight.e = fmt.Errorf("api request of title %d has been panicked - %v", tid, r)
+			m.done(tid, flight)
+			panic(r)
+		}
+
+		m.done(tid, flight)
+	}()
+
+	flight.tss, flight.e = fn()
+	return flight.tss, false, flight.e
+}
+
+func (m *titleFlights) done(tid uint16, flight *titleFlight) {
+	m.mu.Lock()
+	delete(m.flights, tid)
+	m.mu.Unlock()
+
+	flight.wg.Done()
+}
+
+// Go calls fn in background if there is no in-flight request of the title;
+// the panic of fn is logged, there is no caller to recover it
+func (m *titleFlights) Go(tid uint16, fn func() ([]*TitleSerie, error)) {
+	m.mu.Lock()
+	_, ok := m.flights[tid]
+	m.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				gLog.Error().Uint16("tid", tid).Msgf("background api request of the title has been panicked - %v", r)
+			}
+		}()
+
+		m.Do(tid, fn)
+	}()
+}
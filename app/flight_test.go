@@ -0,0 +1,144 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTitleFlights checks that concurrent misses of the title make one api request
+// and all callers receive its result
+func TestTitleFlights(t *testing.T) {
+	const callers = 32
+
+	for _, tc := range []struct {
+		name string
+		tss  []*TitleSerie
+		e    error
+	}{
+		{name: "series", tss: []*TitleSerie{{Title: 9000, Serie: 1}}},
+		{name: "error", e: errTestApi},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flights := newTitleFlights()
+
+			var calls, shared int32
+			started, release := make(chan struct{}, callers), make(chan struct{})
+
+			fn := func() ([]*TitleSerie, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return tc.tss, tc.e
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					started <- struct{}{}
+					tss, ok, e := flights.Do(9000, fn)
+
+					if ok {
+						atomic.AddInt32(&shared, 1)
+					}
+
+					if len(tss) != len(tc.tss) || (len(tss) != 0 && tss[0] != tc.tss[0]) || !errors.Is(e, tc.e) {
+						t.Errorf("got %+v, %v, expected %+v, %v", tss, e, tc.tss, tc.e)
+					}
+				}()
+			}
+
+			// all callers must join the flight before the api responds
+			for i := 0; i < callers; i++ {
+				<-started
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			close(release)
+			wg.Wait()
+
+			if calls != 1 || shared != callers-1 {
+				t.Errorf("got %d api calls and %d shared results of %d callers", calls, shared, callers)
+			}
+
+			// the finished flight is not reused
+			if _, ok, _ := flights.Do(9000, func() ([]*TitleSerie, error) { return nil, nil }); ok || calls != 1 {
+				t.Error("the result of the finished flight is shared")
+			}
+		})
+	}
+}
+
+// TestTitleFlightsPanic checks that waiters are released with an error if the api request panics
+func TestTitleFlightsPanic(t *testing.T) {
+	flights := newTitleFlights()
+	entered, release := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer func() { _ = recover() }()
+
+		flights.Do(9000, func() ([]*TitleSerie, error) {
+			close(entered)
+			<-release
+			panic("test")
+		})
+	}()
+
+	<-entered
+	done := make(chan error, 1)
+
+	go func() {
+		_, _, e := flights.Do(9000, func() ([]*TitleSerie, error) { return nil, nil })
+		done <- e
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case e := <-done:
+		if e == nil {
+			t.Error("waiter has not received the error of the panicked request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter is locked after the panic")
+	}
+}
+
+// TestTitleFlightsGoPanic checks that the panic of the background request does not crash
+// the process and the flight of the title is cleared
+func TestTitleFlightsGoPanic(t *testing.T) {
+	flights := newTitleFlights()
+	entered, release := make(chan struct{}), make(chan struct{})
+
+	flights.Go(9000, func() ([]*TitleSerie, error) {
+		close(entered)
+		<-release
+		panic("test")
+	})
+
+	<-entered
+	close(release)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		flights.mu.Lock()
+		_, ok := flights.flights[9000]
+		flights.mu.Unlock()
+
+		if !ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the flight of the panicked request has not been cleared")
+		}
+	}
+
+	// the next request of the title is not shared with the panicked one
+	if _, shared, e := flights.Do(9000, func() ([]*TitleSerie, error) { return nil, nil }); shared || e != nil {
+		t.Errorf("got shared %t, %v after the panicked background request", shared, e)
+	}
+}
@@ -1,12 +1,13 @@
 package app
 
 import (
-	"bytes"
 	"errors"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
 )
@@ -31,9 +32,18 @@ func (*App) fbHndApiPreCondErr(ctx *fiber.Ctx) error {
 		ctx.Set("X-Error", errApiPreBadServer.Error())
 		ctx.SendString(errApiPreBadServer.Error())
 	case errMidAppPreUriRegexp:
-		rlog(ctx).Warn().Msg(errApiPreUriRegexp.Error())
-		ctx.Set("X-Error", errApiPreUriRegexp.Error())
-		ctx.SendString(errApiPreUriRegexp.Error())
+		// typed errors of the media router; the header has no uri
+		err := errApiPreUriRegexp
+		var perr *media.ParseError
+		if e, ok := ctx.Locals("uri_error").(error); ok && errors.As(e, &perr) {
+			rlog(ctx).Warn().Err(e).Msg(errApiPreUriRegexp.Error())
+			err = perr.Err
+		} else {
+			rlog(ctx).Warn().Msg(errApiPreUriRegexp.Error())
+		}
+
+		ctx.Set("X-Error", err.Error())
+		ctx.SendString(err.Error())
 	default:
 		rlog(ctx).Warn().Msg("unknown error")
 	}
@@ -46,50 +56,97 @@ func (m *App) fbHndAppRequestSign(ctx *fiber.Ctx) (e error) {
 	rlog(ctx).Trace().Msg("new 'sign request' request")
 
 	srv, uri := ctx.Locals("srv").(string), ctx.Locals("uri").(string)
-	expires, extra := m.getHlpExtra(
+	cluster, _ := ctx.Locals("cluster").(string)
+
+	// the access log has the expiration of the primary location
+	var location, expires string
+	if location, expires, e = m.getSignedLocation(ctx, srv, uri, cluster); e != nil {
+		return
+	}
+	ctx.Locals("expires", expires)
+
+	// backup locations for client-side failover, see getRequestedBackups()
+	var backups []string
+	if buf, ok := ctx.Locals("backups").([]string); ok {
+		for _, bsrv := range buf {
+			var blocation string
+			if blocation, _, e = m.getSignedLocation(ctx, bsrv, uri, cluster); e != nil {
+				return
+			}
+
+			backups = append(backups, blocation)
+		}
+	}
+
+	if strings.Contains(ctx.Get(fiber.HeaderAccept), fiber.MIMEApplicationJSON) {
+		return ctx.JSON(&struct {
+			Location string   `json:"location"`
+			Backups  []string `json:"backups,omitempty"`
+		}{location, backups})
+	}
+
+	ctx.Set(apiHeaderLocation, location)
+	for idx, blocation := range backups {
+		if idx == 0 {
+			ctx.Set(apiHeaderBackup, blocation)
+			continue
+		}
+
+		ctx.Set(apiHeaderBackup+"-"+strconv.Itoa(idx+1), blocation)
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// getSignedLocation signs the link of the server with the signing scheme and expiration rules of its cluster;
+// it returns the link with its expiration
+func (m *App) getSignedLocation(ctx *fiber.Ctx, srv, uri, cluster string) (_, expires string, e error) {
+	var rgs url.Values
+	if rgs, expires, e = m.getSignedArgs(
 		ctx,
 		uri,
 		srv,
 		ctx.Locals("uid").(string),
-	)
+		cluster,
+	); e != nil {
+		rlog(ctx).Error().Err(e).Msg("could not sign request")
+		return "", "", fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
 
+	// srv may be an ipv6 literal in brackets, so url.Parse(srv + uri) is not suitable here
 	var rrl *url.URL
-	if rrl, e = url.Parse(srv + uri); e != nil {
-		rlog(ctx).Debug().Str("url_parse", srv+uri).Str("remote_addr", ctx.IP()).
+	if rrl, e = url.Parse(uri); e != nil {
+		rlog(ctx).Debug().Str("url_parse", uri).Str("remote_addr", ctx.IP()).
 			Msg("could not sign request; url.Parse error")
-		return fiber.NewError(fiber.StatusInternalServerError, e.Error())
+		return "", "", fiber.NewError(fiber.StatusInternalServerError, e.Error())
 	}
+	rrl.Host = srv
 
-	var rgs = &url.Values{}
 	if ctx.Get("X-Ru-Cluster") != "" {
 		if core := ctx.Locals("core"); core != nil {
 			rgs.Add("core", core.(string))
 		}
 	}
 
-	rgs.Add("expires", expires)
-	rgs.Add("extra", extra)
 	rrl.RawQuery, rrl.Scheme = rgs.Encode(), "https"
 
 	rlog(ctx).Debug().Str("computed_request", rrl.String()).Str("remote_addr", ctx.IP()).
 		Msg("request signing completed")
-	ctx.Set(apiHeaderLocation, rrl.String())
-	return ctx.SendStatus(fiber.StatusNoContent)
+	return rrl.String(), expires, e
 }
 
 func (m *App) fbHndApiCoreBalance(ctx *fiber.Ctx) (e error) {
+	m.lapRequestTimer(ctx, utils.FbReqTmrCoreBalance)
 	if ctx.Get("X-Ru-Cluster") == "" {
 		return ctx.Next()
 	}
 
-	uri := ctx.Locals("uri").(string)
-	sub := m.chunkRegexp.FindSubmatch([]byte(uri))
-
-	buf := bytes.NewBuffer(sub[utils.ChunkTitleId])
-	buf.Write(sub[utils.ChunkEpisodeId])
-	buf.Write(sub[utils.ChunkQualityLevel])
+	mpath, e := m.routes.Parse(ctx.Locals("uri").(string))
+	if e != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
 
-	_, server, e := m.bareBalancer.BalanceByChunk(buf.String(), string(sub[utils.ChunkName]))
+	_, server, e := m.bareBalancer.BalanceByChunk(mpath.Prefix(), mpath.ChunkName())
 	if errors.Is(e, balancer.ErrServerUnavailable) {
 		gLog.Debug().Err(e).Msg("balancer soft error; fallback to random balancing")
 		return ctx.Next()
@@ -98,7 +155,11 @@ func (m *App) fbHndApiCoreBalance(ctx *fiber.Ctx) (e error) {
 		return ctx.Next()
 	}
 
-	srv := strings.ReplaceAll(server.Name, "-node", "") + "." + gCli.String("consul-entries-domain")
+	srv, e := m.getServerDestination(m.bareBalancer, server)
+	if e != nil {
+		return
+	}
+
 	ctx.Locals("core", srv)
 
 	return ctx.Next()
@@ -107,14 +168,12 @@ func (m *App) fbHndApiCoreBalance(ctx *fiber.Ctx) (e error) {
 func (m *App) fbHndBlcNodesBalance(ctx *fiber.Ctx) error {
 	ctx.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
 
-	uri := ctx.Locals("uri").(*string)
-	sub := m.chunkRegexp.FindSubmatch([]byte(*uri))
-
-	buf := bytes.NewBuffer(sub[utils.ChunkTitleId])
-	buf.Write(sub[utils.ChunkEpisodeId])
-	buf.Write(sub[utils.ChunkQualityLevel])
+	mpath, e := m.routes.Parse(*ctx.Locals("uri").(*string))
+	if e != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
 
-	_, server, e := m.bareBalancer.BalanceByChunk(buf.String(), string(sub[utils.ChunkName]))
+	servers, e := m.bareBalancer.BalanceByChunkN(mpath.Prefix(), mpath.ChunkName(), 1+m.getRequestedBackups(ctx))
 	if errors.Is(e, balancer.ErrServerUnavailable) {
 		gLog.Debug().Err(e).Msg("balancer soft error; fallback to random balancing")
 		return ctx.Next()
@@ -123,8 +182,27 @@ func (m *App) fbHndBlcNodesBalance(ctx *fiber.Ctx) error {
 		return ctx.Next()
 	}
 
-	srv := strings.ReplaceAll(server.Name, "-node", "") + "." + gCli.String("consul-entries-domain")
+	srv, e := m.getServerDestination(m.bareBalancer, servers[0])
+	if e != nil {
+		return e
+	}
+
 	ctx.Set("X-Location", srv)
+	ctx.Locals("srv", srv)
+	ctx.Locals("cluster", m.bareBalancer.GetClusterName())
+
+	for idx, server := range servers[1:] {
+		header := apiHeaderBackup
+		if idx != 0 {
+			header = apiHeaderBackup + "-" + strconv.Itoa(idx+1)
+		}
+
+		if srv, e = m.getServerDestination(m.bareBalancer, server); e != nil {
+			return e
+		}
+
+		ctx.Set(header, srv)
+	}
 
 	return ctx.SendStatus(fiber.StatusNoContent)
 }
@@ -137,8 +215,15 @@ func (m *App) fbHndBlcNodesBalanceFallback(ctx *fiber.Ctx) error {
 		return e
 	}
 
-	srv := strings.ReplaceAll(server.Name, "-node", "") + "." + gCli.String("consul-entries-domain")
+	srv, e := m.getServerDestination(m.bareBalancer, server)
+	if e != nil {
+		return e
+	}
+
 	ctx.Set("X-Location", srv)
+	ctx.Locals("srv", srv)
+	ctx.Locals("cluster", m.bareBalancer.GetClusterName())
+	ctx.Locals("fallback", true)
 
 	return ctx.SendStatus(fiber.StatusNoContent)
 }
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
+	"github.com/MindHunter86/addie/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/urfave/cli/v2"
+)
+
+// newTestBalanceApp returns the app which balances requests to cache-NN-node servers of the bare cluster;
+// servers of down list are known by the balancer, but they are not alive
+func newTestBalanceApp(t *testing.T, nservers int, down ...int) *App {
+	t.Helper()
+
+	setTestCliContext(t, []cli.Flag{
+		&cli.IntFlag{Name: "balancer-max-backups", Value: 2},
+		&cli.IntFlag{Name: "balancer-server-max-fails", Value: 3},
+		&cli.StringFlag{Name: "link-sign-scheme", Value: signer.SchemeMD5},
+	})
+
+	entries := make(map[string]*balancer.UpstreamEntry, nservers)
+	for i := 1; i <= nservers; i++ {
+		entry := &balancer.UpstreamEntry{
+			Name: fmt.Sprintf("cache-%02d-node", i),
+			Ip:   net.ParseIP(fmt.Sprintf("10.0.0.%d", i)),
+		}
+		entries[entry.Address()] = entry
+	}
+
+	blcr := newTestBalancer(t)
+	blcr.UpdateServers(entries)
+
+	// servers are disabled by the next update without them
+	if len(down) != 0 {
+		for _, i := range down {
+			delete(entries, fmt.Sprintf("10.0.0.%d", i))
+		}
+		blcr.UpdateServers(entries)
+	}
+
+	keyring := signer.NewKeyring()
+	keyring.Load("test", []*signer.Key{{Id: "test", Secret: "secret"}})
+
+	ctx := newTestContext(t, keyring, blcr)
+
+	app := &App{
+		runtime:       ctx.Value(utils.ContextKeyRuntime).(*runtime.Runtime),
+		keyring:       keyring,
+		cloudBalancer: blcr,
+		bareBalancer:  blcr,
+	}
+
+	var e error
+	if app.signers, e = signer.NewSigners(ctx); e != nil {
+		t.Fatal(e)
+	} else if app.routes, e = media.NewRouter(media.DefaultRoutes); e != nil {
+		t.Fatal(e)
+	} else if app.destinations, e = newDestinationResolver(`{{ .Name }}`, nil, ""); e != nil {
+		t.Fatal(e)
+	}
+
+	return app
+}
+
+// newTestSignFiber returns the fiber app of the sign pipeline - balancing of the chunk and signing of its links
+func (m *App) newTestSignFiber(uri string) *fiber.App {
+	fb := fiber.New()
+	fb.Get("/*", func(c *fiber.Ctx) error {
+		c.Locals("logger", gLog)
+		c.Locals("requestid", "test")
+		c.Locals("uid", "client")
+		c.Locals("uri", uri)
+		return c.Next()
+	}, m.fbMidAppBalance, m.fbHndAppRequestSign)
+
+	return fb
+}
+
+// TestRequestSignBackups checks the limit of requested backups and their response headers
+func TestRequestSignBackups(t *testing.T) {
+	app := newTestBalanceApp(t, 5)
+
+	const uri = "/videos/media/ts/9000/1/1080/hash_00001.ts"
+	fb := app.newTestSignFiber(uri)
+
+	for _, tc := range []struct {
+		requested string
+		backups   int
+	}{
+		{requested: "", backups: 0},
+		{requested: "0", backups: 0},
+		{requested: "1", backups: 1},
+		{requested: " 2 ", backups: 2},
+		// balancer-max-backups limits the count
+		{requested: "5", backups: 2},
+		{requested: "-1", backups: 0},
+		{requested: "two", backups: 0},
+	} {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		if tc.requested != "" {
+			req.Header.Set(apiHeaderBackups, tc.requested)
+		}
+
+		rsp, e := fb.Test(req)
+		if e != nil {
+			t.Fatal(e)
+		} else if rsp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("%q: got status %d", tc.requested, rsp.StatusCode)
+		}
+
+		locations := []string{rsp.Header.Get(apiHeaderLocation)}
+		for idx := 1; idx <= 3; idx++ {
+			header := apiHeaderBackup
+			if idx != 1 {
+				header = apiHeaderBackup + "-" + strconv.Itoa(idx)
+			}
+
+			if location := rsp.Header.Get(header); location != "" {
+				locations = append(locations, location)
+			} else if idx <= tc.backups {
+				t.Errorf("%q: there is no %s header", tc.requested, header)
+			}
+		}
+
+		if len(locations) != 1+tc.backups {
+			t.Errorf("%q: got %d backups, expected %d", tc.requested, len(locations)-1, tc.backups)
+		}
+
+		assertTestLocations(t, uri, locations)
+	}
+}
+
+// TestRequestSignJson checks the json body of the signed location and its backups
+func TestRequestSignJson(t *testing.T) {
+	app := newTestBalanceApp(t, 5)
+
+	const uri = "/videos/media/ts/9000/1/1080/hash_00001.ts"
+	fb := app.newTestSignFiber(uri)
+
+	for _, backups := range []int{0, 2} {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		req.Header.Set(apiHeaderBackups, strconv.Itoa(backups))
+
+		rsp, e := fb.Test(req)
+		if e != nil {
+			t.Fatal(e)
+		} else if rsp.StatusCode != fiber.StatusOK {
+			t.Fatalf("got status %d", rsp.StatusCode)
+		}
+
+		if rsp.Header.Get(apiHeaderLocation) != "" || rsp.Header.Get(apiHeaderBackup) != "" {
+			t.Error("locations are given in headers of the json response")
+		}
+
+		var body struct {
+			Location string   `json:"location"`
+			Backups  []string `json:"backups"`
+		}
+
+		buf, _ := io.ReadAll(rsp.Body)
+		if e = json.Unmarshal(buf, &body); e != nil {
+			t.Fatalf("%v: %s", e, buf)
+		}
+
+		if len(body.Backups) != backups {
+			t.Errorf("got %d backups, expected %d: %s", len(body.Backups), backups, buf)
+		}
+
+		assertTestLocations(t, uri, append([]string{body.Location}, body.Backups...))
+	}
+}
+
+// assertTestLocations checks that locations are signed links of the uri on different servers
+func assertTestLocations(t *testing.T, uri string, locations []string) {
+	t.Helper()
+
+	hosts := make(map[string]struct{}, len(locations))
+	for _, location := range locations {
+		rrl, e := url.Parse(location)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if rrl.Scheme != "https" || rrl.Path != uri || rrl.Query().Get("expires") == "" {
+			t.Errorf("location %s is not the signed link of %s", location, uri)
+		}
+
+		if _, ok := hosts[rrl.Host]; ok {
+			t.Errorf("server %s is given twice in %v", rrl.Host, locations)
+		}
+		hosts[rrl.Host] = struct{}{}
+	}
+}
+
+// TestBlcNodesBalanceBackups checks that backups of the chunk differ from its server and
+// down servers are not given
+func TestBlcNodesBalanceBackups(t *testing.T) {
+	const down = "cache-03-node"
+	app := newTestBalanceApp(t, 6, 3)
+
+	var uri string
+	fb := fiber.New()
+	fb.Get("/*", func(c *fiber.Ctx) error {
+		c.Locals("logger", gLog)
+		c.Locals("uri", &uri)
+		return c.Next()
+	}, app.fbHndBlcNodesBalance, func(c *fiber.Ctx) error {
+		// the chunk's server is down, the fallback is tested separately
+		return c.SendStatus(fiber.StatusServiceUnavailable)
+	})
+
+	var balanced int
+	for i := 0; i < 200; i++ {
+		uri = fmt.Sprintf("/videos/media/ts/%d/1/1080/hash_%05d.ts", 9000+i%7, i)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(apiHeaderBackups, "5")
+
+		rsp, e := fb.Test(req)
+		if e != nil {
+			t.Fatal(e)
+		} else if rsp.StatusCode == fiber.StatusServiceUnavailable {
+			continue
+		} else if rsp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("%s: got status %d", uri, rsp.StatusCode)
+		}
+		balanced++
+
+		servers := []string{
+			rsp.Header.Get(apiHeaderLocation),
+			rsp.Header.Get(apiHeaderBackup),
+			rsp.Header.Get(apiHeaderBackup + "-2"),
+		}
+
+		if rsp.Header.Get(apiHeaderBackup+"-3") != "" {
+			t.Errorf("%s: backups are not limited by balancer-max-backups", uri)
+		}
+
+		unique := make(map[string]struct{}, len(servers))
+		for _, server := range servers {
+			if _, ok := unique[server]; ok || server == "" || server == down {
+				t.Errorf("%s: got servers %v", uri, servers)
+				break
+			}
+			unique[server] = struct{}{}
+		}
+	}
+
+	if balanced == 0 {
+		t.Error("all chunks are balanced to the down server")
+	}
+}
+
+// TestRequestSignExpires checks that the access log gets the expiration of the primary location
+func TestRequestSignExpires(t *testing.T) {
+	app := newTestBalanceApp(t, 5)
+
+	const uri = "/videos/media/ts/9000/1/1080/hash_00001.ts"
+
+	var expires string
+	fb := fiber.New()
+	fb.Get("/*", func(c *fiber.Ctx) error {
+		c.Locals("logger", gLog)
+		c.Locals("requestid", "test")
+		c.Locals("uid", "client")
+		c.Locals("uri", uri)
+
+		e := c.Next()
+		expires, _ = c.Locals("expires").(string)
+		return e
+	}, app.fbMidAppBalance, app.fbHndAppRequestSign)
+
+	req := httptest.NewRequest(http.MethodGet, uri, nil)
+	req.Header.Set(apiHeaderBackups, "2")
+
+	rsp, e := fb.Test(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	rrl, e := url.Parse(rsp.Header.Get(apiHeaderLocation))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if expires == "" || expires != rrl.Query().Get("expires") {
+		t.Errorf("got expires %q of the location %s", expires, rrl)
+	}
+}
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// watcherFailsThreshold - count of consecutive failed consul requests for marking a watcher as failed
+const watcherFailsThreshold = 3
+
+type (
+	// watcherState is the progress of one consul blocking query loop
+	watcherState struct {
+		Received time.Time `json:"received"`
+		Index    uint64    `json:"index"`
+		Servers  int       `json:"servers,omitempty"`
+		Fails    int       `json:"fails"`
+		Error    string    `json:"error,omitempty"`
+
+		// filled by check()
+		Ready  bool   `json:"ready"`
+		Reason string `json:"reason,omitempty"`
+	}
+
+	// consulWatchers tracks health service and KV watchers for readiness checks;
+	// prefork children get the parent's snapshot within health reports
+	consulWatchers struct {
+		mu       sync.RWMutex
+		clusters map[string]*watcherState
+		kv       *watcherState
+	}
+	consulWatchersSnapshot struct {
+		Clusters map[string]*watcherState `json:"clusters"`
+		KV       *watcherState            `json:"kv"`
+	}
+)
+
+func newConsulWatchers(clusters ...string) *consulWatchers {
+	watchers := &consulWatchers{
+		clusters: make(map[string]*watcherState, len(clusters)),
+		kv:       &watcherState{},
+	}
+
+	for _, cluster := range clusters {
+		watchers.clusters[cluster] = &watcherState{}
+	}
+
+	return watchers
+}
+
+func (m *consulWatchers) received(state *watcherState, idx uint64, servers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state.Received, state.Index, state.Servers = time.Now(), idx, servers
+	state.Fails, state.Error = 0, ""
+}
+
+func (m *consulWatchers) failed(state *watcherState, e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state.Fails++
+	state.Error = e.Error()
+}
+
+func (m *consulWatchers) clusterReceived(cluster string, idx uint64, servers int) {
+	if state, ok := m.clusters[cluster]; ok {
+		m.received(state, idx, servers)
+	}
+}
+
+func (m *consulWatchers) clusterFailed(cluster string, e error) {
+	if state, ok := m.clusters[cluster]; ok {
+		m.failed(state, e)
+	}
+}
+
+func (m *consulWatchers) kvReceived(idx uint64) { m.received(m.kv, idx, 0) }
+func (m *consulWatchers) kvFailed(e error)      { m.failed(m.kv, e) }
+
+func (m *consulWatchers) snapshot() *consulWatchersSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return (&consulWatchersSnapshot{Clusters: m.clusters, KV: m.kv}).clone()
+}
+
+func (m *consulWatchersSnapshot) clone() *consulWatchersSnapshot {
+	snapshot := &consulWatchersSnapshot{
+		Clusters: make(map[string]*watcherState, len(m.Clusters)),
+	}
+
+	for cluster, state := range m.Clusters {
+		buf := *state
+		snapshot.Clusters[cluster] = &buf
+	}
+
+	kv := *m.KV
+	snapshot.KV = &kv
+
+	return snapshot
+}
+
+// check fills Ready and Reason of all watchers; watchers are stalled if they have not
+// received any response longer than stall timeout, blocking queries return at least once per wait time
+func (m *consulWatchersSnapshot) check(stall time.Duration) (ready bool) {
+	ready = true
+
+	for _, state := range m.Clusters {
+		ready = state.check(stall) && ready
+	}
+
+	return m.KV.check(stall) && ready
+}
+
+func (m *watcherState) check(stall time.Duration) bool {
+	switch {
+	case m.Received.IsZero():
+		m.Reason = "there is no responses from consul yet"
+	case m.Fails >= watcherFailsThreshold:
+		m.Reason = "too many consecutive failed requests"
+	case time.Since(m.Received) > stall:
+		m.Reason = "watcher has stalled"
+	default:
+		m.Ready = true
+	}
+
+	return m.Ready
+}
+
+// circuit breaker states of the api client; the open breaker rejects api requests until
+// the cooldown, then the one probe request is allowed in the half-open state
+const (
+	apiBreakerClosed   = "closed"
+	apiBreakerOpen     = "open"
+	apiBreakerHalfOpen = "half-open"
+)
+
+// apiClientState is the result of the last anilibria API requests;
+// the API is not required for readiness, fake quality falls back to the requested quality
+// or the stale titles cache
+type apiClientState struct {
+	mu sync.RWMutex
+
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+	Fails       int       `json:"fails"`
+
+	Breaker string    `json:"breaker"`
+	RetryAt time.Time `json:"retry_at"`
+
+	// consecutive fails for opening the breaker, 0 - the breaker is disabled
+	threshold int
+	cooldown  time.Duration
+}
+
+func newApiClientState(threshold int, cooldown time.Duration) apiClientState {
+	return apiClientState{
+		Breaker:   apiBreakerClosed,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow reports whether the api request may be made; the caller of the allowed request
+// must report its result with succeeded or failed
+func (m *apiClientState) allow() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.Breaker {
+	case apiBreakerOpen:
+		if time.Now().Before(m.RetryAt) {
+			return false
+		}
+
+		m.Breaker = apiBreakerHalfOpen
+		return true
+	case apiBreakerHalfOpen:
+		// the probe request is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (m *apiClientState) succeeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Breaker != apiBreakerClosed {
+		gLog.Info().Msg("api requests are succeeded, circuit breaker has been closed")
+	}
+
+	m.LastSuccess, m.Fails = time.Now(), 0
+	m.Breaker, m.RetryAt = apiBreakerClosed, time.Time{}
+}
+
+func (m *apiClientState) failed(e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.LastFailure, m.LastError = time.Now(), e.Error()
+	m.Fails++
+
+	if m.threshold == 0 || m.Breaker == apiBreakerClosed && m.Fails < m.threshold {
+		return
+	}
+
+	gLog.Warn().Int("fails", m.Fails).Dur("cooldown", m.cooldown).
+		Msg("api requests are failed, circuit breaker has been opened")
+	m.Breaker, m.RetryAt = apiBreakerOpen, m.LastFailure.Add(m.cooldown)
+}
+
+func (m *apiClientState) snapshot() *apiClientState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return &apiClientState{
+		LastSuccess: m.LastSuccess,
+		LastFailure: m.LastFailure,
+		LastError:   m.LastError,
+		Fails:       m.Fails,
+		Breaker:     m.Breaker,
+		RetryAt:     m.RetryAt,
+	}
+}
+
+type (
+	readinessReport struct {
+		Ready bool   `json:"ready"`
+		Mode  string `json:"mode"`
+
+		Consul    *consulWatchersSnapshot       `json:"consul"`
+		Api       *apiClientState               `json:"api"`
+		Balancers map[string]*balancerReadiness `json:"balancers"`
+		Blocklist *blocklistReadiness           `json:"blocklist"`
+		Keyring   *keyringReadiness             `json:"keyring"`
+		Prefork   *preforkHealth                `json:"prefork,omitempty"`
+	}
+	balancerReadiness struct {
+		Servers   int `json:"servers"`
+		Available int `json:"available"`
+	}
+	blocklistReadiness struct {
+		Enabled bool `json:"enabled"`
+		Size    int  `json:"size"`
+	}
+	keyringReadiness struct {
+		SigningKey string `json:"signing_key"` // empty for the legacy link-secret key
+		Error      string `json:"error,omitempty"`
+	}
+)
+
+// getPreforkMode returns the process role in --http-prefork mode
+func getPreforkMode() string {
+	switch {
+	case gPreforkParent != nil:
+		return "prefork parent"
+	case gPreforkChild != nil:
+		return "prefork child"
+	default:
+		return "standalone"
+	}
+}
+
+// check fills Ready of the report; links could not be signed without a valid key,
+// prefork children are ready if the parent's watchers are ready, the parent's report is fresh
+// and the child has not diverged
+func (m *readinessReport) check(stall time.Duration) {
+	if m.Keyring != nil && m.Keyring.Error != "" {
+		return
+	}
+
+	if m.Mode != "prefork child" {
+		m.Ready = m.Consul != nil && m.Consul.check(stall)
+		return
+	}
+
+	if m.Prefork == nil || m.Prefork.Watchers == nil {
+		return
+	}
+
+	// the health report is shared between requests, so watchers are checked on the copy
+	health := *m.Prefork
+	m.Consul, m.Prefork, health.Watchers = health.Watchers.clone(), &health, nil
+
+	if state, ok := health.Children[os.Getpid()]; health.isStale() || ok && state.Diverged {
+		return
+	}
+
+	m.Ready = m.Consul.check(stall)
+}
@@ -0,0 +1,345 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/signer"
+	"github.com/gofiber/fiber/v2"
+	"github.com/urfave/cli/v2"
+)
+
+var errTestApi = errors.New("api is unavailable")
+
+func TestApiBreakerTransitions(t *testing.T) {
+	state := newApiClientState(3, time.Minute)
+
+	// closed - fails below the threshold do not open the breaker
+	for i := 0; i < 2; i++ {
+		if !state.allow() {
+			t.Fatalf("closed breaker rejects the request after %d fails", i)
+		}
+		state.failed(errTestApi)
+	}
+
+	if state.Breaker != apiBreakerClosed {
+		t.Fatalf("breaker is %s after 2 fails of 3", state.Breaker)
+	}
+
+	// closed => open
+	state.failed(errTestApi)
+	if state.Breaker != apiBreakerOpen || state.allow() {
+		t.Fatalf("breaker is %s after 3 fails, requests must be rejected", state.Breaker)
+	}
+
+	if cooldown := state.RetryAt.Sub(state.LastFailure); cooldown != time.Minute {
+		t.Errorf("got cooldown %s, want 1m", cooldown)
+	}
+
+	// open => half-open after the cooldown
+	state.RetryAt = time.Now().Add(-time.Millisecond)
+	if !state.allow() || state.Breaker != apiBreakerHalfOpen {
+		t.Fatalf("breaker is %s after the cooldown, the probe must be allowed", state.Breaker)
+	}
+
+	// half-open => open if the probe fails
+	state.failed(errTestApi)
+	if state.Breaker != apiBreakerOpen || state.allow() {
+		t.Fatalf("breaker is %s after the failed probe, it must be opened again", state.Breaker)
+	}
+
+	// half-open => closed if the probe succeeds
+	state.RetryAt = time.Now().Add(-time.Millisecond)
+	if !state.allow() {
+		t.Fatal("the second probe is rejected")
+	}
+
+	state.succeeded()
+	if state.Breaker != apiBreakerClosed || state.Fails != 0 || !state.RetryAt.IsZero() {
+		t.Fatalf("breaker is %s with %d fails after the succeeded probe", state.Breaker, state.Fails)
+	}
+
+	if !state.allow() || !state.allow() {
+		t.Error("closed breaker rejects requests")
+	}
+}
+
+func TestApiBreakerSingleProbe(t *testing.T) {
+	const callers = 16
+
+	state := newApiClientState(1, time.Minute)
+	state.failed(errTestApi)
+	state.RetryAt = time.Now().Add(-time.Millisecond)
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			<-start
+			if state.allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	if n := allowed.Load(); n != 1 {
+		t.Fatalf("%d probes are allowed by the half-open breaker, want 1", n)
+	}
+
+	// other requests are rejected until the probe's result
+	if state.allow() {
+		t.Error("the request is allowed while the probe is in flight")
+	}
+}
+
+func TestApiBreakerDisabled(t *testing.T) {
+	state := newApiClientState(0, time.Minute)
+
+	for i := 0; i < 100; i++ {
+		state.failed(errTestApi)
+	}
+
+	if state.Breaker != apiBreakerClosed || !state.allow() {
+		t.Errorf("disabled breaker is %s", state.Breaker)
+	}
+}
+
+type testReadiness struct {
+	controller *Controller
+	watchers   *consulWatchers
+	keyring    *signer.Keyring
+}
+
+// newTestReadiness returns the initialized controller of one cluster with the valid signing key;
+// consul watchers have not received anything yet
+func newTestReadiness(t *testing.T) *testReadiness {
+	t.Helper()
+
+	setTestCliContext(t, []cli.Flag{
+		&cli.DurationFlag{Name: "consul-watch-stall-timeout", Value: time.Minute},
+		&cli.DurationFlag{Name: "http-prefork-check-interval", Value: time.Second},
+	})
+
+	previousConsul, previousApi, previousChild := gConsul, gAniApi, gPreforkChild
+	t.Cleanup(func() { gConsul, gAniApi, gPreforkChild = previousConsul, previousApi, previousChild })
+
+	blcr := newTestBalancer(t)
+	readiness := &testReadiness{
+		watchers: newConsulWatchers(blcr.GetClusterName()),
+		keyring:  signer.NewKeyring(),
+	}
+
+	gConsul = &consulClient{watchers: readiness.watchers}
+	gAniApi = &ApiClient{state: newApiClientState(0, time.Minute)}
+	gPreforkChild = nil
+
+	readiness.keyring.Load("test", []*signer.Key{{Id: "test", Secret: "secret"}})
+
+	readiness.controller = NewController().WithContext(newTestContext(t, readiness.keyring, blcr))
+	readiness.controller.SetReady()
+
+	return readiness
+}
+
+// synced marks all watchers as received
+func (m *testReadiness) synced() {
+	for cluster := range m.watchers.clusters {
+		m.watchers.clusterReceived(cluster, 1, 2)
+	}
+
+	m.watchers.kvReceived(1)
+}
+
+func (m *testReadiness) get(t *testing.T) (int, *readinessReport) {
+	t.Helper()
+
+	app := fiber.New()
+	app.Get("/readyz", m.controller.GetReadiness)
+
+	rsp, e := app.Test(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer rsp.Body.Close()
+
+	// errors of the fiber handler have no report
+	var report *readinessReport
+	if rsp.Header.Get(fiber.HeaderContentType) == fiber.MIMEApplicationJSON {
+		if e = json.NewDecoder(rsp.Body).Decode(&report); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	return rsp.StatusCode, report
+}
+
+func TestReadiness(t *testing.T) {
+	const cluster = "cache-node-internal"
+
+	for _, tc := range []struct {
+		name    string
+		prepare func(*testReadiness)
+		ready   bool
+		reason  func(*readinessReport) string
+	}{
+		{
+			name:    "synced",
+			prepare: func(m *testReadiness) { m.synced() },
+			ready:   true,
+		},
+		{
+			name:    "no cluster server lists",
+			prepare: func(m *testReadiness) { m.watchers.kvReceived(1) },
+			reason:  func(r *readinessReport) string { return r.Consul.Clusters[cluster].Reason },
+		},
+		{
+			name: "runtime KV never synced",
+			prepare: func(m *testReadiness) {
+				m.watchers.clusterReceived(cluster, 1, 2)
+				m.watchers.kvFailed(errTestApi)
+			},
+			reason: func(r *readinessReport) string { return r.Consul.KV.Reason },
+		},
+		{
+			name: "stalled cluster watcher",
+			prepare: func(m *testReadiness) {
+				m.synced()
+				m.watchers.clusters[cluster].Received = time.Now().Add(-time.Hour)
+			},
+			reason: func(r *readinessReport) string { return r.Consul.Clusters[cluster].Reason },
+		},
+		{
+			name: "stalled KV watcher",
+			prepare: func(m *testReadiness) {
+				m.synced()
+				m.watchers.kv.Received = time.Now().Add(-time.Hour)
+			},
+			reason: func(r *readinessReport) string { return r.Consul.KV.Reason },
+		},
+		{
+			name: "failing cluster watcher",
+			prepare: func(m *testReadiness) {
+				m.synced()
+				for i := 0; i < watcherFailsThreshold; i++ {
+					m.watchers.clusterFailed(cluster, errTestApi)
+				}
+			},
+			reason: func(r *readinessReport) string { return r.Consul.Clusters[cluster].Reason },
+		},
+		{
+			name: "no signing key",
+			prepare: func(m *testReadiness) {
+				m.synced()
+				m.keyring.Load("test", nil)
+			},
+			reason: func(r *readinessReport) string { return r.Keyring.Error },
+		},
+	} {
+		readiness := newTestReadiness(t)
+		tc.prepare(readiness)
+
+		status, report := readiness.get(t)
+		if report == nil {
+			t.Errorf("%s: got %d status without the report", tc.name, status)
+			continue
+		}
+
+		if tc.ready {
+			if status != http.StatusOK || !report.Ready || report.Mode != "standalone" || report.Keyring.SigningKey != "test" {
+				t.Errorf("%s: got %d status, report %+v", tc.name, status, report)
+			}
+			continue
+		}
+
+		if status != http.StatusServiceUnavailable || report.Ready {
+			t.Errorf("%s: got %d status, report %+v", tc.name, status, report)
+		} else if tc.reason(report) == "" {
+			t.Errorf("%s: the reason is not reported", tc.name)
+		}
+	}
+}
+
+func TestReadinessNotInitialized(t *testing.T) {
+	readiness := newTestReadiness(t)
+	readiness.synced()
+	readiness.controller.isReady = false
+
+	if status, _ := readiness.get(t); status != http.StatusServiceUnavailable {
+		t.Errorf("got %d status before the initialization", status)
+	}
+}
+
+// TestReadinessPreforkChild checks that children use watchers of the parent's health report
+func TestReadinessPreforkChild(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		health func(*testReadiness) *preforkHealth
+		ready  bool
+	}{
+		{
+			name: "fresh report",
+			health: func(m *testReadiness) *preforkHealth {
+				m.synced()
+				return &preforkHealth{Timestamp: time.Now(), Watchers: m.watchers.snapshot()}
+			},
+			ready: true,
+		},
+		{
+			name:   "no report",
+			health: func(*testReadiness) *preforkHealth { return nil },
+		},
+		{
+			name: "stale report",
+			health: func(m *testReadiness) *preforkHealth {
+				m.synced()
+				return &preforkHealth{Timestamp: time.Now().Add(-time.Minute), Watchers: m.watchers.snapshot()}
+			},
+		},
+		{
+			name: "diverged child",
+			health: func(m *testReadiness) *preforkHealth {
+				m.synced()
+				return &preforkHealth{Timestamp: time.Now(), Watchers: m.watchers.snapshot(),
+					Children: map[int]*preforkChildState{os.Getpid(): {Mismatches: 2, Diverged: true}}}
+			},
+		},
+		{
+			name: "parent watchers are not synced",
+			health: func(m *testReadiness) *preforkHealth {
+				return &preforkHealth{Timestamp: time.Now(), Watchers: m.watchers.snapshot()}
+			},
+		},
+	} {
+		readiness := newTestReadiness(t)
+
+		gPreforkChild = &preforkChild{}
+		if health := tc.health(readiness); health != nil {
+			gPreforkChild.health.Store(health)
+		}
+
+		// the child's own watchers are never used
+		readiness.watchers.kvFailed(errTestApi)
+
+		status, report := readiness.get(t)
+		if report == nil || report.Mode != "prefork child" || report.Ready != tc.ready ||
+			(status == http.StatusOK) != tc.ready {
+			t.Errorf("%s: got %d status, report %+v", tc.name, status, report)
+		}
+	}
+}
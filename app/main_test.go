@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/blocklist"
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+func TestMain(m *testing.M) {
+	log := zerolog.Nop()
+	gLog = &log
+
+	os.Exit(m.Run())
+}
+
+// newTestCliContext returns the context of given flags and arguments
+func newTestCliContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	t.Helper()
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, fl := range flags {
+		if e := fl.Apply(set); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := set.Parse(args); e != nil {
+		t.Fatal(e)
+	}
+
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// setTestCliContext replaces gCli with the context of given flags and arguments for the test
+func setTestCliContext(t *testing.T, flags []cli.Flag, args ...string) {
+	t.Helper()
+
+	previous := gCli
+	t.Cleanup(func() { gCli = previous })
+
+	gCli = newTestCliContext(t, flags, args...)
+}
+
+// newTestBalancer returns the balancer of cache-node-internal cluster
+func newTestBalancer(t *testing.T) *balancer.ClusterBalancer {
+	t.Helper()
+
+	log := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), utils.ContextKeyLogger, &log)
+	ctx = context.WithValue(ctx, utils.ContextKeyCliContext, newTestCliContext(t, []cli.Flag{
+		&cli.StringFlag{Name: "consul-service-nodes", Value: "cache-node-internal"},
+	}))
+
+	return balancer.NewClusterBalancer(ctx, balancer.BalancerClusterNodes)
+}
+
+// newTestContext returns the context of subsystems which are used by the controller and handlers;
+// the runtime is built with gCli
+func newTestContext(t *testing.T, keyring *signer.Keyring, blcr balancer.Balancer) context.Context {
+	t.Helper()
+
+	log := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), utils.ContextKeyLogger, &log)
+	ctx = context.WithValue(ctx, utils.ContextKeyCliContext, gCli)
+	ctx = context.WithValue(ctx, utils.ContextKeyKeyring, keyring)
+	ctx = context.WithValue(ctx, utils.ContextKeyBlocklist, blocklist.NewBlocklist(ctx))
+	ctx = context.WithValue(ctx, utils.ContextKeyBalancers,
+		map[balancer.BalancerCluster]balancer.Balancer{balancer.BalancerClusterNodes: blcr})
+
+	rt, e := runtime.NewRuntime(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ctx = context.WithValue(ctx, utils.ContextKeyRuntime, rt)
+	ctx = context.WithValue(ctx, utils.ContextKeySigners, (*signer.Signers)(nil))
+	ctx = context.WithValue(ctx, utils.ContextKeyTitlesCache, (*TitlesCache)(nil))
+
+	return ctx
+}
@@ -3,9 +3,10 @@ package app
 import (
 	"errors"
 	"net/http"
-	"strconv"
+	"path"
 	"strings"
 
+	"github.com/MindHunter86/addie/media"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
 )
@@ -13,12 +14,12 @@ import (
 type (
 	Title struct {
 		// Names      interface{}
-		// Updated    uint64
-		// LastChange uint64 `json:"last_change"`
 
-		Id     uint16
-		Code   string
-		Player *Player
+		Id         uint16
+		Code       string
+		Updated    uint64
+		LastChange uint64 `json:"last_change"`
+		Player     *Player
 	}
 	Player struct {
 		// AlternativePlayer string `json:"alternative_player"`
@@ -42,8 +43,9 @@ type (
 
 type (
 	TitleSerie struct {
-		Title, Serie  uint16
-		QualityHashes map[utils.TitleQuality]string
+		Title         uint16                        `json:"title"`
+		Serie         uint16                        `json:"serie"`
+		QualityHashes map[utils.TitleQuality]string `json:"quality_hashes"`
 	}
 )
 
@@ -54,20 +56,12 @@ type (
 // ID:SERIE - FHD:HD:SD (links)
 // ID:SERIE:{FHD,HD,SD} - json{[TS LINKS]}
 
-const (
-	tsrRawTitleId = uint8(iota) + 4 // 4 is a skipping of "/videos/media/ts" parts
-	tsrRawTitleSerie
-	tsrRawTitleQuality
-	tsrRawFilename
-)
-
 func getQualityHash(rawpath string) (string, bool) {
 	if rawpath == "" {
 		return "", false
 	}
 
-	filename := strings.Split(rawpath, "/")[tsrRawFilename]
-	return getHashFromUriPath(filename)
+	return getHashFromUriPath(path.Base(rawpath))
 }
 
 func getHashFromUriPath(upath string) (hash string, ok bool) {
@@ -91,26 +85,28 @@ func getHashFromUriPath(upath string) (hash string, ok bool) {
 	return hash, ok
 }
 
-func (m *App) getTitleSerieFromCache(c *fiber.Ctx, tsr *TitleSerieRequest) (*TitleSerie, bool) {
-	serie, e := m.cache.PullSerie(c, tsr.getTitleId(), tsr.getSerieId())
-	if e != nil {
-		gLog.Warn().Err(e).Msg("")
-		return nil, false
+// getTitleSerieFromCache returns fresh series; missing titles and series are returned with errors
+func (m *App) getTitleSerieFromCache(c *fiber.Ctx, tsr *TitleSerieRequest) (serie *TitleSerie, ok bool, e error) {
+	if serie, ok, e = m.cache.GetSerie(tsr.getTitleId(), tsr.getSerieId()); e != nil {
+		rlog(c).Debug().Err(e).Str("tid", tsr.getTitleIdString()).Str("sid", tsr.getSerieIdString()).
+			Msg("title or serie is missing according to the cache")
 	}
 
-	return serie, serie != nil
+	return
 }
 
-func (m *App) getTitleSeriesFromApi(c *fiber.Ctx, titleId string) (_ []*TitleSerie, e error) {
+func (m *App) getTitleSeriesFromApi(c *fiber.Ctx, titleId string) (_ []*TitleSerie, lastChange uint64, e error) {
 	var title *Title
 	e = gAniApi.getApiResponse(c, http.MethodGet, apiMethodGetTitle,
 		[]string{"id", titleId}).parseApiResponse(&title)
 
 	if e != nil {
-		return nil, e
+		return nil, 0, e
+	} else if title == nil || title.Player == nil {
+		return nil, 0, errors.New("there is no player in the api response")
 	}
 
-	return m.validateTitleFromApiResponse(title), e
+	return m.validateTitleFromApiResponse(title), title.LastChange, e
 }
 
 func (*App) validateTitleFromApiResponse(title *Title) (tss []*TitleSerie) {
@@ -148,17 +144,58 @@ func (*App) validateTitleFromApiResponse(title *Title) (tss []*TitleSerie) {
 	return
 }
 
+// newTitleSeriesFetcher returns the api request of the title series which pushes them to the cache;
+// c is nil for background revalidation
+func (m *App) newTitleSeriesFetcher(c *fiber.Ctx, tsr *TitleSerieRequest) func() ([]*TitleSerie, error) {
+	return func() (series []*TitleSerie, e error) {
+		var lastChange uint64
+		var title *CachedTitle
+		if series, lastChange, e = m.getTitleSeriesFromApi(c, tsr.getTitleIdString()); errors.Is(e, errApiTitleNotFound) {
+			title = m.cache.PushMissing(tsr.getTitleId())
+		} else if e != nil {
+			return
+		} else {
+			// titles without series are cached too, series are requested again after the negative ttl
+			title = m.cache.PushSeries(tsr.getTitleId(), lastChange, series)
+		}
+
+		if gPreforkChild != nil {
+			gPreforkChild.pushTitle(title)
+		}
+
+		return
+	}
+}
+
 func (m *App) doTitleSerieRequest(c *fiber.Ctx, tsr *TitleSerieRequest) (ts *TitleSerie, e error) {
 	var ok bool
 
 	rlog(c).Debug().Str("tid", tsr.getTitleIdString()).Str("sid", tsr.getSerieIdString()).Msg("trying to get series from cache")
-	if ts, ok = m.getTitleSerieFromCache(c, tsr); ok {
+	if ts, ok, e = m.getTitleSerieFromCache(c, tsr); ok || e != nil {
+		return
+	}
+
+	// stale series are served while the title is revalidated in background,
+	// so the titles cache covers api outages
+	if ts = m.cache.GetStaleSerie(tsr.getTitleId(), tsr.getSerieId()); ts != nil {
+		rlog(c).Debug().Str("tid", tsr.getTitleIdString()).Str("sid", tsr.getSerieIdString()).
+			Msg("stale serie has been served, the title is revalidating")
+		m.flights.Go(tsr.getTitleId(), m.newTitleSeriesFetcher(nil, tsr))
 		return
 	}
 
 	var tss []*TitleSerie
+	var shared bool
+
+	// concurrent requests of the title share the one api response
 	rlog(c).Info().Str("tid", tsr.getTitleIdString()).Str("sid", tsr.getSerieIdString()).Msg("trying to get series from api")
-	if tss, e = m.getTitleSeriesFromApi(c, tsr.getTitleIdString()); e != nil {
+	tss, shared, e = m.flights.Do(tsr.getTitleId(), m.newTitleSeriesFetcher(c, tsr))
+
+	if shared {
+		rlog(c).Debug().Str("tid", tsr.getTitleIdString()).Msg("series have been received by the concurrent api request")
+	}
+
+	if e != nil {
 		return
 	}
 
@@ -170,11 +207,6 @@ func (m *App) doTitleSerieRequest(c *fiber.Ctx, tsr *TitleSerieRequest) (ts *Tit
 		if t.Serie == tsr.getSerieId() {
 			ts = t
 		}
-
-		if e = m.cache.PushSerie(t); e != nil {
-			rlog(c).Warn().Err(e).Str("tid", tsr.getTitleIdString()).Str("sid", tsr.getSerieIdString()).Msg("")
-			continue
-		}
 	}
 
 	if ts == nil {
@@ -211,90 +243,58 @@ func (m *App) getUriWithFakeQuality(c *fiber.Ctx, tsr *TitleSerieRequest, uri st
 	)
 }
 
+// TitleSerieRequest - the title's media request parsed by media routes
 type TitleSerieRequest struct {
-	titleId, serieId uint16
-	quality          utils.TitleQuality
-	hash             string
-
-	raw []string
+	// nil if the uri is not matched by any route
+	path *media.Path
 }
 
-func NewTitleSerieRequest(uri string) *TitleSerieRequest {
+func (m *App) newTitleSerieRequest(uri string) *TitleSerieRequest {
+	mpath, _ := m.routes.Parse(uri)
 	return &TitleSerieRequest{
-		raw: strings.Split(uri, "/"),
+		path: mpath,
 	}
 }
 
 func (m *TitleSerieRequest) getTitleId() uint16 {
-	if m.titleId != 0 {
-		return m.titleId
-	}
-
-	tid, _ := strconv.ParseUint(m.raw[tsrRawTitleId], 10, 16)
-	m.titleId = uint16(tid)
-	return m.titleId
+	return m.path.Title
 }
 
 func (m *TitleSerieRequest) getTitleIdString() string {
-	return m.raw[tsrRawTitleId]
+	return m.path.TitleId
 }
 
 func (m *TitleSerieRequest) getSerieId() uint16 {
-	if m.serieId != 0 {
-		return m.serieId
-	}
-
-	sid, _ := strconv.ParseUint(m.raw[tsrRawTitleSerie], 10, 16)
-	m.serieId = uint16(sid)
-	return m.serieId
+	return m.path.Episode
 }
 
 func (m *TitleSerieRequest) getSerieIdString() string {
-	return m.raw[tsrRawTitleSerie]
+	return m.path.EpisodeId
 }
 
 func (m *TitleSerieRequest) getTitleQuality() utils.TitleQuality {
-	if m.quality != utils.TitleQualityNone {
-		return m.quality
-	}
-
-	switch m.raw[tsrRawTitleQuality] {
-	case "480":
-		m.quality = utils.TitleQualitySD
-		return m.quality
-	case "720":
-		m.quality = utils.TitleQualityHD
-		return m.quality
-	case "1080":
-		m.quality = utils.TitleQualityFHD
-		return m.quality
-	default:
-		return utils.TitleQualityNone
-	}
+	return m.path.TitleQuality
 }
 
 func (m *TitleSerieRequest) getTitleQualityString() string {
-	return m.raw[tsrRawTitleQuality]
+	return m.path.Quality
 }
 
 func (m *TitleSerieRequest) getTitleHash() (_ string, ok bool) {
-	if m.hash != "" {
-		return m.hash, true
-	}
-
-	m.hash, ok = getHashFromUriPath(m.raw[tsrRawFilename])
-	return m.hash, ok
+	return m.path.Hash()
 }
 
 // TODO - refactor
 func (m *TitleSerieRequest) isOldFormat() bool {
-	return strings.Contains(m.raw[tsrRawFilename], "fff")
+	return strings.Contains(m.path.Name, "fff")
 }
 
 func (m *TitleSerieRequest) isM3U8() bool {
-	return strings.Contains(m.raw[tsrRawFilename], "m3u8")
+	return m.path.Kind() == media.KindPlaylist
 }
 
+// isValid reports if the route has title, episode and quality captures
 func (m *TitleSerieRequest) isValid() bool {
-	return len(m.raw) == 8
+	return m.path != nil && m.path.Title != 0 && m.path.Episode != 0 &&
+		m.path.TitleQuality != utils.TitleQualityNone
 }
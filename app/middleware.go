@@ -6,9 +6,11 @@ import (
 	"math/rand"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
 	"github.com/MindHunter86/addie/runtime"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
@@ -26,7 +28,10 @@ const (
 	apiHeaderUri      = "X-Client-Uri"
 	apiHeaderId       = "X-Client-Id"
 	apiHeaderServer   = "X-Cache-Server"
+	apiHeaderClass    = "X-Client-Class" // optional, class of the client for link expiration rules
 	apiHeaderLocation = "X-Location"
+	apiHeaderBackups  = "X-Location-Backups"
+	apiHeaderBackup   = "X-Location-Backup"
 )
 
 type appMidError uint8
@@ -49,7 +54,7 @@ const (
 // }
 
 func (m *App) fbMidAppPreCond(ctx *fiber.Ctx) (skip bool) {
-	m.lapRequestTimer(ctx, utils.FbReqTmrBlcPreCond)
+	m.lapRequestTimer(ctx, utils.FbReqTmrPreCond)
 	rlog(ctx).Trace().Interface("hdrs", ctx.GetReqHeaders()).Msg("cache-XXX-internal precond balancer")
 
 	var errs appMidError
@@ -72,7 +77,8 @@ func (m *App) fbMidAppPreCond(ctx *fiber.Ctx) (skip bool) {
 	ctx.Locals("srv", strings.TrimSpace(ctx.Get(apiHeaderServer)))
 
 	// match uri
-	if !m.chunkRegexp.Match([]byte(ctx.Get(apiHeaderUri))) {
+	if _, e := m.routes.Parse(ctx.Get(apiHeaderUri)); e != nil {
+		ctx.Locals("uri_error", e)
 		ctx.Locals("errors", errs|errMidAppPreUriRegexp)
 		return
 	}
@@ -86,21 +92,20 @@ func (m *App) fbMidAppFakeQuality(ctx *fiber.Ctx) error {
 	rlog(ctx).Trace().Msg("fake quality check")
 
 	uri := ctx.Get(apiHeaderUri)
-	tsr := NewTitleSerieRequest(uri)
+	tsr := m.newTitleSerieRequest(uri)
 
 	if !tsr.isValid() {
 		ctx.Locals("uri", uri)
 		return ctx.Next()
 	}
 
-	origin := ctx.Get("Origin", "")
-	if origin != "" && m.runtime.Config.Get(runtime.ParamQualityBypass) != nil {
-		reg := m.runtime.Config.Get(runtime.ParamQualityBypass).(*regexp.Regexp)
-		if reg.MatchString(origin) {
-			rlog(ctx).Trace().Msg("request bypassed due matching with bypass regexp from consul")
-			ctx.Locals("uri", uri)
-			return ctx.Next()
-		}
+	// for access log; quality_after is set only for rewritten requests
+	ctx.Locals("quality_before", tsr.getTitleQualityString())
+
+	if m.isQualityBypassed(ctx) {
+		rlog(ctx).Trace().Msg("request bypassed due matching with bypass regexp from consul")
+		ctx.Locals("uri", uri)
+		return ctx.Next()
 	}
 
 	mitigation := m.runtime.Config.Get(runtime.ParamForceRUMitigate).(string)
@@ -128,10 +133,26 @@ func (m *App) fbMidAppFakeQuality(ctx *fiber.Ctx) error {
 	}
 
 	// precondition finished; quality cool down
-	ctx.Locals("uri", m.getUriWithFakeQuality(ctx, tsr, uri, quality))
+	furi := m.getUriWithFakeQuality(ctx, tsr, uri, quality)
+	if furi != uri {
+		ctx.Locals("quality_after", quality.String())
+	}
+
+	ctx.Locals("uri", furi)
 	return ctx.Next()
 }
 
+// isQualityBypassed reports if the request's Origin is matched by the bypass regexp from consul
+func (m *App) isQualityBypassed(ctx *fiber.Ctx) bool {
+	origin := ctx.Get("Origin", "")
+	if origin == "" {
+		return false
+	}
+
+	reg, _ := m.runtime.Config.Get(runtime.ParamQualityBypass).(*regexp.Regexp)
+	return reg != nil && reg.MatchString(origin)
+}
+
 // if return value == true - Balance() will be skipped
 func (m *App) fbMidAppBalancerLottery(_ *fiber.Ctx) bool {
 	return gCli.Bool("balancer-full-bypass") || m.runtime.Config.Get(runtime.ParamLottery).(int) < rand.Intn(99)+1 // skipcq: GSC-G404 math/rand is enough
@@ -141,15 +162,15 @@ func (m *App) fbMidAppBalance(ctx *fiber.Ctx) (e error) {
 	m.lapRequestTimer(ctx, utils.FbReqTmrConsulLottery)
 	rlog(ctx).Trace().Msg("consul lottery winner, rewriting destination server...")
 
-	var server *balancer.BalancerServer
-	uri, reqid := []byte(ctx.Locals("uri").(string)), ctx.Locals("requestid").(string)
-	// uri := []byte(ctx.Locals("uri").(string))
+	reqid := ctx.Locals("requestid").(string)
 
-	prefixbuf := bytes.NewBuffer(m.chunkRegexp.FindSubmatch(uri)[utils.ChunkTitleId])
-	prefixbuf.Write(m.chunkRegexp.FindSubmatch(uri)[utils.ChunkEpisodeId])
-	prefixbuf.Write(m.chunkRegexp.FindSubmatch(uri)[utils.ChunkQualityLevel])
+	// uri may be rewritten by fake quality, so it's parsed again
+	mpath, e := m.routes.Parse(ctx.Locals("uri").(string))
+	if e != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
 
-	// chunkname, prefix := string(m.chunkRegexp.FindSubmatch(uri)[utils.ChunkName]), prefixbuf.String()
+	// chunkname, prefix := mpath.ChunkName(), mpath.Prefix()
 
 	// for _, cluster := range []balancer.Balancer{m.cloudBalancer, m.bareBalancer} {
 	// 	// TODO
@@ -201,9 +222,17 @@ func (m *App) fbMidAppBalance(ctx *fiber.Ctx) (e error) {
 			}
 
 			// trying to balance with giver cluster
-			_, server, e = cluster.BalanceByChunk(
-				prefixbuf.String(),
-				string(m.chunkRegexp.FindSubmatch(uri)[utils.ChunkName]))
+			var servers []*balancer.BalancerServer
+			if m.isStickyCluster(cluster) {
+				servers, e = cluster.BalanceBySession(
+					m.getSessionKey(ctx, mpath),
+					1+m.getRequestedBackups(ctx))
+			} else {
+				servers, e = cluster.BalanceByChunkN(
+					mpath.Prefix(),
+					mpath.ChunkName(),
+					1+m.getRequestedBackups(ctx))
+			}
 
 			if errors.Is(e, balancer.ErrServerUnavailable) {
 				rlog(ctx).Trace().Err(e).Int("fails", fails).Str("req", reqid).
@@ -219,8 +248,22 @@ func (m *App) fbMidAppBalance(ctx *fiber.Ctx) (e error) {
 			}
 
 			// if all ok (if no errors) - save destination and go to the next fiber handler:
-			ctx.Locals("srv",
-				strings.ReplaceAll(server.Name, "-node", "")+"."+gCli.String("consul-entries-domain"))
+			var srv string
+			if srv, e = m.getServerDestination(cluster, servers[0]); e != nil {
+				return
+			}
+			ctx.Locals("srv", srv)
+			ctx.Locals("cluster", cluster.GetClusterName())
+
+			backups := make([]string, 0, len(servers)-1)
+			for _, backup := range servers[1:] {
+				if srv, e = m.getServerDestination(cluster, backup); e != nil {
+					return
+				}
+
+				backups = append(backups, srv)
+			}
+			ctx.Locals("backups", backups)
 
 			return ctx.Next()
 		}
@@ -230,14 +273,62 @@ func (m *App) fbMidAppBalance(ctx *fiber.Ctx) (e error) {
 	return fiber.NewError(fiber.StatusInternalServerError, e.Error())
 }
 
+// isStickyCluster reports if the cluster is balanced by viewing sessions instead of chunks
+func (m *App) isStickyCluster(cluster balancer.Balancer) bool {
+	clusters := m.runtime.Config.Get(runtime.ParamStickyClusters).(string)
+	if clusters == "" {
+		return false
+	}
+
+	for _, name := range strings.Split(clusters, ",") {
+		if name == cluster.GetClusterName() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getSessionKey returns a viewing session key - client id + title + episode;
+// quality is skipped, so quality switches keep the session on its server
+func (*App) getSessionKey(ctx *fiber.Ctx, mpath *media.Path) string {
+	buf := bytes.NewBufferString(ctx.Locals("uid").(string))
+	buf.WriteByte(':')
+	buf.WriteString(mpath.TitleId)
+	buf.WriteByte(':')
+	buf.WriteString(mpath.EpisodeId)
+
+	return buf.String()
+}
+
+// getRequestedBackups returns count of backup servers requested by client (nginx)
+func (*App) getRequestedBackups(ctx *fiber.Ctx) (count int) {
+	var e error
+	if count, e = strconv.Atoi(strings.TrimSpace(ctx.Get(apiHeaderBackups, "0"))); e != nil || count < 0 {
+		return 0
+	}
+
+	if max := gCli.Int("balancer-max-backups"); count > max {
+		count = max
+	}
+
+	return
+}
+
 func (m *App) fbMidAppBalanceFallback(ctx *fiber.Ctx) error {
 	server, e := m.getServerFromRandomBalancer(ctx)
 	if e != nil {
 		return e
 	}
 
-	ctx.Locals("srv",
-		strings.ReplaceAll(server.Name, "-node", "")+"."+gCli.String("consul-entries-domain"))
+	srv, e := m.getServerDestination(m.bareBalancer, server)
+	if e != nil {
+		return e
+	}
+
+	ctx.Locals("srv", srv)
+	ctx.Locals("cluster", m.bareBalancer.GetClusterName())
+	ctx.Locals("fallback", true)
 	return ctx.Next()
 }
 
@@ -266,7 +357,8 @@ func (m *App) fbMidBlcPreCond(ctx *fiber.Ctx) bool {
 
 	if huri := strings.TrimSpace(ctx.Get(apiHeaderUri)); huri == "" {
 		errs = errs | errMidAppPreHeaderUri
-	} else if !m.chunkRegexp.Match([]byte(huri)) {
+	} else if _, e := m.routes.Parse(huri); e != nil {
+		ctx.Locals("uri_error", e)
 		errs = errs | errMidAppPreUriRegexp
 	} else {
 		ctx.Locals("uri", &huri)
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/tracing"
+	"github.com/MindHunter86/addie/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	errPlaylistNoSource = errors.New("playlist-origin or playlist-root must be defined for playlist rewriting")
+	errPlaylistNotHls   = errors.New("uri is not a playlist")
+	errPlaylistNotFound = errors.New("playlist is not found")
+)
+
+// playlistMaxSize - playlists of a long episode are about 100KB
+const playlistMaxSize = 8 * 1024 * 1024
+
+// playlistSource reads playlists from playlist-root directory or fetches them from playlist-origin
+type playlistSource struct {
+	root   string
+	origin *url.URL
+	http   *http.Client
+}
+
+func newPlaylistSource() (_ *playlistSource, e error) {
+	source := &playlistSource{
+		root: gCli.String("playlist-root"),
+		http: &http.Client{
+			Timeout: gCli.Duration("playlist-fetch-timeout"),
+		},
+	}
+
+	if origin := gCli.String("playlist-origin"); origin != "" {
+		if source.origin, e = url.Parse(origin); e != nil {
+			return
+		}
+	}
+
+	return source, e
+}
+
+func (m *playlistSource) load(c *fiber.Ctx, uri string) (_ *media.Playlist, e error) {
+	switch {
+	case m.root != "":
+		return m.read(uri)
+	case m.origin != nil:
+		return m.fetch(c, uri)
+	default:
+		return nil, errPlaylistNoSource
+	}
+}
+
+func (m *playlistSource) read(uri string) (_ *media.Playlist, e error) {
+	// uri is cleaned as the absolute path, so it never leaves the root
+	var fd *os.File
+	if fd, e = os.Open(filepath.Join(m.root, filepath.FromSlash(path.Clean("/"+uri)))); errors.Is(e, fs.ErrNotExist) {
+		return nil, errPlaylistNotFound
+	} else if e != nil {
+		return
+	}
+	defer fd.Close()
+
+	return media.ParsePlaylist(io.LimitReader(fd, playlistMaxSize))
+}
+
+func (m *playlistSource) fetch(c *fiber.Ctx, uri string) (_ *media.Playlist, e error) {
+	rrl := m.origin.ResolveReference(&url.URL{Path: uri})
+
+	var req *http.Request
+	if req, e = http.NewRequest(http.MethodGet, rrl.String(), nil); e != nil {
+		return
+	}
+
+	span := getRequestSpan(c).CurrentStage().Child("playlist origin", tracing.SpanKindClient)
+	span.SetAttribute("http.method", http.MethodGet)
+	span.SetAttribute("http.url", rrl.String())
+	defer span.Finish()
+
+	if span != nil {
+		req.Header.Set(tracing.HeaderTraceparent, span.Traceparent())
+	}
+
+	var rsp *http.Response
+	if rsp, e = m.http.Do(req); e != nil {
+		span.SetError(e)
+		return
+	}
+	defer rsp.Body.Close()
+
+	span.SetAttribute("http.status_code", strconv.Itoa(rsp.StatusCode))
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, errPlaylistNotFound
+	} else if rsp.StatusCode != http.StatusOK {
+		e = fmt.Errorf("playlist origin responded with %d status", rsp.StatusCode)
+		span.SetError(e)
+		return
+	}
+
+	return media.ParsePlaylist(io.LimitReader(rsp.Body, playlistMaxSize))
+}
+
+// fbHndAppPlaylist rewrites the playlist of X-Client-Uri: variants above the runtime quality
+// are removed, segments are balanced to nodes and signed, so players do not ask for every chunk
+func (m *App) fbHndAppPlaylist(ctx *fiber.Ctx) (e error) {
+	m.lapRequestTimer(ctx, utils.FbReqTmrPlaylistFetch)
+
+	uri := ctx.Get(apiHeaderUri)
+	ctx.Locals("uri", uri)
+
+	mpath, e := m.routes.Parse(uri)
+	if e != nil {
+		return fiber.NewError(fiber.StatusPreconditionFailed, e.Error())
+	} else if mpath.Kind() != media.KindPlaylist {
+		return fiber.NewError(fiber.StatusPreconditionFailed, errPlaylistNotHls.Error())
+	}
+
+	var playlist *media.Playlist
+	if playlist, e = m.playlists.load(ctx, uri); errors.Is(e, errPlaylistNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, e.Error())
+	} else if e != nil {
+		rlog(ctx).Error().Err(e).Str("uri", uri).Msg("could not load playlist")
+		return fiber.NewError(fiber.StatusBadGateway, e.Error())
+	}
+
+	m.lapRequestTimer(ctx, utils.FbReqTmrPlaylistRewrite)
+
+	quality := m.runtime.Config.Get(runtime.ParamQuality).(utils.TitleQuality)
+	if m.isQualityBypassed(ctx) {
+		quality = utils.TitleQualityFHD
+	}
+
+	if playlist.Master {
+		m.rewriteMasterPlaylist(ctx, playlist, uri, quality)
+	} else if e = m.rewriteMediaPlaylist(ctx, playlist, m.newTitleSerieRequest(uri), uri, quality); e != nil {
+		return
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+
+	_, e = playlist.WriteTo(ctx)
+	return
+}
+
+// rewriteMasterPlaylist removes variants above the quality if there are variants below it;
+// variants of unknown quality are kept
+func (m *App) rewriteMasterPlaylist(ctx *fiber.Ctx, playlist *media.Playlist, uri string, quality utils.TitleQuality) {
+	var capped, allowed []*media.Line
+
+	for _, line := range playlist.Lines {
+		if line.Kind != media.LineVariant && line.Kind != media.LineRendition {
+			continue
+		}
+
+		line.Uri, _ = media.ResolveUri(uri, line.Uri)
+		if line.Kind != media.LineVariant {
+			continue
+		}
+
+		if vpath, e := m.routes.Parse(line.Uri); e == nil && vpath.TitleQuality > quality {
+			capped = append(capped, line)
+		} else {
+			allowed = append(allowed, line)
+		}
+	}
+
+	if len(allowed) == 0 {
+		rlog(ctx).Warn().Str("uri", uri).Msg("all variants of the playlist are above the quality, the playlist is not capped")
+		return
+	}
+
+	for _, line := range capped {
+		line.Remove()
+	}
+
+	if len(capped) != 0 {
+		ctx.Locals("quality_after", quality.String())
+	}
+}
+
+// rewriteMediaPlaylist rewrites segments of the title above the quality like fbMidAppFakeQuality,
+// then every segment is balanced and signed
+func (m *App) rewriteMediaPlaylist(ctx *fiber.Ctx, playlist *media.Playlist, tsr *TitleSerieRequest,
+	uri string, quality utils.TitleQuality) (e error) {
+
+	capped := tsr.isValid() && tsr.getTitleQuality() > quality
+	if tsr.isValid() {
+		ctx.Locals("quality_before", tsr.getTitleQualityString())
+	}
+
+	if capped {
+		ctx.Locals("quality_after", quality.String())
+	}
+
+	// segments may be balanced to different clusters, all of them are logged
+	clusters := make(map[string]struct{})
+	defer func() {
+		names := make([]string, 0, len(clusters))
+		for cluster := range clusters {
+			names = append(names, cluster)
+		}
+		sort.Strings(names)
+
+		ctx.Locals("cluster", strings.Join(names, ","))
+	}()
+
+	for _, line := range playlist.Lines {
+		if line.Kind != media.LineSegment && line.Kind != media.LineMap {
+			continue
+		}
+
+		var ok bool
+		if line.Uri, ok = media.ResolveUri(uri, line.Uri); !ok {
+			continue
+		}
+
+		if capped {
+			line.Uri = m.getUriWithFakeQuality(ctx, m.newTitleSerieRequest(line.Uri), line.Uri, quality)
+		}
+
+		var cluster string
+		if line.Uri, cluster, e = m.getSegmentLocation(ctx, line.Uri); e != nil {
+			return
+		} else if cluster != "" {
+			clusters[cluster] = struct{}{}
+		}
+	}
+
+	return
+}
+
+// getSegmentLocation balances the segment with the balancer lottery and signs it with the scheme
+// of the returned cluster; X-Cache-Server is used if the segment is not balanced
+func (m *App) getSegmentLocation(ctx *fiber.Ctx, uri string) (location, cluster string, e error) {
+	srv := ctx.Locals("srv").(string)
+
+	if mpath, err := m.routes.Parse(uri); err == nil && !m.fbMidAppBalancerLottery(ctx) {
+		for _, blcr := range []balancer.Balancer{m.cloudBalancer, m.bareBalancer} {
+			var servers []*balancer.BalancerServer
+			if m.isStickyCluster(blcr) {
+				servers, err = blcr.BalanceBySession(m.getSessionKey(ctx, mpath), 1)
+			} else {
+				servers, err = blcr.BalanceByChunkN(mpath.Prefix(), mpath.ChunkName(), 1)
+			}
+
+			if err != nil {
+				rlog(ctx).Trace().Err(err).Str("cluster", blcr.GetClusterName()).Msg("could not balance playlist segment")
+				continue
+			}
+
+			if srv, e = m.getServerDestination(blcr, servers[0]); e != nil {
+				return "", "", e
+			}
+
+			cluster = blcr.GetClusterName()
+			break
+		}
+	}
+
+	location, _, e = m.getSignedLocation(ctx, srv, uri, cluster)
+	return
+}
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MindHunter86/addie/media"
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const testPlaylistMaster = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=854x480
+480/fff6d1a7.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720
+720/fff6d1a7.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5120000,RESOLUTION=1920x1080
+1080/fff6d1a7.m3u8
+`
+
+const testPlaylistMasterHD = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720
+720/fff6d1a7.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5120000,RESOLUTION=1920x1080
+1080/fff6d1a7.m3u8
+`
+
+const testPlaylistMedia = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.000,
+fff6d1a7_00001.ts
+#EXTINF:6.000,
+/videos/media/ts/9000/1/1080/fff6d1a7_00002.ts
+#EXTINF:6.000,
+https://cdn.example.org/fff6d1a7_00003.ts
+#EXT-X-ENDLIST
+`
+
+// testPlaylistResponse is the rewritten playlist with the cluster of the request
+type testPlaylistResponse struct {
+	status   int
+	playlist *media.Playlist
+	cluster  string
+}
+
+// newTestPlaylistApp returns the app with playlists of the directory and the quality of the runtime
+func newTestPlaylistApp(t *testing.T, source *playlistSource, quality utils.TitleQuality) *App {
+	t.Helper()
+
+	app := newTestBalanceApp(t, 5)
+	app.playlists = source
+	app.runtime.Config.Set(runtime.ParamQuality, quality)
+
+	return app
+}
+
+// requestTestPlaylist requests the playlist of the uri
+func (m *App) requestTestPlaylist(t *testing.T, uri string) *testPlaylistResponse {
+	t.Helper()
+
+	response := &testPlaylistResponse{}
+
+	fb := fiber.New()
+	fb.Get("/*", func(c *fiber.Ctx) error {
+		c.Locals("logger", gLog)
+		c.Locals("uid", "client")
+		c.Locals("srv", "cache-default")
+
+		e := m.fbHndAppPlaylist(c)
+		response.cluster, _ = c.Locals("cluster").(string)
+		return e
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/videos/media/playlist", nil)
+	req.Header.Set(apiHeaderUri, uri)
+
+	rsp, e := fb.Test(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if response.status = rsp.StatusCode; response.status == fiber.StatusOK {
+		if response.playlist, e = media.ParsePlaylist(rsp.Body); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	return response
+}
+
+// newTestPlaylistRoot returns the playlist-root directory with given playlists
+func newTestPlaylistRoot(t *testing.T, playlists map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for uri, playlist := range playlists {
+		name := filepath.Join(root, filepath.FromSlash(uri))
+
+		if e := os.MkdirAll(filepath.Dir(name), 0o755); e != nil {
+			t.Fatal(e)
+		} else if e = os.WriteFile(name, []byte(playlist), 0o644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	return root
+}
+
+// getTestPlaylistUris returns uris of lines of the kind
+func getTestPlaylistUris(playlist *media.Playlist, kind media.LineKind) (uris []string) {
+	for _, line := range playlist.Lines {
+		if line.Kind == kind {
+			uris = append(uris, line.Uri)
+		}
+	}
+
+	return
+}
+
+func TestPlaylistMaster(t *testing.T) {
+	root := newTestPlaylistRoot(t, map[string]string{
+		"/videos/media/ts/9000/1/master.m3u8":    testPlaylistMaster,
+		"/videos/media/ts/9000/1/master-hd.m3u8": testPlaylistMasterHD,
+	})
+
+	for _, tc := range []struct {
+		name     string
+		uri      string
+		quality  utils.TitleQuality
+		variants []string
+	}{
+		{name: "capped", uri: "/videos/media/ts/9000/1/master.m3u8", quality: utils.TitleQualityHD, variants: []string{
+			"/videos/media/ts/9000/1/480/fff6d1a7.m3u8",
+			"/videos/media/ts/9000/1/720/fff6d1a7.m3u8",
+		}},
+		{name: "not capped", uri: "/videos/media/ts/9000/1/master.m3u8", quality: utils.TitleQualityFHD, variants: []string{
+			"/videos/media/ts/9000/1/480/fff6d1a7.m3u8",
+			"/videos/media/ts/9000/1/720/fff6d1a7.m3u8",
+			"/videos/media/ts/9000/1/1080/fff6d1a7.m3u8",
+		}},
+		// the player must get any variant, so variants are kept
+		{name: "all variants above quality", uri: "/videos/media/ts/9000/1/master-hd.m3u8", quality: utils.TitleQualitySD, variants: []string{
+			"/videos/media/ts/9000/1/720/fff6d1a7.m3u8",
+			"/videos/media/ts/9000/1/1080/fff6d1a7.m3u8",
+		}},
+	} {
+		app := newTestPlaylistApp(t, &playlistSource{root: root}, tc.quality)
+
+		rsp := app.requestTestPlaylist(t, tc.uri)
+		if rsp.status != fiber.StatusOK {
+			t.Errorf("%s: got status %d", tc.name, rsp.status)
+			continue
+		}
+
+		if variants := getTestPlaylistUris(rsp.playlist, media.LineVariant); strings.Join(variants, " ") != strings.Join(tc.variants, " ") {
+			t.Errorf("%s: got variants %v, expected %v", tc.name, variants, tc.variants)
+		}
+	}
+}
+
+func TestPlaylistMedia(t *testing.T) {
+	root := newTestPlaylistRoot(t, map[string]string{
+		"/videos/media/ts/9000/1/1080/fff6d1a7.m3u8": testPlaylistMedia,
+	})
+
+	app := newTestPlaylistApp(t, &playlistSource{root: root}, utils.TitleQualityHD)
+
+	rsp := app.requestTestPlaylist(t, "/videos/media/ts/9000/1/1080/fff6d1a7.m3u8")
+	if rsp.status != fiber.StatusOK {
+		t.Fatalf("got status %d", rsp.status)
+	}
+
+	segments := getTestPlaylistUris(rsp.playlist, media.LineSegment)
+	if len(segments) != 3 {
+		t.Fatalf("got segments %v", segments)
+	}
+
+	// segments of the title are capped by the quality, balanced and signed
+	for idx, path := range []string{
+		"/videos/media/ts/9000/1/720/fff6d1a7_00001.ts",
+		"/videos/media/ts/9000/1/720/fff6d1a7_00002.ts",
+	} {
+		rrl, e := url.Parse(segments[idx])
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if rrl.Scheme != "https" || rrl.Path != path || rrl.Query().Get("expires") == "" {
+			t.Errorf("segment %s is not the signed link of %s", segments[idx], path)
+		}
+
+		if !strings.HasPrefix(rrl.Host, "cache-") || rrl.Host == "cache-default" {
+			t.Errorf("segment %s is not balanced", segments[idx])
+		}
+	}
+
+	// absolute uris are not rewritten
+	if segments[2] != "https://cdn.example.org/fff6d1a7_00003.ts" {
+		t.Errorf("absolute segment is rewritten to %s", segments[2])
+	}
+
+	if rsp.cluster != app.bareBalancer.GetClusterName() {
+		t.Errorf("got cluster %q of the playlist", rsp.cluster)
+	}
+}
+
+func TestPlaylistErrors(t *testing.T) {
+	root := newTestPlaylistRoot(t, map[string]string{
+		"/videos/media/ts/9000/1/master.m3u8": testPlaylistMaster,
+	})
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/videos/media/ts/9000/1/master.m3u8":
+			_, _ = io.WriteString(w, testPlaylistMaster)
+		case "/videos/media/ts/9000/1/invalid.m3u8":
+			_, _ = io.WriteString(w, "<html></html>")
+		case "/videos/media/ts/9000/1/failed.m3u8":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	rrl, _ := url.Parse(origin.URL)
+	fetcher := &playlistSource{origin: rrl, http: origin.Client()}
+
+	for _, tc := range []struct {
+		name   string
+		source *playlistSource
+		uri    string
+		status int
+	}{
+		{name: "root", source: &playlistSource{root: root}, uri: "/videos/media/ts/9000/1/master.m3u8", status: fiber.StatusOK},
+		{name: "root not found", source: &playlistSource{root: root}, uri: "/videos/media/ts/9000/2/master.m3u8",
+			status: fiber.StatusNotFound},
+		{name: "origin", source: fetcher, uri: "/videos/media/ts/9000/1/master.m3u8", status: fiber.StatusOK},
+		{name: "origin not found", source: fetcher, uri: "/videos/media/ts/9000/2/master.m3u8", status: fiber.StatusNotFound},
+		{name: "origin failed", source: fetcher, uri: "/videos/media/ts/9000/1/failed.m3u8", status: fiber.StatusBadGateway},
+		{name: "origin invalid", source: fetcher, uri: "/videos/media/ts/9000/1/invalid.m3u8", status: fiber.StatusBadGateway},
+		{name: "no source", source: &playlistSource{}, uri: "/videos/media/ts/9000/1/master.m3u8", status: fiber.StatusBadGateway},
+		{name: "not playlist", source: fetcher, uri: "/videos/media/ts/9000/1/1080/fff6d1a7_00001.ts",
+			status: fiber.StatusPreconditionFailed},
+	} {
+		app := newTestPlaylistApp(t, tc.source, utils.TitleQualityFHD)
+
+		if rsp := app.requestTestPlaylist(t, tc.uri); rsp.status != tc.status {
+			t.Errorf("%s: got status %d, expected %d", tc.name, rsp.status, tc.status)
+		}
+	}
+}
+
+// TestPlaylistRootTraversal checks that uris with dot segments do not leave playlist-root
+func TestPlaylistRootTraversal(t *testing.T) {
+	dir := newTestPlaylistRoot(t, map[string]string{
+		"/9000/1/secret.m3u8":           testPlaylistMaster,
+		"/root/videos/9000/1/fine.m3u8": testPlaylistMaster,
+	})
+
+	app := newTestPlaylistApp(t, &playlistSource{root: filepath.Join(dir, "root")}, utils.TitleQualityFHD)
+
+	for _, tc := range []struct {
+		uri    string
+		status int
+	}{
+		// root/../9000/1/secret.m3u8 if the uri is joined as is
+		{uri: "/videos/../../9000/1/secret.m3u8", status: fiber.StatusNotFound},
+		{uri: "/../../../9000/1/secret.m3u8", status: fiber.StatusNotFound},
+		// dot segments inside the root are resolved
+		{uri: "/videos/media/../9000/1/fine.m3u8", status: fiber.StatusOK},
+	} {
+		if rsp := app.requestTestPlaylist(t, tc.uri); rsp.status != tc.status {
+			t.Errorf("%s: got status %d, expected %d", tc.uri, rsp.status, tc.status)
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/runtime"
+)
+
+// with --http-prefork the parent process owns consul and runtime subsystems;
+// children and their parent talk over unix socket with NDJSON messages,
+// the parent listens on the socket, every child keeps one connection to it
+type preforkMessageType string
+
+const (
+	// child => parent
+	preforkMessageHello       preforkMessageType = "hello"
+	preforkMessageStats       preforkMessageType = "stats"
+	preforkMessageDigest      preforkMessageType = "digest"
+	preforkMessageTitleGet    preforkMessageType = "title_get"
+	preforkMessageTitleDelete preforkMessageType = "title_delete"
+
+	// parent => child
+	preforkMessagePatch   preforkMessageType = "patch"
+	preforkMessageServers preforkMessageType = "servers"
+	preforkMessageHealth  preforkMessageType = "health"
+	preforkMessageReply   preforkMessageType = "reply"
+
+	// both; titles fetched by children are persisted by the parent,
+	// titles prewarmed by the parent are pushed to children
+	preforkMessageTitles preforkMessageType = "titles"
+)
+
+// preforkDivergedReports - count of consecutive mismatched digests for marking a child as diverged;
+// a single mismatch is expected while a child applies the last message
+const preforkDivergedReports = 2
+
+// preforkTitlesChunk - max count of titles in the message while replaying the prewarmed cache
+const preforkTitlesChunk = 100
+
+// preforkRequestTimeout - max time of waiting for the parent's reply
+const preforkRequestTimeout = 3 * time.Second
+
+// preforkSocketEnv - the socket path of the parent, children inherit it from the parent's environment
+const preforkSocketEnv = "ADDIE_PREFORK_SOCKET"
+
+var (
+	errPreforkNotConnected = errors.New("prefork child is not connected to the parent")
+	errPreforkNoSocket     = errors.New("prefork socket is not defined in the environment, the parent is unknown")
+	errPreforkPeerForeign  = errors.New("prefork peer is not a child of the parent")
+)
+
+type (
+	preforkMessage struct {
+		Type preforkMessageType `json:"type"`
+		Pid  int                `json:"pid,omitempty"`
+
+		Stats  []*balancer.ClusterStats `json:"stats,omitempty"`
+		Digest string                   `json:"digest,omitempty"`
+
+		Patch   *runtime.RuntimePatch              `json:"patch,omitempty"`
+		Cluster string                             `json:"cluster,omitempty"`
+		Servers map[string]*balancer.UpstreamEntry `json:"servers,omitempty"`
+
+		Health *preforkHealth `json:"health,omitempty"`
+
+		// titles prewarmed by the parent and ids of invalidated ones
+		Titles      []*CachedTitle `json:"titles,omitempty"`
+		Invalidated []uint16       `json:"invalidated,omitempty"`
+
+		// requests of children and replies of the parent are matched by Request
+		Request uint64 `json:"request,omitempty"`
+		Title   uint16 `json:"title,omitempty"`
+		Found   bool   `json:"found,omitempty"`
+	}
+
+	// preforkHealth is the parent's view of children's state and consul watchers
+	preforkHealth struct {
+		Digest    string                     `json:"digest"`
+		Timestamp time.Time                  `json:"timestamp"`
+		Children  map[int]*preforkChildState `json:"children"`
+		Watchers  *consulWatchersSnapshot    `json:"watchers,omitempty"`
+	}
+	preforkChildState struct {
+		Digest     string    `json:"digest"`
+		Reported   time.Time `json:"reported"`
+		Mismatches int       `json:"mismatches"`
+		Diverged   bool      `json:"diverged"`
+	}
+
+	// preforkParent broadcasts runtime patches and server lists to children
+	// and collects children's reports
+	preforkParent struct {
+		digest func() string
+		cache  *TitlesCache
+
+		// the socket is in the private directory of the parent; peers are checked
+		// against pids of children which fiber has forked
+		dir      string
+		listener net.Listener
+		fmu      sync.RWMutex
+		forked   map[int]struct{}
+
+		mu       sync.RWMutex
+		children map[int]*preforkParentConn
+
+		// the last state for replaying to (re)connected children
+		smu     sync.RWMutex
+		servers map[string]map[string]*balancer.UpstreamEntry // cluster => upstream
+		patches map[runtime.RuntimePatchType]*runtime.RuntimePatch
+	}
+	preforkParentConn struct {
+		pid int
+
+		wmu  sync.Mutex
+		conn net.Conn
+		enc  *json.Encoder
+
+		// protected by parent's mutex
+		state    *preforkChildState
+		received time.Time
+		stats    []*balancer.ClusterStats
+	}
+
+	// preforkChild applies parent's messages and sends reports to the parent;
+	// the connection is re-established by run()
+	preforkChild struct {
+		socket    string
+		digest    func() string
+		cache     *TitlesCache
+		balancers map[string]balancer.Balancer // cluster => balancer
+		rpatcher  chan *runtime.RuntimePatch
+
+		mu   sync.Mutex
+		conn net.Conn
+		enc  *json.Encoder
+
+		// requests waiting for the parent's reply
+		rmu      sync.Mutex
+		requests map[uint64]chan *preforkMessage
+		sequence uint64
+
+		health atomic.Pointer[preforkHealth]
+	}
+)
+
+// getStateDigest returns the hash of runtime config, blocklist and balancers' upstreams;
+// the parent and children must have the same digests after applying the same messages
+func getStateDigest(rt *runtime.Runtime, balancers ...balancer.Balancer) string {
+	hash := fnv.New64a()
+	rt.Digest(hash)
+
+	for _, blcr := range balancers {
+		fmt.Fprintf(hash, "cluster %s\n", blcr.GetClusterName())
+
+		// snapshot servers are sorted by name; down servers are skipped because
+		// children connected later have never seen servers that had gone before
+		for _, server := range blcr.GetStatsSnapshot().Servers {
+			if server.IsDown {
+				continue
+			}
+
+			fmt.Fprintf(hash, "%s %s", server.Name, server.Address)
+
+			if server.State != nil {
+				fmt.Fprintf(hash, " %s %d", server.State.Mode, server.State.Until.Unix())
+			}
+
+			fmt.Fprintln(hash)
+		}
+	}
+
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// newPreforkParent listens on the socket in the new private directory; the socket path
+// is exported to the environment, so children forked by fiber inherit it
+func newPreforkParent(digest func() string, cache *TitlesCache) (_ *preforkParent, e error) {
+	parent := &preforkParent{
+		digest:   digest,
+		cache:    cache,
+		forked:   make(map[int]struct{}),
+		children: make(map[int]*preforkParentConn),
+		servers:  make(map[string]map[string]*balancer.UpstreamEntry),
+		patches:  make(map[runtime.RuntimePatchType]*runtime.RuntimePatch),
+	}
+
+	if parent.dir, e = os.MkdirTemp("", gCli.App.Name+"-prefork-"); e != nil {
+		return
+	}
+
+	// MkdirTemp creates 0700 directory, chmod guards against the wider umask tricks
+	if e = os.Chmod(parent.dir, 0700); e != nil {
+		parent.close()
+		return
+	}
+
+	path := filepath.Join(parent.dir, "prefork.sock")
+	if parent.listener, e = net.Listen("unix", path); e != nil {
+		parent.close()
+		return
+	}
+
+	if e = os.Setenv(preforkSocketEnv, path); e != nil {
+		parent.close()
+		return
+	}
+
+	gLog.Debug().Msgf("prefork parent is listening on %s", path)
+	return parent, e
+}
+
+// fork is the fiber's OnFork hook, it's called by fiber for every spawned child
+func (m *preforkParent) fork(pid int) error {
+	m.fmu.Lock()
+	defer m.fmu.Unlock()
+
+	m.forked[pid] = struct{}{}
+	return nil
+}
+
+func (m *preforkParent) isForked(pid int) bool {
+	m.fmu.RLock()
+	defer m.fmu.RUnlock()
+
+	_, ok := m.forked[pid]
+	return ok
+}
+
+func (m *preforkParent) close() {
+	if m.listener != nil {
+		m.listener.Close()
+	}
+
+	if e := os.RemoveAll(m.dir); e != nil {
+		gLog.Warn().Err(e).Msg("could not remove prefork socket directory")
+	}
+}
+
+func (m *preforkParent) serve(ctx context.Context) (e error) {
+	defer gLog.Debug().Msg("prefork parent listener has been stopped")
+
+	go func() {
+		<-ctx.Done()
+		m.close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var conn net.Conn
+		if conn, e = m.listener.Accept(); e != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// the peer is checked before any message, so foreign processes never get the state
+			pid, err := m.verifyPeer(conn)
+			if err != nil {
+				gLog.Error().Err(err).Int("pid", pid).Msg("prefork connection has been rejected")
+				conn.Close()
+				return
+			}
+
+			m.handle(ctx, conn, pid)
+		}()
+	}
+}
+
+// verifyPeer returns the peer's pid; peers of other users and processes which are not
+// forked by fiber are rejected. pid is 0 if the platform has no peer credentials,
+// the private socket directory protects the socket there
+func (m *preforkParent) verifyPeer(conn net.Conn) (pid int, e error) {
+	if pid, e = getPeerPid(conn); e != nil || pid == 0 {
+		return
+	}
+
+	// fiber calls the fork hook right after the child start, the child may be faster
+	for i := 0; i < 10 && !m.isForked(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if !m.isForked(pid) {
+		return pid, errPreforkPeerForeign
+	}
+
+	return
+}
+
+func (m *preforkParent) handle(ctx context.Context, conn net.Conn, pid int) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	child := &preforkParentConn{
+		conn:  conn,
+		enc:   json.NewEncoder(conn),
+		state: &preforkChildState{},
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var msg *preforkMessage
+		if e := dec.Decode(&msg); e != nil {
+			if ctx.Err() == nil {
+				gLog.Debug().Err(e).Int("pid", child.pid).Msg("prefork child connection has been closed")
+			}
+
+			break
+		}
+
+		switch msg.Type {
+		case preforkMessageHello:
+			// verified pid has priority over the reported one
+			if child.pid = msg.Pid; pid != 0 {
+				child.pid = pid
+			}
+
+			m.mu.Lock()
+			m.children[child.pid] = child
+			m.mu.Unlock()
+
+			gLog.Info().Int("pid", child.pid).Msg("prefork child has been connected, replaying the current state")
+			m.replay(child)
+		case preforkMessageStats:
+			m.mu.Lock()
+			child.received, child.stats = time.Now(), msg.Stats
+			m.mu.Unlock()
+		case preforkMessageDigest:
+			m.checkDigest(child, msg.Digest)
+		case preforkMessageTitles:
+			for _, title := range msg.Titles {
+				m.cache.PushTitle(title)
+			}
+		case preforkMessageTitleGet:
+			reply := &preforkMessage{Type: preforkMessageReply, Request: msg.Request}
+			if title, _ := m.cache.Get(msg.Title); title != nil {
+				reply.Titles, reply.Found = []*CachedTitle{title}, true
+			}
+
+			child.send(reply)
+		case preforkMessageTitleDelete:
+			// the reply follows the broadcast, so the requester has applied the invalidation before the reply
+			found := m.cache.Delete(msg.Title)
+			m.broadcastTitles(nil, []uint16{msg.Title})
+
+			child.send(&preforkMessage{Type: preforkMessageReply, Request: msg.Request, Found: found})
+		default:
+			gLog.Warn().Msgf("undefined prefork message received from %d - %s", msg.Pid, msg.Type)
+		}
+	}
+
+	m.mu.Lock()
+	if m.children[child.pid] == child {
+		delete(m.children, child.pid)
+	}
+	m.mu.Unlock()
+}
+
+// checkDigest compares child's state with the parent's one; diverged children
+// get the full state again and all children get the updated health
+func (m *preforkParent) checkDigest(child *preforkParentConn, digest string) {
+	pdigest := m.digest()
+
+	m.mu.Lock()
+	state := child.state
+	state.Digest, state.Reported = digest, time.Now()
+
+	if digest == pdigest {
+		state.Mismatches, state.Diverged = 0, false
+	} else {
+		state.Mismatches++
+		state.Diverged = state.Mismatches >= preforkDivergedReports
+	}
+
+	diverged := state.Diverged
+	health := m.getHealth(pdigest)
+	m.mu.Unlock()
+
+	if diverged {
+		gLog.Error().Int("pid", child.pid).Str("digest", digest).Str("parent_digest", pdigest).
+			Msg("prefork child has diverged from the parent, replaying the current state")
+		m.replay(child)
+	}
+
+	m.broadcast(&preforkMessage{Type: preforkMessageHealth, Health: health})
+}
+
+// getHealth must be called under the parent's mutex
+func (m *preforkParent) getHealth(digest string) *preforkHealth {
+	health := &preforkHealth{
+		Digest:    digest,
+		Timestamp: time.Now(),
+		Children:  make(map[int]*preforkChildState, len(m.children)),
+		Watchers:  gConsul.watchers.snapshot(),
+	}
+
+	for pid, child := range m.children {
+		state := *child.state
+		health.Children[pid] = &state
+	}
+
+	return health
+}
+
+func (m *preforkParent) replay(child *preforkParentConn) {
+	m.smu.RLock()
+	defer m.smu.RUnlock()
+
+	for cluster, servers := range m.servers {
+		child.send(&preforkMessage{Type: preforkMessageServers, Cluster: cluster, Servers: servers})
+	}
+
+	for _, patch := range m.patches {
+		child.send(&preforkMessage{Type: preforkMessagePatch, Patch: patch})
+	}
+
+	// the prewarmer runs in the parent only, its cache is the source of warm titles
+	titles := m.cache.GetFreshTitles()
+	for len(titles) != 0 {
+		n := len(titles)
+		if n > preforkTitlesChunk {
+			n = preforkTitlesChunk
+		}
+
+		child.send(&preforkMessage{Type: preforkMessageTitles, Titles: titles[:n]})
+		titles = titles[n:]
+	}
+}
+
+func (m *preforkParent) broadcastServers(cluster string, servers map[string]*balancer.UpstreamEntry) {
+	m.smu.Lock()
+	m.servers[cluster] = servers
+	m.smu.Unlock()
+
+	m.broadcast(&preforkMessage{Type: preforkMessageServers, Cluster: cluster, Servers: servers})
+}
+
+func (m *preforkParent) broadcastPatch(patch *runtime.RuntimePatch) {
+	m.smu.Lock()
+	m.patches[patch.Type] = patch
+	m.smu.Unlock()
+
+	m.broadcast(&preforkMessage{Type: preforkMessagePatch, Patch: patch})
+}
+
+func (m *preforkParent) broadcastTitles(titles []*CachedTitle, invalidated []uint16) {
+	if len(titles) == 0 && len(invalidated) == 0 {
+		return
+	}
+
+	m.broadcast(&preforkMessage{Type: preforkMessageTitles, Titles: titles, Invalidated: invalidated})
+}
+
+func (m *preforkParent) broadcast(msg *preforkMessage) {
+	m.mu.RLock()
+	children := make([]*preforkParentConn, 0, len(m.children))
+	for _, child := range m.children {
+		children = append(children, child)
+	}
+	m.mu.RUnlock()
+
+	for _, child := range children {
+		child.send(msg)
+	}
+}
+
+// getChildrenStats returns children's snapshots received not earlier than since
+func (m *preforkParent) getChildrenStats(since time.Time) (stats map[string][]*balancer.ClusterStats) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats = make(map[string][]*balancer.ClusterStats)
+	for _, child := range m.children {
+		if child.received.Before(since) {
+			continue
+		}
+
+		for _, cstats := range child.stats {
+			stats[cstats.Cluster] = append(stats[cstats.Cluster], cstats)
+		}
+	}
+
+	return
+}
+
+func (m *preforkParentConn) send(msg *preforkMessage) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	// a broken connection is closed by the reader in handle()
+	if e := m.conn.SetWriteDeadline(time.Now().Add(time.Second)); e != nil {
+		gLog.Warn().Err(e).Int("pid", m.pid).Msgf("could not set write deadline for %s message to prefork child", msg.Type)
+		return
+	}
+
+	if e := m.enc.Encode(msg); e != nil {
+		gLog.Warn().Err(e).Int("pid", m.pid).Msgf("could not send %s message to prefork child", msg.Type)
+	}
+}
+
+func newPreforkChild(digest func() string, rpatcher chan *runtime.RuntimePatch, cache *TitlesCache,
+	balancers ...balancer.Balancer) (_ *preforkChild, e error) {
+	child := &preforkChild{
+		socket:    os.Getenv(preforkSocketEnv),
+		digest:    digest,
+		cache:     cache,
+		balancers: make(map[string]balancer.Balancer, len(balancers)),
+		rpatcher:  rpatcher,
+		requests:  make(map[uint64]chan *preforkMessage),
+	}
+
+	for _, blcr := range balancers {
+		child.balancers[blcr.GetClusterName()] = blcr
+	}
+
+	if child.socket == "" {
+		return nil, errPreforkNoSocket
+	}
+
+	return child, e
+}
+
+// run keeps the connection to the parent and reports child's digest every interval
+func (m *preforkChild) run(ctx context.Context, interval time.Duration) {
+	gLog.Debug().Msg("prefork child listener started")
+	defer gLog.Debug().Msg("prefork child listener stopped")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if e := m.send(&preforkMessage{Type: preforkMessageDigest, Digest: m.digest()}); e != nil {
+					gLog.Debug().Err(e).Msg("could not send digest to the prefork parent")
+				}
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if e := m.listen(ctx); e != nil && ctx.Err() == nil {
+			gLog.Warn().Err(e).Msg("prefork parent connection has been lost, reconnecting...")
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (m *preforkChild) listen(ctx context.Context) (e error) {
+	var conn net.Conn
+	if conn, e = net.DialTimeout("unix", m.socket, time.Second); e != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.conn, m.enc = conn, json.NewEncoder(conn)
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.conn.Close()
+		m.conn, m.enc = nil, nil
+		m.mu.Unlock()
+
+		// replies of pending requests are lost with the connection
+		m.rmu.Lock()
+		for id, reply := range m.requests {
+			close(reply)
+			delete(m.requests, id)
+		}
+		m.rmu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if e = m.send(&preforkMessage{Type: preforkMessageHello}); e != nil {
+		return
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var msg *preforkMessage
+		if e = dec.Decode(&msg); e != nil {
+			return
+		}
+
+		switch msg.Type {
+		case preforkMessagePatch:
+			if msg.Patch == nil {
+				continue
+			}
+
+			select {
+			case m.rpatcher <- msg.Patch:
+			case <-ctx.Done():
+				return
+			}
+		case preforkMessageServers:
+			if blcr, ok := m.balancers[msg.Cluster]; ok {
+				blcr.UpdateServers(msg.Servers)
+			} else {
+				gLog.Warn().Msgf("prefork parent sent servers of undefined cluster %s", msg.Cluster)
+			}
+		case preforkMessageHealth:
+			m.health.Store(msg.Health)
+		case preforkMessageTitles:
+			for _, title := range msg.Titles {
+				m.cache.PushTitle(title)
+			}
+
+			for _, tid := range msg.Invalidated {
+				m.cache.Delete(tid)
+			}
+		case preforkMessageReply:
+			m.rmu.Lock()
+			if reply, ok := m.requests[msg.Request]; ok {
+				reply <- msg
+				delete(m.requests, msg.Request)
+			}
+			m.rmu.Unlock()
+		default:
+			gLog.Warn().Msgf("undefined prefork message received from the parent - %s", msg.Type)
+		}
+	}
+}
+
+func (m *preforkChild) send(msg *preforkMessage) (e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return errPreforkNotConnected
+	}
+
+	msg.Pid = os.Getpid()
+
+	if e = m.conn.SetWriteDeadline(time.Now().Add(time.Second)); e != nil {
+		return
+	}
+
+	return m.enc.Encode(msg)
+}
+
+// request sends the message to the parent and waits for its reply
+func (m *preforkChild) request(ctx context.Context, msg *preforkMessage) (_ *preforkMessage, e error) {
+	reply := make(chan *preforkMessage, 1)
+
+	m.rmu.Lock()
+	m.sequence++
+	msg.Request = m.sequence
+	m.requests[msg.Request] = reply
+	m.rmu.Unlock()
+
+	defer func() {
+		m.rmu.Lock()
+		delete(m.requests, msg.Request)
+		m.rmu.Unlock()
+	}()
+
+	if e = m.send(msg); e != nil {
+		return
+	}
+
+	select {
+	case buf, ok := <-reply:
+		if !ok {
+			return nil, errPreforkNotConnected
+		}
+
+		return buf, e
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getTitle returns the title of the parent's cache; children forward fetched titles to the parent,
+// so the parent's cache is the same for all children
+func (m *preforkChild) getTitle(ctx context.Context, tid uint16) (_ *CachedTitle, e error) {
+	var reply *preforkMessage
+	if reply, e = m.request(ctx, &preforkMessage{Type: preforkMessageTitleGet, Title: tid}); e != nil {
+		return
+	} else if !reply.Found || len(reply.Titles) == 0 {
+		return nil, e
+	}
+
+	return reply.Titles[0], e
+}
+
+// deleteTitle invalidates the title in the parent and all children; found is true
+// if the parent has had the title
+func (m *preforkChild) deleteTitle(ctx context.Context, tid uint16) (found bool, e error) {
+	var reply *preforkMessage
+	if reply, e = m.request(ctx, &preforkMessage{Type: preforkMessageTitleDelete, Title: tid}); e != nil {
+		return
+	}
+
+	return reply.Found, e
+}
+
+// pushTitle forwards the title fetched by the child to the parent, which persists it
+func (m *preforkChild) pushTitle(title *CachedTitle) {
+	if e := m.send(&preforkMessage{Type: preforkMessageTitles, Titles: []*CachedTitle{title}}); e != nil {
+		gLog.Debug().Err(e).Uint16("tid", title.Id).Msg("could not forward title to the prefork parent")
+	}
+}
+
+// getHealth returns the last parent's view of children
+func (m *preforkChild) getHealth() *preforkHealth {
+	return m.health.Load()
+}
+
+// isStale reports if the parent has not sent health reports for a while
+func (m *preforkHealth) isStale() bool {
+	return time.Since(m.Timestamp) > preforkDivergedReports*2*gCli.Duration("http-prefork-check-interval")
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+var errPreforkPeerUnix = errors.New("prefork peer connection is not a unix socket")
+
+// getPeerPid returns the pid of the unix socket peer by SO_PEERCRED;
+// peers of other users are rejected
+func getPeerPid(conn net.Conn) (pid int, e error) {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, errPreforkPeerUnix
+	}
+
+	var raw syscall.RawConn
+	if raw, e = uconn.SyscallConn(); e != nil {
+		return
+	}
+
+	var cred *syscall.Ucred
+	var err error
+	if e = raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); e != nil {
+		return
+	} else if err != nil {
+		return 0, err
+	}
+
+	if int(cred.Uid) != os.Getuid() {
+		return int(cred.Pid), fmt.Errorf("%w; peer uid %d differs from the parent's one", errPreforkPeerForeign, cred.Uid)
+	}
+
+	return int(cred.Pid), e
+}
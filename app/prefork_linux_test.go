@@ -0,0 +1,48 @@
+//go:build linux
+
+package app
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/runtime"
+)
+
+// TestPreforkForeignPeer checks that processes which are not forked by fiber get nothing
+func TestPreforkForeignPeer(t *testing.T) {
+	parent := newTestPreforkParent(t)
+	parent.broadcastPatch(&runtime.RuntimePatch{Type: runtime.RuntimePatchLottery, Patch: []byte("10")})
+
+	conn, e := net.Dial("unix", os.Getenv(preforkSocketEnv))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	if e = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); e != nil {
+		t.Fatal(e)
+	}
+
+	// the connection is closed without any message
+	if n, e := conn.Read(make([]byte, 1)); n != 0 || e == nil || errors.Is(e, os.ErrDeadlineExceeded) {
+		t.Errorf("foreign peer got %d bytes, %v", n, e)
+	}
+
+	if parent.isConnected(os.Getpid()) {
+		t.Error("foreign peer is connected")
+	}
+}
+
+func TestGetPeerPid(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if _, e := getPeerPid(server); !errors.Is(e, errPreforkPeerUnix) {
+		t.Errorf("expected errPreforkPeerUnix, got %v", e)
+	}
+}
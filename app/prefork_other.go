@@ -0,0 +1,11 @@
+//go:build !linux
+
+package app
+
+import "net"
+
+// getPeerPid - there are no portable peer credentials, peers are not checked;
+// the socket is protected by the private directory of the parent
+func getPeerPid(net.Conn) (int, error) {
+	return 0, nil
+}
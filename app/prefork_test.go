@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/runtime"
+)
+
+type testPreforkParent struct {
+	*preforkParent
+
+	mu     sync.Mutex
+	digest string
+}
+
+func (m *testPreforkParent) setDigest(digest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.digest = digest
+}
+
+func (m *testPreforkParent) getDigest() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.digest
+}
+
+// newTestPreforkParent serves the socket in the private directory and exports it to the environment
+func newTestPreforkParent(t *testing.T) *testPreforkParent {
+	t.Helper()
+
+	t.Setenv(preforkSocketEnv, "")
+	setTestCliContext(t, nil)
+
+	previous := gConsul
+	t.Cleanup(func() { gConsul = previous })
+	gConsul = &consulClient{watchers: newConsulWatchers("cache-node-internal")}
+
+	parent := &testPreforkParent{digest: "parent"}
+
+	var e error
+	if parent.preforkParent, e = newPreforkParent(parent.getDigest, newTestTitlesCache(t)); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if err := parent.serve(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return parent
+}
+
+type testPreforkChild struct {
+	*preforkChild
+
+	balancer *balancer.ClusterBalancer
+	patches  chan *runtime.RuntimePatch
+	done     chan error
+}
+
+// newTestPreforkChild connects to the parent of the environment's socket
+func newTestPreforkChild(t *testing.T) *testPreforkChild {
+	t.Helper()
+
+	child := &testPreforkChild{
+		balancer: newTestBalancer(t),
+		patches:  make(chan *runtime.RuntimePatch, 16),
+		done:     make(chan error, 1),
+	}
+
+	var e error
+	if child.preforkChild, e = newPreforkChild(func() string { return "child" }, child.patches,
+		newTestTitlesCache(t), child.balancer); e != nil {
+		t.Fatal(e)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { child.done <- child.listen(ctx) }()
+
+	t.Cleanup(cancel)
+	return child
+}
+
+func newTestTitlesCache(t *testing.T) *TitlesCache {
+	t.Helper()
+
+	cache, e := NewTitlesCache(100, time.Hour, time.Minute, time.Hour, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return cache
+}
+
+// waitFor polls the condition, prefork messages are applied by children asynchronously
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for %s", what)
+		}
+	}
+}
+
+// receivePatches returns patches which has been pushed to the child's runtime
+func (m *testPreforkChild) receivePatches() map[runtime.RuntimePatchType]string {
+	patches := make(map[runtime.RuntimePatchType]string)
+	for {
+		select {
+		case patch := <-m.patches:
+			patches[patch.Type] = string(patch.Patch)
+		default:
+			return patches
+		}
+	}
+}
+
+func (m *preforkParent) isConnected(pid int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.children[pid]
+	return ok
+}
+
+// TestPreforkHandshake checks that the connected child gets the last servers,
+// the last patch of every type and prewarmed titles of the parent
+func TestPreforkHandshake(t *testing.T) {
+	parent := newTestPreforkParent(t)
+
+	if socket := os.Getenv(preforkSocketEnv); socket == "" {
+		t.Fatal("socket is not exported to the environment")
+	}
+
+	if info, e := os.Stat(parent.dir); e != nil {
+		t.Fatal(e)
+	} else if info.Mode().Perm() != 0700 {
+		t.Fatalf("socket directory has mode %v", info.Mode())
+	}
+
+	parent.broadcastServers("cache-node-internal", map[string]*balancer.UpstreamEntry{
+		"10.0.0.1": {Name: "node-001", Ip: net.ParseIP("10.0.0.1")},
+	})
+	parent.broadcastServers("cache-node-internal", map[string]*balancer.UpstreamEntry{
+		"10.0.0.2": {Name: "node-002", Ip: net.ParseIP("10.0.0.2")},
+	})
+	parent.broadcastPatch(&runtime.RuntimePatch{Type: runtime.RuntimePatchLottery, Patch: []byte("10")})
+	parent.broadcastPatch(&runtime.RuntimePatch{Type: runtime.RuntimePatchQuality, Patch: []byte("480")})
+	parent.broadcastPatch(&runtime.RuntimePatch{Type: runtime.RuntimePatchLottery, Patch: []byte("20")})
+	parent.cache.PushSeries(9000, 1, []*TitleSerie{{Serie: 1}})
+
+	// the test process is the child of fiber
+	if e := parent.fork(os.Getpid()); e != nil {
+		t.Fatal(e)
+	}
+
+	child := newTestPreforkChild(t)
+	waitFor(t, "the child's hello", func() bool { return parent.isConnected(os.Getpid()) })
+	waitFor(t, "replayed titles", func() bool { title, _ := child.cache.Get(9000); return title != nil })
+
+	if !child.balancer.HasServer("node-002") || child.balancer.HasServer("node-001") {
+		t.Error("the last servers of the cluster are not replayed")
+	}
+
+	patches := child.receivePatches()
+	if len(patches) != 2 || patches[runtime.RuntimePatchLottery] != "20" || patches[runtime.RuntimePatchQuality] != "480" {
+		t.Errorf("got replayed patches %v", patches)
+	}
+
+	// broadcasts after the handshake
+	parent.broadcastTitles(nil, []uint16{9000})
+	waitFor(t, "invalidated title", func() bool { title, _ := child.cache.Get(9000); return title == nil })
+}
+
+// TestPreforkDigestResync checks that the child is marked as diverged after consecutive
+// mismatched digests and it gets the full state again
+func TestPreforkDigestResync(t *testing.T) {
+	parent := newTestPreforkParent(t)
+	parent.broadcastPatch(&runtime.RuntimePatch{Type: runtime.RuntimePatchLottery, Patch: []byte("10")})
+
+	if e := parent.fork(os.Getpid()); e != nil {
+		t.Fatal(e)
+	}
+
+	child := newTestPreforkChild(t)
+	waitFor(t, "the replayed patch", func() bool { return len(child.patches) == 1 })
+	child.receivePatches()
+
+	pid := os.Getpid()
+	report := func(digest string, mismatches int) *preforkChildState {
+		t.Helper()
+
+		if e := child.send(&preforkMessage{Type: preforkMessageDigest, Digest: digest}); e != nil {
+			t.Fatal(e)
+		}
+
+		// the health is broadcasted after the replay, so the child has got replayed messages
+		var state *preforkChildState
+		waitFor(t, "the health report", func() bool {
+			if health := child.getHealth(); health != nil && health.Children[pid] != nil {
+				state = health.Children[pid]
+				return state.Digest == digest && state.Mismatches == mismatches
+			}
+
+			return false
+		})
+
+		return state
+	}
+
+	// a single mismatch is expected while the child applies the last message
+	if state := report("stale", 1); state.Diverged || len(child.receivePatches()) != 0 {
+		t.Fatalf("the child is resynced after the single mismatch - %+v", state)
+	}
+
+	if state := report("stale", 2); !state.Diverged {
+		t.Fatalf("the child is not diverged after consecutive mismatches - %+v", state)
+	}
+
+	if patches := child.receivePatches(); patches[runtime.RuntimePatchLottery] != "10" {
+		t.Errorf("the diverged child is not resynced, got patches %v", patches)
+	}
+
+	if state := report("parent", 0); state.Diverged {
+		t.Errorf("the child is diverged after the matched digest - %+v", state)
+	}
+
+	if health := child.getHealth(); health.Digest != "parent" || len(health.Children) != 1 {
+		t.Errorf("got health %+v", health)
+	}
+}
+
+// TestPreforkTitleRequests checks that children read and delete titles of the parent's cache
+// and forward fetched titles to it
+func TestPreforkTitleRequests(t *testing.T) {
+	parent := newTestPreforkParent(t)
+	parent.cache.PushSeries(9000, 1, []*TitleSerie{{Title: 9000, Serie: 1}})
+
+	if e := parent.fork(os.Getpid()); e != nil {
+		t.Fatal(e)
+	}
+
+	child := newTestPreforkChild(t)
+	waitFor(t, "replayed titles", func() bool { title, _ := child.cache.Get(9000); return title != nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), preforkRequestTimeout)
+	defer cancel()
+
+	if title, e := child.getTitle(ctx, 9000); e != nil || title == nil || title.Series[1] == nil {
+		t.Errorf("got title %+v, %v from the parent", title, e)
+	}
+
+	if title, e := child.getTitle(ctx, 9001); e != nil || title != nil {
+		t.Errorf("got title %+v, %v for the unknown title", title, e)
+	}
+
+	// the parent replies after the invalidation has been sent to all children
+	if found, e := child.deleteTitle(ctx, 9000); e != nil || !found {
+		t.Errorf("got %t, %v for the title deletion", found, e)
+	}
+
+	if title, _ := parent.cache.Get(9000); title != nil {
+		t.Error("the title is not deleted from the parent's cache")
+	}
+
+	if title, _ := child.cache.Get(9000); title != nil {
+		t.Error("the title is not invalidated in the child before the reply")
+	}
+
+	if found, e := child.deleteTitle(ctx, 9000); e != nil || found {
+		t.Errorf("got %t, %v for the second deletion", found, e)
+	}
+
+	child.pushTitle(child.cache.PushMissing(9002))
+	waitFor(t, "the forwarded title", func() bool { title, _ := parent.cache.Get(9002); return title != nil && title.Missing })
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	errPrewarmInvalidLimit    = errors.New("title-prewarm-limit must be positive")
+	errPrewarmInvalidInterval = errors.New("title-prewarm-interval must not be negative")
+)
+
+// titlesPrewarmer polls the api updates or the local feed file and pushes new and changed
+// titles to the cache, so the first viewers of the new episode do not wait for the api;
+// with prefork it runs in the parent only, pushed titles are broadcasted to children
+type titlesPrewarmer struct {
+	app *App
+
+	feed     string
+	limit    int
+	interval time.Duration
+
+	// since - the latest updated time of polled titles, only newer titles are requested;
+	// it starts from the previous interval, older titles are requested lazily by the first chunk,
+	// so restarts do not page through the whole api catalog
+	since uint64
+}
+
+func newTitlesPrewarmer(app *App) (_ *titlesPrewarmer, e error) {
+	prewarmer := &titlesPrewarmer{
+		app:      app,
+		feed:     gCli.String("title-prewarm-feed"),
+		limit:    gCli.Int("title-prewarm-limit"),
+		interval: gCli.Duration("title-prewarm-interval"),
+	}
+
+	if prewarmer.limit <= 0 {
+		return nil, errPrewarmInvalidLimit
+	} else if prewarmer.interval < 0 {
+		return nil, errPrewarmInvalidInterval
+	}
+
+	if since := time.Now().Add(-prewarmer.interval).Unix(); since > 0 {
+		prewarmer.since = uint64(since)
+	}
+
+	return prewarmer, e
+}
+
+func (m *titlesPrewarmer) Run(ctx context.Context) {
+	if m.interval == 0 {
+		gLog.Info().Msg("titles prewarming is disabled")
+		return
+	}
+
+	gLog.Debug().Msg("titles prewarmer started")
+	defer gLog.Debug().Msg("titles prewarmer stopped")
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.prewarm()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *titlesPrewarmer) prewarm() {
+	var titles []*Title
+	var e error
+
+	if m.feed != "" {
+		titles, e = m.readFeed()
+	} else {
+		titles, e = m.getUpdates()
+	}
+
+	if e != nil {
+		gLog.Warn().Err(e).Msg("could not get title updates for prewarming")
+		return
+	}
+
+	var pushed []*CachedTitle
+	var invalidated []uint16
+
+	for _, title := range titles {
+		if title == nil || title.Id == 0 {
+			continue
+		}
+
+		if title.Updated > m.since {
+			m.since = title.Updated
+		}
+
+		cached, _ := m.app.cache.Get(title.Id)
+		if cached != nil && !cached.Missing && cached.LastChange == title.LastChange {
+			continue
+		}
+
+		// titles without the player are requested lazily by the first chunk
+		if title.Player == nil {
+			if cached != nil && m.app.cache.Delete(title.Id) {
+				invalidated = append(invalidated, title.Id)
+			}
+			continue
+		}
+
+		pushed = append(pushed,
+			m.app.cache.PushSeries(title.Id, title.LastChange, m.app.validateTitleFromApiResponse(title)))
+	}
+
+	if gPreforkParent != nil {
+		gPreforkParent.broadcastTitles(pushed, invalidated)
+	}
+
+	gLog.Debug().Int("titles", len(titles)).Int("pushed", len(pushed)).Int("invalidated", len(invalidated)).
+		Msg("titles cache has been prewarmed")
+}
+
+// getUpdates returns titles updated since the previous poll; the api returns the last updated
+// titles first, so pages are requested until the short one, otherwise titles of the capped page
+// older than the advanced since are never polled
+func (m *titlesPrewarmer) getUpdates() (titles []*Title, e error) {
+	for {
+		params := []interface{}{
+			[]string{"limit", strconv.Itoa(m.limit)},
+			[]string{"after", strconv.Itoa(len(titles))},
+		}
+
+		if m.since != 0 {
+			params = append(params, []string{"since", strconv.FormatUint(m.since, 10)})
+		}
+
+		var page []*Title
+		if e = gAniApi.getApiResponse(nil, http.MethodGet, apiMethodGetUpdates, params...).parseApiResponse(&page); e != nil {
+			return nil, e
+		}
+
+		if titles = append(titles, page...); len(page) == 0 || len(page) < m.limit {
+			return
+		}
+	}
+}
+
+// readFeed reads the feed file in the getUpdates response format; all titles are returned,
+// unchanged ones are skipped by last_change
+func (m *titlesPrewarmer) readFeed() (titles []*Title, e error) {
+	var buf []byte
+	if buf, e = os.ReadFile(m.feed); e != nil {
+		return
+	}
+
+	e = json.Unmarshal(buf, &titles)
+	return
+}
@@ -0,0 +1,191 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// testUpdatesApi serves getUpdates like the api - the last updated titles first, filtered by since
+// and paged by limit and after
+type testUpdatesApi struct {
+	mu     sync.Mutex
+	titles []*Title
+	fail   int // the page which responds with the error, 0 - none
+
+	requests int
+}
+
+func (m *testUpdatesApi) push(tid uint16, updated uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.titles = append(m.titles, &Title{Id: tid, Updated: updated, LastChange: updated, Player: &Player{}})
+}
+
+func (m *testUpdatesApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests++; m.requests == m.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	after, _ := strconv.Atoi(query.Get("after"))
+	since, _ := strconv.ParseUint(query.Get("since"), 10, 64)
+
+	var titles []*Title
+	for _, title := range m.titles {
+		if title.Updated > since {
+			titles = append(titles, title)
+		}
+	}
+
+	sort.Slice(titles, func(i, j int) bool { return titles[i].Updated > titles[j].Updated })
+
+	if after > len(titles) {
+		after = len(titles)
+	}
+	if titles = titles[after:]; len(titles) > limit {
+		titles = titles[:limit]
+	}
+
+	_ = json.NewEncoder(w).Encode(titles)
+}
+
+func newTestPrewarmer(t *testing.T, api *testUpdatesApi, limit int) *titlesPrewarmer {
+	t.Helper()
+
+	setTestCliContext(t, nil)
+
+	previousApi, previousParent := gAniApi, gPreforkParent
+	t.Cleanup(func() { gAniApi, gPreforkParent = previousApi, previousParent })
+
+	gAniApi, gPreforkParent = newTestApiClient(t, api), nil
+
+	return &titlesPrewarmer{app: &App{cache: newTestTitlesCache(t)}, limit: limit}
+}
+
+// TestPrewarmPaging checks that titles of capped pages are not skipped by the advanced since
+func TestPrewarmPaging(t *testing.T) {
+	api := &testUpdatesApi{}
+	for tid := uint16(1); tid <= 5; tid++ {
+		api.push(tid, uint64(tid))
+	}
+
+	prewarmer := newTestPrewarmer(t, api, 2)
+
+	prewarmer.prewarm()
+	if prewarmer.since != 5 || prewarmer.app.cache.Len() != 5 || api.requests != 3 {
+		t.Fatalf("got since %d, %d titles by %d requests, expected 5, 5 by 3", prewarmer.since, prewarmer.app.cache.Len(), api.requests)
+	}
+
+	// more updates than the limit between polls
+	for tid := uint16(6); tid <= 9; tid++ {
+		api.push(tid, uint64(tid))
+	}
+
+	api.requests = 0
+	prewarmer.prewarm()
+
+	if prewarmer.since != 9 || prewarmer.app.cache.Len() != 9 || api.requests != 3 {
+		t.Errorf("got since %d, %d titles by %d requests, expected 9, 9 by 3", prewarmer.since, prewarmer.app.cache.Len(), api.requests)
+	}
+
+	for tid := uint16(6); tid <= 9; tid++ {
+		if title, _ := prewarmer.app.cache.Get(tid); title == nil {
+			t.Errorf("updated title %d is not prewarmed", tid)
+		}
+	}
+
+	// nothing is updated, the empty page is the last one
+	api.requests = 0
+	if prewarmer.prewarm(); prewarmer.since != 9 || api.requests != 1 {
+		t.Errorf("got since %d by %d requests without updates", prewarmer.since, api.requests)
+	}
+}
+
+// TestPrewarmPagingError checks that since is not advanced if any page is failed
+func TestPrewarmPagingError(t *testing.T) {
+	api := &testUpdatesApi{fail: 2}
+	for tid := uint16(1); tid <= 5; tid++ {
+		api.push(tid, uint64(tid))
+	}
+
+	prewarmer := newTestPrewarmer(t, api, 2)
+
+	if prewarmer.prewarm(); prewarmer.since != 0 || prewarmer.app.cache.Len() != 0 {
+		t.Errorf("got since %d and %d titles after the failed page", prewarmer.since, prewarmer.app.cache.Len())
+	}
+
+	// the next poll requests all pages again
+	if prewarmer.prewarm(); prewarmer.since != 5 || prewarmer.app.cache.Len() != 5 {
+		t.Errorf("got since %d and %d titles after the retry", prewarmer.since, prewarmer.app.cache.Len())
+	}
+}
+
+// TestNewTitlesPrewarmer checks the validation of the limit and the interval and the initial since which
+// keeps the first poll from paging through the whole catalog
+func TestNewTitlesPrewarmer(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		setTestCliContext(t, []cli.Flag{
+			&cli.IntFlag{Name: "title-prewarm-limit", Value: limit},
+			&cli.DurationFlag{Name: "title-prewarm-interval", Value: time.Minute},
+		})
+
+		if _, e := newTitlesPrewarmer(&App{}); !errors.Is(e, errPrewarmInvalidLimit) {
+			t.Errorf("limit %d: got %v", limit, e)
+		}
+	}
+
+	// 0 disables the prewarmer
+	for interval, expected := range map[time.Duration]error{0: nil, -time.Minute: errPrewarmInvalidInterval} {
+		setTestCliContext(t, []cli.Flag{
+			&cli.IntFlag{Name: "title-prewarm-limit", Value: 50},
+			&cli.DurationFlag{Name: "title-prewarm-interval", Value: interval},
+		})
+
+		if _, e := newTitlesPrewarmer(&App{}); !errors.Is(e, expected) {
+			t.Errorf("interval %s: got %v", interval, e)
+		}
+	}
+
+	api := &testUpdatesApi{}
+	now := uint64(time.Now().Unix())
+
+	// the catalog is older than the interval
+	for tid := uint16(1); tid <= 10; tid++ {
+		api.push(tid, now-uint64(tid)*3600)
+	}
+	api.push(100, now-30)
+
+	prewarmer := newTestPrewarmer(t, api, 2)
+	setTestCliContext(t, []cli.Flag{
+		&cli.IntFlag{Name: "title-prewarm-limit", Value: 2},
+		&cli.DurationFlag{Name: "title-prewarm-interval", Value: time.Minute},
+	})
+
+	seeded, e := newTitlesPrewarmer(prewarmer.app)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if since := now - 60; seeded.since < since || seeded.since > since+5 {
+		t.Fatalf("got since %d, expected about %d", seeded.since, since)
+	}
+
+	seeded.prewarm()
+	if title, _ := seeded.app.cache.Get(100); title == nil || seeded.app.cache.Len() != 1 || api.requests != 1 {
+		t.Errorf("got %d titles by %d requests, expected the updated title by 1 request", seeded.app.cache.Len(), api.requests)
+	}
+}
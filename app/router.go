@@ -7,10 +7,12 @@ import (
 	"io"
 	"os"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/tracing"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
@@ -55,92 +57,65 @@ func (m *App) fiberConfigure() {
 	m.fb.Use(requestid.New())
 
 	// prefixed logger initialization
-	// - we send logs in syslog and stdout by default,
-	// - but if access-log-stdout is 0 we use syslog output only
+	// - access records are written by access log subsystem, see accessLogRecord(),
+	// - if access-log-stdout is 0 request logs are discarded
 	m.fb.Use(func(c *fiber.Ctx) error {
 		logger := gLog.With().Str("id", c.Locals("requestid").(string)).Logger().
 			Level(m.runtime.Config.Get(runtime.ParamAccessLevel).(zerolog.Level))
-		syslogger := logger.Output(m.syslogWriter)
 
 		if m.runtime.Config.Get(runtime.ParamAccessStdout).(int) == 0 {
 			logger = logger.Output(io.Discard)
 		}
 
 		c.Locals("logger", &logger)
-		c.Locals("syslogger", &syslogger)
 		return c.Next()
 	})
 
-	// time collector + logger
+	// tracer + time collector + logger
+	// - the root span continues the trace of nginx's traceparent header,
+	// - stages of the root span are laps of lapRequestTimer(), see requestTimerStages
 	m.fb.Use(func(c *fiber.Ctx) (e error) {
-		if !strings.HasPrefix(c.Path(), "/videos/media/ts") &&
-			!strings.HasPrefix(c.Path(), "/api/balancer/cluster") {
+		route := getTracedRoute(c.Path())
+		if route == "" {
 			// rlog(c).Trace().Str("path", c.Path()).Msg("non sign request detected, skipping timings...")
 			return c.Next()
 		}
 
-		c.SetUserContext(context.WithValue(
-			c.UserContext(),
-			utils.FbReqTmruestTimer,
-			make(map[utils.ContextKey]time.Time),
-		))
+		span := m.tracer.Start(c.Get(tracing.HeaderTraceparent), c.Method()+" "+route)
+		span.SetAttribute("http.method", c.Method())
+		span.SetAttribute("http.target", c.Path())
+		span.SetAttribute("http.client_ip", c.IP())
+		span.SetAttribute("http.request_id", c.Locals("requestid").(string))
+
+		c.SetUserContext(context.WithValue(c.UserContext(), utils.FbReqTraceSpan, span))
+		c.Set(tracing.HeaderTraceparent, span.Traceparent())
 
 		start, e := time.Now(), c.Next()
-		stop := time.Now()
-		total := stop.Sub(start).Round(time.Microsecond)
+		total := time.Since(start).Round(time.Microsecond)
 
 		status, lvl, err := c.Response().StatusCode(), zerolog.InfoLevel, new(fiber.Error)
 		if errors.As(e, &err) || status >= fiber.StatusInternalServerError {
 			status, lvl = err.Code, zerolog.WarnLevel
+			span.SetError(e)
+		}
+
+		span.SetAttribute("http.status_code", strconv.Itoa(status))
+		for _, key := range []string{"uid", "srv", "core", "cluster"} {
+			if val, ok := c.Locals(key).(string); ok {
+				span.SetAttribute("addie."+key, val)
+			}
 		}
+		span.Finish()
 
 		if rlog(c).GetLevel() <= zerolog.DebugLevel {
-			routing, precond, blist, fquality, clottery, reqsign :=
-				stop.Sub(m.getRequestTimerSegment(c, utils.FbReqTmrPreCond)).Round(time.Microsecond),
-				stop.Sub(m.getRequestTimerSegment(c, utils.FbReqTmrBlocklist)).Round(time.Microsecond),
-				stop.Sub(m.getRequestTimerSegment(c, utils.FbReqTmrFakeQuality)).Round(time.Microsecond),
-				stop.Sub(m.getRequestTimerSegment(c, utils.FbReqTmrConsulLottery)).Round(time.Microsecond),
-				stop.Sub(m.getRequestTimerSegment(c, utils.FbReqTmrReqSign)).Round(time.Microsecond),
-				stop.Sub(stop).Round(time.Microsecond)
-
-			reqsign = clottery - reqsign
-			clottery = fquality - clottery
-			fquality = blist - fquality
-			blist = precond - blist
-			precond = routing - precond
-			routing = total - routing
-
-			rlog(c).Debug().
-				Dur("routing", routing).
-				Dur("precond", precond).
-				Dur("blist", blist).
-				Dur("fquality", fquality).
-				Dur("clottery", clottery).
-				Dur("reqsign", reqsign).
-				Dur("total", total).
-				Dur("timer", time.Since(stop).Round(time.Microsecond)).
-				Msg("")
-
-			rlog(c).Trace().Msgf(
-				"Total: %s; Routing %s; PreCond %s; Blocklist %s; FQuality %s; CLottery %s; ReqSign %s;",
-				total, routing, precond, blist, fquality, clottery, reqsign)
-			rlog(c).Trace().Msgf("Time Collector %s", time.Since(stop).Round(time.Microsecond))
+			evt := rlog(c).Debug().Str("trace_id", span.TraceID())
+			for _, stage := range span.Stages() {
+				evt.Dur(stage.Name, stage.Duration().Round(time.Microsecond))
+			}
+			evt.Dur("total", total).Msg("")
 		}
 
-		rlog(c).WithLevel(lvl).
-			Int("status", status).
-			Str("method", c.Method()).
-			Str("path", c.Path()).
-			Str("ip", c.IP()).
-			Dur("latency", total).
-			Str("user-agent", c.Get(fiber.HeaderUserAgent)).Msg("")
-		m.rsyslog(c).WithLevel(lvl).
-			Int("status", status).
-			Str("method", c.Method()).
-			Str("path", c.Path()).
-			Str("ip", c.IP()).
-			Dur("latency", total).
-			Str("user-agent", c.Get(fiber.HeaderUserAgent)).Msg("")
+		m.accessLogRecord(c, status, lvl, start, total)
 
 		return
 	})
@@ -176,17 +151,30 @@ func (m *App) fiberConfigure() {
 	// swagger
 	m.fb.Get("/swagger/*", swagger.HandlerDefault)
 
+	// probes
+	m.fb.Get("/healthz", gController.GetHealth)
+	m.fb.Get("/readyz", gController.GetReadiness)
+
 	// group api - /api
 	api := m.fb.Group("/api")
 	api.Post("logger/level", gController.SetLoggerLevel)
 	api.Post("limiter/switch", gController.LimiterSwitch)
 	api.Post("quality", gController.UpdateQualityRewrite)
+	api.Get("prefork/health", gController.GetPreforkHealth)
+	api.Post("sign/verify", gController.VerifySign)
+
+	// group api - titles cache
+	api.Get("cache/titles/:id", gController.GetCachedTitle)
+	api.Delete("cache/titles/:id", gController.DeleteCachedTitle)
 
 	// group upstream
 	upstr := api.Group("/balancer")
 	upstr.Get("/stats", gController.GetBalancerStats)
+	upstr.Get("/stats/server", gController.GetBalancerServerStats)
 	upstr.Post("/stats/reset", gController.BalancerStatsReset)
 	upstr.Post("/reset", gController.BalancerUpstreamReset)
+	upstr.Post("/server/drain", gController.BalancerServerDrain)
+	upstr.Post("/server/maintenance", gController.BalancerServerMaintenance)
 
 	upstrCluster := upstr.Group("/cluster", skip.New(m.fbHndApiPreCondErr, m.fbMidBlcPreCond))
 	upstrCluster.Get("/cache-nodes",
@@ -200,12 +188,8 @@ func (m *App) fiberConfigure() {
 	blist.Post("/switch", gController.BlocklistSwitch)
 	blist.Post("/reset", gController.BlocklistReset)
 
-	// group media - /videos/media/ts
-	media := m.fb.Group("/videos/media/ts", skip.New(m.fbHndApiPreCondErr, m.fbMidAppPreCond))
-
-	// group media - blocklist & limiter
-	media.Use(m.fbMidAppBlocklist)
-	media.Use(limiter.New(limiter.Config{
+	// media and playlist limiter; both groups share the per-IP budget
+	mediaLimiter := limiter.New(limiter.Config{
 		Next: func(c *fiber.Ctx) bool {
 			if m.runtime.Config.Get(runtime.ParamLimiter).(int) == 0 {
 				return true
@@ -222,7 +206,20 @@ func (m *App) fiberConfigure() {
 		},
 
 		Storage: m.fbstor,
-	}))
+	})
+
+	mediaLimiterTimer := func(c *fiber.Ctx) error {
+		m.lapRequestTimer(c, utils.FbReqTmrLimiter)
+		return c.Next()
+	}
+
+	// group media - /videos/media/ts
+	media := m.fb.Group("/videos/media/ts", skip.New(m.fbHndApiPreCondErr, m.fbMidAppPreCond))
+
+	// group media - blocklist & limiter
+	media.Use(m.fbMidAppBlocklist)
+	media.Use(mediaLimiterTimer)
+	media.Use(mediaLimiter)
 
 	// group media - middlewares
 	media.Use(m.fbMidAppFakeQuality)
@@ -233,14 +230,50 @@ func (m *App) fiberConfigure() {
 
 	// group media - sign handler
 	media.Use(m.fbHndAppRequestSign)
+
+	// group playlist - /videos/media/playlist
+	playlist := m.fb.Group("/videos/media/playlist", skip.New(m.fbHndApiPreCondErr, m.fbMidAppPreCond))
+	playlist.Use(m.fbMidAppBlocklist)
+	playlist.Use(mediaLimiterTimer)
+	playlist.Use(mediaLimiter)
+	playlist.Use(m.fbHndAppPlaylist)
+}
+
+// requestTimerStages - span names of lapRequestTimer() stages
+var requestTimerStages = map[utils.ContextKey]string{
+	utils.FbReqTmrPreCond:       "precond",
+	utils.FbReqTmrBlcPreCond:    "precond",
+	utils.FbReqTmrBlocklist:     "blocklist",
+	utils.FbReqTmrLimiter:       "limiter",
+	utils.FbReqTmrFakeQuality:   "fake quality",
+	utils.FbReqTmrConsulLottery: "balancer lottery",
+	utils.FbReqTmrCoreBalance:   "core balance",
+	utils.FbReqTmrReqSign:       "sign",
+
+	utils.FbReqTmrPlaylistFetch:   "playlist fetch",
+	utils.FbReqTmrPlaylistRewrite: "playlist rewrite",
+}
+
+// tracedRoutes - path prefixes of requests with traces and timings
+var tracedRoutes = []string{"/videos/media/ts", "/videos/media/playlist", "/api/balancer/cluster"}
+
+func getTracedRoute(path string) string {
+	for _, route := range tracedRoutes {
+		if strings.HasPrefix(path, route) {
+			return route
+		}
+	}
+
+	return ""
 }
 
+// lapRequestTimer finishes the current stage of the request span and starts the next one
 func (*App) lapRequestTimer(c *fiber.Ctx, k utils.ContextKey) {
-	c.UserContext().
-		Value(utils.FbReqTmruestTimer).(map[utils.ContextKey]time.Time)[k] = time.Now()
+	getRequestSpan(c).Stage(requestTimerStages[k])
 }
 
-func (*App) getRequestTimerSegment(c *fiber.Ctx, k utils.ContextKey) time.Time {
-	return c.UserContext().
-		Value(utils.FbReqTmruestTimer).(map[utils.ContextKey]time.Time)[k]
+// getRequestSpan returns the root span of the request or nil if the request is not traced
+func getRequestSpan(c *fiber.Ctx) *tracing.Span {
+	span, _ := c.UserContext().Value(utils.FbReqTraceSpan).(*tracing.Span)
+	return span
 }
@@ -1,52 +1,78 @@
 package app
 
 import (
-	"crypto/md5" // skipcq: GSC-G501 md5 used in nginx, no choise to fix it
-	"encoding/base64"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
 	"github.com/gofiber/fiber/v2"
 )
 
-// getHlpExtra() simply is a secure_link implementation
-
-// docs:
-// https://nginx.org/ru/docs/http/ngx_http_secure_link_module.html#secure_link
-//
-// bash example:
-//
-//	echo -n '2147483647/s/link127.0.0.1 secret' | \
-//		openssl md5 -binary | openssl base64 | tr +/ -_ | tr -d =
-func (*App) getHlpExtra(c *fiber.Ctx, uri, sip, uid string) (expires, extra string) {
-
-	localts := time.Now().Local().Add(gCli.Duration("link-expiration")).Unix()
-	expires = strconv.Itoa(int(localts))
-
-	// secret link skeleton:
-	// expire:uri:cache_ip:uid secret
-	rlog(c).Trace().
-		Strs("extra_values", []string{expires, uri, sip, uid, gCli.String("link-secret")}).Msg("")
-
-	// concat all values
-	// ?? buf := expires + uri + cip + sip + uid + " " + gCli.String("link-secret")
-	buf := expires + uri + sip + uid + " " + gCli.String("link-secret")
-
-	// md5 sum `openssl md5 -binary`
-	md5sum := md5.Sum([]byte(buf)) // skipcq: GSC-G401 md5 used in nginx, no choise to fix it
-
-	// base64 encoding `openssl base64`
-	b64buf := base64.StdEncoding.EncodeToString(md5sum[:])
-
-	// replace && trim string `tr +/ -_ | tr -d =`
-	extra = strings.Trim(
-		strings.ReplaceAll(
-			strings.ReplaceAll(
-				b64buf, "+", "-",
-			),
-			"/", "_",
-		), "=")
-
-	return
+// getSignedArgs signs the link with the scheme of the server's cluster (see link-sign-cluster-scheme)
+// and the newest valid key of the keyring
+func (m *App) getSignedArgs(c *fiber.Ctx, uri, srv, uid, cluster string) (args url.Values, expires string, e error) {
+	now := time.Now()
+
+	req := &signer.Request{
+		Uri:      uri,
+		Server:   srv,
+		Uid:      uid,
+		ClientIp: c.IP(),
+		Expires:  signer.RoundExpires(now, m.getLinkExpiration(c, uri, cluster), gCli.Duration("link-expiration-bucket")),
+	}
+
+	if req.Key, e = m.keyring.Signing(now); e != nil {
+		return
+	}
+
+	sgnr := m.signers.Get(cluster)
+
+	rlog(c).Trace().Str("scheme", sgnr.Scheme()).Str("kid", req.Key.Id).
+		Strs("extra_values", []string{req.Uri, req.Server, req.Uid, req.ClientIp}).Msg("")
+
+	// links with rounded expiration time are repeated inside the bucket, so they are memoized
+	if m.signMemo != nil {
+		args, e = m.signMemo.Sign(sgnr, req)
+	} else {
+		args, e = sgnr.Sign(req)
+	}
+
+	if e != nil {
+		return
+	}
+
+	return args, strconv.FormatInt(req.Expires, 10), e
+}
+
+// getLinkExpiration returns the lifetime of the first matched rule of the link-expiration-rules
+// runtime param or link-expiration if there are no matched rules
+func (m *App) getLinkExpiration(c *fiber.Ctx, uri, cluster string) time.Duration {
+	policy, _ := m.runtime.Config.Get(runtime.ParamLinkExpiration).(*signer.ExpirationPolicy)
+	if policy.Len() == 0 {
+		return gCli.Duration("link-expiration")
+	}
+
+	req := &signer.ExpirationRequest{
+		Uri:         uri,
+		Cluster:     cluster,
+		ClientClass: strings.TrimSpace(c.Get(apiHeaderClass)),
+	}
+
+	// quality_after is set only if the quality of the link has been rewritten
+	var ok bool
+	if req.Quality, ok = c.Locals("quality_after").(string); !ok {
+		req.Quality, _ = c.Locals("quality_before").(string)
+	}
+
+	expiration, ok := policy.Lookup(req)
+	if !ok {
+		return gCli.Duration("link-expiration")
+	}
+
+	rlog(c).Trace().Str("quality", req.Quality).Str("cluster", req.Cluster).Str("file_type", req.FileType()).
+		Str("client_class", req.ClientClass).Dur("expiration", expiration).Msg("link expiration rule matched")
+	return expiration
 }
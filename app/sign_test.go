@@ -0,0 +1,84 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/runtime"
+	"github.com/MindHunter86/addie/signer"
+	"github.com/MindHunter86/addie/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/urfave/cli/v2"
+)
+
+// TestGetLinkExpiration checks request attributes of expiration rules and
+// the fallback to link-expiration
+func TestGetLinkExpiration(t *testing.T) {
+	setTestCliContext(t, []cli.Flag{
+		&cli.DurationFlag{Name: "link-expiration", Value: 10 * time.Second},
+	})
+
+	ctx := newTestContext(t, signer.NewKeyring(), newTestBalancer(t))
+	app := &App{runtime: ctx.Value(utils.ContextKeyRuntime).(*runtime.Runtime)}
+
+	policy, e := signer.ParseExpirationPolicy([]byte(`[
+		{"quality": "480", "cluster": "cache-ru", "expiration": "1m"},
+		{"client_class": "tv", "expiration": "2m"},
+		{"file_type": "m3u8", "expiration": "3m"}
+	]`))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	const chunk = "/videos/media/ts/9000/1/1080/hash_00001.ts"
+
+	for _, tc := range []struct {
+		name   string
+		policy *signer.ExpirationPolicy
+		uri    string
+		class  string
+		locals map[string]string
+
+		expiration time.Duration
+	}{
+		{name: "no rules", uri: "/videos/media/ts/9000/1/1080/hash.m3u8", expiration: 10 * time.Second},
+		{name: "not matched", policy: policy, uri: chunk,
+			locals: map[string]string{"cluster": "cache-ru", "quality_before": "1080"}, expiration: 10 * time.Second},
+		{name: "rewritten quality", policy: policy, uri: chunk,
+			locals: map[string]string{"cluster": "cache-ru", "quality_before": "1080", "quality_after": "480"}, expiration: time.Minute},
+		{name: "requested quality", policy: policy, uri: chunk,
+			locals: map[string]string{"cluster": "cache-ru", "quality_before": "480"}, expiration: time.Minute},
+		{name: "client class", policy: policy, uri: chunk, class: " tv ",
+			locals: map[string]string{"cluster": "cache-eu", "quality_before": "480"}, expiration: 2 * time.Minute},
+		{name: "file type", policy: policy, uri: "/videos/media/ts/9000/1/1080/hash.m3u8", expiration: 3 * time.Minute},
+	} {
+		app.runtime.Config.Set(runtime.ParamLinkExpiration, tc.policy)
+
+		var expiration time.Duration
+		fb := fiber.New()
+		fb.Get("/*", func(c *fiber.Ctx) error {
+			c.Locals("logger", gLog)
+			for key, value := range tc.locals {
+				c.Locals(key, value)
+			}
+
+			expiration = app.getLinkExpiration(c, c.Path(), tc.locals["cluster"])
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, tc.uri, nil)
+		if tc.class != "" {
+			req.Header.Set(apiHeaderClass, tc.class)
+		}
+
+		if _, e = fb.Test(req); e != nil {
+			t.Fatal(e)
+		}
+
+		if expiration != tc.expiration {
+			t.Errorf("%s: got %s, expected %s", tc.name, expiration, tc.expiration)
+		}
+	}
+}
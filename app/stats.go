@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/gofiber/fiber/v2"
+)
+
+// statsScopeStaleFactor - published snapshots older than factor*interval
+// are considered as snapshots of dead instances
+const statsScopeStaleFactor = 3
+
+// statsPublisher periodically publishes balancers' stats to consul KV;
+// prefork children send their stats to the parent, the parent publishes the merged ones
+type statsPublisher struct {
+	balancers []balancer.Balancer
+	interval  time.Duration
+	instance  string
+
+	// consul session of published keys, see consulClient.createStatsSession()
+	session string
+}
+
+func newStatsPublisher(balancers ...balancer.Balancer) *statsPublisher {
+	return &statsPublisher{
+		balancers: balancers,
+		interval:  gCli.Duration("balancer-stats-publish-interval"),
+		instance:  getStatsInstance(),
+	}
+}
+
+// getStatsInstance returns the instance name of published stats, hostname with the listen address
+// by default - instances of one host are different instances of the cluster
+func getStatsInstance() (instance string) {
+	if instance = gCli.String("balancer-stats-instance"); instance != "" {
+		return
+	}
+
+	var e error
+	if instance, e = os.Hostname(); e != nil {
+		gLog.Warn().Err(e).Msg("could not get hostname for stats instance name, pid is used")
+		instance = "pid-" + strconv.Itoa(os.Getpid())
+	}
+
+	if addr := gCli.String("http-listen-addr"); addr != "" {
+		instance += "-" + addr
+	}
+
+	return
+}
+
+func (m *statsPublisher) run(ctx context.Context) {
+	if m.interval <= 0 {
+		gLog.Info().Msg("stats publishing is disabled")
+		return
+	}
+
+	gLog.Debug().Msg("stats publisher started")
+	defer gLog.Debug().Msg("stats publisher stopped")
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	defer m.release()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.publish()
+		}
+	}
+}
+
+func (m *statsPublisher) publish() {
+	snapshots := make([]*balancer.ClusterStats, 0, len(m.balancers))
+	for _, blcr := range m.balancers {
+		snapshots = append(snapshots, blcr.GetStatsSnapshot())
+	}
+
+	switch {
+	case gPreforkChild != nil:
+		if e := gPreforkChild.send(&preforkMessage{
+			Type:  preforkMessageStats,
+			Stats: snapshots,
+		}); e != nil {
+			gLog.Warn().Err(e).Msg("could not send stats to the prefork parent")
+		}
+		return
+	case gPreforkParent != nil:
+		// the parent does not serve requests, so only children's stats are published
+		children := gPreforkParent.getChildrenStats(time.Now().Add(-statsScopeStaleFactor * m.interval))
+		for idx, stats := range snapshots {
+			snapshots[idx] = balancer.MergeClusterStats(stats.Cluster, children[stats.Cluster]...)
+		}
+	}
+
+	if e := m.renewSession(); e != nil {
+		gLog.Warn().Err(e).Msg("could not renew consul session of published stats")
+		return
+	}
+
+	for _, stats := range snapshots {
+		if e := gConsul.publishStats(m.instance, m.session, stats); errors.Is(e, errConsulStatsLocked) {
+			gLog.Warn().Err(e).Msgf("stats of %s are published by another instance named %s, "+
+				"balancer-stats-instance must be unique", stats.Cluster, m.instance)
+		} else if e != nil {
+			gLog.Warn().Err(e).Msgf("could not publish stats of %s to consul", stats.Cluster)
+		}
+	}
+}
+
+// renewSession renews the session of published stats or creates the new one if it's expired;
+// the session lives for a few publish intervals, like snapshots in scoped views
+func (m *statsPublisher) renewSession() (e error) {
+	if m.session != "" {
+		var alive bool
+		if alive, e = gConsul.renewStatsSession(m.session); e != nil || alive {
+			return
+		}
+
+		gLog.Warn().Msgf("consul session %s of published stats has been expired, creating the new one", m.session)
+	}
+
+	m.session, e = gConsul.createStatsSession(m.instance, statsScopeStaleFactor*m.interval)
+	return
+}
+
+// release destroys the session, so stats of the stopped instance are removed from consul KV at once
+func (m *statsPublisher) release() {
+	if m.session == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if e := gConsul.destroyStatsSession(ctx, m.session); e != nil {
+		gLog.Warn().Err(e).Msg("could not destroy consul session of published stats")
+	}
+
+	m.session = ""
+}
+
+// getScopedStats returns stats of the process that handles the request (local), of this instance
+// (all prefork children) or of all instances of the cluster; the last ones are merged from published snapshots
+func getScopedStats(blcr balancer.Balancer, scope string) (_ *balancer.ClusterStats, e error) {
+	var instance string
+	switch scope {
+	case "local":
+		return blcr.GetStatsSnapshot(), e
+	case "instance":
+		instance = getStatsInstance()
+	case "cluster":
+	default:
+		return nil, fiber.NewError(fiber.StatusBadRequest, "scope argument is invalid; local, instance, cluster values are permitted only")
+	}
+
+	cluster := blcr.GetClusterName()
+	since := time.Now().Add(-statsScopeStaleFactor * gCli.Duration("balancer-stats-publish-interval"))
+
+	var snapshots []*balancer.ClusterStats
+	if snapshots, e = gConsul.getPublishedStats(cluster, instance, since); e != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, e.Error())
+	}
+
+	return balancer.MergeClusterStats(cluster, snapshots...), e
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/gofiber/fiber/v2"
+	"github.com/urfave/cli/v2"
+)
+
+const testStatsKey = "addie/stats/cache-node-internal/host-1"
+
+func newTestStatsBalancer(t *testing.T) balancer.Balancer {
+	t.Helper()
+
+	setTestCliContext(t, []cli.Flag{
+		&cli.StringFlag{Name: "consul-kv-prefix", Value: "addie"},
+		&cli.StringFlag{Name: "consul-service-nodes", Value: "cache-node-internal"},
+		&cli.StringFlag{Name: "balancer-stats-instance", Value: "host-1"},
+		&cli.DurationFlag{Name: "balancer-stats-publish-interval", Value: 15 * time.Second},
+	})
+
+	return newTestBalancer(t)
+}
+
+func TestStatsPublisherSession(t *testing.T) {
+	blcr := newTestStatsBalancer(t)
+	fake := newTestConsul(t)
+
+	// the session of the previous run holds the key
+	previous := fake.createSession("addie-stats-host-1", testConsulNode)
+	fake.put(testStatsKey, []byte("{}"), previous)
+
+	publisher := newStatsPublisher(blcr)
+	publisher.publish()
+
+	session := fake.getSession(publisher.session)
+	if session == nil || session.Name != "addie-stats-host-1" || session.Behavior != "delete" || session.TTL != "45s" {
+		t.Fatalf("got session %+v", session)
+	}
+
+	if fake.getSession(previous) != nil {
+		t.Error("the session of the previous run is not destroyed")
+	}
+
+	pair := fake.get(testStatsKey)
+	if pair == nil || pair.Session != publisher.session {
+		t.Fatalf("stats are not published under the session - %+v", pair)
+	}
+
+	var stats *balancer.ClusterStats
+	if e := json.Unmarshal(pair.Value, &stats); e != nil || stats.Cluster != "cache-node-internal" {
+		t.Errorf("got stats %s, %v", pair.Value, e)
+	}
+
+	// the session is renewed by next publishes
+	id := publisher.session
+	if publisher.publish(); publisher.session != id {
+		t.Errorf("alive session %s is replaced by %s", id, publisher.session)
+	}
+
+	// keys of the expired session are deleted by consul, the publisher creates the new session
+	fake.expire(id)
+	if fake.get(testStatsKey) != nil {
+		t.Fatal("key of the expired session is kept")
+	}
+
+	if publisher.publish(); publisher.session == id || fake.get(testStatsKey) == nil {
+		t.Errorf("stats are not published after the session expiration, session %s", publisher.session)
+	}
+
+	// stats of the stopped instance are removed at once
+	publisher.release()
+	if fake.get(testStatsKey) != nil || publisher.session != "" {
+		t.Error("stats are kept after the publisher's stop")
+	}
+}
+
+func TestPublishStatsLocked(t *testing.T) {
+	newTestStatsBalancer(t)
+	fake := newTestConsul(t)
+
+	// the live instance with the same name on the other node
+	other := fake.createSession("addie-stats-host-1", "node-2")
+	fake.put(testStatsKey, []byte("{}"), other)
+
+	session, e := gConsul.createStatsSession("host-1", time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if fake.getSession(other) == nil {
+		t.Error("the session of the other node is destroyed")
+	}
+
+	// ttl is raised to the consul's minimum
+	if ttl := fake.getSession(session).TTL; ttl != "10s" {
+		t.Errorf("got session ttl %s", ttl)
+	}
+
+	if e = gConsul.publishStats("host-1", session, &balancer.ClusterStats{Cluster: "cache-node-internal"}); !errors.Is(e, errConsulStatsLocked) {
+		t.Errorf("expected errConsulStatsLocked, got %v", e)
+	}
+}
+
+func newTestStats(cluster string, timestamp time.Time, requests uint64, instances int) *balancer.ClusterStats {
+	return &balancer.ClusterStats{
+		Cluster:   cluster,
+		Timestamp: timestamp,
+		Instances: instances,
+		Servers:   []*balancer.ServerStats{{Name: "node-001", Requests: requests, Rps: &balancer.RpsStats{}}},
+	}
+}
+
+func TestGetScopedStats(t *testing.T) {
+	blcr := newTestStatsBalancer(t)
+	fake := newTestConsul(t)
+
+	now := time.Now()
+	for key, stats := range map[string]*balancer.ClusterStats{
+		"addie/stats/cache-node-internal/host-1":  newTestStats("cache-node-internal", now, 1, 2),
+		"addie/stats/cache-node-internal/host-10": newTestStats("cache-node-internal", now, 10, 0),
+		// snapshots of dead instances are skipped
+		"addie/stats/cache-node-internal/host-2": newTestStats("cache-node-internal", now.Add(-time.Minute), 100, 0),
+		"addie/stats/cache-cloud-ingress/host-1": newTestStats("cache-cloud-ingress", now, 1000, 0),
+	} {
+		buf, e := json.Marshal(stats)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		fake.put(key, buf, "")
+	}
+	fake.put("addie/stats/cache-node-internal/host-3", []byte("{"), "")
+
+	for _, tc := range []struct {
+		scope     string
+		requests  uint64
+		instances int
+		err       int
+	}{
+		{scope: "local"},
+		// host-10 is not the instance of host-1 prefix
+		{scope: "instance", requests: 1, instances: 2},
+		{scope: "cluster", requests: 11, instances: 3},
+		{scope: "global", err: fiber.StatusBadRequest},
+	} {
+		stats, e := getScopedStats(blcr, tc.scope)
+
+		var ferr *fiber.Error
+		switch {
+		case tc.err != 0:
+			if !errors.As(e, &ferr) || ferr.Code != tc.err {
+				t.Errorf("%s: expected status %d, got %v", tc.scope, tc.err, e)
+			}
+		case e != nil:
+			t.Errorf("%s: unexpected error %v", tc.scope, e)
+		case stats.Cluster != "cache-node-internal" || stats.Requests != tc.requests || stats.Instances != tc.instances:
+			t.Errorf("%s: got cluster %s, requests %d, instances %d", tc.scope, stats.Cluster, stats.Requests, stats.Instances)
+		}
+	}
+}
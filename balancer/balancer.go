@@ -3,14 +3,18 @@ package balancer
 import (
 	"errors"
 	"io"
-	"net"
 )
 
 type Balancer interface {
 	BalanceByChunk(prefix, chunkname string) (_ string, server *BalancerServer, e error)
+	BalanceByChunkN(prefix, chunkname string, count int) (servers []*BalancerServer, e error)
+	BalanceBySession(session string, count int) (servers []*BalancerServer, e error)
 	BalanceRandom() (_ string, server *BalancerServer, e error)
-	UpdateServers(servers map[string]net.IP)
+	UpdateServers(servers map[string]*UpstreamEntry)
+	UpdateServerStates(states ServerStates)
+	HasServer(name string) bool
 	GetStats() io.Reader
+	GetStatsSnapshot() *ClusterStats
 	ResetStats()
 	ResetUpstream()
 	GetClusterName() string
@@ -20,6 +24,7 @@ var (
 	ErrUnparsableChunk     = errors.New("could not get server because of invalid chunk name")
 	ErrServerUnavailable   = errors.New("rolled server is down now")
 	ErrUpstreamUnavailable = errors.New("upstream is empty or undefined; balancing is not possible")
+	ErrInvalidServiceEntry = errors.New("service entry is empty or has invalid address")
 )
 
 type BalancerCluster uint8
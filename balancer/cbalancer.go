@@ -1,18 +1,15 @@
 package balancer
 
 import (
-	"bytes"
 	"context"
 	"io"
-	"math"
 	"math/rand"
-	"net"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/MindHunter86/addie/utils"
-	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/rs/zerolog"
 	"github.com/spaolacci/murmur3"
 	"github.com/urfave/cli/v2"
@@ -24,23 +21,42 @@ type ClusterBalancer struct {
 
 	cluster BalancerCluster
 
-	ulock    sync.RWMutex
-	upstream *upstream
+	// upstream is an immutable snapshot, so balancing never takes locks;
+	// ulock serializes only snapshot writers (consul updates, resets)
+	ulock    sync.Mutex
+	upstream atomic.Pointer[upstream]
 
-	sync.RWMutex
-	size int
-	ips  []*net.IP
+	slock  sync.RWMutex
+	states ServerStates
+
+	sessions *sessionTable
+
+	loadMetaPrefix string
+	loadThresholds *LoadThresholds
 }
 
 func NewClusterBalancer(ctx context.Context, cluster BalancerCluster) *ClusterBalancer {
-	upstream := make(upstream)
+	cbalancer := &ClusterBalancer{
+		log:     ctx.Value(utils.ContextKeyLogger).(*zerolog.Logger),
+		ccx:     ctx.Value(utils.ContextKeyCliContext).(*cli.Context),
+		cluster: cluster,
+	}
 
-	return &ClusterBalancer{
-		log:      ctx.Value(utils.ContextKeyLogger).(*zerolog.Logger),
-		ccx:      ctx.Value(utils.ContextKeyCliContext).(*cli.Context),
-		cluster:  cluster,
-		upstream: &upstream,
+	cbalancer.sessions = newSessionTable(
+		cbalancer.ccx.Duration("balancer-sticky-ttl"),
+		cbalancer.ccx.Int("balancer-sticky-max-sessions"))
+
+	cbalancer.loadMetaPrefix = cbalancer.ccx.String("balancer-load-meta-prefix")
+	cbalancer.loadThresholds = &LoadThresholds{
+		CPU:      cbalancer.ccx.Float64("balancer-load-cpu-threshold"),
+		Egress:   cbalancer.ccx.Float64("balancer-load-egress-threshold"),
+		HitRatio: cbalancer.ccx.Float64("balancer-load-hit-ratio-threshold"),
+		MinShare: cbalancer.ccx.Float64("balancer-load-min-share"),
+		TTL:      cbalancer.ccx.Duration("balancer-load-report-ttl"),
 	}
+
+	cbalancer.upstream.Store(newUpstream(make(map[string]*BalancerServer)))
+	return cbalancer
 }
 
 func (m *ClusterBalancer) GetClusterName() string {
@@ -55,54 +71,67 @@ func (m *ClusterBalancer) GetClusterName() string {
 }
 
 func (m *ClusterBalancer) BalanceRandom() (_ string, server *BalancerServer, e error) {
-	var ip *net.IP
-	if ip = m.getRandomServer(); ip == nil {
+	if server = m.getRandomServer(); server == nil {
 		e = ErrUpstreamUnavailable
 		return
 	}
 
-	server, ok := m.upstream.getServer(&m.ulock, ip.String())
-	if !ok || server == nil {
-		panic("balance result could not be find in balancer's upstream")
-	} else if server.isDown {
+	if server.isDown.Load() {
+		server.statError()
+		e = ErrServerUnavailable
+	} else if rand.Float64() >= server.share(time.Now()) { // skipcq: GSC-G404 math/rand is enough
 		e = ErrServerUnavailable
 	} else {
 		server.statRequest()
 	}
 
-	return ip.String(), server, e
+	return server.Address(), server, e
 }
 
 func (m *ClusterBalancer) BalanceByChunk(prefix, chunkname string) (_ string, server *BalancerServer, e error) {
+	var servers []*BalancerServer
+	if servers, e = m.BalanceByChunkN(prefix, chunkname, 1); len(servers) == 0 {
+		return
+	}
+
+	return servers[0].Address(), servers[0], e
+}
+
+// BalanceByChunkN returns the chunk's server and up to count-1 alive backup servers;
+// the backups order is stable for the chunk, so clients may retry them in given order
+func (m *ClusterBalancer) BalanceByChunkN(prefix, chunkname string, count int) (servers []*BalancerServer, e error) {
 	var key string
 	if key, e = m.getKeyFromChunkName(&chunkname); e != nil {
 		m.log.Debug().Err(e).Msgf("chunkname - '%s'; fallback to legacy balancing", chunkname)
 		return
 	}
 
-	var ip *net.IP
-	if ip = m.getServer(murmur3.Sum128([]byte(prefix + key))); ip == nil {
+	idx1, idx2 := murmur3.Sum128([]byte(prefix + key))
+	if servers = m.getServers(count, idx1, idx2); len(servers) == 0 {
 		e = ErrUpstreamUnavailable
 		return
 	}
 
-	server, ok := m.upstream.getServer(&m.ulock, ip.String())
-	if !ok || server == nil {
-		panic("balance result could not be find in balancer's upstream")
-	} else if server.isDown {
+	if servers[0].isDown.Load() {
+		servers[0].statError()
 		e = ErrServerUnavailable
 	} else {
-		server.statRequest()
+		servers[0].statRequest()
 	}
 
-	return ip.String(), server, e
+	return servers, e
 }
 
+// getKeyFromChunkName - ts chunks are given without the extension and balanced by their numbers;
+// playlists, init segments and subtitles (see media.Path.ChunkName) are given with the extension
+// and balanced by the whole name
 func (*ClusterBalancer) getKeyFromChunkName(chunkname *string) (key string, e error) {
 	if strings.Contains(*chunkname, "_") {
 		key = strings.Split(*chunkname, "_")[1]
 	} else if strings.Contains(*chunkname, "fff") {
 		key = strings.ReplaceAll(*chunkname, "fff", "")
+	} else if strings.Contains(*chunkname, ".") {
+		key = *chunkname
 	} else {
 		e = ErrUnparsableChunk
 	}
@@ -110,61 +139,77 @@ func (*ClusterBalancer) getKeyFromChunkName(chunkname *string) (key string, e er
 	return
 }
 
-func (m *ClusterBalancer) getServer(idx1, idx2 uint64) (ip *net.IP) {
-	if !m.TryRLock() {
-		m.log.Warn().Msg("could not get lock for reading upstream; fallback to legacy balancing")
-		return
-	}
-	defer m.RUnlock()
+func (m *ClusterBalancer) getServers(count int, idx1, idx2 uint64) (servers []*BalancerServer) {
+	ups := m.upstream.Load()
 
-	if m.size == 0 {
+	size := uint64(ups.size())
+	if size == 0 {
 		return
 	}
 
-	idx3 := idx1 % uint64(m.size)
-	idx4 := idx2 % uint64(m.size)
+	idx3 := idx1 % size
+	idx4 := idx2 % size
 	idx0 := idx3 + idx4
 
-	ip = m.ips[idx0%uint64(m.size)]
-	return ip
-}
+	// drained servers and servers in maintenance hand over their chunks to the next ones;
+	// the point is stable for the chunk, so moved chunks always land on the same server
+	now, point := time.Now(), float64((idx1>>32)%10000)/10000
 
-func (m *ClusterBalancer) getRandomServer() (ip *net.IP) {
-	if !m.TryRLock() {
-		m.log.Error().Msg("could not get lock for reading upstream and force flag is false")
-		return
+	for i := uint64(0); i < size && len(servers) < count; i++ {
+		server := ups.ring[(idx0+i)%size]
+
+		switch {
+		case len(servers) == 0 && point < server.share(now):
+			servers = append(servers, server)
+		case len(servers) != 0 && !server.isDown.Load() && server.share(now) > 0:
+			// backups - the next alive servers in the ring
+			servers = append(servers, server)
+		}
 	}
-	defer m.RUnlock()
 
-	if m.size == 0 {
+	return servers
+}
+
+func (m *ClusterBalancer) getRandomServer() *BalancerServer {
+	ups := m.upstream.Load()
+
+	if ups.size() == 0 {
 		m.log.Error().Msg("could not get random server because of empty upstream")
-		return
+		return nil
 	}
 
-	ip = m.ips[rand.Intn(m.size)] // skipcq: GSC-G404 math/rand is enough
-	return
+	return ups.ring[rand.Intn(ups.size())] // skipcq: GSC-G404 math/rand is enough
 }
 
-func (m *ClusterBalancer) UpdateServers(servers map[string]net.IP) {
+func (m *ClusterBalancer) UpdateServers(servers map[string]*UpstreamEntry) {
 	m.log.Trace().Msg("upstream servers debugging (I/II update iterations)")
 	m.log.Info().Msg("[II] upstream update triggered")
 	m.log.Trace().Interface("[II] servers", servers).Msg("")
 
+	m.ulock.Lock()
+	defer m.ulock.Unlock()
+
 	// find and append balancer's upstream
-	for name, ip := range servers {
-		if server, ok := m.upstream.getServer(&m.ulock, ip.String()); !ok {
-			m.log.Trace().Msgf("[I] new server : %s", name)
-			m.upstream.putServer(&m.ulock, ip.String(), newServer(name, &ip))
+	buf := m.upstream.Load().copy()
+	for address, entry := range servers {
+		if server, ok := buf[address]; !ok {
+			m.log.Trace().Msgf("[I] new server : %s (%s)", entry.Name, address)
+
+			server = newServer(entry)
+			server.setState(m.getServerState(entry.Name))
+			buf[address] = server
 		} else {
-			m.log.Trace().Msgf("[I] server found %s", name)
+			m.log.Trace().Msgf("[I] server found %s (%s)", entry.Name, address)
+			server.setMeta(entry.Meta)
 			server.disable(false)
 		}
+
+		buf[address].setLoad(m.getServerLoad(entry))
 	}
 
 	// find differs and disable dead servers
-	curr := m.upstream.copy(&m.ulock)
-	for _, server := range curr {
-		if _, ok := servers[server.Name]; !ok {
+	for address, server := range buf {
+		if _, ok := servers[address]; !ok {
 			server.disable()
 			m.log.Trace().Msgf("[II] server - %s : disabled", server.Name)
 		} else {
@@ -172,75 +217,80 @@ func (m *ClusterBalancer) UpdateServers(servers map[string]net.IP) {
 		}
 	}
 
-	// update "balancer" (slice that used for getNextServer)
-	m.Lock()
-	defer m.Unlock()
+	// publish the new snapshot
+	ups := newUpstream(buf)
+	m.upstream.Store(ups)
 
-	m.ips, m.size = m.upstream.getIps(&m.ulock)
-	m.log.Trace().Interface("ips", m.ips).Msg("[II]")
-	m.log.Trace().Interface("size", m.size).Msgf("[II]")
+	m.log.Trace().Interface("size", ups.size()).Msgf("[II]")
 }
 
-func (m *ClusterBalancer) GetStats() io.Reader {
-	tb := table.NewWriter()
-	defer tb.Render()
-
-	isDownHumanize := func(i bool) string {
-		switch i {
-		case false:
-			return "no"
-		default:
-			return "yes"
-		}
-	}
+func (m *ClusterBalancer) UpdateServerStates(states ServerStates) {
+	m.log.Info().Int("states", len(states)).Msgf("server states update triggered for %s", m.GetClusterName())
 
-	buf := bytes.NewBuffer(nil)
-	tb.SetOutputMirror(buf)
-	tb.AppendHeader(table.Row{
-		"Name", "Address", "Requests", "Last Diff", "First Diff", "Last Request Time", "Is Down", "Status Time",
-	})
+	// block snapshot writers, so new servers could not get stale states
+	m.ulock.Lock()
+	defer m.ulock.Unlock()
 
-	servers := m.upstream.getServers(&m.ulock)
-	sort.Slice(servers, func(i, j int) bool {
-		return servers[i].handledRequests > servers[j].handledRequests
-	})
+	m.slock.Lock()
+	m.states = states
+	m.slock.Unlock()
 
-	round := func(val float64, precision uint) float64 {
-		ratio := math.Pow(10, float64(precision))
-		return math.Round(val*ratio) / ratio
+	for _, server := range m.upstream.Load().getServers() {
+		server.setState(m.getServerState(server.Name))
 	}
+}
 
-	for idx, server := range servers {
-		var firstdiff, lastdiff float64
-
-		if servers[0].handledRequests != 0 {
-			firstdiff = (float64(server.handledRequests) * 100.00 / float64(servers[0].handledRequests)) - 100.00
+// HasServer reports whether the upstream has the server with given name; disabled servers are kept
+// in the upstream until its reset, so they are found too
+func (m *ClusterBalancer) HasServer(name string) bool {
+	for _, server := range m.upstream.Load().ring {
+		if server.Name == name {
+			return true
 		}
+	}
 
-		if idx != 0 && servers[idx-1].handledRequests != 0 {
-			lastdiff = (float64(server.handledRequests) * 100.00 / float64(servers[idx-1].handledRequests)) - 100.00
-		}
+	return false
+}
+
+func (m *ClusterBalancer) getServerState(name string) *ServerState {
+	m.slock.RLock()
+	defer m.slock.RUnlock()
 
-		tb.AppendRow([]interface{}{
-			server.Name, server.Ip,
-			server.handledRequests, round(lastdiff, 2), round(firstdiff, 2), server.lastRequestTime.Format("2006-01-02T15:04:05.000"),
-			isDownHumanize(server.isDown), server.lastChanged.Format("2006-01-02T15:04:05.000"),
-		})
+	return m.states[name]
+}
+
+// getServerLoad returns nil for servers without (or with invalid) load reports,
+// so they are balanced only by their states
+func (m *ClusterBalancer) getServerLoad(entry *UpstreamEntry) *ServerLoad {
+	if m.loadMetaPrefix == "" {
+		return nil
 	}
 
-	tb.Style().Options.SeparateRows = true
+	load, e := NewServerLoad(entry.Meta, m.loadMetaPrefix, m.loadThresholds)
+	if e != nil {
+		m.log.Warn().Err(e).Msgf("could not parse load report of %s, the report is ignored", entry.Name)
+		return nil
+	}
 
-	return buf
+	if load != nil && load.Share < 1 {
+		m.log.Debug().Float64("share", load.Share).Msgf("server %s is saturated; spilling traffic to the next servers", entry.Name)
+	}
+
+	return load
+}
+
+func (m *ClusterBalancer) GetStats() io.Reader {
+	return RenderStats(m.GetStatsSnapshot())
 }
 
 func (m *ClusterBalancer) ResetStats() {
-	m.upstream.resetServersStats(&m.ulock)
+	m.upstream.Load().resetServersStats()
 }
 
 func (m *ClusterBalancer) ResetUpstream() {
 	m.ulock.Lock()
 	defer m.ulock.Unlock()
 
-	upstream := make(upstream)
-	m.upstream = &upstream
+	m.upstream.Store(newUpstream(make(map[string]*BalancerServer)))
+	m.sessions.reset()
 }
@@ -0,0 +1,209 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+// newTestBalancer returns the balancer with default flags of main.go and n servers
+func newTestBalancer(tb testing.TB, n int) (*ClusterBalancer, map[string]*UpstreamEntry) {
+	tb.Helper()
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, fl := range []cli.Flag{
+		&cli.DurationFlag{Name: "balancer-sticky-ttl", Value: 5 * time.Minute},
+		&cli.IntFlag{Name: "balancer-sticky-max-sessions", Value: 100000},
+		&cli.StringFlag{Name: "balancer-load-meta-prefix", Value: "load_"},
+		&cli.Float64Flag{Name: "balancer-load-cpu-threshold", Value: 85},
+		&cli.Float64Flag{Name: "balancer-load-egress-threshold"},
+		&cli.Float64Flag{Name: "balancer-load-hit-ratio-threshold"},
+		&cli.Float64Flag{Name: "balancer-load-min-share", Value: 0.2},
+		&cli.DurationFlag{Name: "balancer-load-report-ttl", Value: time.Minute},
+		&cli.StringFlag{Name: "consul-service-nodes", Value: "cache-node-internal"},
+		&cli.StringFlag{Name: "consul-service-cloud", Value: "cache-cloud-ingress"},
+	} {
+		if e := fl.Apply(set); e != nil {
+			tb.Fatal(e)
+		}
+	}
+
+	log := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), utils.ContextKeyLogger, &log)
+	ctx = context.WithValue(ctx, utils.ContextKeyCliContext, cli.NewContext(cli.NewApp(), set, nil))
+
+	servers := make(map[string]*UpstreamEntry, n)
+	for i := 0; i < n; i++ {
+		entry := &UpstreamEntry{
+			Name: fmt.Sprintf("node-%03d", i),
+			Ip:   net.IPv4(10, 0, byte(i/250), byte(i%250+1)),
+		}
+
+		servers[entry.Address()] = entry
+	}
+
+	blcr := NewClusterBalancer(ctx, BalancerClusterNodes)
+	blcr.UpdateServers(servers)
+
+	return blcr, servers
+}
+
+func TestBalanceByChunkNConcurrentUpdates(t *testing.T) {
+	const nservers, workers = 30, 8
+
+	blcr, servers := newTestBalancer(t, nservers)
+
+	var updater, wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// consul emulation - some servers are failed and recovered, server states are updated
+	updater.Add(1)
+	go func() {
+		defer updater.Done()
+
+		rnd := rand.New(rand.NewSource(1)) // skipcq: GSC-G404 math/rand is enough
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			alive := make(map[string]*UpstreamEntry, len(servers))
+			for address, entry := range servers {
+				if rnd.Intn(10) != 0 {
+					alive[address] = entry
+				}
+			}
+
+			blcr.UpdateServers(alive)
+			blcr.UpdateServerStates(ServerStates{
+				fmt.Sprintf("node-%03d", rnd.Intn(nservers)): NewDrainState(time.Minute),
+			})
+		}
+	}()
+
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(seed int64) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(seed)) // skipcq: GSC-G404 math/rand is enough
+			for i := 0; i < 20000; i++ {
+				balanced, e := blcr.BalanceByChunkN(
+					fmt.Sprintf("%d%d720", rnd.Intn(1000), rnd.Intn(12)),
+					fmt.Sprintf("hash_%05d", rnd.Intn(500)),
+					3)
+
+				switch {
+				case errors.Is(e, ErrUpstreamUnavailable):
+					errs <- fmt.Errorf("spurious upstream error on iteration %d", i)
+					return
+				case errors.Is(e, ErrServerUnavailable), e == nil:
+					if len(balanced) == 0 {
+						errs <- fmt.Errorf("no servers without error on iteration %d", i)
+						return
+					}
+				default:
+					errs <- e
+					return
+				}
+			}
+		}(int64(w + 2))
+	}
+
+	wg.Wait()
+	close(done)
+	updater.Wait()
+
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+}
+
+func BenchmarkBalanceByChunkN(b *testing.B) {
+	blcr, _ := newTestBalancer(b, 30)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, e := blcr.BalanceByChunkN("9000121080", fmt.Sprintf("hash_%05d", i%500), 3); e != nil {
+				b.Error(e)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func TestHasServer(t *testing.T) {
+	blcr, servers := newTestBalancer(t, 3)
+
+	// disabled servers are kept in the upstream
+	for address, entry := range servers {
+		if entry.Name == "node-001" {
+			delete(servers, address)
+		}
+	}
+	blcr.UpdateServers(servers)
+
+	for name, found := range map[string]bool{"node-000": true, "node-001": true, "node-002": true, "node-003": false, "": false} {
+		if blcr.HasServer(name) != found {
+			t.Errorf("%q: expected found %t", name, found)
+		}
+	}
+
+	blcr.ResetUpstream()
+	if blcr.HasServer("node-000") {
+		t.Error("server is found after the upstream reset")
+	}
+}
+
+// TestGetKeyFromChunkName checks that keys of ts chunks are the same as before media routes,
+// otherwise chunks are reshuffled between servers
+func TestGetKeyFromChunkName(t *testing.T) {
+	for _, tc := range []struct {
+		chunkname, key string
+		err            bool
+	}{
+		{chunkname: "fff6d1a7a6a2d8d0d2f3b4e5_00001", key: "00001"},
+		{chunkname: "6d1a7_00128", key: "00128"},
+		{chunkname: "fff6d1a7", key: "6d1a7"},
+		{chunkname: "6d1a7_00002.m4s", key: "00002.m4s"},
+		{chunkname: "6d1a7.m3u8", key: "6d1a7.m3u8"},
+		{chunkname: "master.m3u8", key: "master.m3u8"},
+		{chunkname: "ru.vtt", key: "ru.vtt"},
+
+		// ts chunks without numbers fall back to the legacy balancing as before
+		{chunkname: "6d1a7", err: true},
+		{chunkname: "", err: true},
+	} {
+		key, e := (*ClusterBalancer)(nil).getKeyFromChunkName(&tc.chunkname)
+		if tc.err {
+			if !errors.Is(e, ErrUnparsableChunk) {
+				t.Errorf("%q: expected ErrUnparsableChunk, got %q, %v", tc.chunkname, key, e)
+			}
+			continue
+		}
+
+		if e != nil || key != tc.key {
+			t.Errorf("%q: got %q, %v, want %q", tc.chunkname, key, e, tc.key)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	loadMetaCPU      = "cpu"       // percent
+	loadMetaEgress   = "egress"    // Mbit/s
+	loadMetaHitRatio = "hit_ratio" // percent
+	loadMetaUpdated  = "updated"   // unix timestamp
+)
+
+type loadMetric uint8
+
+const (
+	loadMetricCPU loadMetric = 1 << iota
+	loadMetricEgress
+	loadMetricHitRatio
+)
+
+var ErrInvalidServerLoad = errors.New("server load report is invalid")
+
+type (
+	// ServerLoad is a load report of a cache node; nodes publish it
+	// in their consul service meta, so every addie instance gets the same reports
+	ServerLoad struct {
+		CPU      float64   `json:"cpu"`
+		Egress   float64   `json:"egress"`
+		HitRatio float64   `json:"hit_ratio"`
+		Updated  time.Time `json:"updated"`
+
+		// part of server's "natural" traffic that it should handle with the reported load
+		Share float64 `json:"share"`
+
+		expires  time.Time
+		reported loadMetric
+	}
+	// LoadThresholds are saturation thresholds; zero values disable the check
+	LoadThresholds struct {
+		CPU      float64
+		Egress   float64
+		HitRatio float64
+
+		MinShare float64
+		TTL      time.Duration
+	}
+)
+
+// NewServerLoad parses the load report from meta keys with the given prefix;
+// it returns nil if the server does not report its load
+func NewServerLoad(meta map[string]string, prefix string, thresholds *LoadThresholds) (load *ServerLoad, e error) {
+	load = &ServerLoad{}
+
+	parse := func(key string, metric loadMetric, value *float64) {
+		buf, ok := meta[prefix+key]
+		if !ok || e != nil {
+			return
+		}
+
+		if *value, e = strconv.ParseFloat(buf, 64); e != nil || *value < 0 {
+			e = fmt.Errorf("%w; %s%s - %s", ErrInvalidServerLoad, prefix, key, buf)
+			return
+		}
+
+		load.reported |= metric
+	}
+
+	parse(loadMetaCPU, loadMetricCPU, &load.CPU)
+	parse(loadMetaEgress, loadMetricEgress, &load.Egress)
+	parse(loadMetaHitRatio, loadMetricHitRatio, &load.HitRatio)
+
+	if e != nil || load.reported == 0 {
+		return nil, e
+	}
+
+	if buf, ok := meta[prefix+loadMetaUpdated]; ok {
+		var updated int64
+		if updated, e = strconv.ParseInt(buf, 10, 64); e != nil {
+			return nil, fmt.Errorf("%w; %s%s - %s", ErrInvalidServerLoad, prefix, loadMetaUpdated, buf)
+		}
+
+		load.Updated = time.Unix(updated, 0)
+		if thresholds.TTL > 0 {
+			load.expires = load.Updated.Add(thresholds.TTL)
+		}
+	}
+
+	load.Share = thresholds.share(load)
+	return load, e
+}
+
+// saturation returns the largest ratio of reported values to their thresholds;
+// low hit ratio means disk saturation, so its ratio is inverted
+func (m *LoadThresholds) saturation(load *ServerLoad) (saturation float64) {
+	if m.CPU > 0 && load.reported&loadMetricCPU != 0 {
+		saturation = math.Max(saturation, load.CPU/m.CPU)
+	}
+
+	if m.Egress > 0 && load.reported&loadMetricEgress != 0 {
+		saturation = math.Max(saturation, load.Egress/m.Egress)
+	}
+
+	if m.HitRatio > 0 && load.reported&loadMetricHitRatio != 0 {
+		if load.HitRatio == 0 {
+			return math.Inf(1)
+		}
+
+		saturation = math.Max(saturation, m.HitRatio/load.HitRatio)
+	}
+
+	return
+}
+
+// share down-weights saturated servers quadratically; the excess traffic is moved
+// to the next ring servers in the same way as for drained ones, so most chunks
+// of a saturated server stay on it and cache locality is kept
+func (m *LoadThresholds) share(load *ServerLoad) float64 {
+	saturation := m.saturation(load)
+	if saturation <= 1 {
+		return 1
+	}
+
+	return math.Max(m.MinShare, 1/(saturation*saturation))
+}
+
+// share returns 1 for nil and expired reports
+func (m *ServerLoad) share(now time.Time) float64 {
+	if m == nil || (!m.expires.IsZero() && now.After(m.expires)) {
+		return 1
+	}
+
+	return m.Share
+}
@@ -0,0 +1,163 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewServerLoad(t *testing.T) {
+	thresholds := &LoadThresholds{CPU: 80, Egress: 1000, HitRatio: 50, MinShare: 0.2, TTL: time.Minute}
+
+	for _, tc := range []struct {
+		name  string
+		meta  map[string]string
+		nil   bool
+		err   bool
+		share float64
+	}{
+		{name: "no report", meta: map[string]string{"version": "1.0"}, nil: true},
+		{name: "updated only", meta: map[string]string{"load_updated": "1700000000"}, nil: true},
+		{name: "idle", meta: map[string]string{"load_cpu": "40", "load_egress": "500", "load_hit_ratio": "90"}, share: 1},
+		{name: "at thresholds", meta: map[string]string{"load_cpu": "80", "load_egress": "1000", "load_hit_ratio": "50"}, share: 1},
+		// saturation 1.25 => 1/1.5625
+		{name: "cpu saturated", meta: map[string]string{"load_cpu": "100"}, share: 0.64},
+		{name: "egress saturated", meta: map[string]string{"load_cpu": "10", "load_egress": "1250"}, share: 0.64},
+		{name: "hit ratio saturated", meta: map[string]string{"load_hit_ratio": "40"}, share: 0.64},
+		// the largest saturation wins; 2 => 0.25
+		{name: "most saturated", meta: map[string]string{"load_cpu": "100", "load_egress": "2000"}, share: 0.25},
+		{name: "min share", meta: map[string]string{"load_cpu": "800"}, share: 0.2},
+		{name: "zero hit ratio", meta: map[string]string{"load_hit_ratio": "0"}, share: 0.2},
+		{name: "invalid value", meta: map[string]string{"load_cpu": "high"}, err: true},
+		{name: "negative value", meta: map[string]string{"load_egress": "-1"}, err: true},
+		{name: "invalid updated", meta: map[string]string{"load_cpu": "10", "load_updated": "yesterday"}, err: true},
+	} {
+		load, e := NewServerLoad(tc.meta, "load_", thresholds)
+
+		switch {
+		case tc.err:
+			if !errors.Is(e, ErrInvalidServerLoad) {
+				t.Errorf("%s: expected ErrInvalidServerLoad, got %v", tc.name, e)
+			}
+		case e != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, e)
+		case tc.nil:
+			if load != nil {
+				t.Errorf("%s: expected no report, got %+v", tc.name, load)
+			}
+		case load == nil:
+			t.Errorf("%s: report is not parsed", tc.name)
+		case math.Abs(load.Share-tc.share) > 1e-9:
+			t.Errorf("%s: got share %v, want %v", tc.name, load.Share, tc.share)
+		}
+	}
+}
+
+func TestServerLoadThresholdsDisabled(t *testing.T) {
+	load, e := NewServerLoad(map[string]string{"load_cpu": "100", "load_egress": "10000", "load_hit_ratio": "1"},
+		"load_", &LoadThresholds{})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if load.Share != 1 || load.CPU != 100 || load.Egress != 10000 || load.HitRatio != 1 {
+		t.Errorf("reports are not checked without thresholds, got %+v", load)
+	}
+}
+
+func TestServerLoadExpiration(t *testing.T) {
+	updated := time.Unix(1700000000, 0)
+	meta := map[string]string{"load_cpu": "160", "load_updated": "1700000000"}
+
+	load, e := NewServerLoad(meta, "load_", &LoadThresholds{CPU: 80, TTL: time.Minute})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if !load.Updated.Equal(updated) {
+		t.Errorf("got updated %s", load.Updated)
+	}
+
+	for _, tc := range []struct {
+		now   time.Time
+		share float64
+	}{
+		{now: updated, share: 0.25},
+		{now: updated.Add(time.Minute), share: 0.25},
+		// stale reports of dead exporters must not keep servers down-weighted
+		{now: updated.Add(time.Minute + time.Second), share: 1},
+	} {
+		if share := load.share(tc.now); share != tc.share {
+			t.Errorf("%s after the report: got share %v, want %v", tc.now.Sub(updated), share, tc.share)
+		}
+	}
+
+	// reports without the timestamp or the ttl never expire
+	load, e = NewServerLoad(map[string]string{"load_cpu": "160"}, "load_", &LoadThresholds{CPU: 80, TTL: time.Minute})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if share := load.share(time.Now().Add(time.Hour)); share != 0.25 {
+		t.Errorf("report without the timestamp has expired, got share %v", share)
+	}
+
+	var empty *ServerLoad
+	if share := empty.share(updated); share != 1 {
+		t.Errorf("server without reports got share %v", share)
+	}
+}
+
+// TestBalanceByChunkLoad checks that the saturated server keeps the part of its chunks
+// and its other chunks are spilled to the next ring servers
+func TestBalanceByChunkLoad(t *testing.T) {
+	const chunks = 20000
+
+	blcr, servers := newTestBalancer(t, 10)
+
+	balance := func() map[string]string {
+		balanced := make(map[string]string, chunks)
+		for i := 0; i < chunks; i++ {
+			chunk := fmt.Sprintf("hash_%05d", i)
+
+			_, server, e := blcr.BalanceByChunk("9000121080", chunk)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			balanced[chunk] = server.Name
+		}
+
+		return balanced
+	}
+
+	natural := balance()
+
+	// cpu 160 of the threshold 85 - saturation 1.88, share 0.28
+	for _, entry := range servers {
+		if entry.Name == "node-003" {
+			entry.Meta = map[string]string{"load_cpu": "160"}
+		}
+	}
+	blcr.UpdateServers(servers)
+
+	var before, kept int
+	for chunk, name := range balance() {
+		switch {
+		case natural[chunk] == "node-003" && name == "node-003":
+			before, kept = before+1, kept+1
+		case natural[chunk] == "node-003":
+			before++
+		case name == "node-003":
+			t.Fatalf("chunk %s is moved to the saturated server from %s", chunk, natural[chunk])
+		case name != natural[chunk]:
+			t.Fatalf("chunk %s of not saturated server %s is moved to %s", chunk, natural[chunk], name)
+		}
+	}
+
+	if share := float64(kept) / float64(before); math.Abs(share-math.Pow(85.0/160, 2)) > 0.1 {
+		t.Errorf("saturated server keeps %d chunks of %d", kept, before)
+	}
+}
@@ -1,60 +1,174 @@
 package balancer
 
 import (
+	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	capi "github.com/hashicorp/consul/api"
 )
 
+// BalancerServer fields used in the balancing hot path are atomic;
+// the mutex protects only rarely changed status fields
 type BalancerServer struct {
 	Ip   net.IP
+	Port int
 	Name string
 
+	meta atomic.Pointer[map[string]string]
+
 	sync.RWMutex
-	isDown      bool
+	isDown      atomic.Bool
 	lastChanged time.Time
+	transitions []*ServerTransition
+
+	state atomic.Pointer[ServerState]
+	load  atomic.Pointer[ServerLoad]
+
+	lastRequestTime atomic.Int64 // unix nano
+	handledRequests atomic.Uint64
+	failedRequests  atomic.Uint64
+	rate            rateCounter
+}
+
+// UpstreamEntry is a server definition received from consul
+type UpstreamEntry struct {
+	Name string
+	Ip   net.IP
+	Port int
+	Meta map[string]string
+}
+
+// NewUpstreamEntry prefers service address over node address;
+// node meta is overridden by service meta
+func NewUpstreamEntry(entry *capi.ServiceEntry) (_ *UpstreamEntry, e error) {
+	if entry == nil || entry.Node == nil || entry.Service == nil {
+		return nil, ErrInvalidServiceEntry
+	}
+
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%w; address - %s", ErrInvalidServiceEntry, address)
+	}
+
+	meta := make(map[string]string, len(entry.Node.Meta)+len(entry.Service.Meta))
+	for k, v := range entry.Node.Meta {
+		meta[k] = v
+	}
+	for k, v := range entry.Service.Meta {
+		meta[k] = v
+	}
+
+	return &UpstreamEntry{
+		Name: entry.Node.Node,
+		Ip:   ip,
+		Port: entry.Service.Port,
+		Meta: meta,
+	}, e
+}
+
+// Address is an upstream server identity
+func (m *UpstreamEntry) Address() string {
+	return joinHostPort(m.Ip, m.Port)
+}
+
+func newServer(entry *UpstreamEntry) *BalancerServer {
+	server := &BalancerServer{
+		Name: entry.Name,
+		Ip:   entry.Ip,
+		Port: entry.Port,
+	}
+
+	server.setMeta(entry.Meta)
+	return server
+}
+
+func joinHostPort(ip net.IP, port int) string {
+	if port == 0 {
+		return ip.String()
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
 
-	lastRequestTime time.Time
-	handledRequests uint64
+func (m *BalancerServer) Address() string {
+	return joinHostPort(m.Ip, m.Port)
 }
 
-func newServer(name string, ip *net.IP) *BalancerServer {
-	return &BalancerServer{
-		Name: name,
-		Ip:   *ip,
+func (m *BalancerServer) GetMeta() map[string]string {
+	if meta := m.meta.Load(); meta != nil {
+		return *meta
 	}
+
+	return nil
+}
+
+func (m *BalancerServer) setMeta(meta map[string]string) {
+	m.meta.Store(&meta)
 }
 
 func (m *BalancerServer) statRequest() {
-	m.Lock()
-	defer m.Unlock()
+	now := time.Now()
 
-	m.lastRequestTime = time.Now()
-	m.handledRequests++
+	m.lastRequestTime.Store(now.UnixNano())
+	m.handledRequests.Add(1)
+	m.rate.inc(now)
 }
 
 func (m *BalancerServer) resetStats() {
-	m.Lock()
-	defer m.Unlock()
-
-	m.lastRequestTime = time.Unix(0, 0)
-	m.handledRequests = uint64(0)
+	m.lastRequestTime.Store(0)
+	m.handledRequests.Store(0)
+	m.failedRequests.Store(0)
+	m.rate.reset()
 }
 
 func (m *BalancerServer) disable(disabled ...bool) {
 	disabled = append(disabled, true)
 
-	m.RLock()
-	unchanged := m.isDown == disabled[0]
-	m.RUnlock()
-
-	if unchanged {
+	if m.isDown.Load() == disabled[0] {
 		return
 	}
 
 	m.Lock()
 	defer m.Unlock()
 
+	if !m.isDown.CompareAndSwap(!disabled[0], disabled[0]) {
+		return
+	}
+
 	m.lastChanged = time.Now()
-	m.isDown = disabled[0]
+	m.statTransition(disabled[0], m.lastChanged)
+}
+
+func (m *BalancerServer) setState(state *ServerState) {
+	m.state.Store(state)
+}
+
+func (m *BalancerServer) getState() *ServerState {
+	return m.state.Load()
+}
+
+func (m *BalancerServer) setLoad(load *ServerLoad) {
+	m.load.Store(load)
+}
+
+func (m *BalancerServer) getLoad() *ServerLoad {
+	return m.load.Load()
+}
+
+// share combines operator's server state with the reported server load
+func (m *BalancerServer) share(now time.Time) float64 {
+	return m.getState().Share(now) * m.getLoad().share(now)
+}
+
+func (m *BalancerServer) getLastRequestTime() time.Time {
+	return time.Unix(0, m.lastRequestTime.Load())
 }
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	capi "github.com/hashicorp/consul/api"
+)
+
+func TestNewUpstreamEntry(t *testing.T) {
+	node := &capi.Node{Node: "node-001", Address: "10.0.0.1", Meta: map[string]string{"rack": "a", "public_hostname": "node.example.org"}}
+
+	for _, tc := range []struct {
+		name    string
+		entry   *capi.ServiceEntry
+		ip      string
+		address string
+		err     bool
+	}{
+		{
+			name:  "node address",
+			entry: &capi.ServiceEntry{Node: node, Service: &capi.AgentService{}},
+			ip:    "10.0.0.1", address: "10.0.0.1",
+		},
+		{
+			name:  "service address",
+			entry: &capi.ServiceEntry{Node: node, Service: &capi.AgentService{Address: "10.1.0.1", Port: 80}},
+			ip:    "10.1.0.1", address: "10.1.0.1:80",
+		},
+		{
+			name:  "service port",
+			entry: &capi.ServiceEntry{Node: node, Service: &capi.AgentService{Port: 8080}},
+			ip:    "10.0.0.1", address: "10.0.0.1:8080",
+		},
+		{
+			name:  "ipv6 service address",
+			entry: &capi.ServiceEntry{Node: node, Service: &capi.AgentService{Address: "2001:db8::1", Port: 8443}},
+			ip:    "2001:db8::1", address: "[2001:db8::1]:8443",
+		},
+		{
+			name:  "ipv6 node address",
+			entry: &capi.ServiceEntry{Node: &capi.Node{Node: "node-001", Address: "2001:db8::2"}, Service: &capi.AgentService{}},
+			ip:    "2001:db8::2", address: "2001:db8::2",
+		},
+		{
+			name:  "hostname address",
+			entry: &capi.ServiceEntry{Node: node, Service: &capi.AgentService{Address: "cache-01.example.org"}},
+			err:   true,
+		},
+		{name: "no service", entry: &capi.ServiceEntry{Node: node}, err: true},
+		{name: "no node", entry: &capi.ServiceEntry{Service: &capi.AgentService{}}, err: true},
+		{name: "no entry", err: true},
+	} {
+		entry, e := NewUpstreamEntry(tc.entry)
+
+		switch {
+		case tc.err:
+			if !errors.Is(e, ErrInvalidServiceEntry) {
+				t.Errorf("%s: expected ErrInvalidServiceEntry, got %v", tc.name, e)
+			}
+		case e != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, e)
+		case entry.Name != "node-001" || !entry.Ip.Equal(net.ParseIP(tc.ip)) || entry.Address() != tc.address:
+			t.Errorf("%s: got %s, %s (%s)", tc.name, entry.Name, entry.Ip, entry.Address())
+		}
+	}
+}
+
+func TestNewUpstreamEntryMeta(t *testing.T) {
+	entry, e := NewUpstreamEntry(&capi.ServiceEntry{
+		Node:    &capi.Node{Node: "node-001", Address: "10.0.0.1", Meta: map[string]string{"rack": "a", "public_hostname": "node.example.org"}},
+		Service: &capi.AgentService{Meta: map[string]string{"public_hostname": "service.example.org"}},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// service meta overrides node meta
+	if entry.Meta["rack"] != "a" || entry.Meta["public_hostname"] != "service.example.org" {
+		t.Errorf("got meta %v", entry.Meta)
+	}
+}
+
+// TestUpdateServersIdentity checks that servers are identified by their service address and port,
+// so services of the same host are different servers
+func TestUpdateServersIdentity(t *testing.T) {
+	blcr, _ := newTestBalancer(t, 0)
+
+	servers := make(map[string]*UpstreamEntry)
+	for _, entry := range []*UpstreamEntry{
+		{Name: "node-001", Ip: net.ParseIP("10.0.0.2"), Port: 8080},
+		{Name: "node-001", Ip: net.ParseIP("10.0.0.2"), Port: 80},
+		{Name: "node-002", Ip: net.ParseIP("10.0.0.10")},
+		{Name: "node-003", Ip: net.ParseIP("2001:db8::1"), Port: 443},
+	} {
+		servers[entry.Address()] = entry
+	}
+
+	blcr.UpdateServers(servers)
+
+	// the ring is sorted by ips (as strings) and ports
+	var addresses []string
+	for _, server := range blcr.upstream.Load().ring {
+		addresses = append(addresses, server.Address())
+	}
+
+	want := []string{"10.0.0.10", "10.0.0.2:80", "10.0.0.2:8080", "[2001:db8::1]:443"}
+	if len(addresses) != len(want) {
+		t.Fatalf("got upstream %v, want %v", addresses, want)
+	}
+
+	for i := range want {
+		if addresses[i] != want[i] {
+			t.Fatalf("got upstream %v, want %v", addresses, want)
+		}
+	}
+
+	// moving the service to another port is the new server, the old one is disabled
+	delete(servers, "10.0.0.2:8080")
+	servers["10.0.0.2:8081"] = &UpstreamEntry{Name: "node-001", Ip: net.ParseIP("10.0.0.2"), Port: 8081}
+	blcr.UpdateServers(servers)
+
+	for _, server := range blcr.upstream.Load().ring {
+		if server.isDown.Load() != (server.Address() == "10.0.0.2:8080") {
+			t.Errorf("%s: got down %t", server.Address(), server.isDown.Load())
+		}
+	}
+}
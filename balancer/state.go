@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"errors"
+	"time"
+)
+
+type ServerMode string
+
+const (
+	ServerModeActive      ServerMode = ""
+	ServerModeDrain       ServerMode = "drain"
+	ServerModeMaintenance ServerMode = "maintenance"
+)
+
+var (
+	ErrInvalidServerState = errors.New("server state is invalid; drain and maintenance modes are permited only")
+)
+
+// ServerState describes the operator's decision about one upstream server;
+// states are stored in consul KV, so every addie instance applies the same ones
+type ServerState struct {
+	Mode ServerMode `json:"mode"`
+
+	// drain mode shifts server's share of traffic away
+	// linearly from Since to Until
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// ServerStates - server name => server state
+type ServerStates map[string]*ServerState
+
+// ClusterServerStates - cluster name (consul service) => server states
+type ClusterServerStates map[string]ServerStates
+
+func NewDrainState(period time.Duration) *ServerState {
+	now := time.Now()
+
+	return &ServerState{
+		Mode:  ServerModeDrain,
+		Since: now,
+		Until: now.Add(period),
+	}
+}
+
+func NewMaintenanceState() *ServerState {
+	return &ServerState{
+		Mode:  ServerModeMaintenance,
+		Since: time.Now(),
+	}
+}
+
+func (m *ServerState) Validate() error {
+	if m == nil {
+		return ErrInvalidServerState
+	}
+
+	switch m.Mode {
+	case ServerModeDrain, ServerModeMaintenance:
+		return nil
+	default:
+		return ErrInvalidServerState
+	}
+}
+
+// Share returns the part of server's "natural" traffic that it should still handle;
+// 1 - all chunks, 0 - nothing
+func (m *ServerState) Share(now time.Time) float64 {
+	if m == nil {
+		return 1
+	}
+
+	switch m.Mode {
+	case ServerModeMaintenance:
+		return 0
+	case ServerModeDrain:
+		if !now.Before(m.Until) {
+			return 0
+		} else if now.Before(m.Since) {
+			return 1
+		}
+
+		return float64(m.Until.Sub(now)) / float64(m.Until.Sub(m.Since))
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,117 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestServerStateShare(t *testing.T) {
+	since := time.Unix(1700000000, 0)
+	drain := &ServerState{Mode: ServerModeDrain, Since: since, Until: since.Add(100 * time.Second)}
+
+	for _, tc := range []struct {
+		name  string
+		state *ServerState
+		now   time.Time
+		share float64
+	}{
+		{name: "active", state: nil, now: since, share: 1},
+		{name: "active mode", state: &ServerState{}, now: since, share: 1},
+		{name: "maintenance", state: &ServerState{Mode: ServerModeMaintenance, Since: since}, now: since, share: 0},
+		{name: "maintenance before since", state: &ServerState{Mode: ServerModeMaintenance, Since: since}, now: since.Add(-time.Hour), share: 0},
+		{name: "drain before since", state: drain, now: since.Add(-time.Second), share: 1},
+		{name: "drain at since", state: drain, now: since, share: 1},
+		{name: "drain quarter", state: drain, now: since.Add(25 * time.Second), share: 0.75},
+		{name: "drain half", state: drain, now: since.Add(50 * time.Second), share: 0.5},
+		{name: "drain almost done", state: drain, now: since.Add(99 * time.Second), share: 0.01},
+		{name: "drain at until", state: drain, now: since.Add(100 * time.Second), share: 0},
+		{name: "drain after until", state: drain, now: since.Add(time.Hour), share: 0},
+		{name: "drain without period", state: &ServerState{Mode: ServerModeDrain, Since: since, Until: since}, now: since, share: 0},
+	} {
+		if share := tc.state.Share(tc.now); math.Abs(share-tc.share) > 1e-9 {
+			t.Errorf("%s: got share %v, want %v", tc.name, share, tc.share)
+		}
+	}
+}
+
+// TestServerStateShareMonotonic checks that the drained server only loses its traffic
+func TestServerStateShareMonotonic(t *testing.T) {
+	state := NewDrainState(time.Minute)
+
+	previous := state.Share(state.Since)
+	for now := state.Since; !now.After(state.Until); now = now.Add(time.Second) {
+		share := state.Share(now)
+		if share > previous || share < 0 || share > 1 {
+			t.Fatalf("got share %v at %s after %v", share, now.Sub(state.Since), previous)
+		}
+
+		previous = share
+	}
+
+	if previous != 0 {
+		t.Errorf("drained server has share %v at the end of the window", previous)
+	}
+}
+
+func TestServerStateValidate(t *testing.T) {
+	var empty *ServerState
+
+	for _, tc := range []struct {
+		state *ServerState
+		valid bool
+	}{
+		{state: empty},
+		{state: &ServerState{}},
+		{state: &ServerState{Mode: "disabled"}},
+		{state: NewDrainState(time.Minute), valid: true},
+		{state: NewMaintenanceState(), valid: true},
+	} {
+		if e := tc.state.Validate(); (e == nil) != tc.valid {
+			t.Errorf("%+v: got %v, valid %t", tc.state, e, tc.valid)
+		}
+	}
+}
+
+// TestBalanceByChunkDrain checks that the server in the middle of the drain window
+// keeps about a half of its chunks and the maintenance server gets nothing
+func TestBalanceByChunkDrain(t *testing.T) {
+	const chunks = 20000
+
+	blcr, _ := newTestBalancer(t, 10)
+
+	count := func(name string) (n int) {
+		for i := 0; i < chunks; i++ {
+			_, server, e := blcr.BalanceByChunk("9000121080", fmt.Sprintf("hash_%05d", i))
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if server.Name == name {
+				n++
+			}
+		}
+
+		return
+	}
+
+	natural := count("node-003")
+	if natural == 0 {
+		t.Fatal("node-003 has no chunks")
+	}
+
+	now := time.Now()
+	blcr.UpdateServerStates(ServerStates{
+		"node-003": {Mode: ServerModeDrain, Since: now.Add(-time.Hour), Until: now.Add(time.Hour)},
+		"node-005": NewMaintenanceState(),
+	})
+
+	if drained := count("node-003"); math.Abs(float64(drained)/float64(natural)-0.5) > 0.1 {
+		t.Errorf("drained server has %d chunks of %d, want about a half", drained, natural)
+	}
+
+	if n := count("node-005"); n != 0 {
+		t.Errorf("server in maintenance has %d chunks", n)
+	}
+}
@@ -0,0 +1,343 @@
+package balancer
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+)
+
+const (
+	statsWindowSize     = 15 * 60 // seconds; the largest rps window
+	statsMaxTransitions = 32
+)
+
+type (
+	ClusterStats struct {
+		Cluster   string    `json:"cluster"`
+		Timestamp time.Time `json:"timestamp"`
+
+		Requests uint64    `json:"requests"`
+		Errors   uint64    `json:"errors"`
+		Rps      *RpsStats `json:"rps"`
+
+		// pinned viewing sessions, see BalanceBySession()
+		Sessions int `json:"sticky_sessions"`
+
+		// count of merged snapshots, see MergeClusterStats()
+		Instances int `json:"instances,omitempty"`
+
+		Servers []*ServerStats `json:"servers"`
+	}
+	ServerStats struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+
+		Requests    uint64    `json:"requests"`
+		Errors      uint64    `json:"errors"`
+		Rps         *RpsStats `json:"rps"`
+		LastRequest time.Time `json:"last_request"`
+
+		IsDown      bool                `json:"is_down"`
+		LastChanged time.Time           `json:"last_changed"`
+		Transitions []*ServerTransition `json:"transitions"`
+
+		State *ServerState `json:"state,omitempty"`
+		Load  *ServerLoad  `json:"load,omitempty"`
+		Share float64      `json:"share"`
+
+		// percentage of cluster requests handled by the server
+		// compared with the percentage it should handle
+		HashShare  float64 `json:"hash_share"`
+		IdealShare float64 `json:"ideal_share"`
+	}
+	RpsStats struct {
+		M1  float64 `json:"1m"`
+		M5  float64 `json:"5m"`
+		M15 float64 `json:"15m"`
+	}
+	ServerTransition struct {
+		IsDown    bool      `json:"is_down"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+)
+
+// rateCounter is a ring of per-second request counters;
+// counters are atomic, so a few requests may be lost on a bucket rotation
+type rateCounter struct {
+	secs   [statsWindowSize]atomic.Int64
+	counts [statsWindowSize]atomic.Uint64
+}
+
+func (m *rateCounter) inc(now time.Time) {
+	sec := now.Unix()
+	idx := sec % statsWindowSize
+
+	if last := m.secs[idx].Load(); last != sec && m.secs[idx].CompareAndSwap(last, sec) {
+		m.counts[idx].Store(0)
+	}
+
+	m.counts[idx].Add(1)
+}
+
+func (m *rateCounter) rate(now time.Time, window int64) float64 {
+	var sum uint64
+	sec := now.Unix()
+
+	for i := range m.secs {
+		if ts := m.secs[i].Load(); ts > sec-window && ts <= sec {
+			sum += m.counts[i].Load()
+		}
+	}
+
+	return float64(sum) / float64(window)
+}
+
+func (m *rateCounter) rps(now time.Time) *RpsStats {
+	return &RpsStats{
+		M1:  m.rate(now, 60),
+		M5:  m.rate(now, 5*60),
+		M15: m.rate(now, 15*60),
+	}
+}
+
+func (m *rateCounter) reset() {
+	for i := range m.secs {
+		m.secs[i].Store(0)
+		m.counts[i].Store(0)
+	}
+}
+
+func (m *BalancerServer) statError() {
+	m.failedRequests.Add(1)
+}
+
+func (m *BalancerServer) statTransition(down bool, ts time.Time) {
+	m.transitions = append(m.transitions, &ServerTransition{
+		IsDown:    down,
+		Timestamp: ts,
+	})
+
+	if len(m.transitions) > statsMaxTransitions {
+		m.transitions = m.transitions[len(m.transitions)-statsMaxTransitions:]
+	}
+}
+
+func (m *BalancerServer) getStats(now time.Time) *ServerStats {
+	m.RLock()
+	transitions := make([]*ServerTransition, len(m.transitions))
+	copy(transitions, m.transitions)
+	lastChanged := m.lastChanged
+	m.RUnlock()
+
+	state := m.getState()
+	return &ServerStats{
+		Name:    m.Name,
+		Address: m.Address(),
+
+		Requests:    m.handledRequests.Load(),
+		Errors:      m.failedRequests.Load(),
+		Rps:         m.rate.rps(now),
+		LastRequest: m.getLastRequestTime(),
+
+		IsDown:      m.isDown.Load(),
+		LastChanged: lastChanged,
+		Transitions: transitions,
+
+		State: state,
+		Load:  m.getLoad(),
+		Share: m.share(now),
+	}
+}
+
+func (m *ClusterBalancer) GetStatsSnapshot() *ClusterStats {
+	now := time.Now()
+	stats := &ClusterStats{
+		Cluster:   m.GetClusterName(),
+		Timestamp: now,
+		Rps:       &RpsStats{},
+		Sessions:  m.sessions.size(),
+	}
+
+	for _, server := range m.upstream.Load().getServers() {
+		sstats := server.getStats(now)
+
+		stats.Requests += sstats.Requests
+		stats.Errors += sstats.Errors
+		stats.Rps.M1 += sstats.Rps.M1
+		stats.Rps.M5 += sstats.Rps.M5
+		stats.Rps.M15 += sstats.Rps.M15
+
+		stats.Servers = append(stats.Servers, sstats)
+	}
+
+	stats.computeShares()
+	return stats
+}
+
+func (m *ClusterStats) computeShares() {
+	var active float64
+	for _, sstats := range m.Servers {
+		if !sstats.IsDown {
+			active += sstats.Share
+		}
+	}
+
+	for _, sstats := range m.Servers {
+		sstats.HashShare, sstats.IdealShare = 0, 0
+
+		if m.Requests != 0 {
+			sstats.HashShare = float64(sstats.Requests) * 100 / float64(m.Requests)
+		}
+
+		if !sstats.IsDown && active != 0 {
+			sstats.IdealShare = sstats.Share * 100 / active
+		}
+	}
+
+	sort.Slice(m.Servers, func(i, j int) bool {
+		return m.Servers[i].Name < m.Servers[j].Name
+	})
+}
+
+// MergeClusterStats sums counters of the given snapshots (instances, prefork children);
+// server statuses are taken from the most recent snapshot
+func MergeClusterStats(cluster string, snapshots ...*ClusterStats) *ClusterStats {
+	stats := &ClusterStats{
+		Cluster: cluster,
+		Rps:     &RpsStats{},
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+
+	servers := make(map[string]*ServerStats)
+	for _, snapshot := range snapshots {
+		if snapshot.Timestamp.After(stats.Timestamp) {
+			stats.Timestamp = snapshot.Timestamp
+		}
+
+		stats.Instances += snapshot.instances()
+		stats.Sessions += snapshot.Sessions
+
+		for _, sstats := range snapshot.Servers {
+			merged, ok := servers[sstats.Address]
+			if !ok {
+				merged = &ServerStats{Rps: &RpsStats{}}
+				servers[sstats.Address] = merged
+			}
+
+			merged.merge(sstats)
+		}
+	}
+
+	for _, sstats := range servers {
+		stats.Requests += sstats.Requests
+		stats.Errors += sstats.Errors
+		stats.Rps.M1 += sstats.Rps.M1
+		stats.Rps.M5 += sstats.Rps.M5
+		stats.Rps.M15 += sstats.Rps.M15
+
+		stats.Servers = append(stats.Servers, sstats)
+	}
+
+	stats.computeShares()
+	return stats
+}
+
+// instances returns 1 for not merged snapshots
+func (m *ClusterStats) instances() int {
+	if m.Instances == 0 {
+		return 1
+	}
+
+	return m.Instances
+}
+
+// merge must be called in snapshots' chronological order
+func (m *ServerStats) merge(sstats *ServerStats) {
+	m.Name, m.Address = sstats.Name, sstats.Address
+
+	m.Requests += sstats.Requests
+	m.Errors += sstats.Errors
+	if sstats.Rps != nil {
+		m.Rps.M1 += sstats.Rps.M1
+		m.Rps.M5 += sstats.Rps.M5
+		m.Rps.M15 += sstats.Rps.M15
+	}
+
+	if sstats.LastRequest.After(m.LastRequest) {
+		m.LastRequest = sstats.LastRequest
+	}
+
+	m.IsDown, m.LastChanged, m.Transitions = sstats.IsDown, sstats.LastChanged, sstats.Transitions
+	m.State, m.Load, m.Share = sstats.State, sstats.Load, sstats.Share
+}
+
+// RenderStats renders cluster stats as a human readable table
+func RenderStats(stats *ClusterStats) io.Reader {
+	tb := table.NewWriter()
+	defer tb.Render()
+
+	isDownHumanize := func(i bool) string {
+		switch i {
+		case false:
+			return "no"
+		default:
+			return "yes"
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	tb.SetOutputMirror(buf)
+	tb.AppendHeader(table.Row{
+		"Name", "Address", "Requests", "Last Diff", "First Diff", "Last Request Time", "Is Down", "Status Time", "State", "Share",
+	})
+
+	servers := make([]*ServerStats, len(stats.Servers))
+	copy(servers, stats.Servers)
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Requests > servers[j].Requests
+	})
+
+	round := func(val float64, precision uint) float64 {
+		ratio := math.Pow(10, float64(precision))
+		return math.Round(val*ratio) / ratio
+	}
+
+	stateHumanize := func(state *ServerState) string {
+		if state == nil {
+			return "active"
+		}
+
+		return string(state.Mode)
+	}
+
+	for idx, server := range servers {
+		var firstdiff, lastdiff float64
+
+		if servers[0].Requests != 0 {
+			firstdiff = (float64(server.Requests) * 100.00 / float64(servers[0].Requests)) - 100.00
+		}
+
+		if idx != 0 && servers[idx-1].Requests != 0 {
+			lastdiff = (float64(server.Requests) * 100.00 / float64(servers[idx-1].Requests)) - 100.00
+		}
+
+		tb.AppendRow([]interface{}{
+			server.Name, server.Address,
+			server.Requests, round(lastdiff, 2), round(firstdiff, 2), server.LastRequest.Format("2006-01-02T15:04:05.000"),
+			isDownHumanize(server.IsDown), server.LastChanged.Format("2006-01-02T15:04:05.000"),
+			stateHumanize(server.State), round(server.Share, 2),
+		})
+	}
+
+	tb.Style().Options.SeparateRows = true
+
+	return buf
+}
@@ -0,0 +1,165 @@
+package balancer
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateCounterWindows(t *testing.T) {
+	var counter rateCounter
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < 5; i++ {
+		counter.inc(start)
+	}
+	for i := 0; i < 3; i++ {
+		counter.inc(start.Add(30 * time.Second))
+	}
+
+	for _, tc := range []struct {
+		now    time.Time
+		window int64
+		rate   float64
+	}{
+		{now: start, window: 60, rate: 5.0 / 60},
+		{now: start.Add(59 * time.Second), window: 60, rate: 8.0 / 60},
+		// the window is (now - window, now]
+		{now: start.Add(60 * time.Second), window: 60, rate: 3.0 / 60},
+		{now: start.Add(90 * time.Second), window: 60, rate: 0},
+		{now: start.Add(90 * time.Second), window: 300, rate: 8.0 / 300},
+		// requests of the future are not counted
+		{now: start.Add(-time.Second), window: 60, rate: 0},
+		{now: start.Add(29 * time.Second), window: 60, rate: 5.0 / 60},
+	} {
+		if rate := counter.rate(tc.now, tc.window); math.Abs(rate-tc.rate) > 1e-9 {
+			t.Errorf("%s, window %d: got %v, want %v", tc.now.Sub(start), tc.window, rate, tc.rate)
+		}
+	}
+}
+
+func TestRateCounterWraparound(t *testing.T) {
+	var counter rateCounter
+	start := time.Unix(1700000000, 0)
+
+	// the bucket of the start second is reused after the full ring
+	for i := 0; i < 10; i++ {
+		counter.inc(start)
+	}
+
+	wrapped := start.Add(statsWindowSize * time.Second)
+	counter.inc(wrapped)
+
+	if rate := counter.rate(wrapped, 60); math.Abs(rate-1.0/60) > 1e-9 {
+		t.Errorf("got %v after the wraparound, counters of the previous lap must be reset", rate)
+	}
+
+	// a request every second for two laps; every window has one request per second
+	counter.reset()
+	now := start
+	for i := 0; i < 2*statsWindowSize; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		counter.inc(now)
+	}
+
+	rps := counter.rps(now)
+	for window, rate := range map[string]float64{"1m": rps.M1, "5m": rps.M5, "15m": rps.M15} {
+		if math.Abs(rate-1) > 1e-9 {
+			t.Errorf("%s: got %v rps, want 1", window, rate)
+		}
+	}
+}
+
+func TestMergeClusterStats(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	older := &ClusterStats{
+		Cluster:   "cache-node-internal",
+		Timestamp: now.Add(-time.Second),
+		Sessions:  3,
+		Instances: 2, // the merged snapshot of prefork children
+		Servers: []*ServerStats{
+			{
+				Name: "node-001", Address: "10.0.0.1:80", Requests: 100, Errors: 2,
+				Rps: &RpsStats{M1: 1, M5: 2, M15: 3}, LastRequest: now.Add(-time.Second), Share: 1,
+			},
+			{
+				Name: "node-002", Address: "10.0.0.2:80", Requests: 50, Errors: 1,
+				Rps: &RpsStats{M1: 0.5, M5: 0.5, M15: 0.5}, IsDown: true, Share: 1,
+			},
+		},
+	}
+
+	newer := &ClusterStats{
+		Cluster:   "cache-node-internal",
+		Timestamp: now,
+		Sessions:  4,
+		Servers: []*ServerStats{
+			{
+				Name: "node-002", Address: "10.0.0.2:80", Requests: 150, Errors: 3,
+				Rps: &RpsStats{M1: 1.5, M5: 1.5, M15: 1.5}, LastRequest: now.Add(-2 * time.Second), Share: 0.5,
+				State: &ServerState{Mode: ServerModeDrain},
+			},
+			{
+				Name: "node-003", Address: "10.0.0.3:80", Requests: 100,
+				Rps: &RpsStats{M1: 1, M5: 1, M15: 1}, Share: 1,
+			},
+		},
+	}
+
+	// the order of snapshots does not matter
+	stats := MergeClusterStats("cache-node-internal", newer, older)
+
+	if stats.Requests != 400 || stats.Errors != 6 || stats.Sessions != 7 || stats.Instances != 3 {
+		t.Errorf("got requests %d, errors %d, sessions %d, instances %d", stats.Requests, stats.Errors, stats.Sessions, stats.Instances)
+	}
+
+	if *stats.Rps != (RpsStats{M1: 4, M5: 5, M15: 6}) {
+		t.Errorf("got rps %+v", *stats.Rps)
+	}
+
+	if !stats.Timestamp.Equal(now) {
+		t.Errorf("got timestamp %s, want the latest one", stats.Timestamp)
+	}
+
+	if len(stats.Servers) != 3 {
+		t.Fatalf("got %d servers, want 3", len(stats.Servers))
+	}
+
+	// servers are sorted by name, statuses are taken from the latest snapshot
+	node1, node2, node3 := stats.Servers[0], stats.Servers[1], stats.Servers[2]
+	if node1.Name != "node-001" || node2.Name != "node-002" || node3.Name != "node-003" {
+		t.Fatalf("servers are not sorted - %s, %s, %s", node1.Name, node2.Name, node3.Name)
+	}
+
+	if node2.Requests != 200 || node2.Errors != 4 || node2.Rps.M1 != 2 {
+		t.Errorf("node-002: got requests %d, errors %d, rps %v", node2.Requests, node2.Errors, node2.Rps.M1)
+	}
+
+	if node2.IsDown || node2.Share != 0.5 || node2.State == nil || !node2.LastRequest.Equal(now.Add(-2*time.Second)) {
+		t.Errorf("node-002: statuses of the latest snapshot are expected - %+v", node2)
+	}
+
+	// shares are percentages of merged requests and of active servers' shares
+	for _, tc := range []struct {
+		sstats      *ServerStats
+		hash, ideal float64
+	}{
+		{sstats: node1, hash: 25, ideal: 40},
+		{sstats: node2, hash: 50, ideal: 20},
+		{sstats: node3, hash: 25, ideal: 40},
+	} {
+		if math.Abs(tc.sstats.HashShare-tc.hash) > 1e-9 || math.Abs(tc.sstats.IdealShare-tc.ideal) > 1e-9 {
+			t.Errorf("%s: got hash share %v, ideal share %v, want %v, %v",
+				tc.sstats.Name, tc.sstats.HashShare, tc.sstats.IdealShare, tc.hash, tc.ideal)
+		}
+	}
+}
+
+func TestMergeClusterStatsEmpty(t *testing.T) {
+	stats := MergeClusterStats("cache-node-internal")
+
+	if stats.Requests != 0 || stats.Instances != 0 || len(stats.Servers) != 0 || stats.Rps == nil {
+		t.Errorf("got %+v", stats)
+	}
+}
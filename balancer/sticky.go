@@ -0,0 +1,145 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/spaolacci/murmur3"
+)
+
+// sessionTableDefaultSize - the table size if balancer-sticky-max-sessions is not positive
+const sessionTableDefaultSize = 100000
+
+type (
+	// sessionTable pins viewing sessions (client + title + episode) to servers;
+	// pins are sliding, every balanced chunk extends the session's ttl. The table is LRU,
+	// so clients with random session headers unpin the least recently used sessions only;
+	// expired sessions are removed by lookups or evicted as the least recently used ones
+	sessionTable struct {
+		mu       sync.Mutex
+		ttl      time.Duration
+		sessions *simplelru.LRU
+	}
+	stickySession struct {
+		address string
+		expires time.Time
+	}
+)
+
+func newSessionTable(ttl time.Duration, size int) *sessionTable {
+	if size <= 0 {
+		size = sessionTableDefaultSize
+	}
+
+	// NewLRU fails on non-positive sizes only
+	sessions, _ := simplelru.NewLRU(size, nil)
+
+	return &sessionTable{
+		ttl:      ttl,
+		sessions: sessions,
+	}
+}
+
+func (m *sessionTable) lookup(key uint64, now time.Time) (address string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf, ok := m.sessions.Get(key)
+	if !ok {
+		return "", false
+	}
+
+	session := buf.(*stickySession)
+	if now.After(session.expires) {
+		m.sessions.Remove(key)
+		return "", false
+	}
+
+	session.expires = now.Add(m.ttl)
+	return session.address, ok
+}
+
+func (m *sessionTable) pin(key uint64, address string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions.Add(key, &stickySession{
+		address: address,
+		expires: now.Add(m.ttl),
+	})
+}
+
+func (m *sessionTable) size() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sessions.Len()
+}
+
+func (m *sessionTable) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions.Purge()
+}
+
+// BalanceBySession returns the session's pinned server and up to count-1 alive backups;
+// if the pinned server fails, the session is consistently hashed over the ring
+// and pinned to the first alive server
+func (m *ClusterBalancer) BalanceBySession(session string, count int) (servers []*BalancerServer, e error) {
+	now := time.Now()
+	idx1, idx2 := murmur3.Sum128([]byte(session))
+
+	// one extra server, the pinned one may be in the candidates list
+	var candidates []*BalancerServer
+	if candidates = m.getServers(count+1, idx1, idx2); len(candidates) == 0 {
+		e = ErrUpstreamUnavailable
+		return
+	}
+
+	// drained servers hand over their sessions gradually, like chunks in getServers()
+	point := float64((idx1>>32)%10000) / 10000
+
+	var primary *BalancerServer
+	if address, ok := m.sessions.lookup(idx1, now); ok {
+		if server, ok := m.upstream.Load().servers[address]; ok && !server.isDown.Load() && point < server.share(now) {
+			primary = server
+		}
+	}
+
+	if primary == nil {
+		for _, server := range candidates {
+			if server.isAvailable(now) {
+				primary = server
+				break
+			}
+		}
+
+		if primary == nil {
+			candidates[0].statError()
+			e = ErrServerUnavailable
+			return
+		}
+
+		m.sessions.pin(idx1, primary.Address(), now)
+	}
+
+	servers = append(servers, primary)
+	for _, server := range candidates {
+		if len(servers) == count {
+			break
+		}
+
+		if server != primary && server.isAvailable(now) {
+			servers = append(servers, server)
+		}
+	}
+
+	primary.statRequest()
+	return servers, e
+}
+
+func (m *BalancerServer) isAvailable(now time.Time) bool {
+	return !m.isDown.Load() && m.share(now) > 0
+}
@@ -0,0 +1,240 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+)
+
+func TestSessionTableBounded(t *testing.T) {
+	const size = 100
+
+	now := time.Now()
+	table := newSessionTable(time.Minute, size)
+
+	// the first session is used, so it's not the least recently used one
+	table.pin(0, "10.0.0.1:80", now)
+	for key := uint64(1); key < 10*size; key++ {
+		table.pin(key, fmt.Sprintf("10.0.0.%d:80", key%250+1), now)
+
+		if _, ok := table.lookup(0, now); !ok {
+			t.Fatalf("recently used session is unpinned after %d pins", key)
+		}
+	}
+
+	if table.size() != size {
+		t.Errorf("got %d sessions, want %d", table.size(), size)
+	}
+
+	if _, ok := table.lookup(1, now); ok {
+		t.Error("the least recently used session is not unpinned")
+	}
+
+	if address, ok := table.lookup(10*size-1, now); !ok || address != fmt.Sprintf("10.0.0.%d:80", (10*size-1)%250+1) {
+		t.Errorf("the last session is pinned to %q, %t", address, ok)
+	}
+}
+
+func TestSessionTableExpiration(t *testing.T) {
+	now := time.Now()
+	table := newSessionTable(time.Minute, 0)
+
+	table.pin(1, "10.0.0.1:80", now)
+	table.pin(2, "10.0.0.2:80", now)
+
+	// lookups slide the ttl
+	if _, ok := table.lookup(1, now.Add(50*time.Second)); !ok {
+		t.Fatal("session is expired before its ttl")
+	}
+
+	if _, ok := table.lookup(1, now.Add(100*time.Second)); !ok {
+		t.Error("session's ttl is not extended by the lookup")
+	}
+
+	if _, ok := table.lookup(2, now.Add(100*time.Second)); ok {
+		t.Error("expired session is returned")
+	}
+
+	// expired sessions are removed by lookups
+	if table.size() != 1 {
+		t.Errorf("got %d sessions after the lookup of the expired one, want 1", table.size())
+	}
+
+	// the expired session is pinned again
+	table.pin(2, "10.0.0.3:80", now.Add(2*time.Minute))
+	if address, ok := table.lookup(2, now.Add(2*time.Minute)); !ok || address != "10.0.0.3:80" {
+		t.Errorf("the session is pinned to %q, %t after the expiration", address, ok)
+	}
+
+	table.reset()
+	if table.size() != 0 {
+		t.Errorf("got %d sessions after the reset", table.size())
+	}
+}
+
+// newTestSession returns the session key, its table key and its drain point
+// which is not close to the bounds
+func newTestSession(t *testing.T) (session string, key uint64, point float64) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		session = fmt.Sprintf("client:9000:%d", i)
+		key, _ = murmur3.Sum128([]byte(session))
+
+		if point = float64((key>>32)%10000) / 10000; point > 0.2 && point < 0.8 {
+			return
+		}
+	}
+}
+
+// newTestPinnedServer pins the session to the server which is not the first candidate of the ring
+func newTestPinnedServer(t *testing.T, blcr *ClusterBalancer, session string, key uint64) (pinned, candidate *BalancerServer) {
+	t.Helper()
+
+	servers, e := blcr.BalanceBySession(session, 2)
+	if e != nil || len(servers) != 2 {
+		t.Fatalf("got %d servers, %v", len(servers), e)
+	}
+
+	candidate, pinned = servers[0], servers[1]
+	blcr.sessions.pin(key, pinned.Address(), time.Now())
+
+	return
+}
+
+func TestBalanceBySessionPinned(t *testing.T) {
+	blcr, _ := newTestBalancer(t, 10)
+	session, key, _ := newTestSession(t)
+
+	pinned, _ := newTestPinnedServer(t, blcr, session, key)
+
+	for i := 0; i < 10; i++ {
+		if servers, e := blcr.BalanceBySession(session, 1); e != nil || len(servers) != 1 || servers[0] != pinned {
+			t.Fatalf("got %v, %v, expected pinned %s", servers, e, pinned.Name)
+		}
+	}
+}
+
+func TestBalanceBySessionRepin(t *testing.T) {
+	session, key, point := newTestSession(t)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		state func(blcr *ClusterBalancer, entries map[string]*UpstreamEntry, pinned *BalancerServer)
+		keep  bool
+	}{
+		{name: "down", state: func(blcr *ClusterBalancer, entries map[string]*UpstreamEntry, pinned *BalancerServer) {
+			delete(entries, pinned.Address())
+			blcr.UpdateServers(entries)
+		}},
+		{name: "maintenance", state: func(blcr *ClusterBalancer, _ map[string]*UpstreamEntry, pinned *BalancerServer) {
+			blcr.UpdateServerStates(ServerStates{pinned.Name: NewMaintenanceState()})
+		}},
+		// the share of the drained server is below the session's point
+		{name: "drained past point", state: func(blcr *ClusterBalancer, _ map[string]*UpstreamEntry, pinned *BalancerServer) {
+			blcr.UpdateServerStates(ServerStates{pinned.Name: &ServerState{
+				Mode:  ServerModeDrain,
+				Since: now.Add(-time.Duration((1 - point/2) * float64(time.Hour))),
+				Until: now.Add(time.Duration(point / 2 * float64(time.Hour))),
+			}})
+		}},
+		// the share of the drained server is above the session's point
+		{name: "drained before point", keep: true, state: func(blcr *ClusterBalancer, _ map[string]*UpstreamEntry, pinned *BalancerServer) {
+			blcr.UpdateServerStates(ServerStates{pinned.Name: &ServerState{
+				Mode:  ServerModeDrain,
+				Since: now.Add(-time.Duration((1 - point) / 2 * float64(time.Hour))),
+				Until: now.Add(time.Duration((1 + point) / 2 * float64(time.Hour))),
+			}})
+		}},
+	} {
+		blcr, entries := newTestBalancer(t, 10)
+		pinned, candidate := newTestPinnedServer(t, blcr, session, key)
+
+		tc.state(blcr, entries, pinned)
+
+		expected := candidate
+		if tc.keep {
+			expected = pinned
+		}
+
+		servers, e := blcr.BalanceBySession(session, 1)
+		if e != nil || len(servers) != 1 || servers[0] != expected {
+			t.Errorf("%s: got %v, %v, expected %s", tc.name, servers, e, expected.Name)
+			continue
+		}
+
+		// the session is pinned to the new server
+		if address, ok := blcr.sessions.lookup(key, time.Now()); !ok || address != expected.Address() {
+			t.Errorf("%s: session is pinned to %q, expected %s", tc.name, address, expected.Address())
+		}
+	}
+}
+
+func TestBalanceBySessionUnavailable(t *testing.T) {
+	blcr, entries := newTestBalancer(t, 5)
+
+	states := make(ServerStates, len(entries))
+	for address, entry := range entries {
+		// the half of servers is down, the rest of them are in maintenance
+		if entry.Ip[len(entry.Ip)-1]%2 == 0 {
+			delete(entries, address)
+		} else {
+			states[entry.Name] = NewMaintenanceState()
+		}
+	}
+
+	blcr.UpdateServers(entries)
+	blcr.UpdateServerStates(states)
+
+	if servers, e := blcr.BalanceBySession("client:9000:1", 3); !errors.Is(e, ErrServerUnavailable) || len(servers) != 0 {
+		t.Errorf("got %v, %v, expected ErrServerUnavailable", servers, e)
+	}
+
+	if blcr.sessions.size() != 0 {
+		t.Error("session is pinned to the unavailable server")
+	}
+}
+
+func TestBalanceBySessionBackups(t *testing.T) {
+	blcr, entries := newTestBalancer(t, 6)
+
+	// two servers are unavailable, so there are four servers at most
+	var n int
+	for address, entry := range entries {
+		if n++; n > 2 {
+			continue
+		}
+
+		delete(entries, address)
+		blcr.UpdateServerStates(ServerStates{entry.Name: NewMaintenanceState()})
+	}
+	blcr.UpdateServers(entries)
+
+	for _, tc := range []struct{ count, servers int }{
+		{count: 1, servers: 1},
+		{count: 3, servers: 3},
+		{count: 4, servers: 4},
+		{count: 10, servers: 4},
+	} {
+		for i := 0; i < 50; i++ {
+			session := fmt.Sprintf("client:%d:1", 9000+i)
+
+			servers, e := blcr.BalanceBySession(session, tc.count)
+			if e != nil || len(servers) != tc.servers {
+				t.Fatalf("%s: got %d servers of %d, %v, expected %d", session, len(servers), tc.count, e, tc.servers)
+			}
+
+			unique := make(map[*BalancerServer]struct{}, len(servers))
+			for _, server := range servers {
+				if _, ok := unique[server]; ok || !server.isAvailable(time.Now()) {
+					t.Fatalf("%s: server %s is duplicated or unavailable", session, server.Name)
+				}
+				unique[server] = struct{}{}
+			}
+		}
+	}
+}
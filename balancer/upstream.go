@@ -1,66 +1,64 @@
 package balancer
 
 import (
-	"net"
 	"sort"
-	"sync"
 )
 
-type upstream map[string]*BalancerServer
+// upstream is an immutable snapshot of balancer's servers;
+// it must not be changed after publishing, all updates build a new one
+type upstream struct {
+	servers map[string]*BalancerServer // address (ip:port) => server
 
-func (m upstream) getServer(l *sync.RWMutex, ip string) (server *BalancerServer, ok bool) {
-	l.RLock()
-	defer l.RUnlock()
-
-	server, ok = m[ip]
-	return
+	// ring is sorted by server's ip (and port) and used for chunk balancing
+	ring []*BalancerServer
 }
 
-func (m upstream) putServer(l *sync.RWMutex, ip string, server *BalancerServer) {
-	l.Lock()
-	defer l.Unlock()
+func newUpstream(servers map[string]*BalancerServer) *upstream {
+	buf := &upstream{
+		servers: servers,
+		ring:    make([]*BalancerServer, 0, len(servers)),
+	}
 
-	m[ip] = server
-}
+	for _, server := range servers {
+		buf.ring = append(buf.ring, server)
+	}
 
-func (m upstream) copy(l *sync.RWMutex) (_ map[string]*BalancerServer) {
-	var buf = make(map[string]*BalancerServer)
+	// ip is compared first for keeping chunks on their servers after upgrade from ip-only identity
+	sort.Slice(buf.ring, func(i, j int) bool {
+		if ipi, ipj := buf.ring[i].Ip.String(), buf.ring[j].Ip.String(); ipi != ipj {
+			return ipi < ipj
+		}
 
-	l.RLock()
-	defer l.RUnlock()
+		return buf.ring[i].Port < buf.ring[j].Port
+	})
 
-	buf = m
 	return buf
 }
 
-func (m upstream) resetServersStats(l *sync.RWMutex) {
-	buf := m.copy(l)
-
-	for _, server := range buf {
-		server.resetStats()
-	}
+func (m *upstream) size() int {
+	return len(m.ring)
 }
 
-func (m upstream) getServers(l *sync.RWMutex) (servers []*BalancerServer) {
-	buf := m.copy(l)
+// copy returns a mutable copy of upstream's servers for building the next snapshot
+func (m *upstream) copy() map[string]*BalancerServer {
+	buf := make(map[string]*BalancerServer, len(m.servers))
 
-	for _, server := range buf {
-		servers = append(servers, server)
+	for ip, server := range m.servers {
+		buf[ip] = server
 	}
 
-	return
+	return buf
 }
 
-func (m upstream) getIps(l *sync.RWMutex) (ips []*net.IP, _ int) {
-	buf := m.copy(l)
-
-	for _, server := range buf {
-		ips = append(ips, &server.Ip)
+func (m *upstream) resetServersStats() {
+	for _, server := range m.ring {
+		server.resetStats()
 	}
+}
 
-	sort.Slice(ips, func(i, j int) bool {
-		return ips[i].String() < ips[j].String()
-	})
+func (m *upstream) getServers() []*BalancerServer {
+	servers := make([]*BalancerServer, len(m.ring))
+	copy(servers, m.ring)
 
-	return ips, len(ips)
+	return servers
 }
@@ -2,7 +2,10 @@ package blocklist
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"runtime"
+	"sort"
 	"sync"
 
 	"github.com/MindHunter86/addie/utils"
@@ -79,3 +82,16 @@ func (m *Blocklist) Size() (size int) {
 
 	return
 }
+
+// Digest writes blocked ips in the stable order
+func (m *Blocklist) Digest(w io.Writer) {
+	blLocker.RLock()
+	ips := make([]string, len(*m))
+	copy(ips, *m)
+	blLocker.RUnlock()
+
+	sort.Strings(ips)
+	for _, ip := range ips {
+		fmt.Fprintln(w, ip)
+	}
+}
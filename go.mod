@@ -1,17 +1,19 @@
 module github.com/MindHunter86/addie
 
-go 1.19
+go 1.23.0
 
 require (
 	github.com/gofiber/fiber/v2 v2.52.6
 	github.com/gofiber/storage/bbolt v1.3.5
 	github.com/gofiber/swagger v1.1.1
 	github.com/hashicorp/consul/api v1.30.0
+	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jedib0t/go-pretty/v6 v6.6.7
 	github.com/rs/zerolog v1.33.0
 	github.com/spaolacci/murmur3 v1.1.0
 	github.com/swaggo/swag v1.16.4
 	github.com/urfave/cli/v2 v2.27.5
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/net v0.37.0
 )
 
@@ -33,7 +35,6 @@ require (
 	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/hashicorp/go-rootcerts v1.0.2 // indirect
-	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/hashicorp/serf v0.10.1 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/klauspost/compress v1.17.9 // indirect
@@ -52,7 +53,6 @@ require (
 	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
-	go.etcd.io/bbolt v1.3.7 // indirect
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
@@ -15,6 +15,9 @@ import (
 	"github.com/urfave/cli/v2"
 
 	application "github.com/MindHunter86/addie/app"
+	"github.com/MindHunter86/addie/media"
+	"github.com/MindHunter86/addie/signer"
+	"github.com/MindHunter86/addie/simulator"
 	"github.com/MindHunter86/addie/utils"
 )
 
@@ -83,6 +86,64 @@ func main() {
 			Value: "",
 		},
 
+		// access log settings
+		&cli.StringFlag{
+			Name:  "access-log-format",
+			Usage: "json, logfmt or combined (apache/nginx); the field list is ignored for combined format",
+			Value: "json",
+		},
+		&cli.StringFlag{
+			Name: "access-log-fields",
+			Usage: "comma separated fields - time, level, id, trace, status, bytes, method, path, ip, latency, user_agent, " +
+				"referer, uid, srv, core, quality_before, quality_after, cluster, fallback, expires",
+			Value: "time,level,id,trace,status,method,path,ip,latency,user_agent,uid,srv,core," +
+				"quality_before,quality_after,cluster,fallback,expires",
+		},
+		&cli.StringSliceFlag{
+			Name: "access-log-sink",
+			Usage: "stdout, file:///PATH?max_size=BYTES&max_backups=N, syslog+udp://HOST:PORT?tag=TAG&facility=N, " +
+				"syslog+tcp://HOST:PORT, syslog+unix:///dev/log; syslog-server is added as rfc5424 sink as well",
+			Value: cli.NewStringSlice("stdout"),
+		},
+		&cli.StringSliceFlag{
+			Name:  "access-log-sample",
+			Usage: "PATH_PREFIX=RATE, e.g. /videos/media/ts=0.1; the longest prefix wins, 5xx records are never sampled out",
+		},
+
+		// tracing settings
+		&cli.StringFlag{
+			Name:  "tracing-exporter",
+			Usage: "none, stdout (info log record per span) or otlp (OTLP/HTTP json to the collector)",
+			Value: "none",
+		},
+		&cli.StringFlag{
+			Name:  "tracing-otlp-endpoint",
+			Usage: "OTLP/HTTP traces endpoint of the collector",
+			Value: "http://127.0.0.1:4318/v1/traces",
+		},
+		&cli.DurationFlag{
+			Name:  "tracing-otlp-timeout",
+			Value: 3 * time.Second,
+		},
+		&cli.Float64Flag{
+			Name:  "tracing-sample-ratio",
+			Usage: "sample ratio of requests without traceparent header; the sampled flag of traceparent is respected",
+			Value: 0.01,
+		},
+		&cli.IntFlag{
+			Name:  "tracing-batch-size",
+			Value: 512,
+		},
+		&cli.DurationFlag{
+			Name:  "tracing-batch-timeout",
+			Value: 5 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "tracing-queue-size",
+			Usage: "max count of traces waiting for the export; traces are dropped if the queue is full",
+			Value: 2048,
+		},
+
 		// http client settings
 		&cli.BoolFlag{
 			Name:  "http-client-insecure",
@@ -139,6 +200,11 @@ func main() {
 			if enabled, the application will need to be ran
 			through a shell because prefork mode sets environment variables`,
 		},
+		&cli.DurationFlag{
+			Name:  "http-prefork-check-interval",
+			Usage: "how often prefork children report their state digests to the parent for divergence checks",
+			Value: 10 * time.Second,
+		},
 		&cli.BoolFlag{
 			Name:  "http-cors",
 			Usage: "enable cors requests serving",
@@ -162,6 +228,48 @@ func main() {
 			Name:  "limiter-records-duration",
 			Value: 5 * time.Minute,
 		},
+		&cli.DurationFlag{
+			Name: "balancer-stats-publish-interval",
+			Usage: "how often balancers' stats are published to consul KV for ?scope=instance|cluster views; " +
+				"prefork children send them to the parent; 0 - disabled; keys are held by the consul session " +
+				"with TTL of 3 intervals (session:write ACL is required), consul deletes them when the instance is gone",
+			Value: 15 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "balancer-stats-instance",
+			Usage: "unique instance name of published stats; hostname with http-listen-addr by default",
+		},
+		&cli.StringFlag{
+			Name: "balancer-load-meta-prefix",
+			Usage: "consul service meta prefix of cache nodes' load reports - cpu (%), egress (Mbit/s), " +
+				"hit_ratio (%) and updated (unix time) keys; empty value disables load feedback",
+			Value: "load_",
+		},
+		&cli.Float64Flag{
+			Name:  "balancer-load-cpu-threshold",
+			Usage: "cpu usage (%) of saturated cache node; 0 - disabled",
+			Value: 85,
+		},
+		&cli.Float64Flag{
+			Name:  "balancer-load-egress-threshold",
+			Usage: "egress bandwidth (Mbit/s) of saturated cache node; 0 - disabled",
+			Value: 0,
+		},
+		&cli.Float64Flag{
+			Name:  "balancer-load-hit-ratio-threshold",
+			Usage: "disk hit ratio (%) of saturated cache node, lower values are saturated; 0 - disabled",
+			Value: 0,
+		},
+		&cli.Float64Flag{
+			Name:  "balancer-load-min-share",
+			Usage: "the lowest part of its chunks that saturated cache node keeps",
+			Value: 0.2,
+		},
+		&cli.DurationFlag{
+			Name:  "balancer-load-report-ttl",
+			Usage: "load reports older than ttl are ignored; 0 - reports never expire",
+			Value: time.Minute,
+		},
 
 		// bbolt settings
 		&cli.StringFlag{
@@ -169,6 +277,49 @@ func main() {
 			Value: ".",
 		},
 
+		// titles cache settings
+		&cli.IntFlag{
+			Name:  "title-cache-size",
+			Usage: "LRU size of cached titles from the api",
+			Value: 4096,
+		},
+		&cli.DurationFlag{
+			Name:  "title-cache-ttl",
+			Usage: "titles are requested from the api again after ttl, so re-encoded series get new quality hashes",
+			Value: 30 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "title-cache-negative-ttl",
+			Usage: "ttl of titles and series which are missing in the api",
+			Value: 5 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name: "title-cache-stale-ttl",
+			Usage: "expired titles are served for stale ttl while they are revalidated in background, " +
+				"so the titles cache covers api outages; 0 - stale titles are not served",
+			Value: 6 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name: "title-cache-persist",
+			Usage: "persist titles cache in database-prefix bbolt database; in prefork mode the database " +
+				"is owned by the parent, children forward fetched titles to it",
+		},
+		&cli.DurationFlag{
+			Name: "title-prewarm-interval",
+			Usage: "poll `INTERVAL` of the api updates for pushing new and changed titles to the cache; " +
+				"0 - disabled; in prefork mode the parent polls the api and pushes titles to children",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "title-prewarm-feed",
+			Usage: "local feed `FILE` in the getUpdates response format, it is polled instead of the api",
+		},
+		&cli.IntFlag{
+			Name:  "title-prewarm-limit",
+			Usage: "count of titles in one page of the api updates request; pages are requested until the short one",
+			Value: 50,
+		},
+
 		// anilibria settings
 		&cli.StringFlag{
 			Name:  "anilibria-baseurl",
@@ -180,6 +331,47 @@ func main() {
 			Usage: "",
 			Value: "https://api.anilibria.tv/v2",
 		},
+		&cli.IntFlag{
+			Name:  "anilibria-api-max-concurrency",
+			Usage: "max count of concurrent api requests; 0 - unlimited",
+			Value: 16,
+		},
+		&cli.DurationFlag{
+			Name:  "anilibria-api-queue-timeout",
+			Usage: "max wait `TIMEOUT` of the api request if concurrency cap is reached; the original quality is served after it",
+			Value: 500 * time.Millisecond,
+		},
+		&cli.IntFlag{
+			Name: "anilibria-api-retries",
+			Usage: "retries of failed GET api requests of background revalidation and prewarming; " +
+				"timeouts, 5xx and 429 responses are retried, requests of clients make one attempt",
+			Value: 2,
+		},
+		&cli.DurationFlag{
+			Name:  "anilibria-api-retry-backoff",
+			Usage: "base `BACKOFF` of api retries, it's doubled every attempt and jittered",
+			Value: 100 * time.Millisecond,
+		},
+		&cli.DurationFlag{
+			Name:  "anilibria-api-retry-max-backoff",
+			Usage: "max `BACKOFF` of api retries",
+			Value: time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "anilibria-api-retry-timeout",
+			Usage: "overall `TIMEOUT` of the api request with all its retries and backoffs",
+			Value: 10 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "anilibria-api-breaker-threshold",
+			Usage: "consecutive failed api requests for opening the circuit breaker; 0 - disabled",
+			Value: 5,
+		},
+		&cli.DurationFlag{
+			Name:  "anilibria-api-breaker-cooldown",
+			Usage: "api requests are rejected for `COOLDOWN` after opening the circuit breaker",
+			Value: 30 * time.Second,
+		},
 
 		// balancer
 		&cli.UintFlag{
@@ -187,6 +379,23 @@ func main() {
 			Usage: "max fails for one request; max value - 10",
 			Value: 3,
 		},
+		&cli.IntFlag{
+			Name:  "balancer-max-backups",
+			Usage: "max count of backup servers that client may request with X-Location-Backups header; 0 - disabled",
+			Value: 2,
+		},
+		&cli.DurationFlag{
+			Name: "balancer-sticky-ttl",
+			Usage: "how long a viewing session (client + title + episode) stays pinned to its server after the last chunk; " +
+				"sticky mode is enabled per cluster with balancer-sticky-clusters runtime param",
+			Value: 5 * time.Minute,
+		},
+		&cli.IntFlag{
+			Name: "balancer-sticky-max-sessions",
+			Usage: "max count of pinned viewing sessions per cluster; the least recently used sessions " +
+				"are unpinned when the table is full and hashed over the ring as usual",
+			Value: 100000,
+		},
 		&cli.BoolFlag{
 			Name:  "balancer-full-bypass",
 			Usage: "use X-Server header as a balance target",
@@ -213,16 +422,60 @@ func main() {
 		// ...
 		&cli.DurationFlag{
 			Name:    "link-expiration",
-			Usage:   "",
+			Usage:   "lifetime of links which are not matched by consul KV link-expiration-rules",
 			Value:   10 * time.Second,
 			EnvVars: []string{"LINK_EXPIRATION"},
 		},
+		&cli.DurationFlag{
+			Name: "link-expiration-bucket",
+			Usage: "round expiration time of links up to the bucket boundary, so identical requests inside " +
+				"the bucket get identical cacheable links; links live up to link-expiration + bucket; 0 - disabled",
+		},
+		&cli.IntFlag{
+			Name:  "link-sign-memo-size",
+			Usage: "LRU size of signed links memoized inside link-expiration-bucket; 0 - disabled",
+			Value: 65536,
+		},
+		&cli.StringFlag{
+			Name:    "link-secret",
+			Usage:   "legacy signing secret without key id; links signed with it have no kid argument",
+			EnvVars: []string{"SIGN_SECRET"},
+		},
+		&cli.StringFlag{
+			Name: "link-keyring-file",
+			Usage: "json array of signing keys - " +
+				`[{"id": "ID", "secret": "SECRET", "not_before": "RFC3339", "not_after": "RFC3339"}]; ` +
+				"keys are merged with link-secret and consul KV link-keyring keys, the newest valid key signs links",
+			EnvVars: []string{"SIGN_KEYRING_FILE"},
+		},
 		&cli.StringFlag{
-			Name:        "link-secret",
-			Usage:       "",
-			Value:       "TZj3Ts1Lsvk",
-			EnvVars:     []string{"SIGN_SECRET"},
-			DefaultText: "CHANGE DEFAULT SECRET",
+			Name:  "link-sign-scheme",
+			Usage: "default signing scheme - md5 (legacy secure_link), hmac-sha256, nginx-template, akamai, cloudfront",
+			Value: "md5",
+		},
+		&cli.StringSliceFlag{
+			Name:  "link-sign-cluster-scheme",
+			Usage: "CLUSTER=SCHEME, signing scheme of links to servers of the consul service",
+		},
+		&cli.StringFlag{
+			Name: "link-sign-template",
+			Usage: "nginx secure_link_md5 expression of nginx-template scheme; variables - $secure_link_expires, " +
+				"$uri, $server, $uid, $remote_addr (client ip binding), $kid, $secret",
+			Value: "$secure_link_expires$uri$server$uid $secret",
+		},
+		&cli.BoolFlag{
+			Name:  "link-sign-akamai-ip",
+			Usage: "bind akamai tokens to the client ip",
+		},
+		&cli.DurationFlag{
+			Name:  "link-keyring-reload-interval",
+			Usage: "how often link-keyring-file is checked for changes",
+			Value: 10 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name: "link-keyring-consul",
+			Usage: "signing keys are managed in consul KV link-keyring; without it link-secret or link-keyring-file " +
+				"must have the valid key at startup, with it the application is not ready until consul keys are received",
 		},
 
 		// consul settings
@@ -250,12 +503,184 @@ func main() {
 			Usage: "add domain for all service entries",
 			Value: "libria.fun",
 		},
+		&cli.StringFlag{
+			Name:  "playlist-origin",
+			Usage: "base `URL` of the origin with HLS playlists for /videos/media/playlist rewriting",
+		},
+		&cli.StringFlag{
+			Name:  "playlist-root",
+			Usage: "`DIR` with HLS playlists for /videos/media/playlist rewriting; used instead of playlist-origin",
+		},
+		&cli.DurationFlag{
+			Name:  "playlist-fetch-timeout",
+			Value: 3 * time.Second,
+		},
+		&cli.StringSliceFlag{
+			Name: "media-route",
+			Usage: "layout of media uris with {title}, {episode}, {quality}, {name} and {ext} captures; " +
+				"{capture:regexp} overrides the capture expression, {name} and {ext} are required, " +
+				"{*} matches any path segment; " +
+				"routes are matched in the given order",
+			Value: cli.NewStringSlice(media.DefaultRoutes...),
+		},
+		&cli.StringFlag{
+			Name: "balancer-destination-template",
+			Usage: `go template of sign target (host or host:port) for balanced servers;
+			fields: .Name, .Ip, .Port, .Meta (consul node and service meta), .Domain (consul-entries-domain);
+			funcs: replace, trimSuffix, trimPrefix, lower, host (brackets for ipv6), hostport`,
+			Value: `{{ replace .Name "-node" "" }}.{{ .Domain }}`,
+		},
+		&cli.StringSliceFlag{
+			Name: "balancer-destination-rule",
+			Usage: `per-cluster sign target rule, overrides balancer-destination-template; may be repeated;
+			formats: CLUSTER=template:GO_TEMPLATE or CLUSTER=regexp:/EXPR/REPLACEMENT/ (applied to node name);
+			CLUSTER is a consul service name; ex: cache-node-internal=regexp:/^(.+)-node$/${1}.libria.fun/`,
+		},
+		&cli.StringFlag{
+			Name:  "balancer-destination-meta-key",
+			Usage: "consul node or service meta key with sign target that overrides all destination rules; empty - disabled",
+			Value: "public_hostname",
+		},
+		&cli.DurationFlag{
+			Name: "consul-watch-stall-timeout",
+			Usage: "consul watchers are considered as stalled if there is no responses for this time; " +
+				"must be greater than the blocking query wait time (5m by default)",
+			Value: 6 * time.Minute,
+		},
 		&cli.StringFlag{
 			Name:  "consul-kv-prefix",
 			Value: fmt.Sprintf("anilibria/%s", app.Name),
 		},
 	}
 
+	app.Commands = []*cli.Command{
+		{
+			Name:  "balancer",
+			Usage: "balancer utilities",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "simulate",
+					Usage: "run chunk requests through the cluster balancer and report load skew and rebalance impact",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{
+							Name:  "server",
+							Usage: "upstream server in `NAME=IP` format; may be repeated",
+						},
+						&cli.StringFlag{
+							Name:  "consul-snapshot",
+							Usage: "JSON `FILE` with /v1/health/service/:service consul response",
+						},
+						&cli.StringFlag{
+							Name:  "access-log",
+							Usage: "access log `FILE`; chunk uris are extracted from every line",
+						},
+						&cli.IntFlag{
+							Name:  "generate-requests",
+							Usage: "count of generated requests if access log is not defined",
+							Value: 100000,
+						},
+						&cli.UintFlag{
+							Name:  "generate-titles",
+							Value: 500,
+						},
+						&cli.UintFlag{
+							Name:  "generate-episodes",
+							Value: 12,
+						},
+						&cli.UintFlag{
+							Name:  "generate-chunks",
+							Value: 400,
+						},
+						&cli.Int64Flag{
+							Name:  "generate-seed",
+							Value: 1,
+						},
+						&cli.StringSliceFlag{
+							Name:  "add-node",
+							Usage: "report chunks movement if `NAME=IP` node would be added; may be repeated",
+						},
+						&cli.StringSliceFlag{
+							Name:  "remove-node",
+							Usage: "report chunks movement if `NAME` node would be removed; may be repeated",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return simulator.NewSimulator(c, &log).Run()
+					},
+				},
+			},
+		},
+		{
+			Name:  "sign",
+			Usage: "link signing utilities; keys are loaded from link-secret and link-keyring-file",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "recompute the signature of the link with link-sign-* scheme and report why it is not valid",
+					ArgsUsage: "LINK",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "uid",
+							Usage: "user id the link has been signed for",
+						},
+						&cli.StringFlag{
+							Name:  "server",
+							Usage: "server the viewer requested; the link's host is used if empty",
+						},
+						&cli.StringFlag{
+							Name:  "client-ip",
+							Usage: "client ip for schemes with the ip binding",
+						},
+						&cli.StringFlag{
+							Name:  "cluster",
+							Usage: "cluster of the server for link-sign-cluster-scheme",
+						},
+					},
+					Action: func(c *cli.Context) (e error) {
+						var tool *signer.Tool
+						if tool, e = signer.NewTool(c, &log); e != nil {
+							return
+						}
+						return tool.Verify()
+					},
+				},
+				{
+					Name:      "generate",
+					Usage:     "generate the signed link for tests",
+					ArgsUsage: "URI",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "server",
+							Usage: "server of the link",
+						},
+						&cli.StringFlag{
+							Name: "uid",
+						},
+						&cli.StringFlag{
+							Name:  "client-ip",
+							Usage: "client ip for schemes with the ip binding",
+						},
+						&cli.StringFlag{
+							Name:  "cluster",
+							Usage: "cluster of the server for link-sign-cluster-scheme",
+						},
+						&cli.DurationFlag{
+							Name:  "expiration",
+							Value: time.Hour,
+						},
+					},
+					Action: func(c *cli.Context) (e error) {
+						var tool *signer.Tool
+						if tool, e = signer.NewTool(c, &log); e != nil {
+							return
+						}
+						return tool.Generate()
+					},
+				},
+			},
+		},
+	}
+
 	app.Action = func(c *cli.Context) (e error) {
 		var lvl zerolog.Level
 		if lvl, e = zerolog.ParseLevel(c.String("log-level")); e != nil {
@@ -299,7 +724,7 @@ func main() {
 		}
 
 		log.Debug().Msgf("%s (%s) builded %s now is ready...", app.Name, version, buildtime)
-		return application.NewApp(c, &log, syslogWriter).Bootstrap()
+		return application.NewApp(c, &log).Bootstrap()
 	}
 
 	// TODO sort.Sort of Flags uses too much allocs; temporary disabled
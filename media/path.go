@@ -0,0 +1,90 @@
+package media
+
+import (
+	"strings"
+
+	"github.com/MindHunter86/addie/utils"
+)
+
+type Kind uint8
+
+const (
+	KindUnknown  Kind = iota
+	KindChunk         // .ts
+	KindPlaylist      // .m3u8
+	KindSegment       // fMP4 .m4s
+	KindInit          // fMP4 init segment .mp4
+	KindSubtitle      // .vtt, .srt, .ass
+)
+
+var kindByExt = map[string]Kind{
+	"ts":   KindChunk,
+	"m3u8": KindPlaylist,
+	"m4s":  KindSegment,
+	"mp4":  KindInit,
+	"vtt":  KindSubtitle,
+	"srt":  KindSubtitle,
+	"ass":  KindSubtitle,
+}
+
+func (m Kind) String() string {
+	switch m {
+	case KindChunk:
+		return "chunk"
+	case KindPlaylist:
+		return "playlist"
+	case KindSegment:
+		return "segment"
+	case KindInit:
+		return "init"
+	case KindSubtitle:
+		return "subtitle"
+	default:
+		return "unknown"
+	}
+}
+
+// Path - captures of the matched route; ids and quality are empty if the route has no such captures
+type Path struct {
+	Uri   string
+	Route string
+
+	Title, Episode     uint16
+	TitleId, EpisodeId string
+
+	Quality      string
+	TitleQuality utils.TitleQuality
+
+	Name, Ext string
+}
+
+func (m *Path) Kind() Kind {
+	return kindByExt[m.Ext]
+}
+
+// Prefix is the balancing prefix - title, episode and quality without separators
+func (m *Path) Prefix() string {
+	return m.TitleId + m.EpisodeId + m.Quality
+}
+
+// ChunkName is the balancing name; ts chunks have no extension as names of the replaced chunk regexp,
+// so their balancing keys are kept. Other media are balanced by the whole name with the extension
+func (m *Path) ChunkName() string {
+	if m.Kind() == KindChunk {
+		return m.Name
+	}
+
+	return m.Name + "." + m.Ext
+}
+
+// Hash returns the quality hash of the title - hash_00028.ts, hash_00028.m4s, hash.m3u8
+func (m *Path) Hash() (hash string, ok bool) {
+	switch m.Kind() {
+	case KindChunk, KindSegment:
+		hash, _, ok = strings.Cut(m.Name, "_")
+	case KindPlaylist:
+		hash, ok = m.Name, m.Name != ""
+	}
+
+	return hash, ok && hash != ""
+}
@@ -0,0 +1,141 @@
+package media
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrNotPlaylist = errors.New("playlist has no #EXTM3U header")
+
+type LineKind uint8
+
+const (
+	LineTag         LineKind = iota // tags and comments which are written as is
+	LineVariantInfo                 // #EXT-X-STREAM-INF, the next uri line is its variant
+	LineVariant                     // media playlist of the master playlist
+	LineRendition                   // #EXT-X-MEDIA and #EXT-X-I-FRAME-STREAM-INF with URI attribute
+	LineSegment
+	LineMap // #EXT-X-MAP init segment
+)
+
+// tags with URI attribute which are rewritten; #EXT-X-KEY is not rewritten, keys are not on cache nodes
+var uriTags = map[string]LineKind{
+	"#EXT-X-MEDIA":              LineRendition,
+	"#EXT-X-I-FRAME-STREAM-INF": LineRendition,
+	"#EXT-X-MAP":                LineMap,
+}
+
+var uriAttribute = regexp.MustCompile(`URI="[^"]*"`)
+
+type Line struct {
+	Kind LineKind
+	Raw  string
+
+	// uri of uri lines or URI attribute of tags
+	Uri string
+
+	info    *Line // #EXT-X-STREAM-INF line of the variant
+	removed bool
+}
+
+// Remove removes the line from the playlist; variants are removed with their #EXT-X-STREAM-INF lines
+func (m *Line) Remove() {
+	if m.removed = true; m.info != nil {
+		m.info.removed = true
+	}
+}
+
+type Playlist struct {
+	Lines []*Line
+
+	// master playlists have variants, media playlists have segments
+	Master bool
+}
+
+// ParsePlaylist parses HLS master and media playlists line by line;
+// uris are not resolved, see ResolveUri
+func ParsePlaylist(r io.Reader) (_ *Playlist, e error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		if e = scanner.Err(); e == nil {
+			e = ErrNotPlaylist
+		}
+		return
+	}
+
+	playlist := &Playlist{
+		Lines: []*Line{{Kind: LineTag, Raw: "#EXTM3U"}},
+	}
+
+	var info *Line
+	for scanner.Scan() {
+		line := &Line{Raw: strings.TrimSpace(scanner.Text())}
+
+		switch tag, _, _ := strings.Cut(line.Raw, ":"); {
+		case line.Raw == "":
+			line.Kind = LineTag
+		case tag == "#EXT-X-STREAM-INF":
+			line.Kind, info, playlist.Master = LineVariantInfo, line, true
+		case strings.HasPrefix(line.Raw, "#"):
+			line.Kind = LineTag
+			if kind, ok := uriTags[tag]; ok {
+				if attr := uriAttribute.FindString(line.Raw); attr != "" {
+					line.Kind, line.Uri = kind, attr[len(`URI="`):len(attr)-1]
+				}
+			}
+		case info != nil:
+			line.Kind, line.Uri, line.info, info = LineVariant, line.Raw, info, nil
+		default:
+			line.Kind, line.Uri = LineSegment, line.Raw
+		}
+
+		playlist.Lines = append(playlist.Lines, line)
+	}
+
+	return playlist, scanner.Err()
+}
+
+// WriteTo writes the playlist with rewritten uris, removed lines are skipped
+func (m *Playlist) WriteTo(w io.Writer) (n int64, e error) {
+	bw := bufio.NewWriter(w)
+
+	for _, line := range m.Lines {
+		if line.removed {
+			continue
+		}
+
+		buf := line.Raw
+		switch line.Kind {
+		case LineVariant, LineSegment:
+			buf = line.Uri
+		case LineRendition, LineMap:
+			buf = uriAttribute.ReplaceAllLiteralString(line.Raw, `URI="`+line.Uri+`"`)
+		}
+
+		var nn int
+		if nn, e = bw.WriteString(buf + "\n"); e != nil {
+			return
+		}
+		n += int64(nn)
+	}
+
+	return n, bw.Flush()
+}
+
+// ResolveUri resolves the playlist's relative uri against the playlist's uri;
+// absolute urls of other hosts are returned with ok = false
+func ResolveUri(playlist, uri string) (_ string, ok bool) {
+	ref, e := url.Parse(uri)
+	if e != nil || ref.IsAbs() || ref.Host != "" {
+		return uri, false
+	}
+
+	base := &url.URL{Path: playlist}
+	return base.ResolveReference(&url.URL{Path: ref.Path}).Path, true
+}
@@ -0,0 +1,229 @@
+package media
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="ru",DEFAULT=YES,URI="audio/ru.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=854x480,AUDIO="aac"
+480/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1280x720,AUDIO="aac"
+https://cdn.example.org/720/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="480/iframes.m3u8"
+`
+
+const testMediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.org/key"
+#EXT-X-MAP:URI="init.mp4"
+
+#EXTINF:6.000,
+fff6d1a7_00001.ts
+#EXTINF:6.000,
+/videos/media/ts/9000/1/720/fff6d1a7_00002.ts
+#EXT-X-ENDLIST
+`
+
+func TestParsePlaylist(t *testing.T) {
+	type line struct {
+		kind LineKind
+		uri  string
+	}
+
+	for _, tc := range []struct {
+		name     string
+		playlist string
+		master   bool
+		lines    []line
+	}{
+		{
+			name:     "master",
+			playlist: testMasterPlaylist,
+			master:   true,
+			lines: []line{
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineRendition, uri: "audio/ru.m3u8"},
+				{kind: LineVariantInfo},
+				{kind: LineVariant, uri: "480/index.m3u8"},
+				{kind: LineVariantInfo},
+				{kind: LineVariant, uri: "https://cdn.example.org/720/index.m3u8"},
+				{kind: LineRendition, uri: "480/iframes.m3u8"},
+			},
+		},
+		{
+			name:     "media",
+			playlist: testMediaPlaylist,
+			lines: []line{
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineTag}, // keys are not rewritten
+				{kind: LineMap, uri: "init.mp4"},
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineSegment, uri: "fff6d1a7_00001.ts"},
+				{kind: LineTag},
+				{kind: LineSegment, uri: "/videos/media/ts/9000/1/720/fff6d1a7_00002.ts"},
+				{kind: LineTag},
+			},
+		},
+		{
+			name:     "crlf",
+			playlist: "#EXTM3U\r\n#EXTINF:6.000,\r\n00001.ts\r\n",
+			lines: []line{
+				{kind: LineTag},
+				{kind: LineTag},
+				{kind: LineSegment, uri: "00001.ts"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			playlist, e := ParsePlaylist(strings.NewReader(tc.playlist))
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if playlist.Master != tc.master {
+				t.Errorf("master is %t, want %t", playlist.Master, tc.master)
+			}
+
+			if len(playlist.Lines) != len(tc.lines) {
+				t.Fatalf("got %d lines, want %d", len(playlist.Lines), len(tc.lines))
+			}
+
+			for idx, want := range tc.lines {
+				if got := playlist.Lines[idx]; got.Kind != want.kind || got.Uri != want.uri {
+					t.Errorf("line %d %q: got kind %d uri %q, want kind %d uri %q",
+						idx, got.Raw, got.Kind, got.Uri, want.kind, want.uri)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePlaylistInvalid(t *testing.T) {
+	for _, buf := range []string{"", "\n", "#EXTINF:6.000,\n00001.ts\n", "<html></html>"} {
+		if _, e := ParsePlaylist(strings.NewReader(buf)); !errors.Is(e, ErrNotPlaylist) {
+			t.Errorf("%q: expected ErrNotPlaylist, got %v", buf, e)
+		}
+	}
+}
+
+func TestPlaylistWriteTo(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		playlist string
+		rewrite  func(*Line)
+		want     string
+	}{
+		{
+			name:     "master passthrough",
+			playlist: testMasterPlaylist,
+			rewrite:  func(*Line) {},
+			want:     testMasterPlaylist,
+		},
+		{
+			name:     "media passthrough",
+			playlist: testMediaPlaylist,
+			rewrite:  func(*Line) {},
+			want:     testMediaPlaylist,
+		},
+		{
+			name:     "master rewrite and remove",
+			playlist: testMasterPlaylist,
+			rewrite: func(line *Line) {
+				switch {
+				case strings.HasPrefix(line.Uri, "https://"):
+					line.Remove()
+				case line.Uri != "":
+					line.Uri = "/videos/media/playlist/9000/1/" + line.Uri
+				}
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="ru",DEFAULT=YES,URI="/videos/media/playlist/9000/1/audio/ru.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=854x480,AUDIO="aac"
+/videos/media/playlist/9000/1/480/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="/videos/media/playlist/9000/1/480/iframes.m3u8"
+`,
+		},
+		{
+			name:     "media rewrite",
+			playlist: testMediaPlaylist,
+			rewrite: func(line *Line) {
+				if line.Kind == LineSegment || line.Kind == LineMap {
+					line.Uri = "/videos/media/ts/9000/1/720/" + line.Uri[strings.LastIndex(line.Uri, "/")+1:]
+				}
+			},
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.org/key"
+#EXT-X-MAP:URI="/videos/media/ts/9000/1/720/init.mp4"
+
+#EXTINF:6.000,
+/videos/media/ts/9000/1/720/fff6d1a7_00001.ts
+#EXTINF:6.000,
+/videos/media/ts/9000/1/720/fff6d1a7_00002.ts
+#EXT-X-ENDLIST
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			playlist, e := ParsePlaylist(strings.NewReader(tc.playlist))
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			for _, line := range playlist.Lines {
+				tc.rewrite(line)
+			}
+
+			var buf strings.Builder
+			n, e := playlist.WriteTo(&buf)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			if buf.String() != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", buf.String(), tc.want)
+			}
+
+			if n != int64(buf.Len()) {
+				t.Errorf("written %d bytes, reported %d", buf.Len(), n)
+			}
+		})
+	}
+}
+
+func TestResolveUri(t *testing.T) {
+	const base = "/videos/media/playlist/9000/1/master.m3u8"
+
+	for _, tc := range []struct {
+		uri  string
+		want string
+		ok   bool
+	}{
+		{uri: "480/index.m3u8", want: "/videos/media/playlist/9000/1/480/index.m3u8", ok: true},
+		{uri: "../2/master.m3u8", want: "/videos/media/playlist/9000/2/master.m3u8", ok: true},
+		{uri: "fff6d1a7_00001.ts?t=1", want: "/videos/media/playlist/9000/1/fff6d1a7_00001.ts", ok: true},
+		{uri: "/videos/media/ts/9000/1/720/fff6d1a7_00001.ts", want: "/videos/media/ts/9000/1/720/fff6d1a7_00001.ts", ok: true},
+		{uri: "https://cdn.example.org/720/index.m3u8", want: "https://cdn.example.org/720/index.m3u8"},
+		{uri: "//cdn.example.org/720/index.m3u8", want: "//cdn.example.org/720/index.m3u8"},
+		{uri: "%zz", want: "%zz"},
+	} {
+		got, ok := ResolveUri(base, tc.uri)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %s %t, want %s %t", tc.uri, got, ok, tc.want, tc.ok)
+		}
+	}
+}
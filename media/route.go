@@ -0,0 +1,232 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MindHunter86/addie/utils"
+)
+
+var (
+	ErrEmptyUri        = errors.New("uri is empty")
+	ErrRouteNotMatched = errors.New("uri is not matched by any media route")
+	ErrInvalidTitle    = errors.New("title id is invalid")
+	ErrInvalidEpisode  = errors.New("episode id is invalid")
+	ErrInvalidQuality  = errors.New("quality is invalid; 480, 720, 1080 values are permited only")
+
+	ErrInvalidRoute = errors.New("media route is invalid")
+)
+
+// ParseError - the uri and the route which matched it; Err is one of Err* values
+type ParseError struct {
+	Uri   string
+	Route string
+	Err   error
+}
+
+func (m *ParseError) Error() string {
+	if m.Route == "" {
+		return fmt.Sprintf("%s - %s", m.Err.Error(), m.Uri)
+	}
+
+	return fmt.Sprintf("%s - %s (route %s)", m.Err.Error(), m.Uri, m.Route)
+}
+
+func (m *ParseError) Unwrap() error { return m.Err }
+
+// route captures; name and ext are required in every route
+const (
+	CaptureTitle   = "title"
+	CaptureEpisode = "episode"
+	CaptureQuality = "quality"
+	CaptureName    = "name"
+	CaptureExt     = "ext"
+
+	// CaptureSegment is the anonymous path segment, it's not captured and may be repeated
+	CaptureSegment = "*"
+)
+
+// captureDefaults - expressions of captures without the explicit one
+var captureDefaults = map[string]string{
+	CaptureTitle:   `[^/]+`,
+	CaptureEpisode: `[^/]+`,
+	CaptureQuality: `[^/]+`,
+	CaptureName:    `[^/]+`,
+	CaptureExt:     `[^/.]+`,
+	CaptureSegment: `[^/]+`,
+}
+
+// DefaultRoutes - ts chunks and playlists, fMP4 segments with init segments, master playlists and subtitles;
+// any three leading segments are accepted as by the chunk regexp which has been replaced by routes
+var DefaultRoutes = []string{
+	"/{*}/{*}/{*}/{title}/{episode}/{quality}/{name}.{ext:ts|m3u8|m4s|mp4}",
+	"/{*}/{*}/{*}/{title}/{episode}/{name}.{ext:m3u8}",
+	"/videos/media/subs/{title}/{episode}/{name}.{ext:vtt|srt|ass}",
+}
+
+type Route struct {
+	pattern string
+	reg     *regexp.Regexp
+
+	// indexes of captures in submatches, -1 if the route has no capture
+	title, episode, quality, name, ext int
+}
+
+var routeCapture = regexp.MustCompile(`\{([a-z]+|\*)(?::([^}]+))?\}`)
+
+// NewRoute compiles the pattern with {capture} or {capture:expression} placeholders, e.g.
+//
+//	/videos/media/ts/{title}/{episode}/{quality}/{name}.{ext:ts|m3u8}
+//	/{*}/{*:media|cdn}/{title}/{episode}/{quality}/{name}.{ext:ts}
+func NewRoute(pattern string) (_ *Route, e error) {
+	var buf strings.Builder
+	buf.WriteByte('^')
+
+	captures, last := make(map[string]struct{}), 0
+	for _, loc := range routeCapture.FindAllStringSubmatchIndex(pattern, -1) {
+		capture := pattern[loc[2]:loc[3]]
+
+		expression, ok := captureDefaults[capture]
+		if !ok {
+			return nil, fmt.Errorf("%w; unknown capture {%s} in %s", ErrInvalidRoute, capture, pattern)
+		} else if _, ok = captures[capture]; ok && capture != CaptureSegment {
+			return nil, fmt.Errorf("%w; duplicated capture {%s} in %s", ErrInvalidRoute, capture, pattern)
+		}
+		captures[capture] = struct{}{}
+
+		if loc[4] != -1 {
+			expression = pattern[loc[4]:loc[5]]
+		}
+
+		buf.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		if capture == CaptureSegment {
+			fmt.Fprintf(&buf, "(?:%s)", expression)
+		} else {
+			fmt.Fprintf(&buf, "(?P<%s>%s)", capture, expression)
+		}
+		last = loc[1]
+	}
+
+	buf.WriteString(regexp.QuoteMeta(pattern[last:]))
+	buf.WriteByte('$')
+
+	route := &Route{pattern: pattern}
+	if route.reg, e = regexp.Compile(buf.String()); e != nil {
+		return nil, fmt.Errorf("%w; %s - %s", ErrInvalidRoute, pattern, e.Error())
+	}
+
+	route.title, route.episode, route.quality, route.name, route.ext =
+		route.reg.SubexpIndex(CaptureTitle),
+		route.reg.SubexpIndex(CaptureEpisode),
+		route.reg.SubexpIndex(CaptureQuality),
+		route.reg.SubexpIndex(CaptureName),
+		route.reg.SubexpIndex(CaptureExt)
+
+	if route.name == -1 || route.ext == -1 {
+		return nil, fmt.Errorf("%w; {name} and {ext} captures are required in %s", ErrInvalidRoute, pattern)
+	}
+
+	return route, e
+}
+
+func (m *Route) String() string { return m.pattern }
+
+func (m *Route) parse(uri string) (_ *Path, e error) {
+	sub := m.reg.FindStringSubmatch(uri)
+	if sub == nil {
+		return nil, ErrRouteNotMatched
+	}
+
+	capture := func(idx int) string {
+		if idx == -1 {
+			return ""
+		}
+
+		return sub[idx]
+	}
+
+	mpath := &Path{
+		Uri:       uri,
+		Route:     m.pattern,
+		TitleId:   capture(m.title),
+		EpisodeId: capture(m.episode),
+		Quality:   capture(m.quality),
+		Name:      capture(m.name),
+		Ext:       capture(m.ext),
+	}
+
+	if m.title != -1 {
+		var id uint64
+		if id, e = strconv.ParseUint(mpath.TitleId, 10, 16); e != nil || id == 0 {
+			return nil, ErrInvalidTitle
+		}
+		mpath.Title = uint16(id)
+	}
+
+	if m.episode != -1 {
+		var id uint64
+		if id, e = strconv.ParseUint(mpath.EpisodeId, 10, 16); e != nil || id == 0 {
+			return nil, ErrInvalidEpisode
+		}
+		mpath.Episode = uint16(id)
+	}
+
+	if m.quality != -1 {
+		var ok bool
+		if mpath.TitleQuality, ok = utils.GetTitleQualityByString[mpath.Quality]; !ok {
+			return nil, ErrInvalidQuality
+		}
+	}
+
+	return mpath, nil
+}
+
+// Router matches uris by routes in the given order, the first matched route wins
+type Router struct {
+	routes []*Route
+}
+
+func NewRouter(patterns []string) (_ *Router, e error) {
+	router := &Router{
+		routes: make([]*Route, 0, len(patterns)),
+	}
+
+	for _, pattern := range patterns {
+		var route *Route
+		if route, e = NewRoute(pattern); e != nil {
+			return
+		}
+
+		router.routes = append(router.routes, route)
+	}
+
+	return router, e
+}
+
+// Parse returns *ParseError if the uri is not matched or its captures are invalid
+func (m *Router) Parse(uri string) (_ *Path, e error) {
+	if uri == "" {
+		return nil, &ParseError{Uri: uri, Err: ErrEmptyUri}
+	}
+
+	for _, route := range m.routes {
+		var mpath *Path
+		if mpath, e = route.parse(uri); errors.Is(e, ErrRouteNotMatched) {
+			continue
+		} else if e != nil {
+			return nil, &ParseError{Uri: uri, Route: route.pattern, Err: e}
+		}
+
+		return mpath, nil
+	}
+
+	return nil, &ParseError{Uri: uri, Err: ErrRouteNotMatched}
+}
+
+func (m *Router) Match(uri string) bool {
+	_, e := m.Parse(uri)
+	return e == nil
+}
@@ -0,0 +1,243 @@
+package media
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/MindHunter86/addie/utils"
+)
+
+// chunkSplitRegexp is the chunk regexp which was replaced by DefaultRoutes; balancing
+// prefixes and names of chunks must not be changed, otherwise the hash ring is reshuffled
+const chunkSplitRegexp = `^(\/[^\/]+\/[^\/]+\/[^\/]+\/)([^\/]+)\/([^\/]+)\/([^\/]+)\/([^.\/]+)\.ts$`
+
+func newTestRouter(t *testing.T) *Router {
+	t.Helper()
+
+	router, e := NewRouter(DefaultRoutes)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return router
+}
+
+func TestRouterParse(t *testing.T) {
+	router := newTestRouter(t)
+
+	for _, tc := range []struct {
+		uri  string
+		want Path
+		kind Kind
+		hash string
+	}{
+		{
+			uri: "/videos/media/ts/9000/1/720/fff6d1a7a6a2d8d0d2f3b4e5_00001.ts",
+			want: Path{
+				Route: DefaultRoutes[0], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Quality: "720", TitleQuality: utils.TitleQualityHD,
+				Name: "fff6d1a7a6a2d8d0d2f3b4e5_00001", Ext: "ts",
+			},
+			kind: KindChunk,
+			hash: "fff6d1a7a6a2d8d0d2f3b4e5",
+		},
+		{
+			uri: "/videos/media/ts/9000/12/1080/fff6d1a7.m3u8",
+			want: Path{
+				Route: DefaultRoutes[0], Title: 9000, Episode: 12, TitleId: "9000", EpisodeId: "12",
+				Quality: "1080", TitleQuality: utils.TitleQualityFHD, Name: "fff6d1a7", Ext: "m3u8",
+			},
+			kind: KindPlaylist,
+			hash: "fff6d1a7",
+		},
+		{
+			uri: "/videos/media/ts/9000/1/480/fff6d1a7_00002.m4s",
+			want: Path{
+				Route: DefaultRoutes[0], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Quality: "480", TitleQuality: utils.TitleQualitySD, Name: "fff6d1a7_00002", Ext: "m4s",
+			},
+			kind: KindSegment,
+			hash: "fff6d1a7",
+		},
+		{
+			uri: "/videos/media/ts/9000/1/480/init.mp4",
+			want: Path{
+				Route: DefaultRoutes[0], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Quality: "480", TitleQuality: utils.TitleQualitySD, Name: "init", Ext: "mp4",
+			},
+			kind: KindInit,
+		},
+		{
+			uri: "/videos/media/ts/9000/1/master.m3u8",
+			want: Path{
+				Route: DefaultRoutes[1], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Name: "master", Ext: "m3u8",
+			},
+			kind: KindPlaylist,
+			hash: "master",
+		},
+		{
+			uri: "/cdn/media/hls/9000/1/1080/fff6d1a7_00003.ts",
+			want: Path{
+				Route: DefaultRoutes[0], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Quality: "1080", TitleQuality: utils.TitleQualityFHD, Name: "fff6d1a7_00003", Ext: "ts",
+			},
+			kind: KindChunk,
+			hash: "fff6d1a7",
+		},
+		{
+			uri: "/videos/media/subs/9000/1/ru.vtt",
+			want: Path{
+				Route: DefaultRoutes[2], Title: 9000, Episode: 1, TitleId: "9000", EpisodeId: "1",
+				Name: "ru", Ext: "vtt",
+			},
+			kind: KindSubtitle,
+		},
+	} {
+		mpath, e := router.Parse(tc.uri)
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", tc.uri, e)
+			continue
+		}
+
+		if tc.want.Uri = tc.uri; *mpath != tc.want {
+			t.Errorf("%s:\n got %+v\nwant %+v", tc.uri, *mpath, tc.want)
+		}
+
+		if mpath.Kind() != tc.kind {
+			t.Errorf("%s: got kind %s, want %s", tc.uri, mpath.Kind(), tc.kind)
+		}
+
+		hash, ok := mpath.Hash()
+		if hash != tc.hash || ok != (tc.hash != "") {
+			t.Errorf("%s: got hash %q %t, want %q", tc.uri, hash, ok, tc.hash)
+		}
+	}
+}
+
+func TestRouterParseErrors(t *testing.T) {
+	router := newTestRouter(t)
+
+	for _, tc := range []struct {
+		uri   string
+		err   error
+		route string
+	}{
+		{uri: "", err: ErrEmptyUri},
+		{uri: "/videos/media/ts/9000/1/720/fff6d1a7_00001.aac", err: ErrRouteNotMatched},
+		{uri: "/videos/media/ts/9000/1/720/sub/fff6d1a7_00001.ts", err: ErrRouteNotMatched},
+		{uri: "/videos/media/subs/9000/1/ru.ts", err: ErrRouteNotMatched},
+		{uri: "/media/ts/9000/1/720/fff6d1a7_00001.ts", err: ErrRouteNotMatched},
+		{uri: "/a/videos/media/ts/9000/1/720/fff6d1a7_00001.ts", err: ErrRouteNotMatched},
+		{uri: "/videos/media/ts/0/1/720/fff6d1a7_00001.ts", err: ErrInvalidTitle, route: DefaultRoutes[0]},
+		{uri: "/videos/media/ts/70000/1/720/fff6d1a7_00001.ts", err: ErrInvalidTitle, route: DefaultRoutes[0]},
+		{uri: "/videos/media/ts/abc/1/720/fff6d1a7_00001.ts", err: ErrInvalidTitle, route: DefaultRoutes[0]},
+		{uri: "/videos/media/ts/9000/0/720/fff6d1a7_00001.ts", err: ErrInvalidEpisode, route: DefaultRoutes[0]},
+		{uri: "/videos/media/subs/9000/-1/ru.vtt", err: ErrInvalidEpisode, route: DefaultRoutes[2]},
+		{uri: "/videos/media/ts/9000/1/360/fff6d1a7_00001.ts", err: ErrInvalidQuality, route: DefaultRoutes[0]},
+	} {
+		_, e := router.Parse(tc.uri)
+
+		var perr *ParseError
+		if !errors.As(e, &perr) {
+			t.Errorf("%s: expected *ParseError, got %v", tc.uri, e)
+			continue
+		}
+
+		if !errors.Is(e, tc.err) || perr.Uri != tc.uri || perr.Route != tc.route {
+			t.Errorf("%s: got %+v, want %v of route %q", tc.uri, perr, tc.err, tc.route)
+		}
+
+		if router.Match(tc.uri) {
+			t.Errorf("%s: invalid uri is matched", tc.uri)
+		}
+	}
+}
+
+func TestNewRouteErrors(t *testing.T) {
+	for _, pattern := range []string{
+		"/videos/{title}/{name}",
+		"/videos/{title}/{title}/{name}.{ext}",
+		"/videos/{series}/{name}.{ext}",
+		"/videos/{title:[0-9}/{name}.{ext}",
+		"/videos/{*:(}/{name}.{ext}",
+	} {
+		if _, e := NewRoute(pattern); !errors.Is(e, ErrInvalidRoute) {
+			t.Errorf("%s: expected ErrInvalidRoute, got %v", pattern, e)
+		}
+	}
+}
+
+// TestRouterChunkCompatibility checks that balancing keys of chunks are the same as keys of the replaced regexp
+func TestRouterChunkCompatibility(t *testing.T) {
+	router, chunkRegexp := newTestRouter(t), regexp.MustCompile(chunkSplitRegexp)
+
+	for _, uri := range []string{
+		"/videos/media/ts/9000/1/720/fff6d1a7a6a2d8d0d2f3b4e5_00001.ts",
+		"/videos/media/ts/9000/12/1080/fff6d1a7a6a2d8d0d2f3b4e5_00128.ts",
+		"/videos/media/ts/1/1/480/a_1.ts",
+		"/videos/media/ts/65535/65535/480/b.ts",
+		"/cdn/media/hls/9000/1/720/fff6d1a7a6a2d8d0d2f3b4e5_00001.ts",
+	} {
+		sub := chunkRegexp.FindStringSubmatch(uri)
+		if sub == nil {
+			t.Fatalf("%s: the uri is not matched by the old regexp", uri)
+		}
+
+		mpath, e := router.Parse(uri)
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", uri, e)
+			continue
+		}
+
+		if prefix := sub[2] + sub[3] + sub[4]; mpath.Prefix() != prefix {
+			t.Errorf("%s: got prefix %s, the old regexp has %s", uri, mpath.Prefix(), prefix)
+		}
+
+		if mpath.ChunkName() != sub[5] {
+			t.Errorf("%s: got name %s, the old regexp has %s", uri, mpath.ChunkName(), sub[5])
+		}
+	}
+}
+
+func TestRouteSegment(t *testing.T) {
+	route, e := NewRoute("/{*}/{*:media|cdn}/{title}/{name}.{ext:ts}")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for uri, matched := range map[string]bool{
+		"/videos/media/9000/a_1.ts": true,
+		"/static/cdn/9000/a_1.ts":   true,
+		"/videos/hls/9000/a_1.ts":   false,
+		"/videos/9000/a_1.ts":       false,
+		"//media/9000/a_1.ts":       false,
+	} {
+		mpath, e := route.parse(uri)
+		if matched != (e == nil) {
+			t.Errorf("%s: got %v, matched %t", uri, e, matched)
+		} else if matched && (mpath.Title != 9000 || mpath.Name != "a_1") {
+			t.Errorf("%s: got %+v", uri, mpath)
+		}
+	}
+}
+
+func TestPathChunkName(t *testing.T) {
+	router := newTestRouter(t)
+
+	for uri, name := range map[string]string{
+		"/videos/media/ts/9000/1/720/fff6d1a7_00001.ts":  "fff6d1a7_00001",
+		"/videos/media/ts/9000/1/720/fff6d1a7_00001.m4s": "fff6d1a7_00001.m4s",
+		"/videos/media/ts/9000/1/720/fff6d1a7.m3u8":      "fff6d1a7.m3u8",
+		"/videos/media/ts/9000/1/master.m3u8":            "master.m3u8",
+		"/videos/media/subs/9000/1/ru.vtt":               "ru.vtt",
+	} {
+		mpath, e := router.Parse(uri)
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", uri, e)
+		} else if mpath.ChunkName() != name {
+			t.Errorf("%s: got chunk name %s, want %s", uri, mpath.ChunkName(), name)
+		}
+	}
+}
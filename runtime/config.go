@@ -3,6 +3,8 @@ package runtime
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -27,6 +29,8 @@ const (
 	ParamAccessLevel
 	ParamQualityBypass
 	ParamForceRUMitigate
+	ParamStickyClusters
+	ParamLinkExpiration
 
 	paramMaxSize // used only for make(maxvalue)
 )
@@ -41,6 +45,8 @@ var ParamDefaults = map[StorageParam]interface{}{
 	ParamAccessLevel:     zerolog.InfoLevel,
 	ParamQualityBypass:   nil,
 	ParamForceRUMitigate: "",
+	ParamStickyClusters:  "",
+	ParamLinkExpiration:  nil,
 }
 
 var GetNameByParam = map[StorageParam]string{
@@ -53,6 +59,8 @@ var GetNameByParam = map[StorageParam]string{
 	ParamAccessLevel:     runtimeChangesHumanize[RuntimePatchAccessLevel],
 	ParamQualityBypass:   runtimeChangesHumanize[RuntimePatchQualityBypass],
 	ParamForceRUMitigate: runtimeChangesHumanize[RuntimePatchForceRUMitigate],
+	ParamStickyClusters:  runtimeChangesHumanize[RuntimePatchStickyClusters],
+	ParamLinkExpiration:  runtimeChangesHumanize[RuntimePatchLinkExpiration],
 }
 
 type Storage struct {
@@ -135,6 +143,16 @@ func (m *Storage) Get(param StorageParam) interface{} {
 	panic("undefined entry or param not found in config storage")
 }
 
+// Digest writes committed values of all params in the stable order;
+// values under smooth deploy are written as committed ones
+func (m *Storage) Digest(w io.Writer) {
+	for param := StorageParam(0); param < paramMaxSize; param++ {
+		if e, ok := m.getEntry(param); ok {
+			fmt.Fprintf(w, "%d=%v\n", param, e.get(true))
+		}
+	}
+}
+
 func (m *Storage) Set(param StorageParam, val interface{}) {
 	e, ok := m.getEntry(param)
 	if !ok && e != nil {
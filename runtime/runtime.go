@@ -2,13 +2,17 @@ package runtime
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/MindHunter86/addie/balancer"
 	"github.com/MindHunter86/addie/blocklist"
+	"github.com/MindHunter86/addie/signer"
 	"github.com/MindHunter86/addie/utils"
 	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v2"
@@ -26,6 +30,10 @@ const (
 	RuntimePatchAccessLevel
 	RuntimePatchQualityBypass
 	RuntimePatchForceRUMitigate
+	RuntimePatchServerStates
+	RuntimePatchStickyClusters
+	RuntimePatchLinkKeyring
+	RuntimePatchLinkExpiration
 )
 
 var (
@@ -41,6 +49,12 @@ var (
 		utils.CfgAccessLogLevel:    RuntimePatchAccessLevel,
 		utils.CfgQualityBypass:     RuntimePatchQualityBypass,
 		utils.CfgForceRUMitigate:   RuntimePatchForceRUMitigate,
+
+		utils.CfgBalancerServerStates:   RuntimePatchServerStates,
+		utils.CfgBalancerStickyClusters: RuntimePatchStickyClusters,
+
+		utils.CfgLinkKeyring:    RuntimePatchLinkKeyring,
+		utils.CfgLinkExpiration: RuntimePatchLinkExpiration,
 	}
 
 	// intenal
@@ -56,6 +70,10 @@ var (
 		RuntimePatchAccessLevel:     "access_log loglevel",
 		RuntimePatchQualityBypass:   "quality rewrite bypass",
 		RuntimePatchForceRUMitigate: "migrate unbypassed ru to europe",
+		RuntimePatchServerStates:    "balancer server states",
+		RuntimePatchStickyClusters:  "balancer sticky clusters",
+		RuntimePatchLinkKeyring:     "link signing keyring",
+		RuntimePatchLinkExpiration:  "link expiration rules",
 	}
 )
 
@@ -65,6 +83,8 @@ type (
 
 		// todo - refactor
 		blocklist *blocklist.Blocklist // temporary;
+		balancers map[balancer.BalancerCluster]balancer.Balancer
+		keyring   *signer.Keyring
 		cli       *cli.Context
 	}
 	RuntimePatch struct {
@@ -77,9 +97,13 @@ func NewRuntime(c context.Context) (r *Runtime, e error) {
 	blist := c.Value(utils.ContextKeyBlocklist).(*blocklist.Blocklist)
 	log = c.Value(utils.ContextKeyLogger).(*zerolog.Logger)
 	clictx := c.Value(utils.ContextKeyCliContext).(*cli.Context)
+	blcs := c.Value(utils.ContextKeyBalancers).(map[balancer.BalancerCluster]balancer.Balancer)
+	keyring := c.Value(utils.ContextKeyKeyring).(*signer.Keyring)
 
 	r = &Runtime{
 		blocklist: blist,
+		balancers: blcs,
+		keyring:   keyring,
 		cli:       clictx,
 	}
 
@@ -90,6 +114,13 @@ func NewRuntime(c context.Context) (r *Runtime, e error) {
 	return
 }
 
+// Digest writes runtime state for comparing it between processes
+func (m *Runtime) Digest(w io.Writer) {
+	m.Config.Digest(w)
+	m.blocklist.Digest(w)
+	m.keyring.Digest(w)
+}
+
 func (m *Runtime) ApplyPatch(patch *RuntimePatch) (e error) {
 
 	if len(patch.Patch) == 0 {
@@ -129,6 +160,16 @@ func (m *Runtime) ApplyPatch(patch *RuntimePatch) (e error) {
 		}
 		e = patch.ApplyForceRUMitigation(m.Config, ParamForceRUMitigate)
 
+	case RuntimePatchServerStates:
+		e = patch.ApplyServerStates(m.balancers)
+	case RuntimePatchStickyClusters:
+		e = patch.ApplyStickyClusters(m.Config, ParamStickyClusters)
+
+	case RuntimePatchLinkKeyring:
+		e = patch.ApplyLinkKeyring(m.keyring)
+	case RuntimePatchLinkExpiration:
+		e = patch.ApplyLinkExpiration(m.Config, ParamLinkExpiration)
+
 	default:
 		panic("internal error - undefined runtime patch type")
 	}
@@ -141,6 +182,94 @@ func (m *Runtime) ApplyPatch(patch *RuntimePatch) (e error) {
 	return
 }
 
+func (m *RuntimePatch) ApplyServerStates(balancers map[balancer.BalancerCluster]balancer.Balancer) (e error) {
+	var states balancer.ClusterServerStates
+	if e = json.Unmarshal(m.Patch, &states); e != nil {
+		return
+	}
+
+	for cluster, servers := range states {
+		for name, state := range servers {
+			if e = state.Validate(); e != nil {
+				return fmt.Errorf("%w; cluster %s, server %s", e, cluster, name)
+			}
+		}
+	}
+
+	for _, blcr := range balancers {
+		blcr.UpdateServerStates(states[blcr.GetClusterName()])
+	}
+
+	log.Info().Msgf("runtime patch has been applied for %s, %d clusters", runtimeChangesHumanize[m.Type], len(states))
+	return
+}
+
+// ApplyLinkKeyring replaces consul keys of the signing keyring with the given json array; "_" removes them.
+// Secrets are never logged, only key ids
+func (m *RuntimePatch) ApplyLinkKeyring(keyring *signer.Keyring) (e error) {
+	if strings.TrimSpace(string(m.Patch)) == "_" {
+		keyring.Load(signer.SourceConsul, nil)
+		log.Info().Msgf("runtime patch has been applied for %s with '' (reset)", runtimeChangesHumanize[m.Type])
+		return
+	}
+
+	var keys []*signer.Key
+	if keys, e = signer.ParseKeys(m.Patch); e != nil {
+		return
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.Id)
+	}
+
+	keyring.Load(signer.SourceConsul, keys)
+	log.Info().Msgf("runtime patch has been applied for %s with keys %s", runtimeChangesHumanize[m.Type], strings.Join(ids, ","))
+	return
+}
+
+// ApplyLinkExpiration replaces link expiration rules with the given json array;
+// "_" removes them, so link-expiration is used for all links
+func (m *RuntimePatch) ApplyLinkExpiration(st *Storage, param StorageParam) (e error) {
+	if strings.TrimSpace(string(m.Patch)) == "_" {
+		st.Set(param, nil)
+		log.Info().Msgf("runtime patch has been applied for %s with nil (reset)", GetNameByParam[param])
+		return
+	}
+
+	var policy *signer.ExpirationPolicy
+	if policy, e = signer.ParseExpirationPolicy(m.Patch); e != nil {
+		return
+	}
+
+	st.Set(param, policy)
+	log.Info().Msgf("runtime patch has been applied for %s with %d rules", GetNameByParam[param], policy.Len())
+	return
+}
+
+// ApplyStickyClusters enables sticky session balancing for the given
+// comma separated consul services; "_" resets the list
+func (m *RuntimePatch) ApplyStickyClusters(st *Storage, param StorageParam) (e error) {
+	buf := strings.TrimSpace(string(m.Patch))
+
+	if buf == "_" {
+		st.Set(param, "")
+		log.Info().Msgf("runtime patch has been applied for %s with '' (reset)", GetNameByParam[param])
+		return
+	}
+
+	clusters := make([]string, 0, strings.Count(buf, ",")+1)
+	for _, cluster := range strings.Split(buf, ",") {
+		if cluster = strings.TrimSpace(cluster); cluster != "" {
+			clusters = append(clusters, cluster)
+		}
+	}
+
+	st.Set(param, strings.Join(clusters, ","))
+	log.Info().Msgf("runtime patch has been applied for %s with %s", GetNameByParam[param], buf)
+	return
+}
+
 func (m *RuntimePatch) ApplyForceRUMitigation(st *Storage, param StorageParam) (e error) {
 	buf := strings.TrimSpace(string(m.Patch))
 
@@ -0,0 +1,127 @@
+package signer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/MindHunter86/addie/utils"
+)
+
+var ErrInvalidExpirationRule = errors.New("link expiration rule is invalid")
+
+// ExpirationRequest - attributes of the signed link which expiration rules are matched by
+type ExpirationRequest struct {
+	Quality     string // 480, 720, 1080; empty if the uri is not a chunk of the title
+	Cluster     string
+	Uri         string
+	ClientClass string
+}
+
+// FileType returns the extension of the uri without the dot - ts, m3u8
+func (m *ExpirationRequest) FileType() string {
+	return strings.TrimPrefix(path.Ext(m.Uri), ".")
+}
+
+// ExpirationRule sets the lifetime of links matched by all non-empty fields
+type ExpirationRule struct {
+	Quality     string        `json:"quality,omitempty"`
+	Cluster     string        `json:"cluster,omitempty"`
+	FileType    string        `json:"file_type,omitempty"`
+	ClientClass string        `json:"client_class,omitempty"`
+	Expiration  time.Duration `json:"-"`
+}
+
+func (m *ExpirationRule) match(req *ExpirationRequest) bool {
+	return (m.Quality == "" || m.Quality == req.Quality) &&
+		(m.Cluster == "" || m.Cluster == req.Cluster) &&
+		(m.FileType == "" || m.FileType == req.FileType()) &&
+		(m.ClientClass == "" || m.ClientClass == req.ClientClass)
+}
+
+// ExpirationPolicy is the ordered list of rules, the first matched rule wins;
+// links which are not matched by any rule have link-expiration lifetime
+type ExpirationPolicy struct {
+	rules []*ExpirationRule
+}
+
+// ParseExpirationPolicy parses json array of rules:
+//
+//	[{"file_type": "m3u8", "expiration": "6h"}, {"cluster": "cache-ru", "quality": "1080", "expiration": "30m"}]
+func ParseExpirationPolicy(payload []byte) (_ *ExpirationPolicy, e error) {
+	var raw []*struct {
+		ExpirationRule
+		Expiration string `json:"expiration"`
+	}
+
+	if e = json.Unmarshal(payload, &raw); e != nil {
+		return
+	}
+
+	policy := &ExpirationPolicy{
+		rules: make([]*ExpirationRule, 0, len(raw)),
+	}
+
+	for idx, buf := range raw {
+		if buf == nil {
+			return nil, fmt.Errorf("%w; rule %d is empty", ErrInvalidExpirationRule, idx)
+		}
+
+		rule := buf.ExpirationRule
+		if rule.Expiration, e = time.ParseDuration(buf.Expiration); e != nil {
+			return nil, fmt.Errorf("%w; rule %d - %s", ErrInvalidExpirationRule, idx, e.Error())
+		} else if rule.Expiration <= 0 {
+			return nil, fmt.Errorf("%w; rule %d has non-positive expiration", ErrInvalidExpirationRule, idx)
+		}
+
+		if _, ok := utils.GetTitleQualityByString[rule.Quality]; rule.Quality != "" && !ok {
+			return nil, fmt.Errorf("%w; rule %d has unknown quality %s", ErrInvalidExpirationRule, idx, rule.Quality)
+		}
+
+		rule.FileType = strings.TrimPrefix(rule.FileType, ".")
+		policy.rules = append(policy.rules, &rule)
+	}
+
+	return policy, e
+}
+
+// Lookup returns the lifetime of the first matched rule; nil policy matches nothing
+func (m *ExpirationPolicy) Lookup(req *ExpirationRequest) (time.Duration, bool) {
+	if m == nil {
+		return 0, false
+	}
+
+	for _, rule := range m.rules {
+		if rule.match(req) {
+			return rule.Expiration, true
+		}
+	}
+
+	return 0, false
+}
+
+func (m *ExpirationPolicy) Len() int {
+	if m == nil {
+		return 0
+	}
+
+	return len(m.rules)
+}
+
+// String is used in runtime digests, so rules are written in the stable form
+func (m *ExpirationPolicy) String() string {
+	if m == nil {
+		return "<nil>"
+	}
+
+	var buf strings.Builder
+	for _, rule := range m.rules {
+		fmt.Fprintf(&buf, "[quality=%s cluster=%s file_type=%s client_class=%s expiration=%s]",
+			rule.Quality, rule.Cluster, rule.FileType, rule.ClientClass, rule.Expiration)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,115 @@
+package signer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpirationPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		rules   int
+		err     bool
+	}{
+		{name: "empty", payload: `[]`},
+		{name: "file type with dot", payload: `[{"file_type": ".m3u8", "expiration": "6h"}]`, rules: 1},
+		{name: "all fields", payload: `[{"quality": "1080", "cluster": "cache-ru", "file_type": "ts",
+			"client_class": "tv", "expiration": "30m"}, {"expiration": "1m"}]`, rules: 2},
+
+		{name: "broken json", payload: `[{"expiration": "1m"`, err: true},
+		{name: "null rule", payload: `[null]`, err: true},
+		{name: "no expiration", payload: `[{"quality": "1080"}]`, err: true},
+		{name: "invalid expiration", payload: `[{"expiration": "hour"}]`, err: true},
+		{name: "zero expiration", payload: `[{"expiration": "0s"}]`, err: true},
+		{name: "negative expiration", payload: `[{"expiration": "-1m"}]`, err: true},
+		{name: "unknown quality", payload: `[{"quality": "4k", "expiration": "1m"}]`, err: true},
+	} {
+		policy, e := ParseExpirationPolicy([]byte(tc.payload))
+		if tc.err {
+			if e == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, e)
+		} else if policy.Len() != tc.rules {
+			t.Errorf("%s: got %d rules, expected %d", tc.name, policy.Len(), tc.rules)
+		}
+	}
+}
+
+// TestExpirationPrecedence checks that the first matched rule wins, so specific rules
+// must be placed before general ones, and all non-empty fields of the rule must match
+func TestExpirationPrecedence(t *testing.T) {
+	policy, e := ParseExpirationPolicy([]byte(`[
+		{"quality": "1080", "cluster": "cache-ru", "file_type": "ts", "client_class": "tv", "expiration": "1m"},
+		{"quality": "1080", "cluster": "cache-ru", "expiration": "2m"},
+		{"client_class": "tv", "expiration": "3m"},
+		{"file_type": "m3u8", "expiration": "4m"},
+		{"cluster": "cache-ru", "expiration": "5m"},
+		{"quality": "480", "expiration": "6m"},
+		{"file_type": "ts", "expiration": "7m"},
+		{"file_type": "m3u8", "client_class": "bot", "expiration": "8m"}
+	]`))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	const chunk, playlist = "/videos/media/ts/9000/1/1080/hash_00001.ts", "/videos/media/ts/9000/1/1080/hash.m3u8"
+
+	for _, tc := range []struct {
+		name       string
+		req        *ExpirationRequest
+		expiration time.Duration
+	}{
+		{name: "all fields matched",
+			req: &ExpirationRequest{Quality: "1080", Cluster: "cache-ru", Uri: chunk, ClientClass: "tv"}, expiration: time.Minute},
+		{name: "quality and cluster over client class",
+			req: &ExpirationRequest{Quality: "1080", Cluster: "cache-ru", Uri: playlist, ClientClass: "tv"}, expiration: 2 * time.Minute},
+		{name: "client class over file type",
+			req: &ExpirationRequest{Quality: "720", Cluster: "cache-ru", Uri: playlist, ClientClass: "tv"}, expiration: 3 * time.Minute},
+		{name: "file type over cluster",
+			req: &ExpirationRequest{Quality: "720", Cluster: "cache-ru", Uri: playlist}, expiration: 4 * time.Minute},
+		{name: "cluster over quality",
+			req: &ExpirationRequest{Quality: "480", Cluster: "cache-ru", Uri: chunk}, expiration: 5 * time.Minute},
+		{name: "quality over file type",
+			req: &ExpirationRequest{Quality: "480", Cluster: "cache-eu", Uri: chunk}, expiration: 6 * time.Minute},
+		{name: "file type",
+			req: &ExpirationRequest{Quality: "720", Cluster: "cache-eu", Uri: chunk}, expiration: 7 * time.Minute},
+		{name: "shadowed rule is never matched",
+			req: &ExpirationRequest{Cluster: "cache-eu", Uri: playlist, ClientClass: "bot"}, expiration: 4 * time.Minute},
+		{name: "client class is case sensitive",
+			req: &ExpirationRequest{Quality: "1080", Cluster: "cache-eu", Uri: "/api/v1/titles", ClientClass: "TV"}},
+		{name: "unknown quality",
+			req: &ExpirationRequest{Cluster: "cache-eu", Uri: "/api/v1/titles"}},
+	} {
+		expiration, ok := policy.Lookup(tc.req)
+		if ok != (tc.expiration != 0) || expiration != tc.expiration {
+			t.Errorf("%s: got %s, %v, expected %s", tc.name, expiration, ok, tc.expiration)
+		}
+	}
+}
+
+func TestExpirationNilPolicy(t *testing.T) {
+	var policy *ExpirationPolicy
+
+	if _, ok := policy.Lookup(&ExpirationRequest{Uri: "/a.ts"}); ok || policy.Len() != 0 || policy.String() != "<nil>" {
+		t.Error("nil policy must match nothing")
+	}
+}
+
+func TestExpirationRequestFileType(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"/videos/media/ts/9000/1/1080/hash_00001.ts": "ts",
+		"/videos/media/ts/9000/1/1080/hash.m3u8":     "m3u8",
+		"/videos/media/ts/9000/1/1080/":              "",
+		"/api.v1/titles":                             "",
+	} {
+		if ftype := (&ExpirationRequest{Uri: uri}).FileType(); ftype != expected {
+			t.Errorf("%s: got file type %q, expected %q", uri, ftype, expected)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrNoSigningKey = errors.New("there is no valid signing key in the keyring")
+	ErrInvalidKey   = errors.New("keyring key is invalid")
+)
+
+// keyring sources; keys of all sources are merged
+const (
+	SourceFlag   = "flag"
+	SourceFile   = "file"
+	SourceConsul = "consul"
+)
+
+// Key is a signing secret with the validity window; zero times are unbounded.
+// Links are signed with the newest valid key, older keys are kept for verification
+// while cache nodes accept both of them
+type Key struct {
+	Id        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+}
+
+func (m *Key) IsValid(now time.Time) bool {
+	return !now.Before(m.NotBefore) && (m.NotAfter.IsZero() || now.Before(m.NotAfter))
+}
+
+// ParseKeys parses json array of keys:
+//
+//	[{"id": "2024-06", "secret": "...", "not_before": "2024-06-01T00:00:00Z", "not_after": "2024-07-01T00:00:00Z"}]
+func ParseKeys(payload []byte) (keys []*Key, e error) {
+	if e = json.Unmarshal(payload, &keys); e != nil {
+		return
+	}
+
+	ids := make(map[string]struct{}, len(keys))
+	for idx, key := range keys {
+		switch {
+		case key == nil:
+			return nil, fmt.Errorf("%w; key %d is empty", ErrInvalidKey, idx)
+		case key.Id == "":
+			return nil, fmt.Errorf("%w; key %d has no id", ErrInvalidKey, idx)
+		case key.Secret == "":
+			return nil, fmt.Errorf("%w; key %s has no secret", ErrInvalidKey, key.Id)
+		case !key.NotAfter.IsZero() && !key.NotAfter.After(key.NotBefore):
+			return nil, fmt.Errorf("%w; key %s has not_after before not_before", ErrInvalidKey, key.Id)
+		}
+
+		if _, ok := ids[key.Id]; ok {
+			return nil, fmt.Errorf("%w; key %s is duplicated", ErrInvalidKey, key.Id)
+		}
+		ids[key.Id] = struct{}{}
+	}
+
+	return
+}
+
+type Keyring struct {
+	mu      sync.RWMutex
+	sources map[string][]*Key
+
+	// merged keys of all sources, the newest one is the first
+	keys []*Key
+
+	// the state of the last loaded file, changes after loading are not missed by WatchFile
+	fstat os.FileInfo
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		sources: make(map[string][]*Key),
+	}
+}
+
+// Load replaces keys of the source; nil keys remove the source
+func (m *Keyring) Load(source string, keys []*Key) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if keys == nil {
+		delete(m.sources, source)
+	} else {
+		m.sources[source] = keys
+	}
+
+	sources := make([]string, 0, len(m.sources))
+	for src := range m.sources {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+
+	m.keys = m.keys[:0:0]
+	for _, src := range sources {
+		m.keys = append(m.keys, m.sources[src]...)
+	}
+
+	sort.SliceStable(m.keys, func(i, j int) bool {
+		return m.keys[i].NotBefore.After(m.keys[j].NotBefore)
+	})
+}
+
+// Signing returns the newest valid key
+func (m *Keyring) Signing(now time.Time) (*Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.keys {
+		if key.IsValid(now) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrNoSigningKey
+}
+
+// Get returns the newest key with the id; the legacy link-secret key has the empty id
+func (m *Keyring) Get(id string) (*Key, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.keys {
+		if key.Id == id {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// List returns keys of all sources, the newest one is the first
+func (m *Keyring) List() []*Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]*Key(nil), m.keys...)
+}
+
+// Digest writes ids and validity windows of keys, secrets are not written
+func (m *Keyring) Digest(w io.Writer) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.keys {
+		fmt.Fprintf(w, "key=%s,%d,%d\n", key.Id, key.NotBefore.Unix(), key.NotAfter.Unix())
+	}
+}
+
+// LoadFile loads keys of the file source
+func (m *Keyring) LoadFile(path string) (e error) {
+	// the file is stated before reading, so the change while reading is reloaded later
+	var stat os.FileInfo
+	if stat, e = os.Stat(path); e != nil {
+		return
+	}
+
+	var payload []byte
+	if payload, e = os.ReadFile(path); e != nil {
+		return
+	}
+
+	var keys []*Key
+	if keys, e = ParseKeys(payload); e != nil {
+		return
+	}
+
+	m.Load(SourceFile, keys)
+
+	m.mu.Lock()
+	m.fstat = stat
+	m.mu.Unlock()
+
+	return
+}
+
+// WatchFile reloads the file if its modification time or size is changed since the last load;
+// the previous keys are kept if the file is broken
+func (m *Keyring) WatchFile(ctx context.Context, log *zerolog.Logger, path string, interval time.Duration) {
+	m.mu.RLock()
+	stat := m.fstat
+	m.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		buf, e := os.Stat(path)
+		if e != nil {
+			log.Warn().Err(e).Msg("could not stat keyring file")
+			continue
+		} else if stat != nil && buf.ModTime().Equal(stat.ModTime()) && buf.Size() == stat.Size() {
+			continue
+		}
+
+		// the broken file is not reloaded until the next change
+		if stat, e = buf, m.LoadFile(path); e != nil {
+			log.Error().Err(e).Msg("could not reload keyring file, the previous keys are kept")
+			continue
+		}
+
+		log.Info().Str("path", path).Msg("keyring file has been reloaded")
+	}
+}
@@ -0,0 +1,209 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		keys    int
+		err     bool
+	}{
+		{name: "empty", payload: `[]`},
+		{name: "unbounded", payload: `[{"id": "a", "secret": "s"}]`, keys: 1},
+		{name: "window", payload: `[{"id": "a", "secret": "s", "not_before": "2026-10-01T00:00:00Z", "not_after": "2026-11-01T00:00:00Z"},
+			{"id": "b", "secret": "s", "not_before": "2026-09-01T00:00:00Z"}]`, keys: 2},
+
+		{name: "broken json", payload: `[{"id": "a"`, err: true},
+		{name: "null key", payload: `[null]`, err: true},
+		{name: "no id", payload: `[{"secret": "s"}]`, err: true},
+		{name: "no secret", payload: `[{"id": "a"}]`, err: true},
+		{name: "inverted window", payload: `[{"id": "a", "secret": "s", "not_before": "2026-11-01T00:00:00Z", "not_after": "2026-10-01T00:00:00Z"}]`, err: true},
+		{name: "empty window", payload: `[{"id": "a", "secret": "s", "not_before": "2026-10-01T00:00:00Z", "not_after": "2026-10-01T00:00:00Z"}]`, err: true},
+		{name: "duplicated id", payload: `[{"id": "a", "secret": "s"}, {"id": "a", "secret": "t"}]`, err: true},
+	} {
+		keys, e := ParseKeys([]byte(tc.payload))
+		if tc.err {
+			if e == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, e)
+		} else if len(keys) != tc.keys {
+			t.Errorf("%s: got %d keys, expected %d", tc.name, len(keys), tc.keys)
+		}
+	}
+}
+
+// TestKeyringSigning checks that the newest valid key signs links while overlapping
+// windows are rotated and keys outside of their windows are never chosen
+func TestKeyringSigning(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+
+	// september key is valid until 10th, october key is valid since 5th, the next key is not valid yet
+	september := &Key{Id: "2026-09", Secret: "september", NotBefore: day(1).AddDate(0, -1, 0), NotAfter: day(10)}
+	october := &Key{Id: "2026-10", Secret: "october", NotBefore: day(5), NotAfter: day(1).AddDate(0, 1, 5)}
+	next := &Key{Id: "2026-11", Secret: "november", NotBefore: day(1).AddDate(0, 1, 0)}
+
+	keyring := NewKeyring()
+	keyring.Load(SourceFile, []*Key{september, next})
+	keyring.Load(SourceConsul, []*Key{october})
+
+	for _, tc := range []struct {
+		now     time.Time
+		signing *Key
+	}{
+		{now: day(1).AddDate(0, -1, -1)},
+		{now: day(1).AddDate(0, -1, 0), signing: september},
+		{now: day(4), signing: september},
+		{now: day(5), signing: october},
+		{now: day(9), signing: october},
+		{now: day(10), signing: october},
+		{now: day(1).AddDate(0, 1, 0), signing: next},
+		{now: day(1).AddDate(1, 0, 0), signing: next},
+	} {
+		key, e := keyring.Signing(tc.now)
+		if tc.signing == nil {
+			if !errors.Is(e, ErrNoSigningKey) {
+				t.Errorf("%s: expected ErrNoSigningKey, got key %v, %v", tc.now, key, e)
+			}
+			continue
+		}
+
+		if e != nil || key != tc.signing {
+			t.Errorf("%s: got key %v, %v, expected %s", tc.now, key, e, tc.signing.Id)
+		}
+	}
+
+	// keys are sorted by their windows, the newest one is the first
+	keys := keyring.List()
+	if len(keys) != 3 || keys[0] != next || keys[1] != october || keys[2] != september {
+		t.Errorf("got unsorted keys %v", keys)
+	}
+
+	// expired keys are kept for verification of issued links
+	if key, ok := keyring.Get(september.Id); !ok || key != september {
+		t.Error("expired key is not found by its id")
+	}
+
+	// the source is removed with nil keys
+	keyring.Load(SourceConsul, nil)
+	if _, ok := keyring.Get(october.Id); ok {
+		t.Error("the key of the removed source is found")
+	} else if key, e := keyring.Signing(day(6)); e != nil || key != september {
+		t.Errorf("got key %v, %v after the source removal", key, e)
+	}
+}
+
+func TestKeyringExpired(t *testing.T) {
+	now := time.Now()
+
+	keyring := NewKeyring()
+	keyring.Load(SourceFile, []*Key{
+		{Id: "expired", Secret: "s", NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)},
+		{Id: "future", Secret: "s", NotBefore: now.Add(time.Hour)},
+	})
+
+	if key, e := keyring.Signing(now); !errors.Is(e, ErrNoSigningKey) {
+		t.Errorf("expected ErrNoSigningKey, got key %v, %v", key, e)
+	}
+
+	// the legacy key has no window
+	keyring.Load(SourceFlag, []*Key{{Secret: "legacy"}})
+	if key, e := keyring.Signing(now); e != nil || key.Id != "" {
+		t.Errorf("got key %v, %v, expected the legacy one", key, e)
+	}
+}
+
+// TestKeyringDigest checks that secrets never leave the process with digests
+func TestKeyringDigest(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.Load(SourceFile, []*Key{{Id: "a", Secret: "very-secret"}})
+
+	var buf bytes.Buffer
+	keyring.Digest(&buf)
+
+	if expected := fmt.Sprintf("key=a,%d,%d\n", time.Time{}.Unix(), time.Time{}.Unix()); buf.String() != expected {
+		t.Errorf("got digest %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestKeyringWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	write := func(payload string) {
+		t.Helper()
+
+		if e := os.WriteFile(path, []byte(payload), 0600); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	write(`[{"id": "a", "secret": "s"}]`)
+
+	keyring := NewKeyring()
+	if e := keyring.LoadFile(path); e != nil {
+		t.Fatal(e)
+	}
+
+	log := zerolog.Nop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		keyring.WatchFile(ctx, &log, path, 10*time.Millisecond)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitKey := func(id string) {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if key, e := keyring.Signing(time.Now()); e == nil && key.Id == id {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatalf("timeout while waiting for key %s, got %v, %v", id, key, e)
+			}
+		}
+	}
+
+	// the new key is added, the size of the file is changed
+	write(`[{"id": "b", "secret": "s", "not_before": "2026-01-01T00:00:00Z"}, {"id": "a", "secret": "s"}]`)
+	waitKey("b")
+
+	// the broken file keeps the previous keys
+	write(`[{"id": "c", "secret": "s", "not_before": "2026-02-01T00:00:00Z"}, {"id": "c", "secret": "s"}]`)
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := keyring.Get("c"); ok {
+		t.Fatal("keys of the broken file are loaded")
+	} else if _, ok = keyring.Get("a"); !ok {
+		t.Fatal("the previous keys are removed by the broken file")
+	}
+
+	// the fixed file is reloaded
+	write(`[{"id": "c", "secret": "s", "not_before": "2026-02-01T00:00:00Z"}]`)
+	waitKey("c")
+
+	if _, ok := keyring.Get("a"); ok {
+		t.Error("removed key is kept after the reload")
+	}
+}
@@ -0,0 +1,93 @@
+package signer
+
+import (
+	"net/url"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// RoundExpires rounds the expiration time up to the bucket boundary, so identical requests
+// inside the bucket get identical links; links live at least the expiration and boundaries
+// are aligned to the unix epoch, so all nodes and prefork children produce the same values
+func RoundExpires(now time.Time, expiration, bucket time.Duration) int64 {
+	expires := now.Add(expiration).Unix()
+
+	size := int64(bucket / time.Second)
+	if size <= 1 {
+		return expires
+	}
+
+	return (expires + size - 1) / size * size
+}
+
+// Memo caches signed arguments of links with rounded expiration time
+type Memo struct {
+	cache *lru.Cache
+}
+
+// ipBinder is implemented by schemes which may sign the client ip
+type ipBinder interface {
+	BindsClientIp() bool
+}
+
+// memoKey - the signer and the key are compared by pointers, so reloaded keyrings
+// never hit old entries; the client ip is a part of the key for schemes with the ip binding only,
+// links of other schemes are shared by all viewers
+type memoKey struct {
+	sgnr Signer
+	key  *Key
+
+	uri, server, uid, clientIp string
+	expires                    int64
+}
+
+func NewMemo(size int) (_ *Memo, e error) {
+	memo := &Memo{}
+	if memo.cache, e = lru.New(size); e != nil {
+		return
+	}
+
+	return memo, e
+}
+
+// Sign returns the copy of memoized arguments or signs the request with the signer
+func (m *Memo) Sign(sgnr Signer, req *Request) (args url.Values, e error) {
+	mkey := memoKey{
+		sgnr:    sgnr,
+		key:     req.Key,
+		uri:     req.Uri,
+		server:  req.Server,
+		uid:     req.Uid,
+		expires: req.Expires,
+	}
+
+	if binder, ok := sgnr.(ipBinder); ok && binder.BindsClientIp() {
+		mkey.clientIp = req.ClientIp
+	}
+
+	if buf, ok := m.cache.Get(mkey); ok {
+		return copyValues(buf.(url.Values)), e
+	}
+
+	if args, e = sgnr.Sign(req); e != nil {
+		return
+	}
+
+	m.cache.Add(mkey, copyValues(args))
+	return
+}
+
+func (m *Memo) Len() int {
+	return m.cache.Len()
+}
+
+// copyValues - callers add their own arguments to signed ones
+func copyValues(args url.Values) url.Values {
+	buf := make(url.Values, len(args))
+	for arg, values := range args {
+		buf[arg] = append([]string(nil), values...)
+	}
+
+	return buf
+}
@@ -0,0 +1,76 @@
+package signer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoClientIp(t *testing.T) {
+	legacy, e := newNginxSigner(SchemeMD5, legacyTemplate)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	template, e := newNginxSigner(SchemeNginxTemplate, "$secure_link_expires$uri$remote_addr $secret")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sgnr    Signer
+		secret  string
+		entries int
+	}{
+		{name: "md5", sgnr: legacy, secret: "secret", entries: 1},
+		{name: "hmac-sha256", sgnr: &hmacSigner{}, secret: "secret", entries: 1},
+		{name: "akamai", sgnr: &akamaiSigner{}, secret: "0a1b2c3d4e5f", entries: 1},
+		{name: "nginx-template with ip", sgnr: template, secret: "secret", entries: 2},
+		{name: "akamai with ip", sgnr: &akamaiSigner{bindIp: true}, secret: "0a1b2c3d4e5f", entries: 2},
+	} {
+		memo, e := NewMemo(16)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		key := &Key{Id: "2026-10", Secret: tc.secret}
+		for _, ip := range []string{"192.0.2.10", "192.0.2.20", "192.0.2.10"} {
+			req := newTestRequest(key)
+			req.ClientIp = ip
+
+			args, e := memo.Sign(tc.sgnr, req)
+			if e != nil {
+				t.Fatal(e)
+			}
+
+			// memoized arguments must be the same as signed ones for the viewer
+			want, _ := tc.sgnr.Sign(req)
+			if args.Encode() != want.Encode() {
+				t.Errorf("%s, %s: got %s, want %s", tc.name, ip, args.Encode(), want.Encode())
+			}
+		}
+
+		if memo.Len() != tc.entries {
+			t.Errorf("%s: got %d memo entries, want %d", tc.name, memo.Len(), tc.entries)
+		}
+	}
+}
+
+func TestRoundExpires(t *testing.T) {
+	now := time.Unix(1700000005, 0)
+
+	for _, tc := range []struct {
+		expiration, bucket time.Duration
+		expires            int64
+	}{
+		{expiration: time.Hour, bucket: 0, expires: 1700003605},
+		{expiration: time.Hour, bucket: time.Second, expires: 1700003605},
+		{expiration: time.Hour, bucket: time.Minute, expires: 1700003640},
+		{expiration: time.Hour + 35*time.Second, bucket: time.Minute, expires: 1700003640},
+		{expiration: time.Hour + 36*time.Second, bucket: time.Minute, expires: 1700003700},
+	} {
+		if expires := RoundExpires(now, tc.expiration, tc.bucket); expires != tc.expires {
+			t.Errorf("expiration %s, bucket %s: got %d, want %d", tc.expiration, tc.bucket, expires, tc.expires)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5" // skipcq: GSC-G501 md5 used in nginx, no choise to fix it
+	"crypto/rsa"
+	"crypto/sha1" // skipcq: GSC-G505 sha1 used in cloudfront canned policies, no choise to fix it
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// legacyTemplate is the layout of links signed before signing schemes:
+// expire:uri:cache_ip:uid secret
+const legacyTemplate = "$secure_link_expires$uri$server$uid $secret"
+
+// nginxSigner is nginx secure_link_md5 implementation with the configurable expression
+//
+// docs:
+// https://nginx.org/ru/docs/http/ngx_http_secure_link_module.html#secure_link
+//
+// bash example of the legacy layout:
+//
+//	echo -n '2147483647/s/link127.0.0.1 secret' | \
+//		openssl md5 -binary | openssl base64 | tr +/ -_ | tr -d =
+type nginxSigner struct {
+	scheme   string
+	template string
+
+	// bindIp - the template has $remote_addr
+	bindIp bool
+}
+
+// templateVars - variables of nginx expressions; remote_addr is the client ip binding
+var templateVars = map[string]func(*Request) string{
+	"secure_link_expires": (*Request).expires,
+	"expires":             (*Request).expires,
+	"uri":                 func(r *Request) string { return r.Uri },
+	"server":              func(r *Request) string { return r.Server },
+	"uid":                 func(r *Request) string { return r.Uid },
+	"remote_addr":         func(r *Request) string { return r.ClientIp },
+	"secret":              func(r *Request) string { return r.Key.Secret },
+	"kid":                 func(r *Request) string { return r.Key.Id },
+}
+
+func newNginxSigner(scheme, template string) (_ *nginxSigner, e error) {
+	var secret, bindIp bool
+	os.Expand(template, func(name string) string {
+		if _, ok := templateVars[name]; !ok && e == nil {
+			e = fmt.Errorf("nginx template variable $%s is undefined", name)
+		}
+
+		secret = secret || name == "secret"
+		bindIp = bindIp || name == "remote_addr"
+		return ""
+	})
+
+	if e == nil && !secret {
+		e = errors.New("nginx template must contain $secret variable")
+	}
+
+	return &nginxSigner{scheme: scheme, template: template, bindIp: bindIp}, e
+}
+
+func (m *nginxSigner) Scheme() string { return m.scheme }
+
+func (m *nginxSigner) BindsClientIp() bool { return m.bindIp }
+
+func (m *nginxSigner) Sign(req *Request) (url.Values, error) {
+	buf := os.Expand(m.template, func(name string) string {
+		return templateVars[name](req)
+	})
+
+	// md5 sum `openssl md5 -binary`
+	md5sum := md5.Sum([]byte(buf)) // skipcq: GSC-G401 md5 used in nginx, no choise to fix it
+
+	// `openssl base64 | tr +/ -_ | tr -d =`
+	return getExtraArgs(req, base64.RawURLEncoding.EncodeToString(md5sum[:])), nil
+}
+
+func (*nginxSigner) Parse(args url.Values) (int64, string, error) {
+	return parseExtraArgs(args)
+}
+
+// hmacSigner signs the legacy layout without the secret with HMAC-SHA256
+type hmacSigner struct{}
+
+func (*hmacSigner) Scheme() string { return SchemeHMACSHA256 }
+
+func (*hmacSigner) Sign(req *Request) (url.Values, error) {
+	mac := hmac.New(sha256.New, []byte(req.Key.Secret))
+	mac.Write([]byte(req.expires() + req.Uri + req.Server + req.Uid))
+
+	return getExtraArgs(req, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))), nil
+}
+
+func (*hmacSigner) Parse(args url.Values) (int64, string, error) {
+	return parseExtraArgs(args)
+}
+
+func getExtraArgs(req *Request, extra string) url.Values {
+	args := url.Values{}
+	args.Set("expires", req.expires())
+	args.Set("extra", extra)
+
+	if req.Key.Id != "" {
+		args.Set("kid", req.Key.Id)
+	}
+
+	return args
+}
+
+func parseExtraArgs(args url.Values) (expires int64, kid string, e error) {
+	if args.Get("expires") == "" || args.Get("extra") == "" {
+		return 0, "", ErrMissingArgs
+	}
+
+	expires, e = parseExpires(args.Get("expires"))
+	return expires, args.Get("kid"), e
+}
+
+// akamaiSigner makes EdgeAuth tokens - hdnts=ip=IP~exp=EXPIRES~acl=URI~id=UID~hmac=HEX;
+// secrets are hex encoded as in akamai property settings
+type akamaiSigner struct {
+	bindIp bool
+}
+
+const akamaiTokenArg = "hdnts"
+
+func (*akamaiSigner) Scheme() string { return SchemeAkamai }
+
+func (m *akamaiSigner) BindsClientIp() bool { return m.bindIp }
+
+func (m *akamaiSigner) Sign(req *Request) (_ url.Values, e error) {
+	var key []byte
+	if key, e = hex.DecodeString(req.Key.Secret); e != nil {
+		return nil, fmt.Errorf("akamai secret of key %s must be hex encoded", req.Key.Id)
+	}
+
+	fields := make([]string, 0, 4)
+	if m.bindIp {
+		fields = append(fields, "ip="+req.ClientIp)
+	}
+
+	fields = append(fields, "exp="+req.expires(), "acl="+req.Uri)
+	if req.Uid != "" {
+		fields = append(fields, "id="+req.Uid)
+	}
+
+	token := strings.Join(fields, "~")
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+
+	args := url.Values{}
+	args.Set(akamaiTokenArg, token+"~hmac="+hex.EncodeToString(mac.Sum(nil)))
+
+	if req.Key.Id != "" {
+		args.Set("kid", req.Key.Id)
+	}
+
+	return args, e
+}
+
+func (*akamaiSigner) Parse(args url.Values) (expires int64, kid string, e error) {
+	fields := parseAkamaiToken(args.Get(akamaiTokenArg))
+
+	exp, ok := fields["exp"]
+	if !ok {
+		return 0, "", ErrMissingArgs
+	}
+
+	expires, e = parseExpires(exp)
+	return expires, args.Get("kid"), e
+}
+
+// ParseSigned returns values of the token, they are signed as is
+func (*akamaiSigner) ParseSigned(args url.Values) *Request {
+	fields := parseAkamaiToken(args.Get(akamaiTokenArg))
+
+	return &Request{
+		Uri:      fields["acl"],
+		Uid:      fields["id"],
+		ClientIp: fields["ip"],
+	}
+}
+
+// parseAkamaiToken returns name=value fields of the token; the empty token has no fields
+func parseAkamaiToken(token string) map[string]string {
+	fields := make(map[string]string)
+	if token == "" {
+		return fields
+	}
+
+	for _, field := range strings.Split(token, "~") {
+		if name, value, ok := strings.Cut(field, "="); ok {
+			fields[name] = value
+		}
+	}
+
+	return fields
+}
+
+// cloudFrontSigner makes canned policy signatures; secrets are PEM encoded RSA private keys
+// and key ids are cloudfront key pair ids
+type cloudFrontSigner struct {
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey // secret => parsed key
+}
+
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+func newCloudFrontSigner() *cloudFrontSigner {
+	return &cloudFrontSigner{
+		keys: make(map[string]*rsa.PrivateKey),
+	}
+}
+
+func (*cloudFrontSigner) Scheme() string { return SchemeCloudFront }
+
+// getPrivateKey parses secrets once; parsed keys of removed keyring entries
+// are not evicted, keyrings are small and rarely changed
+func (m *cloudFrontSigner) getPrivateKey(key *Key) (_ *rsa.PrivateKey, e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pkey, ok := m.keys[key.Secret]; ok {
+		return pkey, e
+	}
+
+	block, _ := pem.Decode([]byte(key.Secret))
+	if block == nil {
+		return nil, fmt.Errorf("cloudfront secret of key %s must be PEM encoded", key.Id)
+	}
+
+	var pkey interface{}
+	if pkey, e = x509.ParsePKCS1PrivateKey(block.Bytes); e != nil {
+		if pkey, e = x509.ParsePKCS8PrivateKey(block.Bytes); e != nil {
+			return nil, fmt.Errorf("cloudfront secret of key %s could not be parsed - %w", key.Id, e)
+		}
+	}
+
+	rsakey, ok := pkey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("cloudfront secret of key %s is not RSA private key", key.Id)
+	}
+
+	m.keys[key.Secret] = rsakey
+	return rsakey, e
+}
+
+func (m *cloudFrontSigner) Sign(req *Request) (_ url.Values, e error) {
+	var pkey *rsa.PrivateKey
+	if pkey, e = m.getPrivateKey(req.Key); e != nil {
+		return
+	}
+
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"https://%s%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+		req.Server, req.Uri, req.Expires)
+	hash := sha1.Sum([]byte(policy)) // skipcq: GSC-G401 sha1 used in cloudfront, no choise to fix it
+
+	var signature []byte
+	if signature, e = rsa.SignPKCS1v15(nil, pkey, crypto.SHA1, hash[:]); e != nil {
+		return
+	}
+
+	args := url.Values{}
+	args.Set("Expires", req.expires())
+	args.Set("Signature", cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(signature)))
+
+	if req.Key.Id != "" {
+		args.Set("Key-Pair-Id", req.Key.Id)
+	}
+
+	return args, e
+}
+
+func (*cloudFrontSigner) Parse(args url.Values) (expires int64, kid string, e error) {
+	if args.Get("Expires") == "" || args.Get("Signature") == "" {
+		return 0, "", ErrMissingArgs
+	}
+
+	expires, e = parseExpires(args.Get("Expires"))
+	return expires, args.Get("Key-Pair-Id"), e
+}
@@ -0,0 +1,172 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func newTestRequest(key *Key) *Request {
+	return &Request{
+		Uri:      "/videos/media/ts/9000/1/720/fff6d1a7_00001.ts",
+		Server:   "cache-01.example.org",
+		Uid:      "u1",
+		ClientIp: "192.0.2.10",
+		Expires:  testNow.Add(time.Hour).Unix(),
+		Key:      key,
+	}
+}
+
+// newTestLink returns the signed link as cache nodes get it
+func newTestLink(t *testing.T, sgnr Signer, req *Request) *url.URL {
+	t.Helper()
+
+	args, e := sgnr.Sign(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return &url.URL{Scheme: "https", Host: req.Server, Path: req.Uri, RawQuery: args.Encode()}
+}
+
+func newTestRSAKey(t *testing.T) string {
+	t.Helper()
+
+	pkey, e := rsa.GenerateKey(rand.Reader, 1024)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pkey)}))
+}
+
+type testScheme struct {
+	name   string
+	sgnr   Signer
+	secret string
+}
+
+func newTestSchemes(t *testing.T) []*testScheme {
+	t.Helper()
+
+	legacy, e := newNginxSigner(SchemeMD5, legacyTemplate)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	template, e := newNginxSigner(SchemeNginxTemplate, "$secure_link_expires$uri$remote_addr$kid $secret")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return []*testScheme{
+		{name: "md5", sgnr: legacy, secret: "secret"},
+		{name: "nginx-template", sgnr: template, secret: "secret"},
+		{name: "hmac-sha256", sgnr: &hmacSigner{}, secret: "secret"},
+		{name: "akamai", sgnr: &akamaiSigner{}, secret: "0a1b2c3d4e5f"},
+		{name: "akamai with ip", sgnr: &akamaiSigner{bindIp: true}, secret: "0a1b2c3d4e5f"},
+		{name: "cloudfront", sgnr: newCloudFrontSigner(), secret: newTestRSAKey(t)},
+	}
+}
+
+func TestSignParse(t *testing.T) {
+	for _, scheme := range newTestSchemes(t) {
+		for _, kid := range []string{"", "2026-10"} {
+			req := newTestRequest(&Key{Id: kid, Secret: scheme.secret})
+
+			args, e := scheme.sgnr.Sign(req)
+			if e != nil {
+				t.Fatalf("%s, kid %q: %v", scheme.name, kid, e)
+			}
+
+			expires, parsed, e := scheme.sgnr.Parse(args)
+			if e != nil {
+				t.Errorf("%s, kid %q: could not parse %s - %v", scheme.name, kid, args.Encode(), e)
+			} else if expires != req.Expires || parsed != kid {
+				t.Errorf("%s, kid %q: got expiration %d and kid %q", scheme.name, kid, expires, parsed)
+			}
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, scheme := range newTestSchemes(t) {
+		for _, kid := range []string{"", "2026-10"} {
+			key := &Key{Id: kid, Secret: scheme.secret}
+
+			keyring := NewKeyring()
+			keyring.Load(SourceFile, []*Key{key})
+
+			req := newTestRequest(key)
+			link := newTestLink(t, scheme.sgnr, req)
+
+			vrf := Verify(scheme.sgnr, keyring, &VerifyRequest{Link: link, Uid: req.Uid, ClientIp: req.ClientIp}, testNow)
+			if !vrf.Valid || !vrf.Signature || vrf.Reason != "" {
+				t.Errorf("%s, kid %q: link %s is not verified - %+v", scheme.name, kid, link, vrf)
+			}
+
+			if vrf.Kid != kid || vrf.SignedBy != kid || vrf.Scheme != scheme.sgnr.Scheme() {
+				t.Errorf("%s, kid %q: got kid %q signed by %q of scheme %s", scheme.name, kid, vrf.Kid, vrf.SignedBy, vrf.Scheme)
+			}
+
+			if !vrf.Expires.Equal(time.Unix(req.Expires, 0)) || vrf.Expired {
+				t.Errorf("%s, kid %q: got expiration %s, expired %t", scheme.name, kid, vrf.Expires, vrf.Expired)
+			}
+		}
+	}
+}
+
+func TestSignIsDeterministic(t *testing.T) {
+	for _, scheme := range newTestSchemes(t) {
+		req := newTestRequest(&Key{Id: "2026-10", Secret: scheme.secret})
+
+		if first, second := newTestLink(t, scheme.sgnr, req), newTestLink(t, scheme.sgnr, req); *first != *second {
+			t.Errorf("%s: links of the same request differ - %s, %s", scheme.name, first, second)
+		}
+	}
+}
+
+func TestParseMissingArgs(t *testing.T) {
+	for _, scheme := range newTestSchemes(t) {
+		if _, _, e := scheme.sgnr.Parse(url.Values{"kid": {"2026-10"}}); !errors.Is(e, ErrMissingArgs) {
+			t.Errorf("%s: expected ErrMissingArgs, got %v", scheme.name, e)
+		}
+	}
+}
+
+// TestLegacyMD5 checks that links of the md5 scheme are the same as links signed before signing schemes;
+// extra values are computed by the shell example in nginxSigner docs
+func TestLegacyMD5(t *testing.T) {
+	sgnr, e := newNginxSigner(SchemeMD5, legacyTemplate)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, tc := range []struct {
+		req  *Request
+		link string
+	}{
+		{
+			req:  &Request{Uri: "/s/link", Server: "127.0.0.1", Expires: 2147483647, Key: &Key{Secret: "secret"}},
+			link: "https://127.0.0.1/s/link?expires=2147483647&extra=_e4Nc3iduzkWRm01TBBNYw",
+		},
+		{
+			req: &Request{
+				Uri: "/videos/media/ts/9000/1/720/fff6d1a7_00001.ts", Server: "10.0.0.1", Uid: "u1",
+				ClientIp: "192.0.2.10", Expires: 1700000000, Key: &Key{Secret: "secret"},
+			},
+			link: "https://10.0.0.1/videos/media/ts/9000/1/720/fff6d1a7_00001.ts?expires=1700000000&extra=MgnLmd2PJB6K6e-LLZ4_uw",
+		},
+	} {
+		if link := newTestLink(t, sgnr, tc.req).String(); link != tc.link {
+			t.Errorf("got %s, want %s", link, tc.link)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrInvalidScheme  = errors.New("signing scheme is invalid; md5, hmac-sha256, nginx-template, akamai, cloudfront values are permited only")
+	ErrInvalidCluster = errors.New("cluster signing scheme is invalid; format is CLUSTER=SCHEME")
+	ErrMissingArgs    = errors.New("signed link has no signature arguments of the scheme")
+)
+
+const (
+	SchemeMD5           = "md5"
+	SchemeHMACSHA256    = "hmac-sha256"
+	SchemeNginxTemplate = "nginx-template"
+	SchemeAkamai        = "akamai"
+	SchemeCloudFront    = "cloudfront"
+)
+
+// Request is the link for signing or verification
+type Request struct {
+	Uri      string // path with the leading slash
+	Server   string
+	Uid      string
+	ClientIp string
+	Expires  int64 // unix time
+	Key      *Key
+}
+
+func (m *Request) expires() string {
+	return strconv.FormatInt(m.Expires, 10)
+}
+
+type Signer interface {
+	Scheme() string
+
+	// Sign returns query arguments of the signed link including the key id
+	Sign(req *Request) (url.Values, error)
+
+	// Parse returns the expiration time and the key id from arguments of the signed link
+	Parse(args url.Values) (expires int64, kid string, e error)
+}
+
+func NewSigner(ccx *cli.Context, scheme string) (Signer, error) {
+	switch scheme {
+	case SchemeMD5:
+		return newNginxSigner(SchemeMD5, legacyTemplate)
+	case SchemeHMACSHA256:
+		return &hmacSigner{}, nil
+	case SchemeNginxTemplate:
+		return newNginxSigner(SchemeNginxTemplate, ccx.String("link-sign-template"))
+	case SchemeAkamai:
+		return &akamaiSigner{bindIp: ccx.Bool("link-sign-akamai-ip")}, nil
+	case SchemeCloudFront:
+		return newCloudFrontSigner(), nil
+	default:
+		return nil, fmt.Errorf("%w; %s", ErrInvalidScheme, scheme)
+	}
+}
+
+// Signers selects the signing scheme by the cluster of balanced cache server;
+// links of unbalanced requests are signed with the default scheme
+type Signers struct {
+	byDefault Signer
+	clusters  map[string]Signer
+}
+
+func NewSigners(ctx context.Context) (_ *Signers, e error) {
+	ccx := ctx.Value(utils.ContextKeyCliContext).(*cli.Context)
+
+	signers := &Signers{
+		clusters: make(map[string]Signer),
+	}
+
+	if signers.byDefault, e = NewSigner(ccx, ccx.String("link-sign-scheme")); e != nil {
+		return
+	}
+
+	for _, buf := range ccx.StringSlice("link-sign-cluster-scheme") {
+		cluster, scheme, ok := strings.Cut(buf, "=")
+		if !ok || cluster == "" {
+			return nil, fmt.Errorf("%w; %s", ErrInvalidCluster, buf)
+		}
+
+		if signers.clusters[cluster], e = NewSigner(ccx, scheme); e != nil {
+			return
+		}
+	}
+
+	return signers, e
+}
+
+func (m *Signers) Get(cluster string) Signer {
+	if signer, ok := m.clusters[cluster]; ok {
+		return signer
+	}
+
+	return m.byDefault
+}
+
+// parseExpires parses the unix time argument
+func parseExpires(buf string) (expires int64, e error) {
+	if expires, e = strconv.ParseInt(buf, 10, 64); e != nil {
+		return 0, fmt.Errorf("expiration time is invalid - %s", buf)
+	}
+
+	return
+}
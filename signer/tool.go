@@ -0,0 +1,119 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	errToolEmptyArg    = errors.New("link or uri argument is required")
+	errToolEmptyServer = errors.New("server could not be empty")
+	errToolInvalidLink = errors.New("link is not valid")
+)
+
+// Tool generates and verifies links with link-* flags of the application;
+// keys of consul KV are not loaded, use link-keyring-file with the same keys
+type Tool struct {
+	log *zerolog.Logger
+	ccx *cli.Context
+
+	keyring *Keyring
+	signers *Signers
+}
+
+func NewTool(c *cli.Context, l *zerolog.Logger) (_ *Tool, e error) {
+	tool := &Tool{
+		log:     l,
+		ccx:     c,
+		keyring: NewKeyring(),
+	}
+
+	if secret := c.String("link-secret"); secret != "" {
+		tool.keyring.Load(SourceFlag, []*Key{{Secret: secret}})
+	}
+
+	if path := c.String("link-keyring-file"); path != "" {
+		if e = tool.keyring.LoadFile(path); e != nil {
+			return
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), utils.ContextKeyCliContext, c)
+	if tool.signers, e = NewSigners(ctx); e != nil {
+		return
+	}
+
+	return tool, e
+}
+
+// Generate prints the signed link of the uri argument
+func (m *Tool) Generate() (e error) {
+	uri := m.ccx.Args().First()
+	if uri == "" {
+		return errToolEmptyArg
+	} else if m.ccx.String("server") == "" {
+		return errToolEmptyServer
+	}
+
+	now := time.Now()
+	req := &Request{
+		Uri:      uri,
+		Server:   m.ccx.String("server"),
+		Uid:      m.ccx.String("uid"),
+		ClientIp: m.ccx.String("client-ip"),
+		Expires:  now.Add(m.ccx.Duration("expiration")).Unix(),
+	}
+
+	if req.Key, e = m.keyring.Signing(now); e != nil {
+		return
+	}
+
+	var args url.Values
+	if args, e = m.signers.Get(m.ccx.String("cluster")).Sign(req); e != nil {
+		return
+	}
+
+	rrl := &url.URL{Scheme: "https", Host: req.Server, Path: req.Uri, RawQuery: args.Encode()}
+	fmt.Println(rrl.String())
+	return
+}
+
+// Verify prints the verification of the link argument; invalid links are reported with the error
+func (m *Tool) Verify() (e error) {
+	if m.ccx.Args().First() == "" {
+		return errToolEmptyArg
+	}
+
+	vreq := &VerifyRequest{
+		Uid:      m.ccx.String("uid"),
+		ClientIp: m.ccx.String("client-ip"),
+		Server:   m.ccx.String("server"),
+	}
+
+	if vreq.Link, e = url.Parse(m.ccx.Args().First()); e != nil {
+		return
+	}
+
+	vrf := Verify(m.signers.Get(m.ccx.String("cluster")), m.keyring, vreq, time.Now())
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if e = enc.Encode(vrf); e != nil {
+		return
+	}
+
+	if !vrf.Valid {
+		return errToolInvalidLink
+	}
+
+	return
+}
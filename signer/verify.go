@@ -0,0 +1,153 @@
+package signer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// VerifyRequest is the signed link with values which are not in the link itself
+type VerifyRequest struct {
+	Link     *url.URL
+	Uid      string
+	ClientIp string
+
+	// the server the viewer requested, the link's host is used if empty
+	Server string
+}
+
+// signedParser is implemented by schemes which keep signed values in the link,
+// so mismatched values are reported exactly
+type signedParser interface {
+	// ParseSigned returns signed uri, uid and client ip of the link; values which
+	// are not in the link are empty
+	ParseSigned(args url.Values) *Request
+}
+
+type Verification struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+
+	Scheme    string    `json:"scheme"`
+	Kid       string    `json:"kid"`
+	SignedBy  string    `json:"signed_by,omitempty"` // key id which matches the signature
+	Signature bool      `json:"signature"`
+	Expires   time.Time `json:"expires"`
+	Expired   bool      `json:"expired"`
+}
+
+// Verify recomputes the signature with the scheme and keys of the keyring;
+// if the signature mismatches, the link's host, other keys and signed values of the link are tried for the reason
+func Verify(sgnr Signer, keyring *Keyring, vreq *VerifyRequest, now time.Time) (vrf *Verification) {
+	vrf = &Verification{Scheme: sgnr.Scheme()}
+	args := vreq.Link.Query()
+
+	var expires int64
+	var e error
+	if expires, vrf.Kid, e = sgnr.Parse(args); e != nil {
+		vrf.Reason = e.Error()
+		return
+	}
+
+	vrf.Expires = time.Unix(expires, 0)
+	vrf.Expired = expires < now.Unix()
+
+	req := &Request{
+		Uri:      vreq.Link.Path,
+		Server:   vreq.Server,
+		Uid:      vreq.Uid,
+		ClientIp: vreq.ClientIp,
+		Expires:  expires,
+	}
+
+	if req.Server == "" {
+		req.Server = vreq.Link.Host
+	}
+
+	var ok bool
+	if req.Key, ok = keyring.Get(vrf.Kid); !ok {
+		vrf.Reason = fmt.Sprintf("key %q is not found in the keyring", vrf.Kid)
+		return
+	}
+
+	switch {
+	case isSignedWith(sgnr, req, args):
+		vrf.Signature, vrf.SignedBy = true, req.Key.Id
+	case req.Server != vreq.Link.Host && isSignedWith(sgnr, withServer(req, vreq.Link.Host), args):
+		vrf.Reason = fmt.Sprintf("link is signed for server %s, not %s", vreq.Link.Host, req.Server)
+		return
+	default:
+		for _, key := range keyring.List() {
+			if key != req.Key && isSignedWith(sgnr, withKey(req, key), args) {
+				vrf.SignedBy = key.Id
+				vrf.Reason = fmt.Sprintf("link is signed with key %q, but its key id is %q", key.Id, vrf.Kid)
+				return
+			}
+		}
+
+		vrf.Reason = getMismatchReason(sgnr, req, args)
+		return
+	}
+
+	if vrf.Expired {
+		vrf.Reason = fmt.Sprintf("link has expired %s ago", now.Sub(vrf.Expires).Round(time.Second))
+		return
+	}
+
+	vrf.Valid = true
+	return
+}
+
+// getMismatchReason compares signed values of the link with the request's ones if the scheme allows it
+func getMismatchReason(sgnr Signer, req *Request, args url.Values) string {
+	parser, ok := sgnr.(signedParser)
+	if !ok {
+		return "signature mismatch; uid, client ip, server or the secret differs"
+	}
+
+	signed := parser.ParseSigned(args)
+	switch {
+	case signed.Uid != req.Uid:
+		return fmt.Sprintf("uid mismatch; link is signed for uid %q, not %q", signed.Uid, req.Uid)
+	case signed.ClientIp != "" && signed.ClientIp != req.ClientIp:
+		return fmt.Sprintf("client ip mismatch; link is signed for %s, not %s", signed.ClientIp, req.ClientIp)
+	case signed.Uri != req.Uri:
+		return fmt.Sprintf("uri mismatch; link is signed for %s, not %s", signed.Uri, req.Uri)
+	default:
+		return "signature mismatch; the secret or signed values differ"
+	}
+}
+
+func withServer(req *Request, server string) *Request {
+	buf := *req
+	buf.Server = server
+	return &buf
+}
+
+func withKey(req *Request, key *Key) *Request {
+	buf := *req
+	buf.Key = key
+	return &buf
+}
+
+// isSignedWith reports if all signed arguments are equal to the link's ones;
+// the key id argument is not compared, it's checked before
+func isSignedWith(sgnr Signer, req *Request, args url.Values) bool {
+	signed, e := sgnr.Sign(req)
+	if e != nil {
+		return false
+	}
+
+	for arg := range signed {
+		if arg == "kid" || arg == "Key-Pair-Id" {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(signed.Get(arg)), []byte(args.Get(arg))) != 1 {
+			return false
+		}
+	}
+
+	return true
+}
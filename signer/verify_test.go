@@ -0,0 +1,189 @@
+package signer
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyFailures(t *testing.T) {
+	legacy, e := newNginxSigner(SchemeMD5, legacyTemplate)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	current, previous := &Key{Id: "2026-10", Secret: "secret"}, &Key{Id: "2026-09", Secret: "previous"}
+
+	keyring := NewKeyring()
+	keyring.Load(SourceFile, []*Key{current, previous})
+
+	for _, tc := range []struct {
+		name string
+
+		// the link is signed by signer, tamper changes the link and the verify request
+		signer   Signer
+		verifier Signer
+		tamper   func(link *url.URL, vreq *VerifyRequest)
+
+		signature bool
+		expired   bool
+		signedBy  string
+		reason    string
+	}{
+		{
+			name:   "tampered expiration",
+			signer: legacy, verifier: legacy,
+			tamper: func(link *url.URL, _ *VerifyRequest) {
+				args := link.Query()
+				args.Set("expires", "1690000000")
+				link.RawQuery = args.Encode()
+			},
+			// the expiration is signed, so the prolonged link has the bad signature
+			expired: true,
+			reason:  "signature mismatch",
+		},
+		{
+			name:   "bad signature",
+			signer: &hmacSigner{}, verifier: &hmacSigner{},
+			tamper: func(link *url.URL, _ *VerifyRequest) {
+				args := link.Query()
+				args.Set("extra", "AAAAAAAAAAAAAAAAAAAAAA")
+				link.RawQuery = args.Encode()
+			},
+			reason: "signature mismatch",
+		},
+		{
+			name:   "wrong scheme with the same arguments",
+			signer: &hmacSigner{}, verifier: legacy,
+			reason: "signature mismatch",
+		},
+		{
+			name:   "wrong scheme",
+			signer: &akamaiSigner{}, verifier: &hmacSigner{},
+			reason: ErrMissingArgs.Error(),
+		},
+		{
+			name:   "unknown kid",
+			signer: legacy, verifier: legacy,
+			tamper: func(link *url.URL, _ *VerifyRequest) {
+				args := link.Query()
+				args.Set("kid", "2020-01")
+				link.RawQuery = args.Encode()
+			},
+			reason: `key "2020-01" is not found in the keyring`,
+		},
+		{
+			name:   "wrong kid",
+			signer: legacy, verifier: legacy,
+			tamper: func(link *url.URL, _ *VerifyRequest) {
+				args := link.Query()
+				args.Set("kid", previous.Id)
+				link.RawQuery = args.Encode()
+			},
+			signedBy: current.Id,
+			reason:   `link is signed with key "2026-10", but its key id is "2026-09"`,
+		},
+		{
+			name:   "wrong server",
+			signer: legacy, verifier: legacy,
+			tamper: func(_ *url.URL, vreq *VerifyRequest) {
+				vreq.Server = "cache-02.example.org"
+			},
+			reason: "link is signed for server cache-01.example.org, not cache-02.example.org",
+		},
+		{
+			name:   "uid mismatch",
+			signer: &akamaiSigner{}, verifier: &akamaiSigner{},
+			tamper: func(_ *url.URL, vreq *VerifyRequest) {
+				vreq.Uid = "u2"
+			},
+			reason: `uid mismatch; link is signed for uid "u1", not "u2"`,
+		},
+		{
+			name:   "client ip mismatch",
+			signer: &akamaiSigner{bindIp: true}, verifier: &akamaiSigner{bindIp: true},
+			tamper: func(_ *url.URL, vreq *VerifyRequest) {
+				vreq.ClientIp = "192.0.2.20"
+			},
+			reason: "client ip mismatch; link is signed for 192.0.2.10, not 192.0.2.20",
+		},
+		{
+			name:   "uri mismatch",
+			signer: &akamaiSigner{}, verifier: &akamaiSigner{},
+			tamper: func(link *url.URL, _ *VerifyRequest) {
+				link.Path = "/videos/media/ts/9000/1/720/fff6d1a7_00002.ts"
+			},
+			reason: "uri mismatch; link is signed for /videos/media/ts/9000/1/720/fff6d1a7_00001.ts",
+		},
+		{
+			name:   "uid mismatch without signed values",
+			signer: legacy, verifier: legacy,
+			tamper: func(_ *url.URL, vreq *VerifyRequest) {
+				vreq.Uid = "u2"
+			},
+			reason: "signature mismatch; uid, client ip, server or the secret differs",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := current.Secret
+			if _, ok := tc.signer.(*akamaiSigner); ok {
+				secret = "0a1b2c3d4e5f"
+			}
+
+			key := &Key{Id: current.Id, Secret: secret}
+			kr := keyring
+			if secret != current.Secret {
+				kr = NewKeyring()
+				kr.Load(SourceFile, []*Key{key})
+			}
+
+			req := newTestRequest(key)
+			link := newTestLink(t, tc.signer, req)
+			vreq := &VerifyRequest{Link: link, Uid: req.Uid, ClientIp: req.ClientIp}
+
+			if tc.tamper != nil {
+				tc.tamper(link, vreq)
+			}
+
+			vrf := Verify(tc.verifier, kr, vreq, testNow)
+			if vrf.Valid {
+				t.Fatalf("link %s is verified - %+v", link, vrf)
+			}
+
+			if !strings.Contains(vrf.Reason, tc.reason) {
+				t.Errorf("got reason %q, want %q", vrf.Reason, tc.reason)
+			}
+
+			if vrf.Signature != tc.signature || vrf.Expired != tc.expired || vrf.SignedBy != tc.signedBy {
+				t.Errorf("got signature %t, expired %t, signed by %q", vrf.Signature, vrf.Expired, vrf.SignedBy)
+			}
+		})
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	key := &Key{Id: "2026-10", Secret: "secret"}
+
+	keyring := NewKeyring()
+	keyring.Load(SourceFile, []*Key{key})
+
+	for _, scheme := range newTestSchemes(t) {
+		key.Secret = scheme.secret
+
+		req := newTestRequest(key)
+		req.Expires = testNow.Add(-90 * time.Second).Unix()
+
+		vrf := Verify(scheme.sgnr, keyring, &VerifyRequest{
+			Link: newTestLink(t, scheme.sgnr, req), Uid: req.Uid, ClientIp: req.ClientIp,
+		}, testNow)
+
+		if vrf.Valid || !vrf.Signature || !vrf.Expired {
+			t.Errorf("%s: expired link is not detected - %+v", scheme.name, vrf)
+		}
+
+		if want := "link has expired 1m30s ago"; vrf.Reason != want {
+			t.Errorf("%s: got reason %q, want %q", scheme.name, vrf.Reason, want)
+		}
+	}
+}
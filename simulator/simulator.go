@@ -0,0 +1,386 @@
+package simulator
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5" // skipcq: GSC-G501 md5 used only for fake chunk names
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
+	"github.com/MindHunter86/addie/utils"
+	capi "github.com/hashicorp/consul/api"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	errSimEmptyServers = errors.New("there are no servers for simulation; use --server or --consul-snapshot")
+	errSimInvalidNode  = errors.New("invalid server definition; format is name=ip or name=ip:port")
+	errSimEmptyUris    = errors.New("there are no chunk requests for simulation")
+)
+
+var qualities = []string{"480", "720", "1080"}
+
+type (
+	Simulator struct {
+		log *zerolog.Logger
+		ccx *cli.Context
+		ctx context.Context
+
+		accessRegexp *regexp.Regexp
+	}
+	simRequest struct {
+		prefix, chunkname string
+	}
+	simLoad struct {
+		mean, stddev, cov, ratio float64
+	}
+	simImpact struct {
+		chunks, movedChunks     int
+		requests, movedRequests int
+	}
+)
+
+func NewSimulator(c *cli.Context, l *zerolog.Logger) *Simulator {
+	// balancer's logs are too noisy for the simulation output
+	blog := l.Level(zerolog.WarnLevel)
+
+	ctx := context.WithValue(context.Background(), utils.ContextKeyLogger, &blog)
+	ctx = context.WithValue(ctx, utils.ContextKeyCliContext, c)
+
+	return &Simulator{
+		log: l,
+		ccx: c,
+		ctx: ctx,
+
+		accessRegexp: regexp.MustCompile(`\/videos\/media\/[^\s"?]+`),
+	}
+}
+
+func (m *Simulator) Run() (e error) {
+	var servers map[string]*balancer.UpstreamEntry
+	if servers, e = m.loadServers(); e != nil {
+		return
+	}
+
+	var requests []*simRequest
+	if requests, e = m.loadRequests(); e != nil {
+		return
+	}
+
+	m.log.Info().Int("servers", len(servers)).Int("requests", len(requests)).Msg("starting balancer simulation...")
+
+	blcr, unparsable := m.newBalancer(servers), 0
+	for _, req := range requests {
+		if _, _, e = blcr.BalanceByChunk(req.prefix, req.chunkname); e != nil {
+			unparsable++
+		}
+	}
+
+	m.printLoadStats(os.Stdout, blcr.GetStatsSnapshot(), unparsable)
+
+	for _, node := range m.ccx.StringSlice("add-node") {
+		entry, err := parseNode(node)
+		if err != nil {
+			return err
+		}
+
+		changed := copyServers(servers)
+		changed[entry.Address()] = entry
+		m.printImpact(os.Stdout, "add "+entry.Name, servers, changed, requests)
+	}
+
+	for _, name := range m.ccx.StringSlice("remove-node") {
+		changed := copyServers(servers)
+		for address, entry := range changed {
+			if entry.Name == name || address == name {
+				delete(changed, address)
+			}
+		}
+
+		m.printImpact(os.Stdout, "remove "+name, servers, changed, requests)
+	}
+
+	return nil
+}
+
+func (m *Simulator) newBalancer(servers map[string]*balancer.UpstreamEntry) *balancer.ClusterBalancer {
+	blcr := balancer.NewClusterBalancer(m.ctx, balancer.BalancerClusterNodes)
+	blcr.UpdateServers(servers)
+	return blcr
+}
+
+func (m *Simulator) loadServers() (servers map[string]*balancer.UpstreamEntry, e error) {
+	servers = make(map[string]*balancer.UpstreamEntry)
+
+	for _, node := range m.ccx.StringSlice("server") {
+		entry, err := parseNode(node)
+		if err != nil {
+			return nil, err
+		}
+
+		servers[entry.Address()] = entry
+	}
+
+	if path := m.ccx.String("consul-snapshot"); path != "" {
+		var buf []byte
+		if buf, e = os.ReadFile(path); e != nil {
+			return
+		}
+
+		// snapshot is a /v1/health/service/:service response
+		var entries []*capi.ServiceEntry
+		if e = json.Unmarshal(buf, &entries); e != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			upstream, err := balancer.NewUpstreamEntry(entry)
+			if err != nil {
+				m.log.Warn().Err(err).Msg("there is invalid service entry in the snapshot")
+				continue
+			}
+
+			servers[upstream.Address()] = upstream
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, errSimEmptyServers
+	}
+
+	return
+}
+
+func (m *Simulator) loadRequests() (requests []*simRequest, e error) {
+	var uris []string
+
+	if path := m.ccx.String("access-log"); path != "" {
+		if uris, e = m.readAccessLog(path); e != nil {
+			return
+		}
+	} else {
+		uris = m.generateUris()
+	}
+
+	var router *media.Router
+	if router, e = media.NewRouter(m.ccx.StringSlice("media-route")); e != nil {
+		return
+	}
+
+	for _, uri := range uris {
+		mpath, err := router.Parse(uri)
+		if err != nil {
+			continue
+		}
+
+		requests = append(requests, &simRequest{
+			prefix:    mpath.Prefix(),
+			chunkname: mpath.ChunkName(),
+		})
+	}
+
+	if len(requests) == 0 {
+		return nil, errSimEmptyUris
+	}
+
+	return
+}
+
+func (m *Simulator) readAccessLog(path string) (uris []string, e error) {
+	var fd *os.File
+	if fd, e = os.Open(path); e != nil {
+		return
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if uri := m.accessRegexp.FindString(scanner.Text()); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris, scanner.Err()
+}
+
+// generateUris makes zipf-distributed chunk requests for
+// --generate-titles titles with all their episodes, qualities and chunks
+func (m *Simulator) generateUris() (uris []string) {
+	titles, episodes, chunks :=
+		uint64(m.ccx.Uint("generate-titles")),
+		m.ccx.Uint("generate-episodes"),
+		m.ccx.Uint("generate-chunks")
+
+	if titles == 0 || episodes == 0 || chunks == 0 {
+		return
+	}
+
+	rnd := rand.New(rand.NewSource(m.ccx.Int64("generate-seed"))) // skipcq: GSC-G404 math/rand is enough
+	zipf := rand.NewZipf(rnd, 1.1, 1, titles-1)
+
+	for i := 0; i < m.ccx.Int("generate-requests"); i++ {
+		tid := zipf.Uint64() + 1
+		ep := uint(rnd.Intn(int(episodes))) + 1
+		quality := qualities[rnd.Intn(len(qualities))]
+
+		hash := md5.Sum([]byte(fmt.Sprintf("%d/%d/%s", tid, ep, quality))) // skipcq: GSC-G401 fake names only
+		uris = append(uris, fmt.Sprintf("/videos/media/ts/%d/%d/%s/%s_%05d.ts",
+			tid, ep, quality, hex.EncodeToString(hash[:]), rnd.Intn(int(chunks))+1))
+	}
+
+	return
+}
+
+func (*Simulator) printLoadStats(w io.Writer, stats *balancer.ClusterStats, unparsable int) {
+	tb := table.NewWriter()
+	tb.SetOutputMirror(w)
+	tb.AppendHeader(table.Row{"Name", "Address", "Requests", "Share", "Ideal Share", "Skew"})
+
+	for _, server := range stats.Servers {
+		skew := server.HashShare - server.IdealShare
+
+		tb.AppendRow(table.Row{
+			server.Name, server.Address, server.Requests,
+			round(server.HashShare), round(server.IdealShare), round(skew),
+		})
+	}
+
+	tb.Render()
+
+	load := getLoad(stats)
+	fmt.Fprintf(w, "requests: %d, unparsable: %d\n", stats.Requests, unparsable)
+	fmt.Fprintf(w, "load per node: mean %.2f, stddev %.2f, cov %.2f%%, max/min %.3f\n\n",
+		load.mean, load.stddev, load.cov, load.ratio)
+}
+
+// getLoad returns the distribution of requests over servers; cov (coefficient of variation)
+// is the stddev in percents of the mean
+func getLoad(stats *balancer.ClusterStats) *simLoad {
+	var min, max, sum, sqsum float64 = math.MaxFloat64, 0, 0, 0
+	for _, server := range stats.Servers {
+		load := float64(server.Requests)
+		min, max = math.Min(min, load), math.Max(max, load)
+		sum, sqsum = sum+load, sqsum+load*load
+	}
+
+	count := float64(len(stats.Servers))
+	if count == 0 {
+		return &simLoad{}
+	}
+
+	sload := &simLoad{mean: sum / count}
+	sload.stddev = math.Sqrt(math.Max(sqsum/count-sload.mean*sload.mean, 0))
+
+	if sload.mean != 0 {
+		sload.cov = sload.stddev * 100 / sload.mean
+	}
+	if min != 0 {
+		sload.ratio = max / min
+	}
+
+	return sload
+}
+
+func (m *Simulator) printImpact(w io.Writer, change string, before, after map[string]*balancer.UpstreamEntry, requests []*simRequest) {
+	impact := m.getImpact(before, after, requests)
+	if impact.requests == 0 || impact.chunks == 0 {
+		fmt.Fprintf(w, "%s: there are no balanced requests\n", change)
+		return
+	}
+
+	fmt.Fprintf(w, "%s: %.2f%% of chunks (%d/%d) and %.2f%% of requests (%d/%d) would move\n",
+		change,
+		float64(impact.movedChunks)*100/float64(impact.chunks), impact.movedChunks, impact.chunks,
+		float64(impact.movedRequests)*100/float64(impact.requests), impact.movedRequests, impact.requests)
+}
+
+// getImpact balances requests by both upstreams and counts chunks (and requests) which land
+// on other servers after the upstream change
+func (m *Simulator) getImpact(before, after map[string]*balancer.UpstreamEntry, requests []*simRequest) *simImpact {
+	old, cur := m.newBalancer(before), m.newBalancer(after)
+
+	impact, uniq := &simImpact{}, make(map[string]struct{})
+	for _, req := range requests {
+		oip, _, e1 := old.BalanceByChunk(req.prefix, req.chunkname)
+		nip, _, e2 := cur.BalanceByChunk(req.prefix, req.chunkname)
+		if e1 != nil || e2 != nil {
+			continue
+		}
+
+		impact.requests++
+		isMoved := oip != nip
+
+		if isMoved {
+			impact.movedRequests++
+		}
+
+		key := req.prefix + req.chunkname
+		if _, ok := uniq[key]; !ok {
+			uniq[key] = struct{}{}
+			impact.chunks++
+
+			if isMoved {
+				impact.movedChunks++
+			}
+		}
+	}
+
+	return impact
+}
+
+// parseNode parses name=ip, name=ip:port and name=[ipv6]:port definitions
+func parseNode(node string) (_ *balancer.UpstreamEntry, e error) {
+	name, addr, ok := strings.Cut(node, "=")
+	if !ok || name == "" {
+		return nil, errSimInvalidNode
+	}
+
+	entry := &balancer.UpstreamEntry{Name: name}
+	if entry.Ip = net.ParseIP(addr); entry.Ip != nil {
+		return entry, e
+	}
+
+	var host, port string
+	if host, port, e = net.SplitHostPort(addr); e != nil {
+		return nil, fmt.Errorf("%w; %s", errSimInvalidNode, node)
+	}
+
+	if entry.Ip = net.ParseIP(host); entry.Ip == nil {
+		return nil, fmt.Errorf("%w; %s", errSimInvalidNode, node)
+	}
+
+	if entry.Port, e = strconv.Atoi(port); e != nil {
+		return nil, fmt.Errorf("%w; %s", errSimInvalidNode, node)
+	}
+
+	return entry, e
+}
+
+func copyServers(servers map[string]*balancer.UpstreamEntry) map[string]*balancer.UpstreamEntry {
+	buf := make(map[string]*balancer.UpstreamEntry, len(servers))
+	for address, entry := range servers {
+		buf[address] = entry
+	}
+
+	return buf
+}
+
+func round(val float64) float64 {
+	return math.Round(val*100) / 100
+}
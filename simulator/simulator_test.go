@@ -0,0 +1,231 @@
+package simulator
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/balancer"
+	"github.com/MindHunter86/addie/media"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+// newTestSimulator returns the simulator with default flags of main.go and given arguments
+func newTestSimulator(t *testing.T, args ...string) *Simulator {
+	t.Helper()
+
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, fl := range []cli.Flag{
+		&cli.StringSliceFlag{Name: "server"},
+		&cli.StringFlag{Name: "consul-snapshot"},
+		&cli.StringFlag{Name: "access-log"},
+		&cli.IntFlag{Name: "generate-requests", Value: 100000},
+		&cli.UintFlag{Name: "generate-titles", Value: 500},
+		&cli.UintFlag{Name: "generate-episodes", Value: 12},
+		&cli.UintFlag{Name: "generate-chunks", Value: 400},
+		&cli.Int64Flag{Name: "generate-seed", Value: 1},
+		&cli.StringSliceFlag{Name: "media-route", Value: cli.NewStringSlice(media.DefaultRoutes...)},
+		&cli.DurationFlag{Name: "balancer-sticky-ttl", Value: 5 * time.Minute},
+		&cli.StringFlag{Name: "consul-service-nodes", Value: "cache-node-internal"},
+	} {
+		if e := fl.Apply(set); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e := set.Parse(args); e != nil {
+		t.Fatal(e)
+	}
+
+	log := zerolog.Nop()
+	return NewSimulator(cli.NewContext(cli.NewApp(), set, nil), &log)
+}
+
+// newTestServers returns the fixed upstream of n servers
+func newTestServers(n int) map[string]*balancer.UpstreamEntry {
+	servers := make(map[string]*balancer.UpstreamEntry, n)
+	for i := 0; i < n; i++ {
+		entry := &balancer.UpstreamEntry{
+			Name: fmt.Sprintf("node-%03d", i),
+			Ip:   net.IPv4(10, 0, 0, byte(i+1)),
+		}
+
+		servers[entry.Address()] = entry
+	}
+
+	return servers
+}
+
+func TestParseNode(t *testing.T) {
+	for _, tc := range []struct {
+		node    string
+		address string
+		err     bool
+	}{
+		{node: "node-001=10.0.0.1", address: "10.0.0.1"},
+		{node: "node-001=10.0.0.1:8080", address: "10.0.0.1:8080"},
+		{node: "node-001=2001:db8::1", address: "2001:db8::1"},
+		{node: "node-001=[2001:db8::1]:8080", address: "[2001:db8::1]:8080"},
+		{node: "10.0.0.1", err: true},
+		{node: "=10.0.0.1", err: true},
+		{node: "node-001=cache-01.example.org", err: true},
+		{node: "node-001=10.0.0.1:http", err: true},
+	} {
+		entry, e := parseNode(tc.node)
+
+		switch {
+		case tc.err:
+			if !errors.Is(e, errSimInvalidNode) {
+				t.Errorf("%s: expected errSimInvalidNode, got %v", tc.node, e)
+			}
+		case e != nil:
+			t.Errorf("%s: unexpected error %v", tc.node, e)
+		case entry.Name != "node-001" || entry.Address() != tc.address:
+			t.Errorf("%s: got %s (%s), want %s", tc.node, entry.Name, entry.Address(), tc.address)
+		}
+	}
+}
+
+func TestLoadRequests(t *testing.T) {
+	sim := newTestSimulator(t, "--generate-requests", "1000")
+
+	generated, e := sim.loadRequests()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if len(generated) != 1000 {
+		t.Errorf("got %d generated requests, want 1000", len(generated))
+	}
+
+	// requests are generated by the seed, so simulations are reproducible
+	again, e := sim.loadRequests()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for i := range generated {
+		if *generated[i] != *again[i] {
+			t.Fatalf("request %d differs - %+v, %+v", i, *generated[i], *again[i])
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	if e = os.WriteFile(path, []byte(
+		`10.0.0.1 - - [18/Oct/2026:10:00:00 +0000] "GET /videos/media/ts/9000/1/720/fff6d1a7_00001.ts?expires=1 HTTP/1.1" 200 0`+"\n"+
+			`10.0.0.1 - - [18/Oct/2026:10:00:01 +0000] "GET /videos/media/ts/9000/1/360/fff6d1a7_00001.ts HTTP/1.1" 200 0`+"\n"+
+			`10.0.0.1 - - [18/Oct/2026:10:00:02 +0000] "GET /api/v1/health HTTP/1.1" 200 0`+"\n",
+	), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	requests, e := newTestSimulator(t, "--access-log", path).loadRequests()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// the invalid quality and not media uris are skipped
+	if len(requests) != 1 || *requests[0] != (simRequest{prefix: "90001720", chunkname: "fff6d1a7_00001"}) {
+		t.Errorf("got requests %v", requests)
+	}
+
+	if _, e = newTestSimulator(t, "--generate-requests", "0").loadRequests(); !errors.Is(e, errSimEmptyUris) {
+		t.Errorf("expected errSimEmptyUris, got %v", e)
+	}
+}
+
+// TestLoadSkew checks the distribution of the fixed request set over the fixed upstream
+func TestLoadSkew(t *testing.T) {
+	sim := newTestSimulator(t, "--generate-requests", "20000")
+
+	requests, e := sim.loadRequests()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	blcr := sim.newBalancer(newTestServers(10))
+	for _, req := range requests {
+		if _, _, e = blcr.BalanceByChunk(req.prefix, req.chunkname); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	stats := blcr.GetStatsSnapshot()
+	if stats.Requests != 20000 || len(stats.Servers) != 10 {
+		t.Fatalf("got %d requests over %d servers", stats.Requests, len(stats.Servers))
+	}
+
+	// the skew is the same for every run; it's changed only by balancing changes
+	load := getLoad(stats)
+	if load.mean != 2000 || math.Abs(load.cov-3.01) > 0.01 || math.Abs(load.ratio-1.114) > 0.001 {
+		t.Errorf("got load %+v", *load)
+	}
+
+	for _, server := range stats.Servers {
+		if math.Abs(server.HashShare-server.IdealShare) > 1 {
+			t.Errorf("%s: got share %.2f%%, ideal share %.2f%%", server.Name, server.HashShare, server.IdealShare)
+		}
+	}
+
+	if empty := getLoad(&balancer.ClusterStats{}); *empty != (simLoad{}) {
+		t.Errorf("got load %+v of the empty upstream", *empty)
+	}
+}
+
+// TestRebalanceImpact pins the count of moved chunks of the fixed request set; the ring is indexed
+// by the modulo of its size, so the most of chunks are moved on any change of the upstream size
+func TestRebalanceImpact(t *testing.T) {
+	sim := newTestSimulator(t, "--generate-requests", "20000")
+
+	requests, e := sim.loadRequests()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	servers := newTestServers(10)
+	without := func(name string) map[string]*balancer.UpstreamEntry {
+		changed := copyServers(servers)
+		for address, entry := range changed {
+			if entry.Name == name {
+				delete(changed, address)
+			}
+		}
+
+		return changed
+	}
+
+	added := copyServers(servers)
+	entry := &balancer.UpstreamEntry{Name: "node-010", Ip: net.IPv4(10, 0, 0, 11)}
+	added[entry.Address()] = entry
+
+	for _, tc := range []struct {
+		change string
+		after  map[string]*balancer.UpstreamEntry
+		impact simImpact
+	}{
+		{change: "unchanged", after: copyServers(servers), impact: simImpact{chunks: 19284, requests: 20000}},
+		{
+			change: "add node-010", after: added,
+			impact: simImpact{chunks: 19284, movedChunks: 17459, requests: 20000, movedRequests: 18112},
+		},
+		{
+			change: "remove node-004", after: without("node-004"),
+			impact: simImpact{chunks: 19284, movedChunks: 17297, requests: 20000, movedRequests: 17946},
+		},
+		{
+			change: "remove node-009", after: without("node-009"),
+			impact: simImpact{chunks: 19284, movedChunks: 17328, requests: 20000, movedRequests: 17976},
+		},
+	} {
+		if impact := sim.getImpact(servers, tc.after, requests); *impact != tc.impact {
+			t.Errorf("%s: got %+v, want %+v", tc.change, *impact, tc.impact)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type exporter interface {
+	export(spans []*Span) error
+}
+
+// stdoutExporter writes one log line per span; spans share the non-blocking writer
+// of the logger, so they are not interleaved with log records
+type stdoutExporter struct {
+	log *zerolog.Logger
+}
+
+func newStdoutExporter(log *zerolog.Logger) *stdoutExporter {
+	return &stdoutExporter{
+		log: log,
+	}
+}
+
+func (m *stdoutExporter) export(spans []*Span) (e error) {
+	for _, span := range spans {
+		event := m.log.Info().
+			Str("trace_id", span.Context.TraceID.String()).
+			Str("span_id", span.Context.SpanID.String())
+
+		if span.ParentID.IsValid() {
+			event.Str("parent_id", span.ParentID.String())
+		}
+
+		event.Time("start", span.Start).
+			Float64("duration", float64(span.Duration().Microseconds())/1000) // milliseconds
+
+		if len(span.Attributes) != 0 {
+			attributes := zerolog.Dict()
+			for _, attr := range span.Attributes {
+				attributes.Str(attr.Key, attr.Value)
+			}
+
+			event.Dict("attributes", attributes)
+		}
+
+		if span.Error != "" {
+			event.Str("error", span.Error)
+		}
+
+		event.Msg(span.Name)
+	}
+
+	return
+}
+
+// otlpExporter sends spans to the collector with OTLP/HTTP json encoding
+type otlpExporter struct {
+	endpoint string
+	timeout  time.Duration
+	client   *http.Client
+
+	resource *otlpResource
+	scope    *otlpScope
+}
+
+type (
+	otlpRequest struct {
+		ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   *otlpResource     `json:"resource"`
+		ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []*otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope *otlpScope  `json:"scope"`
+		Spans []*otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string           `json:"traceId"`
+		SpanID            string           `json:"spanId"`
+		ParentSpanID      string           `json:"parentSpanId,omitempty"`
+		Name              string           `json:"name"`
+		Kind              SpanKind         `json:"kind"`
+		StartTimeUnixNano string           `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+		Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus      `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const otlpStatusCodeError = 2
+
+func newOtlpAttribute(key, value string) *otlpAttribute {
+	attr := &otlpAttribute{Key: key}
+	attr.Value.StringValue = value
+	return attr
+}
+
+func newOtlpExporter(endpoint string, timeout time.Duration, service, version string) *otlpExporter {
+	hostname, _ := os.Hostname()
+
+	return &otlpExporter{
+		endpoint: endpoint,
+		timeout:  timeout,
+		client:   &http.Client{},
+
+		resource: &otlpResource{
+			Attributes: []*otlpAttribute{
+				newOtlpAttribute("service.name", service),
+				newOtlpAttribute("service.version", version),
+				newOtlpAttribute("host.name", hostname),
+				newOtlpAttribute("process.pid", strconv.Itoa(os.Getpid())),
+			},
+		},
+		scope: &otlpScope{Name: service, Version: version},
+	}
+}
+
+func (m *otlpExporter) export(spans []*Span) (e error) {
+	scoped := &otlpScopeSpans{
+		Scope: m.scope,
+		Spans: make([]*otlpSpan, 0, len(spans)),
+	}
+
+	for _, span := range spans {
+		ospan := &otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+
+		if span.ParentID.IsValid() {
+			ospan.ParentSpanID = span.ParentID.String()
+		}
+
+		for _, attr := range span.Attributes {
+			ospan.Attributes = append(ospan.Attributes, newOtlpAttribute(attr.Key, attr.Value))
+		}
+
+		if span.Error != "" {
+			ospan.Status = &otlpStatus{Code: otlpStatusCodeError, Message: span.Error}
+		}
+
+		scoped.Spans = append(scoped.Spans, ospan)
+	}
+
+	var payload []byte
+	if payload, e = json.Marshal(&otlpRequest{
+		ResourceSpans: []*otlpResourceSpans{{
+			Resource:   m.resource,
+			ScopeSpans: []*otlpScopeSpans{scoped},
+		}},
+	}); e != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	var req *http.Request
+	if req, e = http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(payload)); e != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var rsp *http.Response
+	if rsp, e = m.client.Do(req); e != nil {
+		return
+	}
+	defer rsp.Body.Close()
+
+	// the body is drained for the connection reuse
+	_, _ = io.Copy(io.Discard, rsp.Body)
+
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %d status", rsp.StatusCode)
+	}
+
+	return
+}
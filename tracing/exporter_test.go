@@ -0,0 +1,197 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestSpans returns the finished root span with one child and the error
+func newTestSpans(t *testing.T) []*Span {
+	t.Helper()
+
+	sc, e := ParseTraceparent("00-" + testTraceID + "-" + testSpanID + "-01")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	start := time.Date(2026, 10, 18, 16, 0, 0, 0, time.UTC)
+
+	root := &Span{
+		Name:  "GET /videos/media/ts",
+		Kind:  SpanKindServer,
+		Start: start,
+		End:   start.Add(25 * time.Millisecond),
+		Context: SpanContext{
+			TraceID: sc.TraceID,
+			SpanID:  SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			Flags:   sc.Flags,
+		},
+		ParentID:   sc.SpanID,
+		Attributes: []Attribute{{"http.status_code", "200"}},
+	}
+
+	child := &Span{
+		Name:  "anilibria api",
+		Kind:  SpanKindClient,
+		Start: start.Add(time.Millisecond),
+		End:   start.Add(11500 * time.Microsecond),
+		Context: SpanContext{
+			TraceID: sc.TraceID,
+			SpanID:  SpanID{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11},
+			Flags:   sc.Flags,
+		},
+		ParentID: root.Context.SpanID,
+		Error:    "context deadline exceeded",
+	}
+
+	return []*Span{child, root}
+}
+
+const testOtlpPayload = `{
+  "resourceSpans": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "addie"}},
+      {"key": "service.version", "value": {"stringValue": "test"}}
+    ]},
+    "scopeSpans": [{
+      "scope": {"name": "addie", "version": "test"},
+      "spans": [{
+        "traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+        "spanId": "0a0b0c0d0e0f1011",
+        "parentSpanId": "0102030405060708",
+        "name": "anilibria api",
+        "kind": 3,
+        "startTimeUnixNano": "1792339200001000000",
+        "endTimeUnixNano": "1792339200011500000",
+        "status": {"code": 2, "message": "context deadline exceeded"}
+      }, {
+        "traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+        "spanId": "0102030405060708",
+        "parentSpanId": "00f067aa0ba902b7",
+        "name": "GET /videos/media/ts",
+        "kind": 2,
+        "startTimeUnixNano": "1792339200000000000",
+        "endTimeUnixNano": "1792339200025000000",
+        "attributes": [{"key": "http.status_code", "value": {"stringValue": "200"}}]
+      }]
+    }]
+  }]
+}`
+
+func TestOtlpExporterPayload(t *testing.T) {
+	var payload []byte
+	var contentType string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		payload, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	exp := newOtlpExporter(srv.URL, time.Second, "addie", "test")
+
+	// hostname and pid differ between runs
+	exp.resource.Attributes = exp.resource.Attributes[:2]
+
+	if e := exp.export(newTestSpans(t)); e != nil {
+		t.Fatal(e)
+	}
+
+	if contentType != "application/json" {
+		t.Errorf("got content type %s", contentType)
+	}
+
+	var expected bytes.Buffer
+	if e := json.Compact(&expected, []byte(testOtlpPayload)); e != nil {
+		t.Fatal(e)
+	}
+
+	if !bytes.Equal(payload, expected.Bytes()) {
+		t.Errorf("got payload\n%s\nexpected\n%s", payload, expected.Bytes())
+	}
+}
+
+func TestOtlpExporterStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if e := newOtlpExporter(srv.URL, time.Second, "addie", "test").export(newTestSpans(t)); e == nil {
+		t.Error("expected error on 503 status of the collector")
+	}
+}
+
+const testStdoutPayload = `{"level":"info","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"0a0b0c0d0e0f1011","parent_id":"0102030405060708","start":"2026-10-18T16:00:00.001Z","duration":10.5,"error":"context deadline exceeded","message":"anilibria api"}
+{"level":"info","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"0102030405060708","parent_id":"00f067aa0ba902b7","start":"2026-10-18T16:00:00Z","duration":25,"attributes":{"http.status_code":"200"},"message":"GET /videos/media/ts"}
+`
+
+func TestStdoutExporter(t *testing.T) {
+	format := zerolog.TimeFieldFormat
+	defer func() { zerolog.TimeFieldFormat = format }()
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+
+	var buf bytes.Buffer
+	log := zerolog.New(&buf)
+
+	if e := newStdoutExporter(&log).export(newTestSpans(t)); e != nil {
+		t.Fatal(e)
+	}
+
+	if buf.String() != testStdoutPayload {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), testStdoutPayload)
+	}
+}
+
+type testFailedExporter struct {
+	batches [][]*Span
+}
+
+func (m *testFailedExporter) export(spans []*Span) error {
+	m.batches = append(m.batches, spans)
+	return errors.New("collector is unavailable")
+}
+
+// TestRunFlush checks that queued traces are exported in batches and flushed on the shutdown
+func TestRunFlush(t *testing.T) {
+	log := zerolog.Nop()
+	exp := &testFailedExporter{}
+
+	tracer := newTestTracer(1, exp)
+	tracer.log, tracer.batchSize, tracer.batchTimeout = &log, 3, time.Hour
+
+	spans := newTestSpans(t)
+	for i := 0; i < 4; i++ {
+		tracer.enqueue(spans[:1])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		tracer.Run(ctx)
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); len(tracer.queue) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for the queue")
+		}
+	}
+
+	cancel()
+	<-done
+
+	if len(exp.batches) != 2 || len(exp.batches[0]) != 3 || len(exp.batches[1]) != 1 {
+		t.Errorf("got %d batches", len(exp.batches))
+	}
+}
@@ -0,0 +1,257 @@
+package tracing
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTraceparent = errors.New("traceparent header is invalid")
+
+const (
+	HeaderTraceparent = "traceparent"
+
+	flagSampled byte = 0x01
+)
+
+type SpanKind uint8
+
+// values are the same as in OTLP
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (m TraceID) String() string { return hex.EncodeToString(m[:]) }
+func (m SpanID) String() string  { return hex.EncodeToString(m[:]) }
+
+func (m TraceID) IsValid() bool { return m != TraceID{} }
+func (m SpanID) IsValid() bool  { return m != SpanID{} }
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64()) // skipcq: GSC-G404 math/rand is enough for ids
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64()) // skipcq: GSC-G404 math/rand is enough for ids
+	}
+
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64()) // skipcq: GSC-G404 math/rand is enough for ids
+	}
+
+	return
+}
+
+// SpanContext is the propagated part of the span, see W3C Trace Context
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// ParseTraceparent parses VERSION-TRACEID-PARENTID-FLAGS header value;
+// unknown versions are parsed as 00 if the value is long enough
+func ParseTraceparent(buf string) (sc SpanContext, e error) {
+	parts := strings.Split(strings.TrimSpace(buf), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceparent
+	} else if parts[0] == "00" && len(parts) != 4 {
+		return sc, ErrInvalidTraceparent
+	}
+
+	var flags []byte
+	if _, e = hex.Decode(sc.TraceID[:], []byte(parts[1])); e != nil {
+		return sc, ErrInvalidTraceparent
+	} else if _, e = hex.Decode(sc.SpanID[:], []byte(parts[2])); e != nil {
+		return sc, ErrInvalidTraceparent
+	} else if flags, e = hex.DecodeString(parts[3]); e != nil {
+		return sc, ErrInvalidTraceparent
+	}
+
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+
+	sc.Flags = flags[0]
+	return
+}
+
+func (m SpanContext) Traceparent() string {
+	return "00-" + m.TraceID.String() + "-" + m.SpanID.String() + "-" + hex.EncodeToString([]byte{m.Flags})
+}
+
+func (m SpanContext) IsSampled() bool {
+	return m.Flags&flagSampled != 0
+}
+
+type Attribute struct {
+	Key, Value string
+}
+
+// Span methods are nil-safe, so callers do not check if the request is traced
+type Span struct {
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	ParentID SpanID
+
+	Start, End time.Time
+	Attributes []Attribute
+	Error      string
+
+	trace *spanTrace
+
+	// sequential children, see Stage()
+	stages []*Span
+}
+
+// spanTrace collects finished spans of one local trace, they are exported with the root span
+type spanTrace struct {
+	tracer *Tracer
+	root   *Span
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (m *Span) newChild(name string, kind SpanKind) *Span {
+	return &Span{
+		Name: name,
+		Kind: kind,
+		Context: SpanContext{
+			TraceID: m.Context.TraceID,
+			SpanID:  newSpanID(),
+			Flags:   m.Context.Flags,
+		},
+		ParentID: m.Context.SpanID,
+		Start:    time.Now(),
+		trace:    m.trace,
+	}
+}
+
+// Child starts a nested span, e.g. an outgoing request
+func (m *Span) Child(name string, kind SpanKind) *Span {
+	if m == nil {
+		return nil
+	}
+
+	return m.newChild(name, kind)
+}
+
+// Stage finishes the current stage of the span and starts the next one;
+// stages are sequential children like middlewares of one request
+func (m *Span) Stage(name string) *Span {
+	if m == nil {
+		return nil
+	}
+
+	if len(m.stages) != 0 {
+		m.stages[len(m.stages)-1].Finish()
+	}
+
+	stage := m.newChild(name, SpanKindInternal)
+	m.stages = append(m.stages, stage)
+
+	return stage
+}
+
+// CurrentStage returns the last started stage or the span itself if there are no stages
+func (m *Span) CurrentStage() *Span {
+	if m == nil || len(m.stages) == 0 {
+		return m
+	}
+
+	return m.stages[len(m.stages)-1]
+}
+
+// Stages returns the span stages; they must not be modified by callers
+func (m *Span) Stages() []*Span {
+	if m == nil {
+		return nil
+	}
+
+	return m.stages
+}
+
+func (m *Span) SetAttribute(key, value string) {
+	if m == nil || value == "" {
+		return
+	}
+
+	m.Attributes = append(m.Attributes, Attribute{key, value})
+}
+
+func (m *Span) SetError(e error) {
+	if m == nil || e == nil {
+		return
+	}
+
+	m.Error = e.Error()
+}
+
+func (m *Span) Traceparent() string {
+	if m == nil {
+		return ""
+	}
+
+	return m.Context.Traceparent()
+}
+
+func (m *Span) TraceID() string {
+	if m == nil {
+		return ""
+	}
+
+	return m.Context.TraceID.String()
+}
+
+func (m *Span) Duration() time.Duration {
+	if m == nil || m.End.IsZero() {
+		return 0
+	}
+
+	return m.End.Sub(m.Start)
+}
+
+// Finish ends the span; the root span finishes its last stage and
+// sends all finished spans of the trace to the exporter if the trace is sampled
+func (m *Span) Finish() {
+	if m == nil || !m.End.IsZero() {
+		return
+	}
+
+	if len(m.stages) != 0 {
+		m.stages[len(m.stages)-1].Finish()
+	}
+
+	m.End = time.Now()
+
+	m.trace.mu.Lock()
+	m.trace.spans = append(m.trace.spans, m)
+	m.trace.mu.Unlock()
+
+	if m.trace.root != m || !m.Context.IsSampled() {
+		return
+	}
+
+	m.trace.mu.Lock()
+	spans := m.trace.spans
+	m.trace.spans = nil
+	m.trace.mu.Unlock()
+
+	m.trace.tracer.enqueue(spans)
+}
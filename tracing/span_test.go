@@ -0,0 +1,195 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		buf     string
+		flags   byte
+		sampled bool
+		err     bool
+	}{
+		{name: "sampled", buf: "00-" + testTraceID + "-" + testSpanID + "-01", flags: 0x01, sampled: true},
+		{name: "not sampled", buf: "00-" + testTraceID + "-" + testSpanID + "-00"},
+		{name: "unknown flags", buf: "00-" + testTraceID + "-" + testSpanID + "-09", flags: 0x09, sampled: true},
+		{name: "spaces", buf: " 00-" + testTraceID + "-" + testSpanID + "-01 ", flags: 0x01, sampled: true},
+		{name: "future version", buf: "cc-" + testTraceID + "-" + testSpanID + "-01-future", flags: 0x01, sampled: true},
+
+		{name: "empty", buf: "", err: true},
+		{name: "forbidden version", buf: "ff-" + testTraceID + "-" + testSpanID + "-01", err: true},
+		{name: "version 00 with extra part", buf: "00-" + testTraceID + "-" + testSpanID + "-01-future", err: true},
+		{name: "short trace id", buf: "00-" + testTraceID[2:] + "-" + testSpanID + "-01", err: true},
+		{name: "short span id", buf: "00-" + testTraceID + "-" + testSpanID[2:] + "-01", err: true},
+		{name: "short flags", buf: "00-" + testTraceID + "-" + testSpanID + "-1", err: true},
+		{name: "not hex", buf: "00-" + testTraceID[:31] + "x-" + testSpanID + "-01", err: true},
+		{name: "zero trace id", buf: "00-00000000000000000000000000000000-" + testSpanID + "-01", err: true},
+		{name: "zero span id", buf: "00-" + testTraceID + "-0000000000000000-01", err: true},
+	} {
+		sc, e := ParseTraceparent(tc.buf)
+		if tc.err {
+			if !errors.Is(e, ErrInvalidTraceparent) {
+				t.Errorf("%s: expected ErrInvalidTraceparent, got %v", tc.name, e)
+			}
+			continue
+		}
+
+		if e != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, e)
+			continue
+		}
+
+		if sc.TraceID.String() != testTraceID || sc.SpanID.String() != testSpanID {
+			t.Errorf("%s: got trace %s span %s", tc.name, sc.TraceID, sc.SpanID)
+		}
+
+		if sc.Flags != tc.flags || sc.IsSampled() != tc.sampled {
+			t.Errorf("%s: got flags %02x, sampled %v", tc.name, sc.Flags, sc.IsSampled())
+		}
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	buf := "00-" + testTraceID + "-" + testSpanID + "-01"
+
+	sc, e := ParseTraceparent(buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if sc.Traceparent() != buf {
+		t.Errorf("got %s, expected %s", sc.Traceparent(), buf)
+	}
+}
+
+type testExporter struct {
+	spans []*Span
+}
+
+func (m *testExporter) export(spans []*Span) error {
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+func newTestTracer(ratio float64, exp exporter) *Tracer {
+	return &Tracer{
+		exporter: exp,
+		ratio:    ratio,
+		queue:    make(chan []*Span, 16),
+	}
+}
+
+// TestStartPropagation checks that the remote sampled flag wins over the local ratio
+// and the flag is propagated to the next hops
+func TestStartPropagation(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		traceparent string
+		ratio       float64
+		disabled    bool
+		sampled     bool
+		remote      bool
+	}{
+		{name: "sampled parent, ratio 0", traceparent: "00-" + testTraceID + "-" + testSpanID + "-01", sampled: true, remote: true},
+		{name: "not sampled parent, ratio 1", traceparent: "00-" + testTraceID + "-" + testSpanID + "-00", ratio: 1, remote: true},
+		{name: "new trace, ratio 1", ratio: 1, sampled: true},
+		{name: "new trace, ratio 0"},
+		{name: "invalid parent, ratio 1", traceparent: "00-invalid", ratio: 1, sampled: true},
+		{name: "sampled parent, no exporter", traceparent: "00-" + testTraceID + "-" + testSpanID + "-01", disabled: true, remote: true},
+	} {
+		var exp exporter = &testExporter{}
+		if tc.disabled {
+			exp = nil
+		}
+
+		span := newTestTracer(tc.ratio, exp).Start(tc.traceparent, "GET /")
+		if span.Context.IsSampled() != tc.sampled {
+			t.Errorf("%s: got sampled %v", tc.name, span.Context.IsSampled())
+		}
+
+		if remote := span.TraceID() == testTraceID && span.ParentID.String() == testSpanID; remote != tc.remote {
+			t.Errorf("%s: got trace %s, parent %s", tc.name, span.TraceID(), span.ParentID)
+		}
+
+		if !span.Context.SpanID.IsValid() || span.Context.SpanID.String() == testSpanID {
+			t.Errorf("%s: span id %s is not a new one", tc.name, span.Context.SpanID)
+		}
+
+		// outgoing requests carry the same trace and the sampled flag of the root
+		child := span.Stage("proxy").Child("origin", SpanKindClient)
+
+		sc, e := ParseTraceparent(child.Traceparent())
+		if e != nil {
+			t.Errorf("%s: child traceparent %q is invalid - %v", tc.name, child.Traceparent(), e)
+		} else if sc.TraceID != span.Context.TraceID || sc.IsSampled() != tc.sampled {
+			t.Errorf("%s: got child traceparent %s", tc.name, child.Traceparent())
+		}
+	}
+}
+
+func TestFinishExportsSampledTraces(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		traceparent := "00-" + testTraceID + "-" + testSpanID + "-00"
+		if sampled {
+			traceparent = traceparent[:len(traceparent)-1] + "1"
+		}
+
+		tracer := newTestTracer(0, &testExporter{})
+		root := tracer.Start(traceparent, "GET /")
+
+		stage := root.Stage("proxy")
+		stage.Child("origin", SpanKindClient).Finish()
+		root.Stage("response")
+		root.Finish()
+
+		// finished twice spans are not exported again
+		root.Finish()
+
+		if !sampled {
+			if len(tracer.queue) != 0 {
+				t.Errorf("not sampled trace is enqueued")
+			}
+			continue
+		}
+
+		if len(tracer.queue) != 1 {
+			t.Fatalf("got %d enqueued traces", len(tracer.queue))
+		}
+
+		spans := <-tracer.queue
+		if len(spans) != 4 || spans[len(spans)-1] != root {
+			t.Fatalf("got %d spans, the root must be the last one", len(spans))
+		}
+
+		for _, span := range spans {
+			if span.End.IsZero() || span.Context.TraceID != root.Context.TraceID {
+				t.Errorf("span %s is not finished or has another trace", span.Name)
+			}
+		}
+
+		if stage.End.IsZero() || root.CurrentStage().Name != "response" {
+			t.Error("stages are not finished sequentially")
+		}
+	}
+}
+
+func TestSpanNilSafe(t *testing.T) {
+	var span *Span
+
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.Finish()
+
+	if span.Child("child", SpanKindClient) != nil || span.Stage("stage") != nil ||
+		span.Traceparent() != "" || span.TraceID() != "" || span.Duration() != 0 {
+		t.Error("nil span methods must return zero values")
+	}
+}
@@ -0,0 +1,163 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrInvalidExporter    = errors.New("tracing exporter is invalid; none, stdout, otlp values are permited only")
+	ErrInvalidSampleRatio = errors.New("tracing sample ratio is invalid; ratio is in [0, 1]")
+	ErrInvalidBatch       = errors.New("tracing batch is invalid; batch timeout must be positive, batch size must not be negative")
+	ErrInvalidQueueSize   = errors.New("tracing queue size is invalid; size must not be negative")
+)
+
+// Tracer makes root spans of incoming requests and exports sampled traces in batches
+type Tracer struct {
+	log *zerolog.Logger
+
+	exporter exporter
+	ratio    float64
+
+	batchSize    int
+	batchTimeout time.Duration
+
+	queue   chan []*Span
+	dropped uint64
+}
+
+func NewTracer(ctx context.Context) (_ *Tracer, e error) {
+	ccx := ctx.Value(utils.ContextKeyCliContext).(*cli.Context)
+
+	tracer := &Tracer{
+		log:          ctx.Value(utils.ContextKeyLogger).(*zerolog.Logger),
+		ratio:        ccx.Float64("tracing-sample-ratio"),
+		batchSize:    ccx.Int("tracing-batch-size"),
+		batchTimeout: ccx.Duration("tracing-batch-timeout"),
+	}
+
+	if tracer.ratio < 0 || tracer.ratio > 1 {
+		return nil, fmt.Errorf("%w; %f", ErrInvalidSampleRatio, tracer.ratio)
+	}
+
+	if tracer.batchTimeout <= 0 || tracer.batchSize < 0 {
+		return nil, fmt.Errorf("%w; timeout %s, size %d", ErrInvalidBatch, tracer.batchTimeout, tracer.batchSize)
+	}
+
+	size := ccx.Int("tracing-queue-size")
+	if size < 0 {
+		return nil, fmt.Errorf("%w; %d", ErrInvalidQueueSize, size)
+	}
+	tracer.queue = make(chan []*Span, size)
+
+	switch ccx.String("tracing-exporter") {
+	case "none":
+	case "stdout":
+		tracer.exporter = newStdoutExporter(tracer.log)
+	case "otlp":
+		tracer.exporter = newOtlpExporter(ccx.String("tracing-otlp-endpoint"),
+			ccx.Duration("tracing-otlp-timeout"), ccx.App.Name, ccx.App.Version)
+	default:
+		return nil, fmt.Errorf("%w; %s", ErrInvalidExporter, ccx.String("tracing-exporter"))
+	}
+
+	return tracer, e
+}
+
+// Start makes the root span from the traceparent header value of the incoming request;
+// the sampled flag of the remote parent is respected, new traces are sampled by the ratio
+func (m *Tracer) Start(traceparent, name string) *Span {
+	span := &Span{
+		Name:  name,
+		Kind:  SpanKindServer,
+		Start: time.Now(),
+	}
+	span.trace = &spanTrace{tracer: m, root: span}
+
+	if parent, e := ParseTraceparent(traceparent); e == nil {
+		span.Context.TraceID, span.ParentID, span.Context.Flags =
+			parent.TraceID, parent.SpanID, parent.Flags
+	} else {
+		span.Context.TraceID = newTraceID()
+		if m.ratio == 1 || rand.Float64() < m.ratio { // skipcq: GSC-G404 math/rand is enough
+			span.Context.Flags = flagSampled
+		}
+	}
+
+	// nothing would be exported, so the flag is not set for the next hops
+	if m.exporter == nil {
+		span.Context.Flags &^= flagSampled
+	}
+
+	span.Context.SpanID = newSpanID()
+	return span
+}
+
+func (m *Tracer) enqueue(spans []*Span) {
+	if m.exporter == nil {
+		return
+	}
+
+	select {
+	case m.queue <- spans:
+	default:
+		atomic.AddUint64(&m.dropped, uint64(len(spans)))
+	}
+}
+
+// Run exports queued traces until the context is done; the last batch is flushed before return
+func (m *Tracer) Run(ctx context.Context) {
+	if m.exporter == nil {
+		m.log.Info().Msg("tracing is disabled")
+		return
+	}
+
+	m.log.Debug().Msg("tracing exporter started")
+	defer m.log.Debug().Msg("tracing exporter stopped")
+
+	ticker := time.NewTicker(m.batchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, m.batchSize)
+	flush := func() {
+		if dropped := atomic.SwapUint64(&m.dropped, 0); dropped != 0 {
+			m.log.Warn().Uint64("dropped", dropped).Msg("tracing queue is full, some spans have been dropped")
+		}
+
+		if len(batch) == 0 {
+			return
+		}
+
+		if e := m.exporter.export(batch); e != nil {
+			m.log.Warn().Err(e).Int("spans", len(batch)).Msg("could not export spans")
+		}
+
+		batch = make([]*Span, 0, m.batchSize)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for len(m.queue) != 0 {
+				batch = append(batch, <-m.queue...)
+			}
+
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		case spans := <-m.queue:
+			if batch = append(batch, spans...); len(batch) >= m.batchSize {
+				flush()
+			}
+		}
+	}
+}
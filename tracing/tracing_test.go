@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/MindHunter86/addie/utils"
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+func TestNewTracer(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ratio   float64
+		size    int
+		timeout time.Duration
+		queue   int
+		err     error
+	}{
+		{name: "defaults", ratio: 0.5, size: 512, timeout: 5 * time.Second, queue: 2048},
+		{name: "unbuffered queue", ratio: 1, size: 0, timeout: time.Second, queue: 0},
+		{name: "ratio", ratio: 1.5, size: 512, timeout: time.Second, queue: 2048, err: ErrInvalidSampleRatio},
+		{name: "zero timeout", ratio: 1, size: 512, queue: 2048, err: ErrInvalidBatch},
+		{name: "negative timeout", ratio: 1, size: 512, timeout: -time.Second, queue: 2048, err: ErrInvalidBatch},
+		{name: "negative size", ratio: 1, size: -1, timeout: time.Second, queue: 2048, err: ErrInvalidBatch},
+		{name: "negative queue", ratio: 1, size: 512, timeout: time.Second, queue: -1, err: ErrInvalidQueueSize},
+	} {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		for _, fl := range []cli.Flag{
+			&cli.StringFlag{Name: "tracing-exporter", Value: "stdout"},
+			&cli.Float64Flag{Name: "tracing-sample-ratio", Value: tc.ratio},
+			&cli.IntFlag{Name: "tracing-batch-size", Value: tc.size},
+			&cli.DurationFlag{Name: "tracing-batch-timeout", Value: tc.timeout},
+			&cli.IntFlag{Name: "tracing-queue-size", Value: tc.queue},
+		} {
+			if e := fl.Apply(set); e != nil {
+				t.Fatal(e)
+			}
+		}
+
+		log := zerolog.Nop()
+		ctx := context.WithValue(context.Background(), utils.ContextKeyLogger, &log)
+		ctx = context.WithValue(ctx, utils.ContextKeyCliContext, cli.NewContext(cli.NewApp(), set, nil))
+
+		if _, e := NewTracer(ctx); !errors.Is(e, tc.err) {
+			t.Errorf("%s: got %v, expected %v", tc.name, e, tc.err)
+		}
+	}
+}
@@ -10,10 +10,13 @@ const (
 	ContextKeyBlocklist
 	ContextKeyRuntime
 	ContextKeyBalancers
+	ContextKeyKeyring
+	ContextKeySigners
+	ContextKeyTitlesCache
 )
 
 const (
-	FbReqTmruestTimer ContextKey = iota
+	FbReqTraceSpan ContextKey = iota
 )
 
 const (
@@ -23,6 +26,10 @@ const (
 	FbReqTmrConsulLottery
 	FbReqTmrReqSign
 	FbReqTmrBlcPreCond
+	FbReqTmrLimiter
+	FbReqTmrCoreBalance
+	FbReqTmrPlaylistFetch
+	FbReqTmrPlaylistRewrite
 )
 
 const (
@@ -36,14 +43,12 @@ const (
 	CfgAccessLogLevel    = "access-log-level"
 	CfgQualityBypass     = "quality-bypass-for"
 	CfgForceRUMitigate   = "force-ru-mitigate-to"
-)
 
-const (
-	ChunkPath = iota + 1
-	ChunkTitleId
-	ChunkEpisodeId
-	ChunkQualityLevel
-	ChunkName
+	CfgBalancerServerStates   = "balancer-server-states"
+	CfgBalancerStickyClusters = "balancer-sticky-clusters"
+
+	CfgLinkKeyring    = "link-keyring"
+	CfgLinkExpiration = "link-expiration-rules"
 )
 
 type TitleQuality uint8